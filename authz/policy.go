@@ -0,0 +1,131 @@
+package authz
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"opg-file-service/storage"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Policy decides which files a caller can bundle into a zip request, from the roles and
+// scopes in their token. Files are allowed by the location they are fetched from, so that a
+// caller cannot request whatever S3 path they happen to know.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule allows callers with any of its roles or scopes to bundle files from its locations. A
+// rule without roles or scopes applies to every caller.
+type Rule struct {
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+	Allow  []string `json:"allow"` // locations such as s3://bucket or s3://bucket/folder, which cover everything in them
+}
+
+// LoadPolicy reads a policy from a JSON file
+func LoadPolicy(name string) (*Policy, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(b)
+}
+
+// ParsePolicy parses a policy, checking every location it allows is one a file can be fetched from
+func ParsePolicy(b []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+
+	return NewPolicy(p.Rules...)
+}
+
+// NewPolicy returns a policy of rules, checking every location they allow is one a file can be
+// fetched from
+func NewPolicy(rules ...Rule) (*Policy, error) {
+	p := &Policy{Rules: make([]Rule, len(rules))}
+
+	for i, rule := range rules {
+		p.Rules[i] = Rule{Roles: rule.Roles, Scopes: rule.Scopes, Allow: make([]string, len(rule.Allow))}
+
+		for j, allow := range rule.Allow {
+			location, err := canonical(allow)
+			if err != nil {
+				return nil, errors.New("invalid location in policy: " + allow)
+			}
+			p.Rules[i].Allow[j] = location
+		}
+	}
+
+	return p, nil
+}
+
+// Denied returns the paths of the files a caller with roles and scopes is not allowed to bundle
+func (p *Policy) Denied(roles, scopes []string, files []storage.File) []string {
+	var allowed []string
+	for _, rule := range p.Rules {
+		if rule.appliesTo(roles, scopes) {
+			allowed = append(allowed, rule.Allow...)
+		}
+	}
+
+	var denied []string
+	for _, f := range files {
+		location, err := canonical(f.S3path)
+		if err != nil || !slices.ContainsFunc(allowed, func(a string) bool { return covers(a, location) }) {
+			denied = append(denied, f.S3path)
+		}
+	}
+
+	return denied
+}
+
+func (r Rule) appliesTo(roles, scopes []string) bool {
+	if len(r.Roles) == 0 && len(r.Scopes) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(r.Roles, func(role string) bool { return slices.Contains(roles, role) }) ||
+		slices.ContainsFunc(r.Scopes, func(scope string) bool { return slices.Contains(scopes, scope) })
+}
+
+// canonical is the location a file is fetched from, with its scheme and host in lower case. Paths
+// with empty, . or .. segments are rejected rather than cleaned, as files are fetched by their
+// path as it is, so a cleaned path would not be the one that is checked.
+func canonical(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Opaque != "" || u.User != nil || u.Scheme != "file" && u.Host == "" {
+		return "", errors.New("invalid location: " + location)
+	}
+
+	host := strings.ToLower(u.Host)
+	if u.Scheme == "file" && host == "localhost" {
+		host = ""
+	}
+
+	// a location can end with a slash, such as a folder
+	p := strings.TrimSuffix(u.Path, "/")
+	if p != "" {
+		for _, segment := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				return "", errors.New("invalid location: " + location)
+			}
+		}
+	}
+
+	return u.Scheme + "://" + host + p, nil
+}
+
+// covers reports whether an allowed location is, or contains, another location
+func covers(allowed, location string) bool {
+	rest, ok := strings.CutPrefix(location, allowed)
+	return ok && (rest == "" || strings.HasPrefix(rest, "/"))
+}
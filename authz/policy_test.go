@@ -0,0 +1,93 @@
+package authz
+
+import (
+	"opg-file-service/storage"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `{
+	"rules": [
+		{"roles": ["case-worker"], "allow": ["s3://opg-documents/cases/", "https://documents.sirius.example/public"]},
+		{"scopes": ["files:all"], "allow": ["s3://opg-documents", "s3://opg-backoffice", "file:///"]},
+		{"allow": ["s3://opg-public"]}
+	]
+}`
+
+func TestPolicy_Denied(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	assert.Nil(t, err)
+
+	tests := []struct {
+		scenario string
+		roles    []string
+		scopes   []string
+		s3path   string
+		denied   bool
+	}{
+		{"File in a folder allowed for a role", []string{"case-worker"}, nil, "s3://opg-documents/cases/123/letter.pdf", false},
+		{"Folder allowed for a role", []string{"case-worker"}, nil, "s3://opg-documents/cases", false},
+		{"File outside the folder allowed for a role", []string{"case-worker"}, nil, "s3://opg-documents/finance/invoice.pdf", true},
+		{"File in a folder with a similar name", []string{"case-worker"}, nil, "s3://opg-documents/cases-archive/letter.pdf", true},
+		{"File reaching out of an allowed folder", []string{"case-worker"}, nil, "s3://opg-documents/cases/../finance/invoice.pdf", true},
+		{"Encoded path reaching out of an allowed folder", []string{"case-worker"}, nil, "s3://opg-documents/cases/%2E%2E/finance/invoice.pdf", true},
+		{"File reaching back into an allowed folder", []string{"case-worker"}, nil, "s3://opg-documents/finance/../cases/invoice.pdf", true},
+		{"File with an empty segment before an allowed folder", []string{"case-worker"}, nil, "s3://opg-documents//cases/letter.pdf", true},
+		{"File with an empty segment in an allowed folder", []string{"case-worker"}, nil, "s3://opg-documents/cases//letter.pdf", true},
+		{"File with a . segment in an allowed folder", []string{"case-worker"}, nil, "s3://opg-documents/cases/./letter.pdf", true},
+		{"File with an encoded slash reaching into an allowed folder", []string{"case-worker"}, nil, "s3://opg-documents/finance%2F..%2Fcases/letter.pdf", true},
+		{"File on an allowed host", []string{"case-worker"}, nil, "https://documents.sirius.example/public/1", false},
+		{"File on an allowed host with another case", []string{"case-worker"}, nil, "https://Documents.Sirius.example/public/1", false},
+		{"File in a bucket allowed for a scope", nil, []string{"files:all"}, "s3://opg-backoffice/report.csv", false},
+		{"File in a bucket with a similar name", nil, []string{"files:all"}, "s3://opg-backoffice-secrets/report.csv", true},
+		{"Local file allowed for a scope", nil, []string{"files:all"}, "file://localhost/docs/file.txt", false},
+		{"File allowed for every caller", nil, nil, "s3://opg-public/leaflet.pdf", false},
+		{"File in a bucket not allowed for the caller", []string{"other"}, []string{"files:read"}, "s3://opg-documents/cases/123/letter.pdf", true},
+		{"Invalid path", []string{"case-worker"}, []string{"files:all"}, "not a path", true},
+	}
+
+	for _, test := range tests {
+		denied := p.Denied(test.roles, test.scopes, []storage.File{{S3path: test.s3path}})
+		if test.denied {
+			assert.Equal(t, []string{test.s3path}, denied, test.scenario)
+		} else {
+			assert.Empty(t, denied, test.scenario)
+		}
+	}
+}
+
+func TestPolicy_Denied_ListsEveryDeniedFile(t *testing.T) {
+	p, _ := ParsePolicy([]byte(testPolicy))
+
+	denied := p.Denied([]string{"case-worker"}, nil, []storage.File{
+		{S3path: "s3://opg-backoffice/report.csv"},
+		{S3path: "s3://opg-documents/cases/123/letter.pdf"},
+		{S3path: "s3://opg-documents/finance/invoice.pdf"},
+	})
+
+	assert.Equal(t, []string{"s3://opg-backoffice/report.csv", "s3://opg-documents/finance/invoice.pdf"}, denied)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "policy.json")
+	_ = os.WriteFile(name, []byte(testPolicy), 0o644)
+
+	p, err := LoadPolicy(name)
+	assert.Nil(t, err)
+	assert.Len(t, p.Rules, 3)
+
+	_, err = LoadPolicy(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+
+	_, err = ParsePolicy([]byte(`{"rules":[{"roles":["case-worker"],"allow":["opg-documents/cases"]}]}`))
+	assert.EqualError(t, err, "invalid location in policy: opg-documents/cases")
+
+	_, err = ParsePolicy([]byte(`{"rules":[{"roles":["case-worker"],"allow":["s3://opg-documents/cases/../finance"]}]}`))
+	assert.EqualError(t, err, "invalid location in policy: s3://opg-documents/cases/../finance")
+
+	_, err = ParsePolicy([]byte(`not JSON`))
+	assert.NotNil(t, err)
+}
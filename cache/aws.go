@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-secretsmanager-caching-go/v2/secretcache"
+)
+
+// AwsProvider fetches secrets from AWS Secrets Manager, named with the ENVIRONMENT they are for,
+// such as local/jwt-key, and caches them
+type AwsProvider struct {
+	env      string
+	cache    awsSecretsCache
+	versions secretsmanager.ListSecretVersionIdsAPIClient
+	window   time.Duration // how long the previous version of a secret is used for once rotated
+	now      func() time.Time
+
+	mu        sync.Mutex
+	rotations map[string]rotation
+	lookups   map[string]chan struct{} // lookups of when secrets were rotated in progress, closed once they are stored
+}
+
+type awsSecretsCache interface {
+	GetSecretString(secretId string) (string, error)
+	GetSecretStringWithStage(secretId string, versionStage string) (string, error)
+}
+
+const (
+	// rotationTimeout limits how long looking up when a secret was rotated can take
+	rotationTimeout = 5 * time.Second
+	// rotationBackoff is how long a failure to look up when a secret was rotated is kept for,
+	// so that every request using the secret does not wait on Secrets Manager while it is failing
+	rotationBackoff = 30 * time.Second
+)
+
+// rotation is when a secret was last rotated to the value it has, or why that could not be
+// found out, which is tried again after retryAt
+type rotation struct {
+	current string
+	at      time.Time
+	err     error
+	retryAt time.Time
+}
+
+func applyAwsConfig(client *secretsmanager.Client) func(c *secretcache.Cache) {
+	return func(c *secretcache.Cache) {
+		c.Client = client
+	}
+}
+
+// NewAwsProvider returns a provider of the secrets in Secrets Manager, which also provides the
+// previous version of a secret for window after it has been rotated
+func NewAwsProvider(cfg *aws.Config, window time.Duration) (*AwsProvider, error) {
+	env := os.Getenv("ENVIRONMENT")
+	client := secretsmanager.NewFromConfig(*cfg)
+	cache, err := secretcache.New(applyAwsConfig(client))
+	if err != nil {
+		return nil, err
+	}
+	return &AwsProvider{
+		env:       env,
+		cache:     cache,
+		versions:  client,
+		window:    window,
+		now:       time.Now,
+		rotations: map[string]rotation{},
+		lookups:   map[string]chan struct{}{},
+	}, nil
+}
+
+func (p *AwsProvider) GetSecretString(key string) (string, error) {
+	secret, err := p.cache.GetSecretString(p.env + "/" + key)
+	return secret, awsError(key, err)
+}
+
+// GetPreviousSecretString returns the version of a secret before it was last rotated, as long as
+// that was no longer than the rotation window ago, so that what was made with it can still be
+// used while the rest of the system catches up
+func (p *AwsProvider) GetPreviousSecretString(key string) (string, error) {
+	current, err := p.GetSecretString(key)
+	if err != nil {
+		return "", err
+	}
+
+	rotatedAt, err := p.rotatedAt(p.env+"/"+key, current)
+	if err != nil {
+		return "", err
+	}
+	if p.now().Sub(rotatedAt) > p.window {
+		return "", notFoundError{key}
+	}
+
+	previous, err := p.cache.GetSecretStringWithStage(p.env+"/"+key, "AWSPREVIOUS")
+	return previous, awsError(key, err)
+}
+
+// awsError is ErrSecretNotFound when Secrets Manager does not have a secret, or the version of it
+// asked for
+func awsError(key string, err error) error {
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return notFoundError{key}
+	}
+
+	return err
+}
+
+// rotatedAt returns when the current version of a secret was created, which is only looked up
+// again when the secret changes, or once rotationBackoff has passed since the lookup failed.
+// The lookup is made without holding the lock, so that it only holds up callers which have
+// nothing to use for the secret until it finishes.
+func (p *AwsProvider) rotatedAt(secretId string, current string) (time.Time, error) {
+	p.mu.Lock()
+	for {
+		r, ok := p.rotations[secretId]
+		known := ok && r.current == current
+		if known && (r.err == nil || p.now().Before(r.retryAt)) {
+			p.mu.Unlock()
+			return r.at, r.err
+		}
+
+		lookup, looking := p.lookups[secretId]
+		if !looking {
+			break
+		}
+		p.mu.Unlock()
+
+		// the failure is still used while the lookup is being tried again
+		if known {
+			return r.at, r.err
+		}
+
+		<-lookup
+		p.mu.Lock()
+	}
+
+	lookup := make(chan struct{})
+	p.lookups[secretId] = lookup
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rotationTimeout)
+	at, err := p.currentVersionCreated(ctx, secretId)
+	cancel()
+
+	r := rotation{current: current, at: at}
+	if err != nil {
+		r = rotation{current: current, err: err, retryAt: p.now().Add(rotationBackoff)}
+	}
+
+	p.mu.Lock()
+	p.rotations[secretId] = r
+	delete(p.lookups, secretId)
+	p.mu.Unlock()
+	close(lookup)
+
+	return r.at, r.err
+}
+
+// currentVersionCreated looks up when the current version of a secret was created
+func (p *AwsProvider) currentVersionCreated(ctx context.Context, secretId string) (time.Time, error) {
+	pages := secretsmanager.NewListSecretVersionIdsPaginator(p.versions, &secretsmanager.ListSecretVersionIdsInput{SecretId: &secretId})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		for _, version := range page.Versions {
+			if slices.Contains(version.VersionStages, "AWSCURRENT") && version.CreatedDate != nil {
+				return *version.CreatedDate, nil
+			}
+		}
+	}
+
+	return time.Time{}, errors.New("no current version of " + secretId)
+}
@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-secretsmanager-caching-go/v2/secretcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"os"
+	"testing"
+	"time"
+)
+
+type MockAwsSecretsCache struct {
+	mock.Mock
+}
+
+func (m *MockAwsSecretsCache) GetSecretString(secretId string) (string, error) {
+	args := m.Called(secretId)
+	return args.Get(0).(string), args.Error(1)
+}
+
+func (m *MockAwsSecretsCache) GetSecretStringWithStage(secretId string, versionStage string) (string, error) {
+	args := m.Called(secretId, versionStage)
+	return args.Get(0).(string), args.Error(1)
+}
+
+type MockSecretVersions struct {
+	mock.Mock
+}
+
+func (m *MockSecretVersions) ListSecretVersionIds(ctx context.Context, input *secretsmanager.ListSecretVersionIdsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretVersionIdsOutput, error) {
+	args := m.Called(*input.SecretId)
+	output, _ := args.Get(0).(*secretsmanager.ListSecretVersionIdsOutput)
+	return output, args.Error(1)
+}
+
+type mockValue struct {
+	v string
+	e error
+}
+
+func TestNewAwsProvider(t *testing.T) {
+	oldEnv := os.Getenv("ENVIRONMENT")
+	_ = os.Setenv("ENVIRONMENT", "test_env")
+
+	p, err := NewAwsProvider(aws.NewConfig(), time.Hour)
+	assert.Nil(t, err)
+	assert.IsType(t, new(AwsProvider), p)
+	assert.Equal(t, "test_env", p.env)
+	assert.IsType(t, new(secretcache.Cache), p.cache)
+	assert.IsType(t, new(secretsmanager.Client), p.versions)
+	assert.Equal(t, time.Hour, p.window)
+
+	_ = os.Setenv("ENVIRONMENT", oldEnv)
+}
+
+func TestAwsProvider_GetSecretString(t *testing.T) {
+	tests := []struct {
+		scenario       string
+		env            string
+		secretKey      string
+		returnedSecret string
+		returnedErr    error
+		expectedErr    error
+	}{
+		{
+			scenario:       "Secret retrieved successfully",
+			env:            "test_env",
+			secretKey:      "test_key",
+			returnedSecret: "test_secret",
+			returnedErr:    nil,
+			expectedErr:    nil,
+		},
+		{
+			scenario:       "AwsSecretsCache returns an error",
+			env:            "test_env",
+			secretKey:      "test_key",
+			returnedSecret: "",
+			returnedErr:    errors.New("test error"),
+			expectedErr:    errors.New("test error"),
+		},
+		{
+			scenario:       "No ENVIRONMENT defined",
+			env:            "",
+			secretKey:      "test_key",
+			returnedSecret: "",
+			returnedErr:    errors.New("test error"),
+			expectedErr:    errors.New("test error"),
+		},
+		{
+			scenario:       "Secret does not exist",
+			env:            "test_env",
+			secretKey:      "test_key",
+			returnedSecret: "",
+			returnedErr:    &types.ResourceNotFoundException{},
+			expectedErr:    notFoundError{"test_key"},
+		},
+	}
+	for _, test := range tests {
+		msc := new(MockAwsSecretsCache)
+		msc.On("GetSecretString", test.env+"/"+test.secretKey).Return(test.returnedSecret, test.returnedErr).Times(1)
+
+		p := AwsProvider{
+			env:   test.env,
+			cache: msc,
+		}
+		secret, err := p.GetSecretString(test.secretKey)
+
+		assert.Equal(t, test.returnedSecret, secret, test.scenario)
+		assert.Equal(t, test.expectedErr, err, test.scenario)
+	}
+}
+
+func TestAwsProvider_GetPreviousSecretString(t *testing.T) {
+	now := time.Now()
+	versions := func(current time.Time) *secretsmanager.ListSecretVersionIdsOutput {
+		previous := current.Add(-30 * 24 * time.Hour)
+		return &secretsmanager.ListSecretVersionIdsOutput{Versions: []types.SecretVersionsListEntry{
+			{VersionStages: []string{"AWSPREVIOUS"}, CreatedDate: &previous},
+			{VersionStages: []string{"AWSCURRENT"}, CreatedDate: &current},
+		}}
+	}
+
+	tests := []struct {
+		scenario       string
+		current        mockValue
+		previous       mockValue
+		versions       *secretsmanager.ListSecretVersionIdsOutput
+		versionsErr    error
+		expectedSecret string
+		expectedErr    error
+	}{
+		{
+			scenario:       "Rotated within the window",
+			current:        mockValue{"new", nil},
+			previous:       mockValue{"old", nil},
+			versions:       versions(now.Add(-time.Minute)),
+			expectedSecret: "old",
+		},
+		{
+			scenario:    "Rotated before the window",
+			current:     mockValue{"new", nil},
+			previous:    mockValue{"old", nil},
+			versions:    versions(now.Add(-2 * time.Hour)),
+			expectedErr: notFoundError{"test_key"},
+		},
+		{
+			scenario:    "Never rotated",
+			current:     mockValue{"new", nil},
+			previous:    mockValue{"", &types.ResourceNotFoundException{}},
+			versions:    versions(now.Add(-time.Minute)),
+			expectedErr: notFoundError{"test_key"},
+		},
+		{
+			scenario:    "Secret does not exist",
+			current:     mockValue{"", &types.ResourceNotFoundException{}},
+			expectedErr: notFoundError{"test_key"},
+		},
+		{
+			scenario:    "Cannot list versions",
+			current:     mockValue{"new", nil},
+			versionsErr: errors.New("test error"),
+			expectedErr: errors.New("test error"),
+		},
+		{
+			scenario:    "No current version",
+			current:     mockValue{"new", nil},
+			versions:    &secretsmanager.ListSecretVersionIdsOutput{},
+			expectedErr: errors.New("no current version of test_env/test_key"),
+		},
+	}
+
+	for _, test := range tests {
+		msc := new(MockAwsSecretsCache)
+		msc.On("GetSecretString", "test_env/test_key").Return(test.current.v, test.current.e)
+		msc.On("GetSecretStringWithStage", "test_env/test_key", "AWSPREVIOUS").Return(test.previous.v, test.previous.e).Maybe()
+		msv := new(MockSecretVersions)
+		msv.On("ListSecretVersionIds", "test_env/test_key").Return(test.versions, test.versionsErr).Maybe()
+
+		p := AwsProvider{env: "test_env", cache: msc, versions: msv, window: time.Hour, now: func() time.Time { return now }, rotations: map[string]rotation{}, lookups: map[string]chan struct{}{}}
+		secret, err := p.GetPreviousSecretString("test_key")
+
+		assert.Equal(t, test.expectedSecret, secret, test.scenario)
+		assert.Equal(t, test.expectedErr, err, test.scenario)
+	}
+}
+
+func TestAwsProvider_GetPreviousSecretString_Rotation(t *testing.T) {
+	now := time.Now()
+	firstRotation, secondRotation := now.Add(-2*time.Hour), now.Add(-time.Minute)
+
+	msc := new(MockAwsSecretsCache)
+	msc.On("GetSecretString", "test_env/test_key").Return("second", nil).Twice()
+	msc.On("GetSecretString", "test_env/test_key").Return("third", nil).Once()
+	msc.On("GetSecretStringWithStage", "test_env/test_key", "AWSPREVIOUS").Return("second", nil)
+	msv := new(MockSecretVersions)
+	msv.On("ListSecretVersionIds", "test_env/test_key").Return(&secretsmanager.ListSecretVersionIdsOutput{Versions: []types.SecretVersionsListEntry{
+		{VersionStages: []string{"AWSCURRENT"}, CreatedDate: &firstRotation},
+	}}, nil).Once()
+	msv.On("ListSecretVersionIds", "test_env/test_key").Return(&secretsmanager.ListSecretVersionIdsOutput{Versions: []types.SecretVersionsListEntry{
+		{VersionStages: []string{"AWSCURRENT"}, CreatedDate: &secondRotation},
+	}}, nil).Once()
+
+	p := AwsProvider{env: "test_env", cache: msc, versions: msv, window: time.Hour, now: func() time.Time { return now }, rotations: map[string]rotation{}, lookups: map[string]chan struct{}{}}
+
+	// when the secret was rotated is only looked up again once it has changed
+	_, err := p.GetPreviousSecretString("test_key")
+	assert.ErrorIs(t, err, ErrSecretNotFound)
+	_, err = p.GetPreviousSecretString("test_key")
+	assert.ErrorIs(t, err, ErrSecretNotFound)
+
+	secret, err := p.GetPreviousSecretString("test_key")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", secret)
+
+	msv.AssertNumberOfCalls(t, "ListSecretVersionIds", 2)
+}
+
+func TestAwsProvider_GetPreviousSecretString_Backoff(t *testing.T) {
+	now := time.Now()
+	rotated := now.Add(-time.Minute)
+
+	msc := new(MockAwsSecretsCache)
+	msc.On("GetSecretString", "test_env/test_key").Return("new", nil)
+	msc.On("GetSecretStringWithStage", "test_env/test_key", "AWSPREVIOUS").Return("old", nil)
+	msv := new(MockSecretVersions)
+	msv.On("ListSecretVersionIds", "test_env/test_key").Return(nil, errors.New("test error")).Once()
+	msv.On("ListSecretVersionIds", "test_env/test_key").Return(&secretsmanager.ListSecretVersionIdsOutput{Versions: []types.SecretVersionsListEntry{
+		{VersionStages: []string{"AWSCURRENT"}, CreatedDate: &rotated},
+	}}, nil).Once()
+
+	p := AwsProvider{env: "test_env", cache: msc, versions: msv, window: time.Hour, now: func() time.Time { return now }, rotations: map[string]rotation{}, lookups: map[string]chan struct{}{}}
+
+	// a failed lookup is not tried again until the backoff has passed
+	_, err := p.GetPreviousSecretString("test_key")
+	assert.Equal(t, errors.New("test error"), err)
+	_, err = p.GetPreviousSecretString("test_key")
+	assert.Equal(t, errors.New("test error"), err)
+	msv.AssertNumberOfCalls(t, "ListSecretVersionIds", 1)
+
+	now = now.Add(rotationBackoff)
+	secret, err := p.GetPreviousSecretString("test_key")
+	assert.Nil(t, err)
+	assert.Equal(t, "old", secret)
+	msv.AssertNumberOfCalls(t, "ListSecretVersionIds", 2)
+}
+
+func TestAwsProvider_GetPreviousSecretString_Lookup(t *testing.T) {
+	now := time.Now()
+	rotated := now.Add(-time.Minute)
+	versions := &secretsmanager.ListSecretVersionIdsOutput{Versions: []types.SecretVersionsListEntry{
+		{VersionStages: []string{"AWSCURRENT"}, CreatedDate: &rotated},
+	}}
+
+	msc := new(MockAwsSecretsCache)
+	msc.On("GetSecretString", mock.Anything).Return("new", nil)
+	msc.On("GetSecretStringWithStage", "test_env/slow_key", "AWSPREVIOUS").Return("old", nil)
+	msc.On("GetSecretStringWithStage", "test_env/other_key", "AWSPREVIOUS").Return("other old", nil)
+
+	release := make(chan time.Time)
+	msv := new(MockSecretVersions)
+	msv.On("ListSecretVersionIds", "test_env/slow_key").WaitUntil(release).Return(versions, nil).Once()
+
+	p := AwsProvider{env: "test_env", cache: msc, versions: msv, window: time.Hour, now: func() time.Time { return now }, rotations: map[string]rotation{
+		"test_env/slow_key":  {current: "new", err: errors.New("test error"), retryAt: now.Add(-time.Second)},
+		"test_env/other_key": {current: "new", at: rotated},
+	}, lookups: map[string]chan struct{}{}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		secret, err := p.GetPreviousSecretString("slow_key")
+		assert.Nil(t, err)
+		assert.Equal(t, "old", secret)
+	}()
+
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		_, ok := p.lookups["test_env/slow_key"]
+		return ok
+	}, time.Second, time.Millisecond)
+
+	// a slow lookup holds up neither other secrets nor the failure it is trying again
+	secret, err := p.GetPreviousSecretString("other_key")
+	assert.Nil(t, err)
+	assert.Equal(t, "other old", secret)
+	_, err = p.GetPreviousSecretString("slow_key")
+	assert.Equal(t, errors.New("test error"), err)
+
+	close(release)
+	<-done
+
+	secret, err = p.GetPreviousSecretString("slow_key")
+	assert.Nil(t, err)
+	assert.Equal(t, "old", secret)
+	msv.AssertNumberOfCalls(t, "ListSecretVersionIds", 1)
+}
@@ -1,36 +1,78 @@
 package cache
 
 import (
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
-	"github.com/aws/aws-secretsmanager-caching-go/v2/secretcache"
-	"os"
+	"errors"
 )
 
+// ErrSecretNotFound is returned by a SecretProvider which does not have a secret, so that the
+// next provider in a SecretsCache is asked for it instead
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretProvider fetches the secrets of the service by name, such as jwt-key
+type SecretProvider interface {
+	GetSecretString(key string) (string, error)
+}
+
+// previousProvider is a SecretProvider which keeps the previous version of a secret once it has
+// been rotated
+type previousProvider interface {
+	GetPreviousSecretString(key string) (string, error)
+}
+
+// SecretsCache fetches secrets from each of its providers in turn, until one has the secret
 type SecretsCache struct {
-	env   string
-	cache awsSecretsCache
+	providers []SecretProvider
 }
 
-type awsSecretsCache interface {
-	GetSecretString(secretId string) (string, error)
+func New(providers ...SecretProvider) *SecretsCache {
+	return &SecretsCache{providers}
 }
 
-func applyAwsConfig(cfg *aws.Config) func(c *secretcache.Cache) {
-	return func(c *secretcache.Cache) {
-		c.Client = secretsmanager.NewFromConfig(*cfg)
+// GetSecretString returns the secret from the first provider which has it. Any error other than
+// ErrSecretNotFound is returned straight away, rather than falling back to a provider which may
+// hold an older secret.
+func (c *SecretsCache) GetSecretString(key string) (string, error) {
+	for _, provider := range c.providers {
+		secret, err := provider.GetSecretString(key)
+		if !errors.Is(err, ErrSecretNotFound) {
+			return secret, err
+		}
 	}
+
+	return "", notFoundError{key}
 }
 
-func New(cfg *aws.Config) *SecretsCache {
-	env := os.Getenv("ENVIRONMENT")
-	cache, err := secretcache.New(applyAwsConfig(cfg))
-	if err != nil {
-		panic(err)
+// GetPreviousSecretString returns the version of a secret before it was rotated, from the
+// provider of its current version, for as long as that provider keeps it. Providers without
+// versions, such as the environment, never have a previous secret.
+func (c *SecretsCache) GetPreviousSecretString(key string) (string, error) {
+	for _, provider := range c.providers {
+		_, err := provider.GetSecretString(key)
+		if errors.Is(err, ErrSecretNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if p, ok := provider.(previousProvider); ok {
+			return p.GetPreviousSecretString(key)
+		}
+		break
 	}
-	return &SecretsCache{env, cache}
+
+	return "", notFoundError{key}
 }
 
-func (c *SecretsCache) GetSecretString(key string) (string, error) {
-	return c.cache.GetSecretString(c.env + "/" + key)
+// notFoundError is ErrSecretNotFound for a secret, naming it
+type notFoundError struct {
+	key string
+}
+
+func (e notFoundError) Error() string {
+	return ErrSecretNotFound.Error() + ": " + e.key
+}
+
+func (e notFoundError) Unwrap() error {
+	return ErrSecretNotFound
 }
@@ -2,76 +2,125 @@ package cache
 
 import (
 	"errors"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-secretsmanager-caching-go/v2/secretcache"
-	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
-	"os"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
-type MockAwsSecretsCache struct {
-	mock.Mock
+type failingProvider struct {
+	err error
+}
+
+func (p failingProvider) GetSecretString(key string) (string, error) {
+	return "", p.err
 }
 
-func (m *MockAwsSecretsCache) GetSecretString(secretId string) (string, error) {
-	args := m.Called(secretId)
-	return args.Get(0).(string), args.Error(1)
+func TestSecretsCache_GetSecretString(t *testing.T) {
+	tests := []struct {
+		scenario       string
+		providers      []SecretProvider
+		expectedSecret string
+		expectedErr    string
+	}{
+		{
+			scenario:       "Secret from the first provider",
+			providers:      []SecretProvider{StaticProvider{"jwt-key": "first"}, StaticProvider{"jwt-key": "second"}},
+			expectedSecret: "first",
+		},
+		{
+			scenario:       "Secret from a later provider",
+			providers:      []SecretProvider{StaticProvider{}, StaticProvider{"jwt-key": "second"}},
+			expectedSecret: "second",
+		},
+		{
+			scenario:    "No provider has the secret",
+			providers:   []SecretProvider{StaticProvider{}, StaticProvider{"user-hash-salt": "salt"}},
+			expectedErr: "secret not found: jwt-key",
+		},
+		{
+			scenario:    "No providers",
+			expectedErr: "secret not found: jwt-key",
+		},
+		{
+			scenario:    "Provider fails",
+			providers:   []SecretProvider{failingProvider{errors.New("test error")}, StaticProvider{"jwt-key": "second"}},
+			expectedErr: "test error",
+		},
+	}
+
+	for _, test := range tests {
+		secret, err := New(test.providers...).GetSecretString("jwt-key")
+
+		assert.Equal(t, test.expectedSecret, secret, test.scenario)
+		if test.expectedErr == "" {
+			assert.Nil(t, err, test.scenario)
+		} else {
+			assert.EqualError(t, err, test.expectedErr, test.scenario)
+		}
+	}
+
+	_, err := New().GetSecretString("jwt-key")
+	assert.ErrorIs(t, err, ErrSecretNotFound)
 }
 
-func TestNew(t *testing.T) {
-	oldEnv := os.Getenv("ENVIRONMENT")
-	_ = os.Setenv("ENVIRONMENT", "test_env")
+// rotatedProvider has the secrets of current, which were rotated from those of previous
+type rotatedProvider struct {
+	current  StaticProvider
+	previous StaticProvider
+}
 
-	sc := New(aws.NewConfig())
-	assert.IsType(t, new(SecretsCache), sc)
-	assert.Equal(t, "test_env", sc.env)
-	assert.IsType(t, new(secretcache.Cache), sc.cache)
+func (p rotatedProvider) GetSecretString(key string) (string, error) {
+	return p.current.GetSecretString(key)
+}
 
-	_ = os.Setenv("ENVIRONMENT", oldEnv)
+func (p rotatedProvider) GetPreviousSecretString(key string) (string, error) {
+	return p.previous.GetSecretString(key)
 }
 
-func TestSecretsCache_GetSecretString(t *testing.T) {
+func TestSecretsCache_GetPreviousSecretString(t *testing.T) {
+	rotated := rotatedProvider{StaticProvider{"jwt-key": "new"}, StaticProvider{"jwt-key": "old"}}
+
 	tests := []struct {
 		scenario       string
-		env            string
-		secretKey      string
-		returnedSecret string
-		returnedErr    error
+		providers      []SecretProvider
+		expectedSecret string
+		expectedErr    string
 	}{
 		{
-			scenario:       "Secret retrieved successfully",
-			env:            "test_env",
-			secretKey:      "test_key",
-			returnedSecret: "test_secret",
-			returnedErr:    nil,
+			scenario:       "Previous secret of the provider with the current secret",
+			providers:      []SecretProvider{StaticProvider{}, rotated},
+			expectedSecret: "old",
+		},
+		{
+			scenario:    "Provider with the current secret has no versions",
+			providers:   []SecretProvider{StaticProvider{"jwt-key": "env"}, rotated},
+			expectedErr: "secret not found: jwt-key",
 		},
 		{
-			scenario:       "AwsSecretsCache returns an error",
-			env:            "test_env",
-			secretKey:      "test_key",
-			returnedSecret: "",
-			returnedErr:    errors.New("test error"),
+			scenario:    "Provider with the current secret has no previous secret",
+			providers:   []SecretProvider{rotatedProvider{StaticProvider{"jwt-key": "new"}, StaticProvider{}}},
+			expectedErr: "secret not found: jwt-key",
 		},
 		{
-			scenario:       "No ENVIRONMENT defined",
-			env:            "",
-			secretKey:      "test_key",
-			returnedSecret: "",
-			returnedErr:    errors.New("test error"),
+			scenario:    "No provider has the secret",
+			providers:   []SecretProvider{StaticProvider{}},
+			expectedErr: "secret not found: jwt-key",
+		},
+		{
+			scenario:    "Provider fails",
+			providers:   []SecretProvider{failingProvider{errors.New("test error")}, rotated},
+			expectedErr: "test error",
 		},
 	}
+
 	for _, test := range tests {
-		msc := new(MockAwsSecretsCache)
-		msc.On("GetSecretString", test.env+"/"+test.secretKey).Return(test.returnedSecret, test.returnedErr).Times(1)
+		secret, err := New(test.providers...).GetPreviousSecretString("jwt-key")
 
-		sc := SecretsCache{
-			env:   test.env,
-			cache: msc,
+		assert.Equal(t, test.expectedSecret, secret, test.scenario)
+		if test.expectedErr == "" {
+			assert.Nil(t, err, test.scenario)
+		} else {
+			assert.EqualError(t, err, test.expectedErr, test.scenario)
 		}
-		secret, err := sc.GetSecretString(test.secretKey)
-
-		assert.Equal(t, test.returnedSecret, secret, test.scenario)
-		assert.Equal(t, test.returnedErr, err, test.scenario)
 	}
 }
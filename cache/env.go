@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"os"
+	"strings"
+)
+
+// envAliases are the environment variables of secrets which are not named after them
+var envAliases = map[string]string{
+	"jwt-key": "JWT_SECRET",
+}
+
+// EnvProvider fetches secrets from environment variables named after them in upper case, with
+// anything other than letters and digits replaced by underscores, so user-hash-salt is read
+// from USER_HASH_SALT and sse-c-keys/local from SSE_C_KEYS_LOCAL. jwt-key is read from JWT_SECRET.
+type EnvProvider struct {
+	lookup func(string) (string, bool)
+}
+
+func NewEnvProvider() *EnvProvider {
+	return &EnvProvider{os.LookupEnv}
+}
+
+func (p *EnvProvider) GetSecretString(key string) (string, error) {
+	secret, ok := p.lookup(envName(key))
+	if !ok || secret == "" {
+		return "", notFoundError{key}
+	}
+
+	return secret, nil
+}
+
+func envName(key string) string {
+	if name, ok := envAliases[key]; ok {
+		return name
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
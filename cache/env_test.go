@@ -0,0 +1,39 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvProvider_GetSecretString(t *testing.T) {
+	env := map[string]string{
+		"JWT_SECRET":       "MyTestSecret",
+		"USER_HASH_SALT":   "salt",
+		"SSE_C_KEYS_LOCAL": "key",
+		"API_CLIENTS":      "",
+	}
+	p := &EnvProvider{func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}}
+
+	tests := []struct {
+		key            string
+		expectedSecret string
+		expectedErr    error
+	}{
+		{"jwt-key", "MyTestSecret", nil},
+		{"user-hash-salt", "salt", nil},
+		{"sse-c-keys/local", "key", nil},
+		{"api-clients", "", notFoundError{"api-clients"}},
+		{"link-signing-key", "", notFoundError{"link-signing-key"}},
+	}
+
+	for _, test := range tests {
+		secret, err := p.GetSecretString(test.key)
+
+		assert.Equal(t, test.expectedSecret, secret, test.key)
+		assert.Equal(t, test.expectedErr, err, test.key)
+	}
+}
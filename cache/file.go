@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileProvider fetches secrets from files named after them in a directory, such as a mounted
+// Kubernetes secret, so jwt-key is read from <dir>/jwt-key and sse-c-keys/local from
+// <dir>/sse-c-keys/local. The files are read each time, so a secret which is changed on disk is
+// used straight away.
+type FileProvider struct {
+	dir string
+}
+
+func NewFileProvider(dir string) (*FileProvider, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("secrets directory " + dir + " is not a directory")
+	}
+
+	return &FileProvider{dir}, nil
+}
+
+func (p *FileProvider) GetSecretString(key string) (string, error) {
+	// parts of a secret's name can come from a request, such as the SSE-C key of a file, so it
+	// cannot be allowed to reach outside of the directory
+	if !fs.ValidPath(key) {
+		return "", errors.New("invalid secret name: " + key)
+	}
+
+	b, err := os.ReadFile(filepath.Join(p.dir, filepath.FromSlash(key)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", notFoundError{key}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// files written by hand usually end with a newline, which is not part of the secret
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "jwt-key"), []byte("MyTestSecret"), 0o600)
+
+	p, err := NewFileProvider(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, dir, p.dir)
+
+	_, err = NewFileProvider(filepath.Join(dir, "jwt-key"))
+	assert.EqualError(t, err, "secrets directory "+filepath.Join(dir, "jwt-key")+" is not a directory")
+
+	_, err = NewFileProvider(filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFileProvider_GetSecretString(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "jwt-key"), []byte("MyTestSecret"), 0o600)
+	_ = os.WriteFile(filepath.Join(dir, "user-hash-salt"), []byte("salt\n"), 0o600)
+	_ = os.Mkdir(filepath.Join(dir, "sse-c-keys"), 0o700)
+	_ = os.WriteFile(filepath.Join(dir, "sse-c-keys", "local"), []byte("key"), 0o600)
+
+	p := &FileProvider{filepath.Join(dir, "sse-c-keys")}
+	// a secret outside of the directory cannot be read
+	_, err := p.GetSecretString("../jwt-key")
+	assert.EqualError(t, err, "invalid secret name: ../jwt-key")
+
+	p = &FileProvider{dir}
+
+	tests := []struct {
+		key            string
+		expectedSecret string
+		expectedErr    string
+	}{
+		{"jwt-key", "MyTestSecret", ""},
+		{"user-hash-salt", "salt", ""},
+		{"sse-c-keys/local", "key", ""},
+		{"sse-c-keys/other", "", "secret not found: sse-c-keys/other"},
+		{"link-signing-key", "", "secret not found: link-signing-key"},
+		{"sse-c-keys/../jwt-key", "", "invalid secret name: sse-c-keys/../jwt-key"},
+		{"/etc/passwd", "", "invalid secret name: /etc/passwd"},
+	}
+
+	for _, test := range tests {
+		secret, err := p.GetSecretString(test.key)
+
+		assert.Equal(t, test.expectedSecret, secret, test.key)
+		if test.expectedErr == "" {
+			assert.Nil(t, err, test.key)
+		} else {
+			assert.EqualError(t, err, test.expectedErr, test.key)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package cache
+
+// StaticProvider holds secrets in memory by name, for tests
+type StaticProvider map[string]string
+
+func (p StaticProvider) GetSecretString(key string) (string, error) {
+	secret, ok := p[key]
+	if !ok {
+		return "", notFoundError{key}
+	}
+
+	return secret, nil
+}
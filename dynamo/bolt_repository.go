@@ -0,0 +1,361 @@
+package dynamo
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"opg-file-service/storage"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var entriesBucket = []byte("entries")
+
+// BoltRepository keeps entries in a bbolt file on disk, for running the service without
+// DynamoDB while keeping entries across restarts. Entries expire once their Ttl has passed.
+type BoltRepository struct {
+	db  *bolt.DB
+	now func() time.Time
+}
+
+func NewBoltRepository(path string) (*BoltRepository, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(entriesBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &BoltRepository{db: db, now: time.Now}, nil
+}
+
+// Close closes the file, which is locked while it is open
+func (repo *BoltRepository) Close() error {
+	return repo.db.Close()
+}
+
+func (repo *BoltRepository) Get(ctx context.Context, ref string) (*storage.Entry, error) {
+	var entry *storage.Entry
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket).Get([]byte(ref))
+		if b == nil {
+			return nil
+		}
+
+		var err error
+		entry, err = decodeEntry(b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil || repo.expired(entry) {
+		return nil, storage.NotFoundError{Ref: ref}
+	}
+
+	return entry, nil
+}
+
+func (repo *BoltRepository) Delete(ctx context.Context, entry *storage.Entry) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Delete([]byte(entry.Ref))
+	})
+}
+
+func (repo *BoltRepository) Add(ctx context.Context, entry *storage.Entry) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	b, err := encodeEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+
+		// expired entries are removed as new ones are added, so that they do not build up
+		if err := repo.deleteExpired(bucket); err != nil {
+			return err
+		}
+
+		if entry.IdempotencyKey != "" {
+			err := bucket.ForEach(func(k, v []byte) error {
+				if saved, err := decodeEntry(v); err == nil && idempotencyKeyUsed(saved, entry) {
+					return storage.IdempotencyKeyError{Key: entry.IdempotencyKey, Ref: saved.Ref}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return bucket.Put([]byte(entry.Ref), b)
+	})
+}
+
+func (repo *BoltRepository) Claim(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	var entry *storage.Entry
+
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+
+		saved, err := repo.saved(bucket, ref)
+		if err != nil {
+			return err
+		}
+
+		now := repo.now()
+		if !claimable(saved, now) {
+			return claimError(ref, saved)
+		}
+
+		newClaim(saved, now, lease)
+
+		b, err := encodeEntry(saved)
+		if err != nil {
+			return err
+		}
+
+		entry = saved
+		return bucket.Put([]byte(ref), b)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (repo *BoltRepository) Release(ctx context.Context, entry *storage.Entry) error {
+	return repo.endClaim(entry, releaseClaim)
+}
+
+func (repo *BoltRepository) Consume(ctx context.Context, entry *storage.Entry) error {
+	return repo.endClaim(entry, consumeClaim)
+}
+
+// endClaim ends the claim on an entry with end, if the claim is still held
+func (repo *BoltRepository) endClaim(entry *storage.Entry, end func(*storage.Entry, time.Time)) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+
+		saved, err := repo.saved(bucket, entry.Ref)
+		if err != nil {
+			return err
+		}
+
+		if !claimHeld(saved, entry) {
+			return claimError(entry.Ref, saved)
+		}
+
+		end(saved, repo.now())
+
+		b, err := encodeEntry(saved)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(entry.Ref), b)
+	})
+}
+
+func (repo *BoltRepository) ClaimBuild(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	var entry *storage.Entry
+
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+
+		saved, err := repo.saved(bucket, ref)
+		if err != nil {
+			return err
+		}
+
+		now := repo.now()
+		if !buildClaimable(saved, now) {
+			return claimError(ref, saved)
+		}
+
+		newBuildClaim(saved, now, lease)
+
+		b, err := encodeEntry(saved)
+		if err != nil {
+			return err
+		}
+
+		entry = saved
+		return bucket.Put([]byte(ref), b)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (repo *BoltRepository) RenewBuild(ctx context.Context, entry *storage.Entry, lease time.Duration) error {
+	return repo.endBuildClaim(entry, func(saved *storage.Entry, now time.Time) {
+		saved.ClaimExpires = now.Add(lease).Unix()
+	})
+}
+
+func (repo *BoltRepository) EndBuild(ctx context.Context, entry *storage.Entry) error {
+	return repo.endBuildClaim(entry, func(saved *storage.Entry, now time.Time) {
+		endBuildClaim(saved, entry)
+	})
+}
+
+// endBuildClaim changes an entry with change, if the claim on its build is still held
+func (repo *BoltRepository) endBuildClaim(entry *storage.Entry, change func(*storage.Entry, time.Time)) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+
+		saved, err := repo.saved(bucket, entry.Ref)
+		if err != nil {
+			return err
+		}
+
+		if !buildClaimHeld(saved, entry) {
+			return claimError(entry.Ref, saved)
+		}
+
+		change(saved, repo.now())
+
+		b, err := encodeEntry(saved)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(entry.Ref), b)
+	})
+}
+
+func (repo *BoltRepository) List(ctx context.Context, hash string, limit int, after string) ([]*storage.Entry, string, error) {
+	var entries []*storage.Entry
+	var next string
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(entriesBucket).Cursor()
+
+		// entries are kept in order of their reference
+		k, v := c.First()
+		if after != "" {
+			k, v = c.Seek([]byte(after))
+			if string(k) == after {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			entry, err := decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			if entry.Hash != hash || repo.expired(entry) {
+				continue
+			}
+
+			if limit > 0 && len(entries) == limit {
+				next = entries[limit-1].Ref
+				break
+			}
+			entry.Files = nil
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return entries, next, nil
+}
+
+// saved reads an entry within a transaction, which is not found once it has expired
+func (repo *BoltRepository) saved(bucket *bolt.Bucket, ref string) (*storage.Entry, error) {
+	b := bucket.Get([]byte(ref))
+	if b == nil {
+		return nil, storage.NotFoundError{Ref: ref}
+	}
+
+	entry, err := decodeEntry(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if repo.expired(entry) {
+		return nil, storage.NotFoundError{Ref: ref}
+	}
+
+	return entry, nil
+}
+
+func (repo *BoltRepository) deleteExpired(bucket *bolt.Bucket) error {
+	var expired [][]byte
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		if entry, err := decodeEntry(v); err == nil && repo.expired(entry) {
+			expired = append(expired, bytes.Clone(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expired reports whether an entry's Ttl has passed, as DynamoDB would delete it once it has
+func (repo *BoltRepository) expired(entry *storage.Entry) bool {
+	return entry.Ttl > 0 && entry.Ttl < repo.now().Unix()
+}
+
+func encodeEntry(entry *storage.Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeEntry(b []byte) (*storage.Entry, error) {
+	entry := new(storage.Entry)
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(entry); err != nil {
+		return nil, err
+	}
+	entry.FileCount = len(entry.Files)
+	return entry, nil
+}
@@ -0,0 +1,67 @@
+package dynamo
+
+import (
+	"github.com/stretchr/testify/assert"
+	"opg-file-service/storage"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltRepository_Expiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	repo, err := NewBoltRepository(filepath.Join(t.TempDir(), "zip-requests.db"))
+	assert.Nil(t, err)
+	defer func() {
+		_ = repo.Close()
+	}()
+	repo.now = func() time.Time { return now }
+
+	assert.Nil(t, repo.Add(t.Context(), &storage.Entry{Ref: "expiring", Ttl: now.Add(time.Minute).Unix()}))
+	assert.Nil(t, repo.Add(t.Context(), &storage.Entry{Ref: "kept", Ttl: now.Add(time.Hour).Unix()}))
+
+	_, err = repo.Get(t.Context(), "expiring")
+	assert.Nil(t, err)
+
+	now = now.Add(2 * time.Minute)
+
+	_, err = repo.Get(t.Context(), "expiring")
+	assert.Equal(t, storage.NotFoundError{Ref: "expiring"}, err)
+
+	// expired entries are removed as others are added
+	assert.Nil(t, repo.Add(t.Context(), &storage.Entry{Ref: "expiring later", Ttl: now.Add(time.Minute).Unix()}))
+	now = now.Add(2 * time.Minute)
+	assert.Nil(t, repo.Add(t.Context(), &storage.Entry{Ref: "new", Ttl: now.Add(time.Minute).Unix()}))
+
+	var refs []string
+	_ = repo.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			refs = append(refs, string(k))
+			return nil
+		})
+	})
+	assert.Equal(t, []string{"kept", "new"}, refs)
+}
+
+func TestBoltRepository_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zip-requests.db")
+	entry := &storage.Entry{Ref: "test", Hash: "testHash", Ttl: 9999999999, Status: storage.StatusReady}
+
+	repo, err := NewBoltRepository(path)
+	assert.Nil(t, err)
+	assert.Nil(t, repo.Add(t.Context(), entry))
+	assert.Nil(t, repo.Close())
+
+	// entries are kept across restarts
+	repo, err = NewBoltRepository(path)
+	assert.Nil(t, err)
+	defer func() {
+		_ = repo.Close()
+	}()
+
+	got, err := repo.Get(t.Context(), "test")
+	assert.Nil(t, err)
+	assert.Equal(t, entry, got)
+}
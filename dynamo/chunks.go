@@ -0,0 +1,219 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"maps"
+	"opg-file-service/storage"
+	"strconv"
+)
+
+// DynamoDB items can be at most 400 KB, so the files of an entry which would not fit in its
+// item are split across further items, each kept below this size
+const maxItemSize = 350 * 1024
+
+// the number of further items an entry's files are split across, when there are any
+const fileChunksAttribute = "FileChunks"
+
+// the number of files an entry has, so that it can be listed without reading its files
+const fileCountAttribute = "FileCount"
+
+// chunkRef is the key of one of the items an entry's files are split across
+func chunkRef(ref string, i int) string {
+	return ref + "#files#" + strconv.Itoa(i)
+}
+
+// marshalEntry marshals an entry into its item, along with the items its files are split
+// across when they do not fit in it. Each chunk expires along with the entry.
+func marshalEntry(entry *storage.Entry) (map[string]types.AttributeValue, []map[string]types.AttributeValue, error) {
+	av, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	av[fileCountAttribute] = &types.AttributeValueMemberN{Value: strconv.Itoa(len(entry.Files))}
+
+	if itemSize(av) <= maxItemSize {
+		return av, nil, nil
+	}
+
+	files, _ := av["Files"].(*types.AttributeValueMemberL)
+	if files == nil {
+		return nil, nil, errors.New("entry is too large to be saved: " + entry.Ref)
+	}
+
+	var chunks []map[string]types.AttributeValue
+	var chunk []types.AttributeValue
+
+	newChunk := func(files []types.AttributeValue) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"Ref":   &types.AttributeValueMemberS{Value: chunkRef(entry.Ref, len(chunks))},
+			"Ttl":   av["Ttl"],
+			"Files": &types.AttributeValueMemberL{Value: files},
+		}
+	}
+
+	// room is left in each chunk for its key and Ttl, taking the size of the largest key
+	size := itemSize(newChunk(nil)) + len(strconv.Itoa(len(files.Value)))
+	empty := size
+
+	for _, file := range files.Value {
+		fileSize := attributeSize(file) + 1
+		if len(chunk) > 0 && size+fileSize > maxItemSize {
+			chunks = append(chunks, newChunk(chunk))
+			chunk, size = nil, empty
+		}
+		chunk = append(chunk, file)
+		size += fileSize
+	}
+	chunks = append(chunks, newChunk(chunk))
+
+	delete(av, "Files")
+	av[fileChunksAttribute] = &types.AttributeValueMemberN{Value: strconv.Itoa(len(chunks))}
+
+	if itemSize(av) > maxItemSize {
+		return nil, nil, errors.New("entry is too large to be saved: " + entry.Ref)
+	}
+
+	return av, chunks, nil
+}
+
+// unmarshalEntry unmarshals an entry from its item, reading its files back from the items
+// they were split across
+func (repo Repository) unmarshalEntry(ctx context.Context, av map[string]types.AttributeValue) (*storage.Entry, error) {
+	entry := storage.Entry{}
+
+	err := attributevalue.UnmarshalMap(av, &entry)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range fileChunks(av) {
+		result, err := repo.db.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: &repo.table,
+			Key: map[string]types.AttributeValue{
+				"Ref": &types.AttributeValueMemberS{Value: chunkRef(entry.Ref, i)},
+			},
+			// chunks are saved before the entry, so they can always be read once it has been
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.Item == nil {
+			return nil, errors.New("missing chunk " + strconv.Itoa(i) + " of the files of entry: " + entry.Ref)
+		}
+
+		var files []storage.File
+		if err := attributevalue.Unmarshal(result.Item["Files"], &files); err != nil {
+			return nil, err
+		}
+		entry.Files = append(entry.Files, files...)
+	}
+
+	// entries saved before their file count was kept have it worked out from their files
+	if _, ok := av[fileCountAttribute]; !ok {
+		entry.FileCount = len(entry.Files)
+	}
+
+	return &entry, nil
+}
+
+// unmarshalListedEntry unmarshals an entry from its item without its files, only reading them
+// back for entries saved before their file count was kept
+func (repo Repository) unmarshalListedEntry(ctx context.Context, av map[string]types.AttributeValue) (*storage.Entry, error) {
+	if _, ok := av[fileCountAttribute]; ok {
+		av = maps.Clone(av)
+		delete(av, "Files")
+		delete(av, fileChunksAttribute)
+	}
+
+	entry, err := repo.unmarshalEntry(ctx, av)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Files = nil
+	return entry, nil
+}
+
+// putChunks saves the items an entry's files are split across
+func (repo Repository) putChunks(ctx context.Context, chunks []map[string]types.AttributeValue) error {
+	for _, chunk := range chunks {
+		_, err := repo.db.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: &repo.table,
+			Item:      chunk,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteChunks deletes the n items an entry's files were split across
+func (repo Repository) deleteChunks(ctx context.Context, ref string, n int) error {
+	for i := range n {
+		_, err := repo.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: &repo.table,
+			Key: map[string]types.AttributeValue{
+				"Ref": &types.AttributeValueMemberS{Value: chunkRef(ref, i)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fileChunks is the number of items an entry's files are split across, from its item
+func fileChunks(av map[string]types.AttributeValue) int {
+	var n int
+	if v, ok := av[fileChunksAttribute]; ok {
+		_ = attributevalue.Unmarshal(v, &n)
+	}
+	return n
+}
+
+// itemSize estimates the size DynamoDB counts towards the limit of an item, which is the
+// length of each attribute's name and value
+func itemSize(av map[string]types.AttributeValue) int {
+	size := 0
+	for name, v := range av {
+		size += len(name) + attributeSize(v)
+	}
+	return size
+}
+
+func attributeSize(v types.AttributeValue) int {
+	switch v := v.(type) {
+	case *types.AttributeValueMemberS:
+		return len(v.Value)
+	case *types.AttributeValueMemberN:
+		return len(v.Value)/2 + 2
+	case *types.AttributeValueMemberB:
+		return len(v.Value)
+	case *types.AttributeValueMemberL:
+		size := 3
+		for _, e := range v.Value {
+			size += 1 + attributeSize(e)
+		}
+		return size
+	case *types.AttributeValueMemberM:
+		return 3 + len(v.Value) + itemSize(v.Value)
+	case *types.AttributeValueMemberSS:
+		size := 0
+		for _, s := range v.Value {
+			size += len(s)
+		}
+		return size
+	default:
+		return 1
+	}
+}
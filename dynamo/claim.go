@@ -0,0 +1,102 @@
+package dynamo
+
+import (
+	"opg-file-service/storage"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// claimable reports whether an entry can be claimed for download, which it can be when it
+// is not being downloaded, or when the request downloading it has not finished in time
+func claimable(entry *storage.Entry, now time.Time) bool {
+	switch entry.Status {
+	case "":
+		return true
+	case storage.StatusDownloading:
+		return entry.ClaimExpires < now.Unix()
+	default:
+		return false
+	}
+}
+
+// claimHeld reports whether the claim on a saved entry is still the one on claimed
+func claimHeld(saved *storage.Entry, claimed *storage.Entry) bool {
+	return saved.Status == storage.StatusDownloading && claimed.ClaimID != "" && saved.ClaimID == claimed.ClaimID
+}
+
+// claimError explains why a claim on an entry could not be taken or kept, from the entry
+// as it was saved
+func claimError(ref string, saved *storage.Entry) error {
+	switch {
+	case saved == nil || saved.Ref == "":
+		return storage.NotFoundError{Ref: ref}
+	case saved.Status == storage.StatusConsumed:
+		return storage.ConsumedError{Ref: ref}
+	default:
+		return storage.ClaimedError{Ref: ref}
+	}
+}
+
+// newClaim marks an entry as being downloaded by a new claim, which can be taken over once
+// lease has passed
+func newClaim(entry *storage.Entry, now time.Time, lease time.Duration) {
+	entry.Status = storage.StatusDownloading
+	entry.ClaimID = xid.New().String()
+	entry.ClaimExpires = now.Add(lease).Unix()
+}
+
+// releaseClaim marks an entry as no longer being downloaded, so that it can be claimed again
+func releaseClaim(entry *storage.Entry, now time.Time) {
+	entry.Status = ""
+	entry.ClaimID = ""
+	entry.ClaimExpires = 0
+}
+
+// consumeClaim counts a download of an entry, which can no longer be claimed once it has
+// been downloaded as many times as it allows
+func consumeClaim(entry *storage.Entry, now time.Time) {
+	releaseClaim(entry, now)
+
+	entry.Downloads++
+	entry.LastDownload = now.Unix()
+
+	if entry.Downloads >= entry.AllowedDownloads() {
+		entry.Status = storage.StatusConsumed
+	}
+}
+
+// buildClaimable reports whether an asynchronous entry's archive can be claimed to be built,
+// which it can be when it is waiting to be built or its last build failed, or when the worker
+// building it has not kept its claim up
+func buildClaimable(entry *storage.Entry, now time.Time) bool {
+	switch entry.Status {
+	case storage.StatusPending, storage.StatusFailed:
+		return true
+	case storage.StatusBuilding:
+		return entry.ClaimExpires < now.Unix()
+	default:
+		return false
+	}
+}
+
+// buildClaimHeld reports whether the claim on a saved entry's build is still the one on claimed
+func buildClaimHeld(saved *storage.Entry, claimed *storage.Entry) bool {
+	return saved.Status == storage.StatusBuilding && claimed.ClaimID != "" && saved.ClaimID == claimed.ClaimID
+}
+
+// newBuildClaim marks an entry as being built by a new claim, which can be taken over once
+// lease has passed without it being renewed
+func newBuildClaim(entry *storage.Entry, now time.Time, lease time.Duration) {
+	entry.Status = storage.StatusBuilding
+	entry.ClaimID = xid.New().String()
+	entry.ClaimExpires = now.Add(lease).Unix()
+}
+
+// endBuildClaim saves how the build of an entry ended, from the status and archive of built
+func endBuildClaim(saved *storage.Entry, built *storage.Entry) {
+	saved.Status = built.Status
+	saved.ArchiveKey = built.ArchiveKey
+	saved.ClaimID = ""
+	saved.ClaimExpires = 0
+}
@@ -0,0 +1,714 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"maps"
+	"opg-file-service/storage"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDynamoDB keeps items in memory, so that the DynamoDB repository can be run through
+// the conformance tests along with the other repositories
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]types.AttributeValue
+	gets  int
+}
+
+func (f *fakeDynamoDB) GetItem(ctx context.Context, input *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gets++
+	return &dynamodb.GetItemOutput{Item: f.items[input.Key["Ref"].(*types.AttributeValueMemberS).Value]}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(ctx context.Context, input *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ref := input.Key["Ref"].(*types.AttributeValueMemberS).Value
+	old, ok := f.items[ref]
+
+	if input.ConditionExpression != nil {
+		if *input.ConditionExpression != idempotencyKeyHeldCondition {
+			return nil, errors.New("unknown condition: " + *input.ConditionExpression)
+		}
+
+		var saved, values struct {
+			EntryRef string `dynamodbav:"EntryRef"`
+			Ref      string `dynamodbav:":entryRef"`
+		}
+		_ = attributevalue.UnmarshalMap(old, &saved)
+		_ = attributevalue.UnmarshalMap(input.ExpressionAttributeValues, &values)
+
+		if !ok || saved.EntryRef != values.Ref {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+	}
+
+	delete(f.items, ref)
+
+	return &dynamodb.DeleteItemOutput{Attributes: old}, nil
+}
+
+// PutItem only understands the condition used for idempotency keys
+func (f *fakeDynamoDB) PutItem(ctx context.Context, input *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if itemSize(input.Item) > 400*1024 {
+		return nil, errors.New("ValidationException: Item size has exceeded the maximum allowed size")
+	}
+
+	ref := input.Item["Ref"].(*types.AttributeValueMemberS).Value
+	old, ok := f.items[ref]
+
+	if input.ConditionExpression != nil {
+		switch *input.ConditionExpression {
+		case idempotencyKeyCondition:
+			var saved, values struct {
+				Ttl      int64  `dynamodbav:"Ttl"`
+				EntryRef string `dynamodbav:"EntryRef"`
+				Now      int64  `dynamodbav:":now"`
+				Ref      string `dynamodbav:":entryRef"`
+			}
+			_ = attributevalue.UnmarshalMap(old, &saved)
+			_ = attributevalue.UnmarshalMap(input.ExpressionAttributeValues, &values)
+
+			ok = !ok || saved.Ttl != 0 && saved.Ttl < values.Now || saved.EntryRef == values.Ref
+		default:
+			return nil, errors.New("unknown condition: " + *input.ConditionExpression)
+		}
+		if !ok {
+			return nil, &types.ConditionalCheckFailedException{Item: old}
+		}
+	}
+
+	f.items[ref] = input.Item
+	if input.ReturnValues == types.ReturnValueAllOld {
+		return &dynamodb.PutItemOutput{Attributes: old}, nil
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// Query only understands queries of the Hash index, which it reads in order of Ref as a
+// local backend would
+func (f *fakeDynamoDB) Query(ctx context.Context, input *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if *input.KeyConditionExpression != "#hash = :hash" || *input.FilterExpression != unexpiredFilter {
+		return nil, errors.New("unknown query: " + *input.KeyConditionExpression)
+	}
+
+	hash := input.ExpressionAttributeValues[":hash"].(*types.AttributeValueMemberS).Value
+	now, _ := strconv.ParseInt(input.ExpressionAttributeValues[":now"].(*types.AttributeValueMemberN).Value, 10, 64)
+
+	var after string
+	if input.ExclusiveStartKey != nil {
+		after = input.ExclusiveStartKey["Ref"].(*types.AttributeValueMemberS).Value
+	}
+
+	var refs []string
+	for ref, item := range f.items {
+		// the index only has items with a Hash, as it is left out of chunks of files
+		if h, ok := item["Hash"].(*types.AttributeValueMemberS); ok && h.Value == hash && ref > after {
+			refs = append(refs, ref)
+		}
+	}
+	slices.Sort(refs)
+
+	// the limit is of the items read, before they are filtered
+	output := &dynamodb.QueryOutput{}
+	if input.Limit != nil && len(refs) >= int(*input.Limit) {
+		refs = refs[:*input.Limit]
+		output.LastEvaluatedKey = map[string]types.AttributeValue{
+			"Hash": input.ExpressionAttributeValues[":hash"],
+			"Ref":  &types.AttributeValueMemberS{Value: refs[len(refs)-1]},
+		}
+	}
+
+	for _, ref := range refs {
+		ttl, _ := strconv.ParseInt(f.items[ref]["Ttl"].(*types.AttributeValueMemberN).Value, 10, 64)
+		if ttl == 0 || ttl >= now {
+			output.Items = append(output.Items, f.items[ref])
+		}
+	}
+
+	return output, nil
+}
+
+// UpdateItem only understands the conditions used for claims, and SET update expressions
+func (f *fakeDynamoDB) UpdateItem(ctx context.Context, input *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ref := input.Key["Ref"].(*types.AttributeValueMemberS).Value
+	item, ok := f.items[ref]
+
+	var saved, values struct {
+		Status       string `dynamodbav:"Status"`
+		ClaimID      string `dynamodbav:"ClaimID"`
+		ClaimExpires int64  `dynamodbav:"ClaimExpires"`
+		Downloading  string `dynamodbav:":downloading"`
+		Pending      string `dynamodbav:":pending"`
+		Failed       string `dynamodbav:":failed"`
+		Building     string `dynamodbav:":building"`
+		ValueClaimID string `dynamodbav:":claimID"`
+		Now          int64  `dynamodbav:":now"`
+	}
+	_ = attributevalue.UnmarshalMap(item, &saved)
+	_ = attributevalue.UnmarshalMap(input.ExpressionAttributeValues, &values)
+
+	switch *input.ConditionExpression {
+	case claimCondition:
+		ok = ok && (saved.Status == "" || saved.Status == values.Downloading && saved.ClaimExpires < values.Now)
+	case claimHeldCondition:
+		ok = ok && saved.Status == values.Downloading && saved.ClaimID == values.ValueClaimID
+	case buildClaimCondition:
+		ok = ok && (saved.Status == values.Pending || saved.Status == values.Failed || saved.Status == values.Building && saved.ClaimExpires < values.Now)
+	case buildClaimHeldCondition:
+		ok = ok && saved.Status == values.Building && saved.ClaimID == values.ValueClaimID
+	default:
+		return nil, errors.New("unknown condition: " + *input.ConditionExpression)
+	}
+	if !ok {
+		return nil, &types.ConditionalCheckFailedException{Item: item}
+	}
+
+	item = maps.Clone(item)
+	for _, set := range strings.Split(strings.TrimPrefix(*input.UpdateExpression, "SET "), ", ") {
+		name, value, _ := strings.Cut(set, " = ")
+		item[input.ExpressionAttributeNames[name]] = input.ExpressionAttributeValues[value]
+	}
+	f.items[ref] = item
+
+	return &dynamodb.UpdateItemOutput{Attributes: item}, nil
+}
+
+func TestRepositoryConformance(t *testing.T) {
+	repositories := map[string]func(t *testing.T) RepositoryInterface{
+		"DynamoDB": func(t *testing.T) RepositoryInterface {
+			return &Repository{
+				db:        &fakeDynamoDB{items: map[string]map[string]types.AttributeValue{}},
+				logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+				table:     "zip-requests",
+				hashIndex: "Hash",
+			}
+		},
+		"Memory": func(t *testing.T) RepositoryInterface {
+			return NewMemoryRepository()
+		},
+		"Bolt": func(t *testing.T) RepositoryInterface {
+			repo, err := NewBoltRepository(filepath.Join(t.TempDir(), "zip-requests.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				_ = repo.Close()
+			})
+			return repo
+		},
+	}
+
+	for name, newRepo := range repositories {
+		t.Run(name, func(t *testing.T) {
+			testRepository(t, newRepo)
+		})
+	}
+}
+
+// testRepository checks that a repository behaves as the DynamoDB repository does
+func testRepository(t *testing.T, newRepo func(t *testing.T) RepositoryInterface) {
+	newEntry := func() *storage.Entry {
+		return &storage.Entry{
+			Ref:           "test",
+			Hash:          "testHash",
+			Ttl:           9999999999,
+			Format:        storage.FormatZip,
+			FailurePolicy: storage.FailurePolicySkip,
+			Async:         true,
+			Status:        storage.StatusPending,
+			ArchiveKey:    "test.zip",
+			CallbackUrl:   "https://sirius.example/callback",
+			Manifest:      true,
+			Encryption:    &storage.Encryption{Method: storage.EncryptionAES256, Password: "correct horse battery"},
+			Files: []storage.File{
+				{S3path: "s3://files/file1", FileName: "file1", Folder: "folder"},
+				{S3path: "s3://files/file2", FileName: "file2", VersionID: "v2", ETag: `"abc123"`, SSECustomerKeyRef: "documents"},
+			},
+			FileCount: 2,
+		}
+	}
+
+	t.Run("Add and Get", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newEntry()))
+
+		entry, err := repo.Get(t.Context(), "test")
+		assert.Nil(t, err)
+		assert.Equal(t, newEntry(), entry)
+	})
+
+	// more files than fit in a DynamoDB item
+	newLargeEntry := func() *storage.Entry {
+		entry := newEntry()
+		entry.Async, entry.Status, entry.ArchiveKey = false, "", ""
+		entry.Files = make([]storage.File, 5000)
+		for i := range entry.Files {
+			entry.Files[i] = storage.File{
+				S3path:   "s3://files/bulk-disclosure/" + strings.Repeat("x", 80) + "/" + strconv.Itoa(i),
+				FileName: "document " + strconv.Itoa(i) + ".pdf",
+				Folder:   "disclosure",
+			}
+		}
+		entry.FileCount = len(entry.Files)
+		return entry
+	}
+
+	t.Run("Add and Get an entry with many files", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newLargeEntry()))
+
+		entry, err := repo.Get(t.Context(), "test")
+		assert.Nil(t, err)
+		assert.Equal(t, newLargeEntry(), entry)
+
+		claimed, err := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, err)
+		assert.Equal(t, newLargeEntry().Files, claimed.Files)
+
+		entries, _, err := repo.List(t.Context(), "testHash", 10, "")
+		assert.Nil(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Nil(t, entries[0].Files)
+			assert.Equal(t, 5000, entries[0].FileCount)
+		}
+
+		assert.Nil(t, repo.Delete(t.Context(), entry))
+		_, err = repo.Get(t.Context(), "test")
+		assert.Equal(t, storage.NotFoundError{Ref: "test"}, err)
+	})
+
+	t.Run("Get a missing entry", func(t *testing.T) {
+		repo := newRepo(t)
+
+		entry, err := repo.Get(t.Context(), "missing")
+		assert.Nil(t, entry)
+		assert.Equal(t, storage.NotFoundError{Ref: "missing"}, err)
+	})
+
+	t.Run("Changes are only kept once saved", func(t *testing.T) {
+		repo := newRepo(t)
+		entry := newEntry()
+		assert.Nil(t, repo.Add(t.Context(), entry))
+
+		entry.Files[0].FileName = "changed"
+		entry.Encryption.Password = "changed"
+
+		got, _ := repo.Get(t.Context(), "test")
+		got.Files[1].FileName = "changed"
+
+		got, _ = repo.Get(t.Context(), "test")
+		assert.Equal(t, newEntry(), got)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newEntry()))
+
+		assert.Nil(t, repo.Delete(t.Context(), newEntry()))
+		_, err := repo.Get(t.Context(), "test")
+		assert.Equal(t, storage.NotFoundError{Ref: "test"}, err)
+
+		// deleting an entry which has already gone is not an error
+		assert.Nil(t, repo.Delete(t.Context(), newEntry()))
+	})
+
+	// entries which are streamed, rather than built in the background
+	newDownload := func() *storage.Entry {
+		entry := newEntry()
+		entry.Async = false
+		entry.Status = ""
+		entry.ArchiveKey = ""
+		return entry
+	}
+
+	t.Run("Claim", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newDownload()))
+
+		entry, err := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, err)
+		assert.Equal(t, storage.StatusDownloading, entry.Status)
+		assert.NotEmpty(t, entry.ClaimID)
+		assert.Greater(t, entry.ClaimExpires, time.Now().Unix())
+
+		want := newDownload()
+		want.Status, want.ClaimID, want.ClaimExpires = entry.Status, entry.ClaimID, entry.ClaimExpires
+		assert.Equal(t, want, entry)
+
+		got, _ := repo.Get(t.Context(), "test")
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("Claim an entry which is being downloaded", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newDownload()))
+
+		_, err := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, err)
+
+		entry, err := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, entry)
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, err)
+	})
+
+	t.Run("Claim an entry whose claim has expired", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newDownload()))
+
+		first, err := repo.Claim(t.Context(), "test", -time.Minute)
+		assert.Nil(t, err)
+
+		second, err := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, err)
+		assert.NotEqual(t, first.ClaimID, second.ClaimID)
+
+		// the claim which has been taken over can no longer be ended
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, repo.Consume(t.Context(), first))
+		assert.Nil(t, repo.Consume(t.Context(), second))
+	})
+
+	t.Run("Claim a missing entry", func(t *testing.T) {
+		repo := newRepo(t)
+
+		entry, err := repo.Claim(t.Context(), "missing", time.Minute)
+		assert.Nil(t, entry)
+		assert.Equal(t, storage.NotFoundError{Ref: "missing"}, err)
+	})
+
+	t.Run("Claims are only given to one request at a time", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newDownload()))
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for range 10 {
+			wg.Go(func() {
+				_, err := repo.Claim(t.Context(), "test", time.Minute)
+				errs <- err
+			})
+		}
+		wg.Wait()
+		close(errs)
+
+		claimed := 0
+		for err := range errs {
+			if err == nil {
+				claimed++
+			} else {
+				assert.Equal(t, storage.ClaimedError{Ref: "test"}, err)
+			}
+		}
+		assert.Equal(t, 1, claimed)
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newDownload()))
+
+		entry, _ := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, repo.Release(t.Context(), entry))
+
+		got, _ := repo.Get(t.Context(), "test")
+		assert.Equal(t, newDownload(), got)
+
+		// a released entry can be claimed again, but not released twice
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, repo.Release(t.Context(), entry))
+		_, err := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, err)
+	})
+
+	t.Run("Consume", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newDownload()))
+
+		entry, _ := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, repo.Consume(t.Context(), entry))
+
+		got, _ := repo.Get(t.Context(), "test")
+		assert.Equal(t, storage.StatusConsumed, got.Status)
+		assert.Empty(t, got.ClaimID)
+		assert.Equal(t, 1, got.Downloads)
+		assert.InDelta(t, time.Now().Unix(), got.LastDownload, 5)
+
+		_, err := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Equal(t, storage.ConsumedError{Ref: "test"}, err)
+		assert.Equal(t, storage.ConsumedError{Ref: "test"}, repo.Release(t.Context(), entry))
+	})
+
+	t.Run("Consume an entry which can be downloaded more than once", func(t *testing.T) {
+		repo := newRepo(t)
+		entry := newDownload()
+		entry.MaxDownloads = 2
+		assert.Nil(t, repo.Add(t.Context(), entry))
+
+		first, _ := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, repo.Consume(t.Context(), first))
+
+		got, _ := repo.Get(t.Context(), "test")
+		assert.Equal(t, "", got.Status)
+		assert.Equal(t, 1, got.Downloads)
+
+		second, err := repo.Claim(t.Context(), "test", time.Minute)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, second.Downloads)
+		assert.Nil(t, repo.Consume(t.Context(), second))
+
+		got, _ = repo.Get(t.Context(), "test")
+		assert.Equal(t, storage.StatusConsumed, got.Status)
+		assert.Equal(t, 2, got.Downloads)
+
+		_, err = repo.Claim(t.Context(), "test", time.Minute)
+		assert.Equal(t, storage.ConsumedError{Ref: "test"}, err)
+	})
+
+	t.Run("End the claim on a missing entry", func(t *testing.T) {
+		repo := newRepo(t)
+		entry := newDownload()
+		entry.ClaimID = "claim"
+
+		assert.Equal(t, storage.NotFoundError{Ref: "test"}, repo.Release(t.Context(), entry))
+		assert.Equal(t, storage.NotFoundError{Ref: "test"}, repo.Consume(t.Context(), entry))
+	})
+
+	t.Run("ClaimBuild", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newEntry()))
+
+		entry, err := repo.ClaimBuild(t.Context(), "test", time.Minute)
+		assert.Nil(t, err)
+		assert.Equal(t, storage.StatusBuilding, entry.Status)
+		assert.NotEmpty(t, entry.ClaimID)
+		assert.Greater(t, entry.ClaimExpires, time.Now().Unix())
+
+		want := newEntry()
+		want.Status, want.ClaimID, want.ClaimExpires = entry.Status, entry.ClaimID, entry.ClaimExpires
+		assert.Equal(t, want, entry)
+
+		got, _ := repo.Get(t.Context(), "test")
+		assert.Equal(t, want, got)
+
+		_, err = repo.ClaimBuild(t.Context(), "test", time.Minute)
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, err)
+	})
+
+	t.Run("ClaimBuild an entry whose build has expired", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newEntry()))
+
+		first, err := repo.ClaimBuild(t.Context(), "test", -time.Minute)
+		assert.Nil(t, err)
+
+		second, err := repo.ClaimBuild(t.Context(), "test", time.Minute)
+		assert.Nil(t, err)
+		assert.NotEqual(t, first.ClaimID, second.ClaimID)
+
+		// the build which has been taken over can no longer be renewed or ended
+		first.Status = storage.StatusFailed
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, repo.RenewBuild(t.Context(), first, time.Minute))
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, repo.EndBuild(t.Context(), first))
+
+		got, _ := repo.Get(t.Context(), "test")
+		assert.Equal(t, storage.StatusBuilding, got.Status)
+		assert.Equal(t, second.ClaimID, got.ClaimID)
+	})
+
+	t.Run("ClaimBuild an entry which is ready or missing", func(t *testing.T) {
+		repo := newRepo(t)
+		entry := newEntry()
+		entry.Status = storage.StatusReady
+		assert.Nil(t, repo.Add(t.Context(), entry))
+
+		_, err := repo.ClaimBuild(t.Context(), "test", time.Minute)
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, err)
+
+		_, err = repo.ClaimBuild(t.Context(), "missing", time.Minute)
+		assert.Equal(t, storage.NotFoundError{Ref: "missing"}, err)
+	})
+
+	t.Run("RenewBuild", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newEntry()))
+
+		entry, _ := repo.ClaimBuild(t.Context(), "test", -time.Minute)
+		assert.Nil(t, repo.RenewBuild(t.Context(), entry, time.Minute))
+
+		got, _ := repo.Get(t.Context(), "test")
+		assert.Equal(t, entry.ClaimID, got.ClaimID)
+		assert.Greater(t, got.ClaimExpires, time.Now().Unix())
+
+		_, err := repo.ClaimBuild(t.Context(), "test", time.Minute)
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, err)
+	})
+
+	t.Run("EndBuild", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newEntry()))
+
+		entry, _ := repo.ClaimBuild(t.Context(), "test", time.Minute)
+		entry.Status = storage.StatusReady
+		entry.ArchiveKey = "built.zip"
+		assert.Nil(t, repo.EndBuild(t.Context(), entry))
+
+		want := newEntry()
+		want.Status = storage.StatusReady
+		want.ArchiveKey = "built.zip"
+		got, _ := repo.Get(t.Context(), "test")
+		assert.Equal(t, want, got)
+
+		// a build can only be ended once, and a ready archive is not built again
+		entry.Status = storage.StatusFailed
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, repo.EndBuild(t.Context(), entry))
+		_, err := repo.ClaimBuild(t.Context(), "test", time.Minute)
+		assert.Equal(t, storage.ClaimedError{Ref: "test"}, err)
+	})
+
+	t.Run("ClaimBuild an entry whose build failed", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newEntry()))
+
+		entry, _ := repo.ClaimBuild(t.Context(), "test", time.Minute)
+		entry.Status = storage.StatusFailed
+		assert.Nil(t, repo.EndBuild(t.Context(), entry))
+
+		_, err := repo.ClaimBuild(t.Context(), "test", time.Minute)
+		assert.Nil(t, err)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		repo := newRepo(t)
+
+		var want []string
+		for i := range 5 {
+			entry := newDownload()
+			entry.Ref = "test" + strconv.Itoa(i)
+			assert.Nil(t, repo.Add(t.Context(), entry))
+			want = append(want, entry.Ref)
+		}
+
+		other := newDownload()
+		other.Ref, other.Hash = "other", "otherHash"
+		assert.Nil(t, repo.Add(t.Context(), other))
+
+		expired := newDownload()
+		expired.Ref, expired.Ttl = "expired", time.Now().Add(-time.Minute).Unix()
+		assert.Nil(t, repo.Add(t.Context(), expired))
+
+		// a page can be short, or even empty, so the pages are read until there are no more
+		var got []string
+		var after string
+		for range 10 {
+			entries, next, err := repo.List(t.Context(), "testHash", 2, after)
+			assert.Nil(t, err)
+			assert.LessOrEqual(t, len(entries), 2)
+
+			for _, entry := range entries {
+				got = append(got, entry.Ref)
+				assert.Nil(t, entry.Files)
+				assert.Equal(t, 2, entry.FileCount)
+			}
+
+			if next == "" {
+				break
+			}
+			after = next
+		}
+
+		slices.Sort(got)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("List for a user without entries", func(t *testing.T) {
+		repo := newRepo(t)
+		assert.Nil(t, repo.Add(t.Context(), newDownload()))
+
+		entries, next, err := repo.List(t.Context(), "otherHash", 10, "")
+		assert.Nil(t, err)
+		assert.Empty(t, entries)
+		assert.Empty(t, next)
+	})
+
+	t.Run("Idempotency keys", func(t *testing.T) {
+		repo := newRepo(t)
+
+		newKeyed := func(ref, hash, key string) *storage.Entry {
+			entry := newDownload()
+			entry.Ref, entry.Hash, entry.IdempotencyKey, entry.RequestHash = ref, hash, key, "requestHash"
+			return entry
+		}
+
+		assert.Nil(t, repo.Add(t.Context(), newKeyed("test", "testHash", "key")))
+
+		entry, err := repo.Get(t.Context(), "test")
+		assert.Nil(t, err)
+		assert.Equal(t, newKeyed("test", "testHash", "key"), entry)
+
+		// a key can only be used once by a user, but can be used by other users
+		err = repo.Add(t.Context(), newKeyed("retry", "testHash", "key"))
+		assert.Equal(t, storage.IdempotencyKeyError{Key: "key", Ref: "test"}, err)
+		_, err = repo.Get(t.Context(), "retry")
+		assert.Equal(t, storage.NotFoundError{Ref: "retry"}, err)
+
+		assert.Nil(t, repo.Add(t.Context(), newKeyed("other", "otherHash", "key")))
+		assert.Nil(t, repo.Add(t.Context(), newKeyed("another", "testHash", "another key")))
+
+		// saving the entry again does not use its key up
+		assert.Nil(t, repo.Add(t.Context(), newKeyed("test", "testHash", "key")))
+
+		// the key can be used again once its entry has been deleted
+		assert.Nil(t, repo.Delete(t.Context(), newEntry()))
+		assert.Nil(t, repo.Add(t.Context(), newKeyed("retry", "testHash", "key")))
+	})
+
+	t.Run("Idempotency keys of expired entries", func(t *testing.T) {
+		repo := newRepo(t)
+
+		expired := newDownload()
+		expired.Ttl, expired.IdempotencyKey = time.Now().Add(-time.Minute).Unix(), "key"
+		assert.Nil(t, repo.Add(t.Context(), expired))
+
+		entry := newDownload()
+		entry.Ref, entry.IdempotencyKey = "retry", "key"
+		assert.Nil(t, repo.Add(t.Context(), entry))
+
+		err := repo.Add(t.Context(), expired)
+		assert.Equal(t, storage.IdempotencyKeyError{Key: "key", Ref: "retry"}, err)
+	})
+
+	t.Run("Nil entries", func(t *testing.T) {
+		repo := newRepo(t)
+		want := errors.New("entry cannot be nil")
+
+		assert.Equal(t, want, repo.Add(t.Context(), nil))
+		assert.Equal(t, want, repo.Delete(t.Context(), nil))
+		assert.Equal(t, want, repo.Release(t.Context(), nil))
+		assert.Equal(t, want, repo.Consume(t.Context(), nil))
+		assert.Equal(t, want, repo.RenewBuild(t.Context(), nil, time.Minute))
+		assert.Equal(t, want, repo.EndBuild(t.Context(), nil))
+	})
+}
@@ -24,3 +24,13 @@ func (m *MockDynamoDB) PutItem(ctx context.Context, input *dynamodb.PutItemInput
 	args := m.Called(input)
 	return args.Get(0).(*dynamodb.PutItemOutput), args.Error(1)
 }
+
+func (m *MockDynamoDB) UpdateItem(ctx context.Context, input *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func (m *MockDynamoDB) Query(ctx context.Context, input *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
@@ -0,0 +1,113 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"log/slog"
+	"opg-file-service/storage"
+	"time"
+)
+
+// an idempotency key can be saved for an entry when it has not been used, when the entry it
+// was used for has expired, or when it was used for the same entry
+const idempotencyKeyCondition = "attribute_not_exists(#ref) OR (#ttl <> :zero AND #ttl < :now) OR #entryRef = :entryRef"
+
+// idempotencyKeyHeldCondition is met while an idempotency key is still used for an entry
+const idempotencyKeyHeldCondition = "#entryRef = :entryRef"
+
+// idempotencyKeyUsed reports whether a saved entry was made by the same user with the same
+// idempotency key as another entry
+func idempotencyKeyUsed(saved *storage.Entry, entry *storage.Entry) bool {
+	return entry.IdempotencyKey != "" &&
+		saved.Ref != entry.Ref &&
+		saved.Hash == entry.Hash &&
+		saved.IdempotencyKey == entry.IdempotencyKey
+}
+
+// idempotencyKeyRef is the key of the item which keeps an idempotency key unique for a user
+func idempotencyKeyRef(hash, key string) string {
+	return hash + "#idempotency#" + key
+}
+
+// addIdempotencyKey saves the item for an entry's idempotency key, which expires along with
+// the entry, unless its user has already made another entry with the key
+func (repo Repository) addIdempotencyKey(ctx context.Context, entry *storage.Entry) error {
+	values, err := attributevalue.MarshalMap(map[string]any{
+		":zero":     0,
+		":now":      time.Now().Unix(),
+		":entryRef": entry.Ref,
+	})
+	if err != nil {
+		return err
+	}
+
+	item, err := attributevalue.MarshalMap(map[string]any{
+		"Ref":      idempotencyKeyRef(entry.Hash, entry.IdempotencyKey),
+		"Ttl":      entry.Ttl,
+		"EntryRef": entry.Ref,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           &repo.table,
+		Item:                item,
+		ConditionExpression: aws.String(idempotencyKeyCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#ref":      "Ref",
+			"#ttl":      "Ttl",
+			"#entryRef": "EntryRef",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		var used struct{ EntryRef string }
+		if err := attributevalue.UnmarshalMap(conditionErr.Item, &used); err != nil {
+			repo.logger.Info("Failed to unmarshal Record, ", slog.Any("err", err.Error()))
+		}
+
+		return storage.IdempotencyKeyError{Key: entry.IdempotencyKey, Ref: used.EntryRef}
+	}
+
+	return err
+}
+
+// deleteIdempotencyKey deletes the item for the idempotency key of an entry, given the entry's
+// item, unless the key has since been used for another entry
+func (repo Repository) deleteIdempotencyKey(ctx context.Context, ref string, av map[string]types.AttributeValue) error {
+	var saved struct{ Hash, IdempotencyKey string }
+	if err := attributevalue.UnmarshalMap(av, &saved); err != nil || saved.IdempotencyKey == "" {
+		return err
+	}
+
+	entryRef, _ := attributevalue.Marshal(ref)
+
+	_, err := repo.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &repo.table,
+		Key: map[string]types.AttributeValue{
+			"Ref": &types.AttributeValueMemberS{Value: idempotencyKeyRef(saved.Hash, saved.IdempotencyKey)},
+		},
+		ConditionExpression: aws.String(idempotencyKeyHeldCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#entryRef": "EntryRef",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":entryRef": entryRef,
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,236 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"opg-file-service/storage"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryRepository keeps entries in memory, for running the service without DynamoDB.
+// Entries are lost when the service stops, and expire once their Ttl has passed.
+type MemoryRepository struct {
+	mu      sync.Mutex
+	entries map[string]storage.Entry
+	now     func() time.Time
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		entries: map[string]storage.Entry{},
+		now:     time.Now,
+	}
+}
+
+func (repo *MemoryRepository) Get(ctx context.Context, ref string) (*storage.Entry, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	entry, ok := repo.entries[ref]
+	if !ok || repo.expired(entry) {
+		delete(repo.entries, ref)
+		return nil, storage.NotFoundError{Ref: ref}
+	}
+
+	entry = copyEntry(entry)
+	return &entry, nil
+}
+
+func (repo *MemoryRepository) Delete(ctx context.Context, entry *storage.Entry) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	delete(repo.entries, entry.Ref)
+	return nil
+}
+
+func (repo *MemoryRepository) Add(ctx context.Context, entry *storage.Entry) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	// expired entries are removed as new ones are added, so that they do not build up
+	for ref, e := range repo.entries {
+		if repo.expired(e) {
+			delete(repo.entries, ref)
+		} else if idempotencyKeyUsed(&e, entry) {
+			return storage.IdempotencyKeyError{Key: entry.IdempotencyKey, Ref: ref}
+		}
+	}
+
+	repo.entries[entry.Ref] = copyEntry(*entry)
+	return nil
+}
+
+func (repo *MemoryRepository) Claim(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	entry, ok := repo.entries[ref]
+	if !ok || repo.expired(entry) {
+		delete(repo.entries, ref)
+		return nil, storage.NotFoundError{Ref: ref}
+	}
+
+	now := repo.now()
+	if !claimable(&entry, now) {
+		return nil, claimError(ref, &entry)
+	}
+
+	newClaim(&entry, now, lease)
+	repo.entries[ref] = entry
+
+	entry = copyEntry(entry)
+	return &entry, nil
+}
+
+func (repo *MemoryRepository) Release(ctx context.Context, entry *storage.Entry) error {
+	return repo.endClaim(entry, releaseClaim)
+}
+
+func (repo *MemoryRepository) Consume(ctx context.Context, entry *storage.Entry) error {
+	return repo.endClaim(entry, consumeClaim)
+}
+
+func (repo *MemoryRepository) ClaimBuild(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	entry, ok := repo.entries[ref]
+	if !ok || repo.expired(entry) {
+		delete(repo.entries, ref)
+		return nil, storage.NotFoundError{Ref: ref}
+	}
+
+	now := repo.now()
+	if !buildClaimable(&entry, now) {
+		return nil, claimError(ref, &entry)
+	}
+
+	newBuildClaim(&entry, now, lease)
+	repo.entries[ref] = entry
+
+	entry = copyEntry(entry)
+	return &entry, nil
+}
+
+func (repo *MemoryRepository) RenewBuild(ctx context.Context, entry *storage.Entry, lease time.Duration) error {
+	return repo.endBuildClaim(entry, func(saved *storage.Entry, now time.Time) {
+		saved.ClaimExpires = now.Add(lease).Unix()
+	})
+}
+
+func (repo *MemoryRepository) EndBuild(ctx context.Context, entry *storage.Entry) error {
+	return repo.endBuildClaim(entry, func(saved *storage.Entry, now time.Time) {
+		endBuildClaim(saved, entry)
+	})
+}
+
+// endBuildClaim changes an entry with change, if the claim on its build is still held
+func (repo *MemoryRepository) endBuildClaim(entry *storage.Entry, change func(*storage.Entry, time.Time)) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	saved, ok := repo.entries[entry.Ref]
+	if !ok || repo.expired(saved) {
+		delete(repo.entries, entry.Ref)
+		return storage.NotFoundError{Ref: entry.Ref}
+	}
+
+	if !buildClaimHeld(&saved, entry) {
+		return claimError(entry.Ref, &saved)
+	}
+
+	change(&saved, repo.now())
+	repo.entries[entry.Ref] = saved
+	return nil
+}
+
+// endClaim ends the claim on an entry with end, if the claim is still held
+func (repo *MemoryRepository) endClaim(entry *storage.Entry, end func(*storage.Entry, time.Time)) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	saved, ok := repo.entries[entry.Ref]
+	if !ok || repo.expired(saved) {
+		delete(repo.entries, entry.Ref)
+		return storage.NotFoundError{Ref: entry.Ref}
+	}
+
+	if !claimHeld(&saved, entry) {
+		return claimError(entry.Ref, &saved)
+	}
+
+	end(&saved, repo.now())
+	repo.entries[entry.Ref] = saved
+	return nil
+}
+
+func (repo *MemoryRepository) List(ctx context.Context, hash string, limit int, after string) ([]*storage.Entry, string, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var refs []string
+	for ref, entry := range repo.entries {
+		if entry.Hash == hash && ref > after && !repo.expired(entry) {
+			refs = append(refs, ref)
+		}
+	}
+	slices.Sort(refs)
+
+	var next string
+	if limit > 0 && len(refs) > limit {
+		refs = refs[:limit]
+		next = refs[limit-1]
+	}
+
+	entries := make([]*storage.Entry, len(refs))
+	for i, ref := range refs {
+		entry := copyEntry(repo.entries[ref])
+		entry.Files = nil
+		entries[i] = &entry
+	}
+
+	return entries, next, nil
+}
+
+// expired reports whether an entry's Ttl has passed, as DynamoDB would delete it once it has
+func (repo *MemoryRepository) expired(entry storage.Entry) bool {
+	return entry.Ttl > 0 && entry.Ttl < repo.now().Unix()
+}
+
+// copyEntry copies an entry, so that changes made to it by the caller are only kept once
+// they are saved
+func copyEntry(entry storage.Entry) storage.Entry {
+	entry.FileCount = len(entry.Files)
+
+	if entry.Files != nil {
+		files := make([]storage.File, len(entry.Files))
+		copy(files, entry.Files)
+		entry.Files = files
+	}
+
+	if entry.Encryption != nil {
+		enc := *entry.Encryption
+		entry.Encryption = &enc
+	}
+
+	return entry
+}
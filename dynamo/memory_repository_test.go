@@ -0,0 +1,34 @@
+package dynamo
+
+import (
+	"github.com/stretchr/testify/assert"
+	"opg-file-service/storage"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepository_Expiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	repo := NewMemoryRepository()
+	repo.now = func() time.Time { return now }
+
+	assert.Nil(t, repo.Add(t.Context(), &storage.Entry{Ref: "expiring", Ttl: now.Add(time.Minute).Unix()}))
+	assert.Nil(t, repo.Add(t.Context(), &storage.Entry{Ref: "kept", Ttl: now.Add(time.Hour).Unix()}))
+
+	_, err := repo.Get(t.Context(), "expiring")
+	assert.Nil(t, err)
+
+	now = now.Add(2 * time.Minute)
+
+	_, err = repo.Get(t.Context(), "expiring")
+	assert.Equal(t, storage.NotFoundError{Ref: "expiring"}, err)
+
+	// expired entries are removed as others are added
+	assert.Nil(t, repo.Add(t.Context(), &storage.Entry{Ref: "expiring later", Ttl: now.Add(time.Minute).Unix()}))
+	now = now.Add(2 * time.Minute)
+	assert.Nil(t, repo.Add(t.Context(), &storage.Entry{Ref: "new", Ttl: now.Add(time.Minute).Unix()}))
+
+	assert.Len(t, repo.entries, 2)
+	assert.Contains(t, repo.entries, "kept")
+	assert.Contains(t, repo.entries, "new")
+}
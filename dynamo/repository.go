@@ -8,6 +8,7 @@ import (
 	"log/slog"
 	"opg-file-service/internal"
 	"opg-file-service/storage"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -17,21 +18,57 @@ type RepositoryInterface interface {
 	Get(ctx context.Context, ref string) (*storage.Entry, error)
 	Delete(ctx context.Context, entry *storage.Entry) error
 	Add(ctx context.Context, entry *storage.Entry) error
+	// Claim marks an entry as being downloaded, so that no other request can download it
+	// until the claim is released, or until lease has passed
+	Claim(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error)
+	// Release ends a claim on an entry without downloading it, so that it can be claimed again
+	Release(ctx context.Context, entry *storage.Entry) error
+	// Consume ends a claim on an entry once it has been downloaded and counts the download,
+	// so that it cannot be claimed again once it has been downloaded as often as it allows
+	Consume(ctx context.Context, entry *storage.Entry) error
+	// ClaimBuild marks an asynchronous entry as being built, so that no other worker builds it
+	// until the build ends, or until lease has passed without the claim being renewed
+	ClaimBuild(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error)
+	// RenewBuild keeps the claim on an entry's build for another lease from now
+	RenewBuild(ctx context.Context, entry *storage.Entry, lease time.Duration) error
+	// EndBuild ends the claim on an entry's build, saving its Status and ArchiveKey, as long as
+	// the claim has not been taken over
+	EndBuild(ctx context.Context, entry *storage.Entry) error
+	// List finds the entries made by the user with hash which have not expired, up to limit
+	// at a time, starting after the entry with the reference after. The reference to start
+	// the next page after is returned, which is blank once there are no more entries. Entries
+	// are listed with their FileCount but not their Files.
+	List(ctx context.Context, hash string, limit int, after string) ([]*storage.Entry, string, error)
 }
 
+const (
+	// an entry can be claimed when it is not being downloaded, or when its claim has expired
+	claimCondition = "attribute_exists(#ref) AND (attribute_not_exists(#status) OR #status = :none OR (#status = :downloading AND #claimExpires < :now))"
+	// a claim can only be ended by the request which holds it
+	claimHeldCondition = "#status = :downloading AND #claimID = :claimID"
+	// an archive can be built when it is waiting to be, its last build failed, or its build's claim has expired
+	buildClaimCondition = "attribute_exists(#ref) AND (#status = :pending OR #status = :failed OR (#status = :building AND #claimExpires < :now))"
+	// a build's claim can only be renewed or ended by the worker which holds it
+	buildClaimHeldCondition = "#status = :building AND #claimID = :claimID"
+	// DynamoDB can take a while to delete items once their Ttl has passed
+	unexpiredFilter = "#ttl = :zero OR #ttl >= :now"
+)
+
 type Repository struct {
-	db     DBClient
-	logger *slog.Logger
-	table  string
+	db        DBClient
+	logger    *slog.Logger
+	table     string
+	hashIndex string // global secondary index of the table keyed on Hash
 }
 
 func NewRepository(cfg *aws.Config, logger *slog.Logger) RepositoryInterface {
 	dynamo := dynamodb.NewFromConfig(*cfg)
 
 	return &Repository{
-		db:     dynamo,
-		logger: logger,
-		table:  internal.GetEnvVar("AWS_DYNAMODB_TABLE_NAME", "zip-requests"),
+		db:        dynamo,
+		logger:    logger,
+		table:     internal.GetEnvVar("AWS_DYNAMODB_TABLE_NAME", "zip-requests"),
+		hashIndex: internal.GetEnvVar("AWS_DYNAMODB_HASH_INDEX_NAME", "Hash"),
 	}
 }
 
@@ -51,9 +88,12 @@ func (repo Repository) Get(ctx context.Context, ref string) (*storage.Entry, err
 		return nil, notFound
 	}
 
-	entry := storage.Entry{}
+	if result.Item == nil {
+		repo.logger.Info("Ref token " + ref + " has expired or does not exist.")
+		return nil, notFound
+	}
 
-	err = attributevalue.UnmarshalMap(result.Item, &entry)
+	entry, err := repo.unmarshalEntry(ctx, result.Item)
 	if err != nil {
 		repo.logger.Info("Failed to unmarshal Record, ", slog.Any("err", err.Error()))
 		return nil, notFound
@@ -64,7 +104,7 @@ func (repo Repository) Get(ctx context.Context, ref string) (*storage.Entry, err
 		return nil, notFound
 	}
 
-	return &entry, nil
+	return entry, nil
 }
 
 func (repo Repository) Delete(ctx context.Context, entry *storage.Entry) error {
@@ -79,11 +119,21 @@ func (repo Repository) Delete(ctx context.Context, entry *storage.Entry) error {
 		Key: map[string]types.AttributeValue{
 			"Ref": key,
 		},
+		ReturnValues: types.ReturnValueAllOld,
+	}
+
+	result, err := repo.db.DeleteItem(ctx, input)
+	if err != nil {
+		return err
 	}
 
-	_, err := repo.db.DeleteItem(ctx, input)
+	// the entry has gone once its item has, so any chunks left behind expire along with it
+	err = repo.deleteChunks(ctx, entry.Ref, fileChunks(result.Attributes))
+	if err != nil {
+		return err
+	}
 
-	return err
+	return repo.deleteIdempotencyKey(ctx, entry.Ref, result.Attributes)
 }
 
 func (repo Repository) Add(ctx context.Context, entry *storage.Entry) error {
@@ -91,20 +141,321 @@ func (repo Repository) Add(ctx context.Context, entry *storage.Entry) error {
 		return errors.New("entry cannot be nil")
 	}
 
-	av, err := attributevalue.MarshalMap(entry)
+	av, chunks, err := marshalEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	// the idempotency key is saved first, so that only one of two requests with it makes an entry
+	if entry.IdempotencyKey != "" {
+		err = repo.addIdempotencyKey(ctx, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = repo.putChunks(ctx, chunks)
+	if err == nil {
+		input := &dynamodb.PutItemInput{
+			TableName: &repo.table,
+			Item:      av,
+		}
+
+		_, err = repo.db.PutItem(ctx, input)
+	}
+	if err != nil {
+		// the key is freed, so that the request can be retried
+		if err := repo.deleteIdempotencyKey(ctx, entry.Ref, av); err != nil {
+			repo.logger.Error("Unable to delete the idempotency key of entry "+entry.Ref, slog.Any("err", err.Error()))
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (repo Repository) Claim(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	now := time.Now()
+	claimed := storage.Entry{Ref: ref}
+	newClaim(&claimed, now, lease)
+
+	key, _ := attributevalue.Marshal(ref)
+	values, err := attributevalue.MarshalMap(map[string]any{
+		":none":         "",
+		":downloading":  storage.StatusDownloading,
+		":now":          now.Unix(),
+		":claimID":      claimed.ClaimID,
+		":claimExpires": claimed.ClaimExpires,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := repo.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &repo.table,
+		Key: map[string]types.AttributeValue{
+			"Ref": key,
+		},
+		UpdateExpression:    aws.String("SET #status = :downloading, #claimID = :claimID, #claimExpires = :claimExpires"),
+		ConditionExpression: aws.String(claimCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#ref":          "Ref",
+			"#status":       "Status",
+			"#claimID":      "ClaimID",
+			"#claimExpires": "ClaimExpires",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		return nil, repo.conditionError(ref, err)
+	}
+
+	return repo.unmarshalEntry(ctx, result.Attributes)
+}
+
+func (repo Repository) Release(ctx context.Context, entry *storage.Entry) error {
+	return repo.endClaim(ctx, entry, releaseClaim)
+}
+
+func (repo Repository) Consume(ctx context.Context, entry *storage.Entry) error {
+	return repo.endClaim(ctx, entry, consumeClaim)
+}
+
+// endClaim ends the claim on an entry with end, if the claim is still held. Only the
+// request holding the claim can change the entry, so the claimed entry is as it was saved.
+func (repo Repository) endClaim(ctx context.Context, entry *storage.Entry, end func(*storage.Entry, time.Time)) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	ended := *entry
+	end(&ended, time.Now())
+
+	key, _ := attributevalue.Marshal(entry.Ref)
+	values, err := attributevalue.MarshalMap(map[string]any{
+		":status":       ended.Status,
+		":none":         "",
+		":zero":         0,
+		":downloads":    ended.Downloads,
+		":lastDownload": ended.LastDownload,
+		":downloading":  storage.StatusDownloading,
+		":claimID":      entry.ClaimID,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &repo.table,
+		Key: map[string]types.AttributeValue{
+			"Ref": key,
+		},
+		UpdateExpression:    aws.String("SET #status = :status, #claimID = :none, #claimExpires = :zero, #downloads = :downloads, #lastDownload = :lastDownload"),
+		ConditionExpression: aws.String(claimHeldCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#status":       "Status",
+			"#claimID":      "ClaimID",
+			"#claimExpires": "ClaimExpires",
+			"#downloads":    "Downloads",
+			"#lastDownload": "LastDownload",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		return repo.conditionError(entry.Ref, err)
+	}
+
+	return nil
+}
+
+func (repo Repository) ClaimBuild(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	now := time.Now()
+	claimed := storage.Entry{Ref: ref}
+	newBuildClaim(&claimed, now, lease)
+
+	key, _ := attributevalue.Marshal(ref)
+	values, err := attributevalue.MarshalMap(map[string]any{
+		":pending":      storage.StatusPending,
+		":failed":       storage.StatusFailed,
+		":building":     storage.StatusBuilding,
+		":now":          now.Unix(),
+		":claimID":      claimed.ClaimID,
+		":claimExpires": claimed.ClaimExpires,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := repo.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &repo.table,
+		Key: map[string]types.AttributeValue{
+			"Ref": key,
+		},
+		UpdateExpression:    aws.String("SET #status = :building, #claimID = :claimID, #claimExpires = :claimExpires"),
+		ConditionExpression: aws.String(buildClaimCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#ref":          "Ref",
+			"#status":       "Status",
+			"#claimID":      "ClaimID",
+			"#claimExpires": "ClaimExpires",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		return nil, repo.conditionError(ref, err)
+	}
+
+	return repo.unmarshalEntry(ctx, result.Attributes)
+}
+
+func (repo Repository) RenewBuild(ctx context.Context, entry *storage.Entry, lease time.Duration) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	key, _ := attributevalue.Marshal(entry.Ref)
+	values, err := attributevalue.MarshalMap(map[string]any{
+		":building":     storage.StatusBuilding,
+		":claimID":      entry.ClaimID,
+		":claimExpires": time.Now().Add(lease).Unix(),
+	})
 	if err != nil {
 		return err
 	}
 
-	input := &dynamodb.PutItemInput{
+	_, err = repo.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: &repo.table,
-		Item:      av,
+		Key: map[string]types.AttributeValue{
+			"Ref": key,
+		},
+		UpdateExpression:    aws.String("SET #claimExpires = :claimExpires"),
+		ConditionExpression: aws.String(buildClaimHeldCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#status":       "Status",
+			"#claimID":      "ClaimID",
+			"#claimExpires": "ClaimExpires",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		return repo.conditionError(entry.Ref, err)
 	}
 
-	_, err = repo.db.PutItem(ctx, input)
+	return nil
+}
+
+func (repo Repository) EndBuild(ctx context.Context, entry *storage.Entry) error {
+	if entry == nil {
+		return errors.New("entry cannot be nil")
+	}
+
+	key, _ := attributevalue.Marshal(entry.Ref)
+	values, err := attributevalue.MarshalMap(map[string]any{
+		":status":     entry.Status,
+		":archiveKey": entry.ArchiveKey,
+		":none":       "",
+		":zero":       0,
+		":building":   storage.StatusBuilding,
+		":claimID":    entry.ClaimID,
+	})
 	if err != nil {
 		return err
 	}
 
+	_, err = repo.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &repo.table,
+		Key: map[string]types.AttributeValue{
+			"Ref": key,
+		},
+		UpdateExpression:    aws.String("SET #status = :status, #archiveKey = :archiveKey, #claimID = :none, #claimExpires = :zero"),
+		ConditionExpression: aws.String(buildClaimHeldCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#status":       "Status",
+			"#archiveKey":   "ArchiveKey",
+			"#claimID":      "ClaimID",
+			"#claimExpires": "ClaimExpires",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		return repo.conditionError(entry.Ref, err)
+	}
+
 	return nil
 }
+
+func (repo Repository) List(ctx context.Context, hash string, limit int, after string) ([]*storage.Entry, string, error) {
+	key, _ := attributevalue.Marshal(hash)
+	values, err := attributevalue.MarshalMap(map[string]any{
+		":hash": hash,
+		":zero": 0,
+		":now":  time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              &repo.table,
+		IndexName:              &repo.hashIndex,
+		KeyConditionExpression: aws.String("#hash = :hash"),
+		FilterExpression:       aws.String(unexpiredFilter),
+		ExpressionAttributeNames: map[string]string{
+			"#hash": "Hash",
+			"#ttl":  "Ttl",
+		},
+		ExpressionAttributeValues: values,
+		Limit:                     aws.Int32(int32(limit)),
+	}
+
+	// the last key of a page of an index holds the key of the index and of the table
+	if after != "" {
+		start, _ := attributevalue.Marshal(after)
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"Hash": key,
+			"Ref":  start,
+		}
+	}
+
+	result, err := repo.db.Query(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries := make([]*storage.Entry, len(result.Items))
+	for i, item := range result.Items {
+		entries[i], err = repo.unmarshalListedEntry(ctx, item)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var next string
+	if result.LastEvaluatedKey != nil {
+		_ = attributevalue.Unmarshal(result.LastEvaluatedKey["Ref"], &next)
+	}
+
+	return entries, next, nil
+}
+
+// conditionError explains why a claim failed its condition, from the item as it was
+func (repo Repository) conditionError(ref string, err error) error {
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return err
+	}
+
+	saved := storage.Entry{}
+	if err := attributevalue.UnmarshalMap(conditionErr.Item, &saved); err != nil {
+		repo.logger.Info("Failed to unmarshal Record, ", slog.Any("err", err.Error()))
+	}
+
+	return claimError(ref, &saved)
+}
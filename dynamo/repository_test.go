@@ -7,9 +7,14 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
 	"log/slog"
 	"opg-file-service/storage"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func newValidGetItemOutput(ref string) *dynamodb.GetItemOutput {
@@ -165,6 +170,7 @@ func TestRepository_Delete(t *testing.T) {
 			Key: map[string]types.AttributeValue{
 				"Ref": key,
 			},
+			ReturnValues: types.ReturnValueAllOld,
 		}
 
 		mdb.On("DeleteItem", &input).Return(new(dynamodb.DeleteItemOutput), test.dbErr).Once()
@@ -225,3 +231,222 @@ func TestRepository_Add(t *testing.T) {
 		assert.Equal(t, test.wantErr, err, test.scenario)
 	}
 }
+
+func TestRepository_Add_IdempotencyKey(t *testing.T) {
+	mdb := MockDynamoDB{}
+
+	var buf bytes.Buffer
+	repo := Repository{
+		db:     &mdb,
+		logger: slog.New(slog.NewJSONHandler(&buf, nil)),
+		table:  "table",
+	}
+
+	entry := &storage.Entry{Ref: "test", Hash: "testHash", IdempotencyKey: "key"}
+
+	mdb.On("PutItem", mock.MatchedBy(func(input *dynamodb.PutItemInput) bool {
+		return *input.ConditionExpression == idempotencyKeyCondition
+	})).Return(new(dynamodb.PutItemOutput), nil).Once()
+	mdb.On("PutItem", mock.MatchedBy(func(input *dynamodb.PutItemInput) bool {
+		return input.ConditionExpression == nil
+	})).Return(new(dynamodb.PutItemOutput), errors.New("some DB error")).Once()
+
+	// the key is freed when the entry cannot be saved, so that the request can be retried
+	mdb.On("DeleteItem", mock.MatchedBy(func(input *dynamodb.DeleteItemInput) bool {
+		return input.Key["Ref"].(*types.AttributeValueMemberS).Value == "testHash#idempotency#key"
+	})).Return(new(dynamodb.DeleteItemOutput), nil).Once()
+
+	err := repo.Add(t.Context(), entry)
+
+	assert.Equal(t, errors.New("some DB error"), err)
+	mdb.AssertExpectations(t)
+}
+
+func TestRepository_Claim(t *testing.T) {
+	consumed, _ := attributevalue.MarshalMap(storage.Entry{Ref: "test", Status: storage.StatusConsumed})
+	downloading, _ := attributevalue.MarshalMap(storage.Entry{Ref: "test", Status: storage.StatusDownloading})
+	claimed, _ := attributevalue.MarshalMap(storage.Entry{Ref: "test", Status: storage.StatusDownloading, ClaimID: "claim"})
+
+	tests := []struct {
+		scenario  string
+		dbOut     *dynamodb.UpdateItemOutput
+		dbErr     error
+		wantEntry *storage.Entry
+		wantErr   error
+	}{
+		{
+			"Entry claimed successfully",
+			&dynamodb.UpdateItemOutput{Attributes: claimed},
+			nil,
+			&storage.Entry{Ref: "test", Status: storage.StatusDownloading, ClaimID: "claim"},
+			nil,
+		},
+		{
+			"Entry does not exist",
+			nil,
+			&types.ConditionalCheckFailedException{},
+			nil,
+			storage.NotFoundError{Ref: "test"},
+		},
+		{
+			"Entry is being downloaded",
+			nil,
+			&types.ConditionalCheckFailedException{Item: downloading},
+			nil,
+			storage.ClaimedError{Ref: "test"},
+		},
+		{
+			"Entry has already been downloaded",
+			nil,
+			&types.ConditionalCheckFailedException{Item: consumed},
+			nil,
+			storage.ConsumedError{Ref: "test"},
+		},
+		{
+			"Error from DB client",
+			nil,
+			errors.New("some DB error"),
+			nil,
+			errors.New("some DB error"),
+		},
+	}
+
+	for _, test := range tests {
+		mdb := MockDynamoDB{}
+
+		var buf bytes.Buffer
+		repo := Repository{
+			db:     &mdb,
+			logger: slog.New(slog.NewJSONHandler(&buf, nil)),
+			table:  "table",
+		}
+
+		mdb.On("UpdateItem", mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+			return *input.ConditionExpression == claimCondition && input.ReturnValues == types.ReturnValueAllNew
+		})).Return(test.dbOut, test.dbErr).Once()
+
+		entry, err := repo.Claim(t.Context(), "test", time.Minute)
+
+		assert.Equal(t, test.wantEntry, entry, test.scenario)
+		assert.Equal(t, test.wantErr, err, test.scenario)
+	}
+}
+
+func TestRepository_List(t *testing.T) {
+	item, _ := attributevalue.MarshalMap(storage.Entry{Ref: "test2", Hash: "testHash"})
+
+	tests := []struct {
+		scenario    string
+		after       string
+		dbOut       *dynamodb.QueryOutput
+		dbErr       error
+		wantEntries []*storage.Entry
+		wantNext    string
+		wantErr     error
+	}{
+		{
+			"First page",
+			"",
+			&dynamodb.QueryOutput{
+				Items:            []map[string]types.AttributeValue{item},
+				LastEvaluatedKey: map[string]types.AttributeValue{"Hash": item["Hash"], "Ref": item["Ref"]},
+			},
+			nil,
+			[]*storage.Entry{{Ref: "test2", Hash: "testHash"}},
+			"test2",
+			nil,
+		},
+		{
+			"Last page",
+			"test2",
+			&dynamodb.QueryOutput{},
+			nil,
+			[]*storage.Entry{},
+			"",
+			nil,
+		},
+		{
+			"Error from DB client",
+			"",
+			nil,
+			errors.New("some DB error"),
+			nil,
+			"",
+			errors.New("some DB error"),
+		},
+	}
+
+	for _, test := range tests {
+		mdb := MockDynamoDB{}
+
+		var buf bytes.Buffer
+		repo := Repository{
+			db:        &mdb,
+			logger:    slog.New(slog.NewJSONHandler(&buf, nil)),
+			table:     "table",
+			hashIndex: "Hash",
+		}
+
+		mdb.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+			if test.after == "" {
+				return *input.IndexName == "Hash" && *input.Limit == 10 && input.ExclusiveStartKey == nil
+			}
+			return input.ExclusiveStartKey["Ref"].(*types.AttributeValueMemberS).Value == test.after &&
+				input.ExclusiveStartKey["Hash"].(*types.AttributeValueMemberS).Value == "testHash"
+		})).Return(test.dbOut, test.dbErr).Once()
+
+		entries, next, err := repo.List(t.Context(), "testHash", 10, test.after)
+
+		assert.Equal(t, test.wantEntries, entries, test.scenario)
+		assert.Equal(t, test.wantNext, next, test.scenario)
+		assert.Equal(t, test.wantErr, err, test.scenario)
+		mdb.AssertExpectations(t)
+	}
+}
+
+func TestRepository_FileChunks(t *testing.T) {
+	db := &fakeDynamoDB{items: map[string]map[string]types.AttributeValue{}}
+	repo := Repository{
+		db:     db,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		table:  "zip-requests",
+	}
+
+	entry := &storage.Entry{Ref: "test", Hash: "testHash", Ttl: 9999999999}
+	for i := range 10000 {
+		entry.Files = append(entry.Files, storage.File{S3path: "s3://files/" + strconv.Itoa(i), FileName: strings.Repeat("x", 50)})
+	}
+
+	assert.Nil(t, repo.Add(t.Context(), entry))
+
+	// files are split across items which each fit in DynamoDB, and expire with the entry
+	chunks := fileChunks(db.items["test"])
+	assert.Greater(t, chunks, 1)
+	assert.Len(t, db.items, chunks+1)
+	for ref, item := range db.items {
+		assert.LessOrEqual(t, itemSize(item), maxItemSize, ref)
+		assert.Equal(t, db.items["test"]["Ttl"], item["Ttl"], ref)
+	}
+
+	// entries are listed with the number of files they have, without reading their chunks
+	entries, _, err := repo.List(t.Context(), "testHash", 10, "")
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Nil(t, entries[0].Files)
+		assert.Equal(t, 10000, entries[0].FileCount)
+	}
+	assert.Equal(t, 0, db.gets)
+
+	// entries saved before the number of files was kept still have their chunks read
+	delete(db.items["test"], fileCountAttribute)
+	entries, _, err = repo.List(t.Context(), "testHash", 10, "")
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Nil(t, entries[0].Files)
+		assert.Equal(t, 10000, entries[0].FileCount)
+	}
+	assert.Equal(t, chunks, db.gets)
+
+	assert.Nil(t, repo.Delete(t.Context(), entry))
+	assert.Len(t, db.items, 0)
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"opg-file-service/authz"
+	"opg-file-service/middleware"
+	"opg-file-service/storage"
+)
+
+// allowFiles checks the authenticated user's roles and scopes allow them to bundle every file,
+// when there is a policy to check them against, or that an API client's own locations do.
+// Otherwise it writes a response listing the files they are not allowed to bundle, and returns
+// false.
+func allowFiles(rw http.ResponseWriter, r *http.Request, policy *authz.Policy, files []storage.File, logger *slog.Logger) bool {
+	// an API client can only bundle files from its own locations, whatever users can bundle
+	if client, ok := r.Context().Value(middleware.Client{}).(*middleware.ApiClient); ok {
+		policy = client.Policy
+	}
+
+	if policy == nil {
+		return true
+	}
+
+	roles, _ := r.Context().Value(middleware.Roles{}).([]string)
+	scopes, _ := r.Context().Value(middleware.Scopes{}).([]string)
+
+	denied := policy.Denied(roles, scopes, files)
+	if len(denied) == 0 {
+		return true
+	}
+
+	deniedErr := storage.ErrValidation{}
+	for _, path := range denied {
+		deniedErr.Errors = append(deniedErr.Errors, storage.ErrFieldValidation{
+			Field:   "S3Path",
+			Message: "not allowed to access " + path,
+		})
+	}
+
+	logger.Info("Access denied to files for user", slog.Any("user", r.Context().Value(middleware.HashedEmail{})), slog.Any("files", denied))
+	rw.WriteHeader(http.StatusForbidden)
+	if err := json.NewEncoder(rw).Encode(deniedErr); err != nil {
+		logger.Info("Unable to write JSON error to response:", "err", err)
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"opg-file-service/authz"
+	"opg-file-service/middleware"
+	"opg-file-service/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPolicy(t *testing.T) *authz.Policy {
+	policy, err := authz.ParsePolicy([]byte(`{"rules":[{"roles":["case-worker"],"allow":["s3://opg-documents/cases"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+// withRoles adds the hashed email and roles of an authenticated user to a request
+func withRoles(r *http.Request, roles ...string) *http.Request {
+	ctx := context.WithValue(r.Context(), middleware.HashedEmail{}, "user")
+	ctx = context.WithValue(ctx, middleware.Roles{}, roles)
+	return r.WithContext(ctx)
+}
+
+// withClient adds an API client which can bundle files from its own locations to a request
+func withClient(t *testing.T, r *http.Request, allow ...string) *http.Request {
+	policy, err := authz.NewPolicy(authz.Rule{Allow: allow})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(r.Context(), middleware.HashedEmail{}, "client:batch")
+	ctx = context.WithValue(ctx, middleware.Client{}, &middleware.ApiClient{Name: "batch", Policy: policy})
+	return r.WithContext(ctx)
+}
+
+func TestAllowFiles(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://opg-documents/cases/123/letter.pdf"},
+		{S3path: "s3://opg-documents/finance/invoice.pdf"},
+		{S3path: "s3://opg-backoffice/report.csv"},
+	}
+
+	tests := []struct {
+		scenario string
+		policy   *authz.Policy
+		roles    []string
+		files    []storage.File
+		want     bool
+		wantBody string
+	}{
+		{"No policy", nil, nil, files, true, ""},
+		{"Files allowed by the policy", newTestPolicy(t), []string{"case-worker"}, files[:1], true, ""},
+		{
+			"Files denied by the policy",
+			newTestPolicy(t),
+			[]string{"case-worker"},
+			files,
+			false,
+			`{"errors":[{"field":"S3Path","message":"not allowed to access s3://opg-documents/finance/invoice.pdf"},{"field":"S3Path","message":"not allowed to access s3://opg-backoffice/report.csv"}]}`,
+		},
+		{
+			"User without roles",
+			newTestPolicy(t),
+			nil,
+			files[:1],
+			false,
+			`{"errors":[{"field":"S3Path","message":"not allowed to access s3://opg-documents/cases/123/letter.pdf"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		_, l := newTestLogger()
+		req := withRoles(httptest.NewRequest("POST", "/zip/request", nil), test.roles...)
+		rr := httptest.NewRecorder()
+
+		assert.Equal(t, test.want, allowFiles(rr, req, test.policy, test.files, l), test.scenario)
+		if test.want {
+			assert.Equal(t, 0, rr.Body.Len(), test.scenario)
+		} else {
+			assert.Equal(t, http.StatusForbidden, rr.Code, test.scenario)
+			assert.JSONEq(t, test.wantBody, rr.Body.String(), test.scenario)
+		}
+	}
+}
+
+func TestAllowFiles_ApiClient(t *testing.T) {
+	files := []storage.File{{S3path: "s3://opg-documents/cases/123/letter.pdf"}}
+
+	tests := []struct {
+		scenario string
+		policy   *authz.Policy
+		allow    []string
+		want     bool
+	}{
+		{"Files in the client's locations", nil, []string{"s3://opg-documents/cases"}, true},
+		{"Files outside the client's locations", nil, []string{"s3://opg-documents/batch"}, false},
+		{"Client without any locations", nil, nil, false},
+		{"Policy for users does not apply to clients", newTestPolicy(t), []string{"s3://opg-backoffice"}, false},
+	}
+
+	for _, test := range tests {
+		_, l := newTestLogger()
+		req := withClient(t, httptest.NewRequest("POST", "/zip/request", nil), test.allow...)
+		rr := httptest.NewRecorder()
+
+		assert.Equal(t, test.want, allowFiles(rr, req, test.policy, files, l), test.scenario)
+		if !test.want {
+			assert.Equal(t, http.StatusForbidden, rr.Code, test.scenario)
+		}
+	}
+}
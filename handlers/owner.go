@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"opg-file-service/dynamo"
+	"opg-file-service/internal"
+	"opg-file-service/middleware"
+	"opg-file-service/storage"
+)
+
+// findOwnedEntry finds the entry for the reference in the request, as long as it has not
+// expired and belongs to the authenticated user. Otherwise it writes an error response
+// and returns nil.
+func findOwnedEntry(rw http.ResponseWriter, r *http.Request, repo dynamo.RepositoryInterface, logger *slog.Logger) *storage.Entry {
+	reference := r.PathValue("reference")
+
+	entry, err := repo.Get(r.Context(), reference)
+	if err != nil {
+		logger.Error(err.Error())
+		internal.WriteJSONError(rw, "ref", "Reference token not found.", http.StatusNotFound)
+		return nil
+	}
+
+	if entry.IsExpired() {
+		logger.Info("Reference token '" + reference + "' has expired.")
+		internal.WriteJSONError(rw, "ref", "Reference token has expired.", http.StatusNotFound)
+		return nil
+	}
+
+	// zip requests made before user-hash-salt was rotated are still the user's for a while
+	userHash := r.Context().Value(middleware.HashedEmail{})
+	previousHash := r.Context().Value(middleware.PreviousHashedEmail{})
+	if entry.Hash != userHash && (previousHash == nil || entry.Hash != previousHash) {
+		logger.Info("Access denied for user", slog.Any("user", userHash))
+		internal.WriteJSONError(rw, "auth", "Access denied.", http.StatusForbidden)
+		return nil
+	}
+
+	return entry
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is part of a download, from start up to but excluding end
+type byteRange struct {
+	start, end int64
+}
+
+// requestedRange returns the range of a download of the given size asked for by the Range
+// header of r, or nil if the whole download should be sent. As allowed by RFC 9110, Range
+// headers which are invalid, ask for more than one range or are conditional on another
+// version of the download are ignored.
+func requestedRange(r *http.Request, etag string, size int64) (*byteRange, error) {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return nil, nil
+	}
+
+	// If-Range can also hold a date, which never matches as downloads have no Last-Modified
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+		return nil, nil
+	}
+
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	if first == "" {
+		// a suffix range, asking for the last bytes of the download
+		n, err := parseRangeInt(last)
+		if err != nil {
+			return nil, nil
+		}
+		if n == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		return &byteRange{max(size-n, 0), size}, nil
+	}
+
+	start, err := parseRangeInt(first)
+	if err != nil {
+		return nil, nil
+	}
+
+	end := size
+	if last != "" {
+		n, err := parseRangeInt(last)
+		if err != nil || n < start {
+			return nil, nil
+		}
+		end = min(n+1, size)
+	}
+
+	if start >= size {
+		return nil, errRangeNotSatisfiable
+	}
+
+	return &byteRange{start, end}, nil
+}
+
+// contentRange returns the Content-Range header for the range of a download of the given size
+func (br byteRange) contentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(br.start, 10) + "-" + strconv.FormatInt(br.end-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, errors.New("invalid range: " + s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
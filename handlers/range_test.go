@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestedRange(t *testing.T) {
+	tests := []struct {
+		scenario  string
+		rangeHdr  string
+		ifRange   string
+		wantRange *byteRange
+		wantErr   error
+	}{
+		{"No Range header", "", "", nil, nil},
+		{"Range with start and end", "bytes=10-19", "", &byteRange{10, 20}, nil},
+		{"Range with start only", "bytes=10-", "", &byteRange{10, 100}, nil},
+		{"Range past the end of the download", "bytes=90-200", "", &byteRange{90, 100}, nil},
+		{"Suffix range", "bytes=-10", "", &byteRange{90, 100}, nil},
+		{"Suffix range longer than the download", "bytes=-200", "", &byteRange{0, 100}, nil},
+		{"If-Range matches", "bytes=10-19", `"etag"`, &byteRange{10, 20}, nil},
+		{"If-Range does not match", "bytes=10-19", `"other"`, nil, nil},
+		{"If-Range with a weak ETag", "bytes=10-19", `W/"etag"`, nil, nil},
+		{"If-Range with a date", "bytes=10-19", "Wed, 21 Oct 2015 07:28:00 GMT", nil, nil},
+		{"Multiple ranges are ignored", "bytes=0-9,20-29", "", nil, nil},
+		{"Other units are ignored", "items=0-9", "", nil, nil},
+		{"Invalid range", "bytes=abc", "", nil, nil},
+		{"Signed numbers are invalid", "bytes=+10-19", "", nil, nil},
+		{"End before start", "bytes=19-10", "", nil, nil},
+		{"Start past the end of the download", "bytes=100-", "", nil, errRangeNotSatisfiable},
+		{"Empty suffix range", "bytes=-0", "", nil, errRangeNotSatisfiable},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/zip/test", nil)
+		if test.rangeHdr != "" {
+			r.Header.Set("Range", test.rangeHdr)
+		}
+		if test.ifRange != "" {
+			r.Header.Set("If-Range", test.ifRange)
+		}
+
+		br, err := requestedRange(r, `"etag"`, 100)
+		assert.Equal(t, test.wantRange, br, test.scenario)
+		assert.Equal(t, test.wantErr, err, test.scenario)
+	}
+}
+
+func TestByteRange_ContentRange(t *testing.T) {
+	assert.Equal(t, "bytes 10-19/100", byteRange{10, 20}.contentRange(100))
+}
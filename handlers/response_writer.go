@@ -0,0 +1,26 @@
+package handlers
+
+import "net/http"
+
+// countingResponseWriter records how many bytes of the response body have been written
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+	status  int // sent with the first write of the body, rather than the implicit 200
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.status = 0
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountingResponseWriter(t *testing.T) {
+	rr := httptest.NewRecorder()
+	cw := &countingResponseWriter{ResponseWriter: rr}
+
+	_, _ = cw.Write([]byte("Hello "))
+	_, _ = cw.Write([]byte("World"))
+
+	assert.Equal(t, int64(11), cw.written)
+	assert.Equal(t, "Hello World", rr.Body.String())
+	assert.Equal(t, rr, cw.Unwrap())
+}
+
+func TestCountingResponseWriter_Status(t *testing.T) {
+	rr := httptest.NewRecorder()
+	cw := &countingResponseWriter{ResponseWriter: rr, status: http.StatusPartialContent}
+
+	_, _ = cw.Write([]byte("Hello "))
+	_, _ = cw.Write([]byte("World"))
+
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "Hello World", rr.Body.String())
+}
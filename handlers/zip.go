@@ -1,26 +1,45 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"log/slog"
 	"net/http"
+	"opg-file-service/authz"
 	"opg-file-service/dynamo"
 	"opg-file-service/internal"
-	"opg-file-service/middleware"
+	"opg-file-service/storage"
+	"opg-file-service/webhook"
 	"opg-file-service/zipper"
+	"strconv"
 	"time"
 )
 
+// claimLease is how long a download holds its claim on an entry, which is as long as the
+// server allows for writing a response, so that an entry whose claim was never released
+// (such as when the service stops mid download) can be downloaded again afterwards
+const claimLease = 15 * time.Minute
+
 type ZipHandler struct {
-	repo   dynamo.RepositoryInterface
-	zipper zipper.ZipperInterface
-	logger *slog.Logger
+	repo      dynamo.RepositoryInterface
+	newZipper func() zipper.ZipperInterface
+	notifier  webhook.NotifierInterface
+	signer    zipper.Signer
+	policy    *authz.Policy // nil when every user can bundle any file
+	logger    *slog.Logger
 }
 
-func NewZipHandler(logger *slog.Logger, cfg *aws.Config, repo dynamo.RepositoryInterface) *ZipHandler {
+func NewZipHandler(logger *slog.Logger, cfg *aws.Config, repo dynamo.RepositoryInterface, notifier webhook.NotifierInterface, signer zipper.Signer, keys zipper.CustomerKeys, passwords zipper.Passwords, policy *authz.Policy) *ZipHandler {
+	z := zipper.NewZipper(cfg, keys, passwords)
+
 	return &ZipHandler{
 		repo,
-		zipper.NewZipper(cfg),
+		// zippers hold the state of a single download, so each request gets its own
+		func() zipper.ZipperInterface { return z.Clone() },
+		notifier,
+		signer,
+		policy,
 		logger,
 	}
 }
@@ -31,49 +50,226 @@ func (zh *ZipHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	reference := r.PathValue("reference")
 	zh.logger.Info("Zip files for reference: " + reference)
 
-	// fetch entry from DynamoDB
-	entry, err := zh.repo.Get(r.Context(), reference)
-	if err != nil {
-		zh.logger.Error(err.Error())
-		internal.WriteJSONError(rw, "ref", "Reference token not found.", http.StatusNotFound)
+	entry := findOwnedEntry(rw, r, zh.repo, zh.logger)
+	if entry == nil {
+		return
+	}
+
+	if entry.Async {
+		internal.WriteJSONError(rw, "ref", "Zip request is built asynchronously, see its status for a download link.", http.StatusConflict)
 		return
 	}
 
-	if entry.IsExpired() {
-		zh.logger.Info("Reference token '" + reference + "' has expired.")
-		internal.WriteJSONError(rw, "ref", "Reference token has expired.", http.StatusNotFound)
+	// the user's access is checked again, as their roles or the policy may have changed since
+	// the request was made
+	if !allowFiles(rw, r, zh.policy, entry.Files, zh.logger) {
 		return
 	}
 
-	userHash := r.Context().Value(middleware.HashedEmail{})
-	if entry.Hash != userHash {
-		zh.logger.Info("Access denied for user", slog.Any("user", userHash))
-		internal.WriteJSONError(rw, "auth", "Access denied.", http.StatusForbidden)
+	// only one download of an entry can be in flight at a time
+	entry, err := zh.repo.Claim(r.Context(), reference, claimLease)
+	if err != nil {
+		zh.logger.Info(err.Error())
+
+		var claimedErr storage.ClaimedError
+		var consumedErr storage.ConsumedError
+		switch {
+		case errors.As(err, &claimedErr):
+			internal.WriteJSONError(rw, "ref", "A download of this reference is already in progress.", http.StatusConflict)
+		case errors.As(err, &consumedErr):
+			internal.WriteJSONError(rw, "ref", "Reference token has already been used.", http.StatusNotFound)
+		default:
+			internal.WriteJSONError(rw, "ref", "Reference token not found.", http.StatusNotFound)
+		}
 		return
 	}
 
+	// unless the whole archive is sent, the entry is released so that the download can be
+	// tried again, or resumed with a request for the rest of it
+	consumed := false
+	defer func() {
+		if !consumed {
+			zh.release(r.Context(), entry)
+		}
+	}()
+
 	entry.DeDupe()
 
-	zh.zipper.Open(rw)
+	// a format chosen when the request was made takes precedence over the Accept header
+	format, ok := zipper.FormatByName(entry.Format)
+	if !ok {
+		format = zipper.FormatFromAccept(r.Header.Get("Accept"))
+	}
+
+	cw := &countingResponseWriter{ResponseWriter: rw}
+
+	z := zh.newZipper()
+	if err := z.Open(cw, format); err != nil {
+		zh.logger.Error(err.Error())
+		internal.WriteJSONError(rw, "zip", "Unable to create archive.", http.StatusInternalServerError)
+		zh.notify(r.Context(), entry, webhook.StatusFailed, nil, 0)
+		return
+	}
+
+	if entry.Encryption != nil {
+		if err := z.Encrypt(entry.Encryption); err != nil {
+			zh.logger.Error(err.Error())
+			writeArchiveError(rw, "Unable to create archive.", http.StatusInternalServerError)
+			zh.notify(r.Context(), entry, webhook.StatusFailed, nil, 0)
+			return
+		}
+	}
+
+	if entry.Manifest {
+		if err := z.RecordManifest(); err != nil {
+			zh.logger.Error(err.Error())
+			writeArchiveError(rw, "Unable to create archive.", http.StatusInternalServerError)
+			zh.notify(r.Context(), entry, webhook.StatusFailed, nil, 0)
+			return
+		}
+	}
+
+	// whether the response runs to the end of the archive, rather than stopping at the end of a range
+	complete := true
 
-	for _, file := range entry.Files {
-		err := zh.zipper.AddFile(r.Context(), &file)
+	// storing files uncompressed lets us tell the client how big the download will be,
+	// and makes the archive the same each time so that a download can be resumed
+	if entry.Store && format.Name == storage.FormatZip {
+		info, err := z.Store(r.Context(), entry.Files)
 		if err != nil {
 			zh.logger.Error(err.Error())
-			internal.WriteJSONError(rw, "zip", "Unable to zip requested file.", http.StatusInternalServerError)
+			writeArchiveError(rw, "Unable to find the size of the requested files.", http.StatusInternalServerError)
+			zh.notify(r.Context(), entry, webhook.StatusFailed, nil, 0)
 			return
 		}
+
+		rw.Header().Set("Accept-Ranges", "bytes")
+		rw.Header().Set("ETag", info.ETag)
+
+		size := info.Size
+
+		br, err := requestedRange(r, info.ETag, info.Size)
+		if err != nil {
+			// the only header of the archive an unsatisfiable range is answered with is its size
+			clearArchiveHeaders(rw)
+			rw.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(info.Size, 10))
+			writeJSONError(rw, "Requested range not satisfiable.", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if br != nil {
+			if err := z.Range(br.start, br.end); err != nil {
+				zh.logger.Error(err.Error())
+				writeArchiveError(rw, "Unable to create archive.", http.StatusInternalServerError)
+				zh.notify(r.Context(), entry, webhook.StatusFailed, nil, 0)
+				return
+			}
+
+			zh.logger.Info("Resuming download for reference", slog.Any("ref", entry.Ref), slog.Any("range", br.contentRange(info.Size)))
+			rw.Header().Set("Content-Range", br.contentRange(info.Size))
+			cw.status = http.StatusPartialContent
+			size = br.end - br.start
+			complete = br.end == info.Size
+		}
+
+		rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	z.Prefetch(r.Context(), entry.Files)
+
+	failures, err := zipper.AddFiles(r.Context(), z, entry.Files, entry.FailurePolicy)
+	if err == nil && entry.Manifest {
+		err = z.AddManifest(zh.signer)
+	}
+
+	for _, f := range failures {
+		zh.logger.Error(f.Reason)
+	}
+	if len(failures) > 0 {
+		zh.logger.Info("Files skipped for reference", slog.Any("ref", entry.Ref), slog.Any("count", len(failures)))
 	}
 
-	err = zh.zipper.Close()
 	if err != nil {
 		zh.logger.Error(err.Error())
+		zh.notify(r.Context(), entry, webhook.StatusFailed, failures, cw.written)
+
+		if cw.written > 0 {
+			// the archive has already started streaming, so the only way left to tell
+			// the client the download failed is to break the connection
+			zh.logger.Info("Aborting download for reference", slog.Any("ref", entry.Ref))
+			panic(http.ErrAbortHandler)
+		}
+
+		writeArchiveError(rw, "Unable to zip requested file.", http.StatusInternalServerError)
+		return
 	}
 
-	err = zh.repo.Delete(r.Context(), entry)
+	err = z.Close()
 	if err != nil {
-		zh.logger.Error("Unable to delete entry for reference", slog.Any("err", err.Error()), slog.Any("ref", entry.Ref))
+		zh.logger.Error(err.Error())
+		zh.notify(r.Context(), entry, webhook.StatusFailed, failures, cw.written)
+
+		if cw.written > 0 {
+			zh.logger.Info("Aborting download for reference", slog.Any("ref", entry.Ref))
+			panic(http.ErrAbortHandler)
+		}
+
+		writeArchiveError(rw, "Unable to zip requested file.", http.StatusInternalServerError)
+		return
+	}
+
+	// an entry is only used up once the end of its archive has been sent
+	if complete {
+		consumed = true
+		err = zh.repo.Consume(r.Context(), entry)
+		if err != nil {
+			zh.logger.Error("Unable to consume entry for reference", slog.Any("err", err.Error()), slog.Any("ref", entry.Ref))
+		}
+
+		zh.notify(r.Context(), entry, webhook.StatusComplete, failures, cw.written)
 	}
 
 	zh.logger.Info("Request took: " + time.Since(start).String())
 }
+
+// release ends the claim on an entry whose archive was not sent to the end. The request
+// may have ended because the client went away, so the claim is released regardless.
+func (zh *ZipHandler) release(ctx context.Context, entry *storage.Entry) {
+	err := zh.repo.Release(context.WithoutCancel(ctx), entry)
+	if err != nil {
+		zh.logger.Error("Unable to release entry for reference", slog.Any("err", err.Error()), slog.Any("ref", entry.Ref))
+	}
+}
+
+// notify tells the entry's callback URL, if it has one, how its download ended
+func (zh *ZipHandler) notify(ctx context.Context, entry *storage.Entry, status string, failures []zipper.FileError, bytes int64) {
+	if entry.CallbackUrl == "" {
+		return
+	}
+
+	zh.notifier.Notify(ctx, entry.CallbackUrl, webhook.Notification{
+		Reference: entry.Ref,
+		Status:    status,
+		Files:     len(entry.Files),
+		Bytes:     bytes,
+		Failures:  failures,
+	})
+}
+
+// writeArchiveError replaces the headers of an archive which has not started streaming with a JSON error
+func writeArchiveError(rw http.ResponseWriter, desc string, status int) {
+	clearArchiveHeaders(rw)
+	writeJSONError(rw, desc, status)
+}
+
+// clearArchiveHeaders removes the headers describing an archive, which do not apply to an error sent in its place
+func clearArchiveHeaders(rw http.ResponseWriter) {
+	for _, h := range []string{"Content-Disposition", "Content-Length", "Accept-Ranges", "ETag", "Content-Range"} {
+		rw.Header().Del(h)
+	}
+}
+
+func writeJSONError(rw http.ResponseWriter, desc string, status int) {
+	rw.Header().Set("Content-Type", "application/json")
+	internal.WriteJSONError(rw, "zip", desc, status)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"log/slog"
+	"net/http"
+	"opg-file-service/dynamo"
+	"opg-file-service/internal"
+)
+
+// allows us to mock s3.Client in our tests
+type ArchiveDeleter interface {
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// ZipCancelHandler revokes a zip request, so that it can no longer be downloaded
+type ZipCancelHandler struct {
+	repo     dynamo.RepositoryInterface
+	archives ArchiveDeleter // nil when asynchronous zip requests are not enabled
+	bucket   string
+	logger   *slog.Logger
+}
+
+func NewZipCancelHandler(logger *slog.Logger, cfg *aws.Config, repo dynamo.RepositoryInterface, bucket string) *ZipCancelHandler {
+	zch := &ZipCancelHandler{
+		repo:   repo,
+		bucket: bucket,
+		logger: logger,
+	}
+
+	if bucket != "" {
+		zch.archives = s3.NewFromConfig(*cfg, func(u *s3.Options) {
+			u.UsePathStyle = true
+		})
+	}
+
+	return zch
+}
+
+func (zch *ZipCancelHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	entry := findOwnedEntry(rw, r, zch.repo, zch.logger)
+	if entry == nil {
+		return
+	}
+
+	err := zch.repo.Delete(r.Context(), entry)
+	if err != nil {
+		zch.logger.Error(err.Error())
+		internal.WriteJSONError(rw, "request", "Unable to cancel the zip request.", http.StatusInternalServerError)
+		return
+	}
+
+	// the archive of an asynchronous zip request is deleted with it, and is otherwise left
+	// for the bucket's lifecycle rule, as is one which finishes building after it is cancelled
+	if entry.ArchiveKey != "" && zch.archives != nil {
+		_, err := zch.archives.DeleteObject(r.Context(), &s3.DeleteObjectInput{
+			Bucket: aws.String(zch.bucket),
+			Key:    aws.String(entry.ArchiveKey),
+		})
+		if err != nil {
+			zch.logger.Error("Unable to delete archive for reference", slog.Any("err", err.Error()), slog.Any("ref", entry.Ref))
+		}
+	}
+
+	zch.logger.Info("Cancelled zip request", slog.Any("ref", entry.Ref))
+	rw.WriteHeader(http.StatusNoContent)
+}
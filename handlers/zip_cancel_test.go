@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"opg-file-service/middleware"
+	"opg-file-service/storage"
+	"testing"
+)
+
+func TestZipCancelHandler_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		scenario    string
+		entry       *storage.Entry
+		getErr      error
+		deleteCalls int
+		deleteErr   error
+		wantCode    int
+	}{
+		{"Zip request cancelled", &storage.Entry{Ref: "test", Hash: "user", Ttl: 1893456000}, nil, 1, nil, http.StatusNoContent},
+		{"Reference token not found", nil, storage.NotFoundError{Ref: "test"}, 0, nil, http.StatusNotFound},
+		{"Access denied", &storage.Entry{Ref: "test", Hash: "other", Ttl: 1893456000}, nil, 0, nil, http.StatusForbidden},
+		{"Unable to delete the zip request", &storage.Entry{Ref: "test", Hash: "user", Ttl: 1893456000}, nil, 1, errors.New("some DB error"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		_, l := newTestLogger()
+
+		zh := ZipCancelHandler{
+			repo:   mr,
+			logger: l,
+		}
+
+		mr.On("Get", "test").Return(test.entry, test.getErr).Once()
+		if test.deleteCalls > 0 {
+			mr.On("Delete", test.entry).Return(test.deleteErr).Once()
+		}
+
+		req := httptest.NewRequest("DELETE", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		mr.AssertExpectations(t)
+	}
+}
+
+func TestZipCancelHandler_ServeHTTP_Archive(t *testing.T) {
+	tests := []struct {
+		scenario    string
+		entry       *storage.Entry
+		deleteCalls int
+		deleteErr   error
+	}{
+		{"Built archive deleted", &storage.Entry{Ref: "test", Hash: "user", Ttl: 1893456000, Async: true, Status: storage.StatusReady, ArchiveKey: "test.zip"}, 1, nil},
+		{"Zip request cancelled when its archive cannot be deleted", &storage.Entry{Ref: "test", Hash: "user", Ttl: 1893456000, Async: true, Status: storage.StatusReady, ArchiveKey: "test.zip"}, 1, errors.New("some S3 error")},
+		{"Archive not built yet", &storage.Entry{Ref: "test", Hash: "user", Ttl: 1893456000, Async: true, Status: storage.StatusPending}, 0, nil},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		ma := new(MockArchiveDeleter)
+		_, l := newTestLogger()
+
+		zh := ZipCancelHandler{
+			repo:     mr,
+			archives: ma,
+			bucket:   "archives",
+			logger:   l,
+		}
+
+		mr.On("Get", "test").Return(test.entry, nil).Once()
+		mr.On("Delete", test.entry).Return(nil).Once()
+		if test.deleteCalls > 0 {
+			ma.On("DeleteObject", &s3.DeleteObjectInput{
+				Bucket: aws.String("archives"),
+				Key:    aws.String("test.zip"),
+			}).Return(new(s3.DeleteObjectOutput), test.deleteErr).Once()
+		}
+
+		req := httptest.NewRequest("DELETE", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code, test.scenario)
+		mr.AssertExpectations(t)
+		ma.AssertExpectations(t)
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"opg-file-service/dynamo"
+)
+
+type ZipManifestFile struct {
+	Path      string // where the file is put in the archive
+	S3path    string
+	VersionID string `json:",omitempty"`
+}
+
+type ZipManifestResponseBody struct {
+	ZipRequestSummary
+	Files []ZipManifestFile
+}
+
+// ZipManifestHandler describes a zip request and the files in it, without fetching any of them
+type ZipManifestHandler struct {
+	repo   dynamo.RepositoryInterface
+	logger *slog.Logger
+}
+
+func NewZipManifestHandler(logger *slog.Logger, repo dynamo.RepositoryInterface) *ZipManifestHandler {
+	return &ZipManifestHandler{
+		repo,
+		logger,
+	}
+}
+
+func (zmh *ZipManifestHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	entry := findOwnedEntry(rw, r, zmh.repo, zmh.logger)
+	if entry == nil {
+		return
+	}
+
+	// files are listed with the names they are given in the archive
+	entry.DeDupe()
+
+	body := ZipManifestResponseBody{
+		ZipRequestSummary: newZipRequestSummary(entry),
+		Files:             make([]ZipManifestFile, len(entry.Files)),
+	}
+	for i, file := range entry.Files {
+		body.Files[i] = ZipManifestFile{
+			Path:      file.GetRelativePath(),
+			S3path:    file.S3path,
+			VersionID: file.VersionID,
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		zmh.logger.Error(err.Error())
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"opg-file-service/middleware"
+	"opg-file-service/storage"
+	"testing"
+)
+
+func TestZipManifestHandler_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		scenario       string
+		entry          *storage.Entry
+		wantCode       int
+		wantInResponse string
+	}{
+		{
+			"Files listed as they are named in the archive",
+			&storage.Entry{
+				Ref:  "test",
+				Hash: "user",
+				Ttl:  1893456000,
+				Files: []storage.File{
+					{S3path: "s3://files/file1", FileName: "file.pdf", Folder: "folder"},
+					{S3path: "s3://files/file2", FileName: "file.pdf", Folder: "folder", VersionID: "v2"},
+				},
+				FileCount: 2,
+			},
+			http.StatusOK,
+			`{"Reference":"test","Expires":"2030-01-01T00:00:00Z","Async":false,"FileCount":2,"Downloads":0,"MaxDownloads":1,"Files":[` +
+				`{"Path":"folder/file.pdf","S3path":"s3://files/file1"},` +
+				`{"Path":"folder/file (1).pdf","S3path":"s3://files/file2","VersionID":"v2"}` +
+				`]}`,
+		},
+		{
+			"Access denied",
+			&storage.Entry{Ref: "test", Hash: "other", Ttl: 1893456000},
+			http.StatusForbidden,
+			"Access denied.",
+		},
+		{
+			"Reference token has expired",
+			&storage.Entry{Ref: "test", Hash: "user", Ttl: 1},
+			http.StatusNotFound,
+			"Reference token has expired.",
+		},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		_, l := newTestLogger()
+
+		zh := ZipManifestHandler{
+			repo:   mr,
+			logger: l,
+		}
+
+		mr.On("Get", "test").Return(test.entry, nil).Once()
+
+		req := httptest.NewRequest("GET", "/zip/test/manifest", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+		mr.AssertNotCalled(t, "Claim", "test", claimLease)
+	}
+}
@@ -2,9 +2,17 @@ package handlers
 
 import (
 	"context"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/stretchr/testify/mock"
+	"io"
 	"net/http"
+	"opg-file-service/jobs"
 	"opg-file-service/storage"
+	"opg-file-service/webhook"
+	"opg-file-service/zipper"
+	"strings"
+	"time"
 )
 
 type MockRepository struct {
@@ -26,12 +34,56 @@ func (m *MockRepository) Add(ctx context.Context, entry *storage.Entry) error {
 	return args.Error(0)
 }
 
+func (m *MockRepository) Claim(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	args := m.Called(ref, lease)
+	entry, _ := args.Get(0).(*storage.Entry)
+	return entry, args.Error(1)
+}
+
+func (m *MockRepository) Release(ctx context.Context, entry *storage.Entry) error {
+	args := m.Called(entry)
+	return args.Error(0)
+}
+
+func (m *MockRepository) Consume(ctx context.Context, entry *storage.Entry) error {
+	args := m.Called(entry)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ClaimBuild(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	args := m.Called(ref, lease)
+	entry, _ := args.Get(0).(*storage.Entry)
+	return entry, args.Error(1)
+}
+
+func (m *MockRepository) RenewBuild(ctx context.Context, entry *storage.Entry, lease time.Duration) error {
+	args := m.Called(entry, lease)
+	return args.Error(0)
+}
+
+func (m *MockRepository) EndBuild(ctx context.Context, entry *storage.Entry) error {
+	args := m.Called(entry)
+	return args.Error(0)
+}
+
+func (m *MockRepository) List(ctx context.Context, hash string, limit int, after string) ([]*storage.Entry, string, error) {
+	args := m.Called(hash, limit, after)
+	entries, _ := args.Get(0).([]*storage.Entry)
+	return entries, args.String(1), args.Error(2)
+}
+
 type MockZipper struct {
 	mock.Mock
 }
 
-func (m *MockZipper) Open(rw http.ResponseWriter) {
-	m.Called(rw)
+func (m *MockZipper) Open(rw http.ResponseWriter, format zipper.Format) error {
+	args := m.Called(rw, format)
+	return args.Error(0)
+}
+
+func (m *MockZipper) OpenWriter(w io.Writer, format zipper.Format) error {
+	args := m.Called(w, format)
+	return args.Error(0)
 }
 
 func (m *MockZipper) Close() error {
@@ -39,7 +91,138 @@ func (m *MockZipper) Close() error {
 	return args.Error(0)
 }
 
+func (m *MockZipper) Store(ctx context.Context, files []storage.File) (zipper.ArchiveInfo, error) {
+	args := m.Called(files)
+	return args.Get(0).(zipper.ArchiveInfo), args.Error(1)
+}
+
+func (m *MockZipper) Range(start, end int64) error {
+	args := m.Called(start, end)
+	return args.Error(0)
+}
+
+func (m *MockZipper) Prefetch(ctx context.Context, files []storage.File) {
+	m.Called(files)
+}
+
 func (m *MockZipper) AddFile(ctx context.Context, f *storage.File) error {
 	args := m.Called(f)
 	return args.Error(0)
 }
+
+func (m *MockZipper) SkipFailures() {
+	m.Called()
+}
+
+func (m *MockZipper) AddErrorReport(failures []zipper.FileError) error {
+	args := m.Called(failures)
+	return args.Error(0)
+}
+
+func (m *MockZipper) Encrypt(enc *storage.Encryption) error {
+	args := m.Called(enc)
+	return args.Error(0)
+}
+
+func (m *MockZipper) RecordManifest() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockZipper) AddManifest(signer zipper.Signer) error {
+	args := m.Called(signer)
+	return args.Error(0)
+}
+
+type MockQueue struct {
+	mock.Mock
+}
+
+func (m *MockQueue) Send(ctx context.Context, job jobs.Job) error {
+	args := m.Called(job)
+	return args.Error(0)
+}
+
+func (m *MockQueue) Receive(ctx context.Context) (*jobs.Message, error) {
+	args := m.Called()
+	return args.Get(0).(*jobs.Message), args.Error(1)
+}
+
+func (m *MockQueue) Delete(ctx context.Context, msg *jobs.Message) error {
+	args := m.Called(msg)
+	return args.Error(0)
+}
+
+func (m *MockQueue) Extend(ctx context.Context, msg *jobs.Message) error {
+	args := m.Called(msg)
+	return args.Error(0)
+}
+
+type MockArchiveDeleter struct {
+	mock.Mock
+}
+
+func (m *MockArchiveDeleter) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(params)
+	out, _ := args.Get(0).(*s3.DeleteObjectOutput)
+	return out, args.Error(1)
+}
+
+type MockPresigner struct {
+	mock.Mock
+}
+
+func (m *MockPresigner) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	opts := s3.PresignOptions{}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	args := m.Called(params, opts.Expires)
+	return args.Get(0).(*v4.PresignedHTTPRequest), args.Error(1)
+}
+
+type MockNotifier struct {
+	mock.Mock
+}
+
+func (m *MockNotifier) Allowed(callbackUrl string) bool {
+	args := m.Called(callbackUrl)
+	return args.Bool(0)
+}
+
+func (m *MockNotifier) Notify(ctx context.Context, callbackUrl string, n webhook.Notification) {
+	m.Called(callbackUrl, n)
+}
+
+type MockLinkSigner struct {
+	mock.Mock
+}
+
+func (m *MockLinkSigner) Sign(ctx context.Context, ref string, expires time.Time) (string, error) {
+	args := m.Called(ref, expires)
+	return args.String(0), args.Error(1)
+}
+
+// fakePasswords seals passwords by marking them as sealed, or fails to with err
+type fakePasswords struct {
+	err error
+}
+
+func (p fakePasswords) Seal(enc *storage.Encryption) error {
+	if p.err != nil {
+		return p.err
+	}
+
+	enc.SealedPassword, enc.Password = "sealed:"+enc.Password, ""
+	return nil
+}
+
+func (p fakePasswords) Open(enc *storage.Encryption) (*storage.Encryption, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	opened := *enc
+	opened.Password, opened.SealedPassword = strings.TrimPrefix(enc.SealedPassword, "sealed:"), ""
+	return &opened, nil
+}
@@ -1,30 +1,67 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"opg-file-service/authz"
 	"opg-file-service/dynamo"
 	"opg-file-service/internal"
+	"opg-file-service/jobs"
 	"opg-file-service/middleware"
 	"opg-file-service/storage"
+	"opg-file-service/webhook"
+	"strconv"
 	"time"
 
 	"github.com/rs/xid"
 )
 
 type ZipRequestResponseBody struct {
-	Link string
+	Link       string
+	SignedLink string `json:",omitempty"` // Link signed so that it can be downloaded without a token, until it expires
+	Password   string `json:",omitempty"` // a generated encryption password, which is only returned to the request which made it, and its retries
+}
+
+// PasswordSealer seals the password of an encrypted zip request before it is saved
+type PasswordSealer interface {
+	Seal(enc *storage.Encryption) error
+	Open(enc *storage.Encryption) (*storage.Encryption, error)
+}
+
+// LinkSigner signs links to download a zip request without a token
+type LinkSigner interface {
+	Sign(ctx context.Context, ref string, expires time.Time) (string, error)
 }
 
 type ZipRequestHandler struct {
-	repo   dynamo.RepositoryInterface
-	logger *slog.Logger
+	repo      dynamo.RepositoryInterface
+	queue     jobs.Queue    // nil when asynchronous zip requests are not enabled
+	asyncTtl  time.Duration // how long asynchronous zip requests and their archives are kept for
+	maxTtl    time.Duration // the longest a zip request can ask to be kept for
+	notifier  webhook.NotifierInterface
+	policy    *authz.Policy // nil when every user can bundle any file
+	links     LinkSigner
+	linkTtl   time.Duration // how long a signed link can be used for, at most
+	passwords PasswordSealer
+	logger    *slog.Logger
 }
 
-func NewZipRequestHandler(logger *slog.Logger, repo dynamo.RepositoryInterface) *ZipRequestHandler {
+func NewZipRequestHandler(logger *slog.Logger, repo dynamo.RepositoryInterface, queue jobs.Queue, notifier webhook.NotifierInterface, policy *authz.Policy, links LinkSigner, passwords PasswordSealer) *ZipRequestHandler {
 	return &ZipRequestHandler{
 		repo,
+		queue,
+		time.Duration(internal.GetEnvInt("ZIP_ASYNC_TTL", 86400)) * time.Second,
+		time.Duration(internal.GetEnvInt("ZIP_MAX_TTL", 86400)) * time.Second,
+		notifier,
+		policy,
+		links,
+		time.Duration(internal.GetEnvInt("ZIP_LINK_TTL", 300)) * time.Second,
+		passwords,
 		logger,
 	}
 }
@@ -49,27 +86,203 @@ func (zrh *ZipRequestHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// a retried request is told apart from another request with the same idempotency key by a
+	// hash of what it asks for, which is taken before anything is added to it
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		entry.IdempotencyKey = key
+		entry.RequestHash, err = requestHash(entry)
+		if err != nil {
+			zrh.logger.Error(err.Error())
+			internal.WriteJSONError(rw, "request", "Invalid JSON request.", http.StatusBadRequest)
+			return
+		}
+	}
+
 	entry.Ref = xid.New().String()
-	entry.Ttl = time.Now().Add(5 * time.Minute).Unix()
 	entry.Hash = r.Context().Value(middleware.HashedEmail{}).(string)
 
-	if ok, err := entry.Validate(); !ok {
-		zrh.logger.Error(err.Error())
+	ttl := 5 * time.Minute
+
+	if entry.Async {
+		if zrh.queue == nil {
+			internal.WriteJSONError(rw, "request", "Asynchronous zip requests are not enabled.", http.StatusBadRequest)
+			return
+		}
+
+		// the archive is downloaded from S3 once it has been built, which may be some time later
+		ttl = zrh.asyncTtl
+		entry.Status = storage.StatusPending
+	}
+
+	if entry.TtlSeconds > 0 {
+		ttl = time.Duration(entry.TtlSeconds) * time.Second
+	}
+	entry.Ttl = time.Now().Add(ttl).Unix()
+
+	// a password generated for the request is returned in the response, so that it can be given to
+	// whoever the archive is sent to without the service having to send it anywhere
+	var generatedPassword string
+	if entry.Encryption != nil {
+		if entry.Encryption.Password == "" {
+			entry.Encryption.GeneratePassword()
+			generatedPassword = entry.Encryption.Password
+		}
+
+		// encrypted archives are zips whatever the Accept header of the download asks for
+		if entry.Format == "" {
+			entry.Format = storage.FormatZip
+		}
+	}
+
+	ok, validationErr := entry.Validate()
+
+	addValidationErr := func(field, message string) {
+		if validationErr == nil {
+			validationErr = new(storage.ErrValidation)
+		}
+		validationErr.Errors = append(validationErr.Errors, storage.ErrFieldValidation{
+			Field:   field,
+			Message: message,
+		})
+		ok = false
+	}
+
+	// callbacks are limited to hosts we trust, so the service cannot be used to make requests elsewhere
+	if entry.CallbackUrl != "" && !zrh.notifier.Allowed(entry.CallbackUrl) {
+		addValidationErr("CallbackUrl", "entry CallbackUrl must be an https URL on an allowed host")
+	}
+
+	// a signed link is downloaded as the user it was signed for, so cannot stand in for an API
+	// client or a caller with a certificate
+	if entry.SignedLink && !middleware.CanSignLinks(r.Context()) {
+		addValidationErr("SignedLink", "entry SignedLink can only be used with a user's token")
+	}
+
+	if maxTtlSeconds := int64(zrh.maxTtl / time.Second); entry.TtlSeconds > maxTtlSeconds {
+		addValidationErr("TtlSeconds", "entry TtlSeconds cannot be more than "+strconv.FormatInt(maxTtlSeconds, 10))
+	}
+
+	if !ok {
+		zrh.logger.Error(validationErr.Error())
 		rw.WriteHeader(http.StatusBadRequest)
-		if err := json.NewEncoder(rw).Encode(err); err != nil {
+		if err := json.NewEncoder(rw).Encode(validationErr); err != nil {
 			zrh.logger.Info("Unable to write JSON error to response:", "err", err)
 		}
 		return
 	}
 
+	if !allowFiles(rw, r, zrh.policy, entry.Files, zrh.logger) {
+		return
+	}
+
+	// the password is only saved sealed, so that it cannot be read by anyone who can read the
+	// zip requests
+	if entry.Encryption != nil {
+		if err := zrh.passwords.Seal(entry.Encryption); err != nil {
+			zrh.logger.Error(err.Error())
+			internal.WriteJSONError(rw, "request", "Unable to save the zip request.", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	err = zrh.repo.Add(r.Context(), entry)
+
+	var keyErr storage.IdempotencyKeyError
+	if errors.As(err, &keyErr) {
+		zrh.logger.Info(err.Error())
+		zrh.replay(rw, r, entry, keyErr.Ref, generatedPassword != "")
+		return
+	}
+	if err != nil {
+		zrh.logger.Error(err.Error())
+		internal.WriteJSONError(rw, "request", "Unable to save the zip request.", http.StatusInternalServerError)
+		return
+	}
+
+	if entry.Async {
+		err = zrh.queue.Send(r.Context(), jobs.Job{Ref: entry.Ref})
+		if err != nil {
+			zrh.logger.Error(err.Error())
+
+			// the zip request is deleted so that a retry makes a new one, rather than being given
+			// one which will never be built
+			if err := zrh.repo.Delete(context.WithoutCancel(r.Context()), entry); err != nil {
+				zrh.logger.Error(err.Error())
+			}
+
+			internal.WriteJSONError(rw, "request", "Unable to queue the zip request.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	zrh.writeResponse(rw, r, entry, generatedPassword)
+
+	zrh.logger.Info("Request took: " + time.Since(start).String())
+}
+
+// replay responds to a retried request with the response to the request which first used its
+// idempotency key, rather than making another zip request
+func (zrh *ZipRequestHandler) replay(rw http.ResponseWriter, r *http.Request, entry *storage.Entry, ref string, passwordGenerated bool) {
+	original, err := zrh.repo.Get(r.Context(), ref)
+
+	var notFoundErr storage.NotFoundError
+	if errors.As(err, &notFoundErr) {
+		// the request which used the key has not finished saving its zip request
+		internal.WriteJSONError(rw, "Idempotency-Key", "A request with this Idempotency-Key is still in progress.", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		zrh.logger.Error(err.Error())
 		internal.WriteJSONError(rw, "request", "Unable to save the zip request.", http.StatusInternalServerError)
 		return
 	}
 
-	jsonResp, err := json.Marshal(ZipRequestResponseBody{Link: "/zip/" + entry.Ref})
+	if original.RequestHash != entry.RequestHash {
+		internal.WriteJSONError(rw, "Idempotency-Key", "Idempotency-Key has already been used for a different request.", http.StatusConflict)
+		return
+	}
+
+	// the requests are the same, so the original had a password generated for it too
+	var password string
+	if passwordGenerated && original.Encryption != nil {
+		enc, err := zrh.passwords.Open(original.Encryption)
+		if err != nil {
+			zrh.logger.Error(err.Error())
+			internal.WriteJSONError(rw, "request", "Unable to save the zip request.", http.StatusInternalServerError)
+			return
+		}
+		password = enc.Password
+	}
+
+	rw.Header().Set("Idempotent-Replayed", "true")
+	zrh.writeResponse(rw, r, original, password)
+}
+
+func (zrh *ZipRequestHandler) writeResponse(rw http.ResponseWriter, r *http.Request, entry *storage.Entry, password string) {
+	link := "/zip/" + entry.Ref
+	if entry.Async {
+		link += "/status"
+	}
+
+	body := ZipRequestResponseBody{Link: link, Password: password}
+
+	// a replayed request is given a new signed link, as the one first given may have expired
+	if entry.SignedLink {
+		expires := time.Now().Add(zrh.linkTtl)
+		if ttl := time.Unix(entry.Ttl, 0); ttl.Before(expires) {
+			expires = ttl
+		}
+
+		query, err := zrh.links.Sign(r.Context(), entry.Ref, expires)
+		if err != nil {
+			zrh.logger.Error(err.Error())
+			internal.WriteJSONError(rw, "request", "Unable to sign the download link.", http.StatusInternalServerError)
+			return
+		}
+		body.SignedLink = link + "?" + query
+	}
+
+	jsonResp, err := json.Marshal(body)
 	if err != nil {
 		zrh.logger.Error(err.Error())
 		internal.WriteJSONError(rw, "request", "Unable to encode response object to JSON.", http.StatusInternalServerError)
@@ -81,6 +294,26 @@ func (zrh *ZipRequestHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request)
 	if err != nil {
 		zrh.logger.Error(err.Error())
 	}
+}
 
-	zrh.logger.Info("Request took: " + time.Since(start).String())
+// requestHash is a hash of what a zip request asks for. It is saved with the zip request, so
+// only whether an encryption password was given is hashed rather than the password itself,
+// which could otherwise be guessed from the hash.
+func requestHash(entry *storage.Entry) (string, error) {
+	hashed := *entry
+	if entry.Encryption != nil {
+		enc := *entry.Encryption
+		if enc.Password != "" {
+			enc.Password = "given"
+		}
+		hashed.Encryption = &enc
+	}
+
+	b, err := json.Marshal(&hashed)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
 }
@@ -3,13 +3,16 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"opg-file-service/jobs"
 	"opg-file-service/middleware"
 	"opg-file-service/storage"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -130,3 +133,476 @@ func TestZipRequestHandler_ServeHTTP(t *testing.T) {
 		}
 	}
 }
+
+func TestZipRequestHandler_ServeHTTP_Async(t *testing.T) {
+	tests := []struct {
+		scenario       string
+		queueEnabled   bool
+		sendErr        error
+		wantCode       int
+		wantInResponse string
+	}{
+		{"Async requests are not enabled", false, nil, http.StatusBadRequest, "Asynchronous zip requests are not enabled."},
+		{"Unable to queue the zip request", true, errors.New("queue error"), http.StatusInternalServerError, "Unable to queue the zip request."},
+		{"Async zip request created and queued", true, nil, http.StatusCreated, "/status"},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mq := new(MockQueue)
+		_, l := newTestLogger()
+
+		zh := ZipRequestHandler{
+			repo:     mr,
+			asyncTtl: time.Hour,
+			logger:   l,
+		}
+		if test.queueEnabled {
+			zh.queue = mq
+		}
+
+		var entry *storage.Entry
+		mr.On("Add", mock.AnythingOfType("*storage.Entry")).Run(func(args mock.Arguments) {
+			entry = args[0].(*storage.Entry)
+		}).Return(nil)
+		mq.On("Send", mock.AnythingOfType("jobs.Job")).Return(test.sendErr)
+		if test.sendErr != nil {
+			mr.On("Delete", mock.AnythingOfType("*storage.Entry")).Return(nil).Once()
+		}
+
+		req := httptest.NewRequest("POST", "/zip/request", strings.NewReader(`{"async":true,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "testHash"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+
+		if test.queueEnabled {
+			assert.Equal(t, storage.StatusPending, entry.Status, test.scenario)
+			assert.Greater(t, entry.Ttl, time.Now().Add(30*time.Minute).Unix(), test.scenario)
+			mq.AssertCalled(t, "Send", jobs.Job{Ref: entry.Ref})
+			mr.AssertExpectations(t)
+		} else {
+			mr.AssertNotCalled(t, "Add", mock.Anything)
+		}
+	}
+}
+
+func TestZipRequestHandler_ServeHTTP_Callback(t *testing.T) {
+	tests := []struct {
+		scenario       string
+		allowed        bool
+		wantCode       int
+		wantInResponse string
+	}{
+		{"Callback URL on an allowed host", true, http.StatusCreated, `"Link":"/zip/`},
+		{"Callback URL not on an allowed host", false, http.StatusBadRequest, "entry CallbackUrl must be an https URL on an allowed host"},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mn := new(MockNotifier)
+		_, l := newTestLogger()
+
+		zh := ZipRequestHandler{
+			repo:     mr,
+			notifier: mn,
+			logger:   l,
+		}
+
+		mn.On("Allowed", "https://sirius.example/callback").Return(test.allowed).Once()
+		mr.On("Add", mock.MatchedBy(func(entry *storage.Entry) bool {
+			return entry.CallbackUrl == "https://sirius.example/callback"
+		})).Return(nil)
+
+		req := httptest.NewRequest("POST", "/zip/request", strings.NewReader(`{"callbackUrl":"https://sirius.example/callback","files":[{"s3path":"s3://test/test","fileName":"test"}]}`))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "testHash"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+		mn.AssertExpectations(t)
+		if !test.allowed {
+			mr.AssertNotCalled(t, "Add", mock.Anything)
+		}
+	}
+}
+
+func TestZipRequestHandler_ServeHTTP_Encryption(t *testing.T) {
+	tests := []struct {
+		scenario       string
+		encryption     string
+		sealErr        error
+		wantCode       int
+		wantPassword   bool
+		wantInResponse string
+	}{
+		{"Password given", `{"method":"aes256","password":"correct horse battery"}`, nil, http.StatusCreated, false, `"Link":"/zip/`},
+		{"Password generated", `{"method":"aes256"}`, nil, http.StatusCreated, true, `"Link":"/zip/`},
+		{"Password too short", `{"password":"short"}`, nil, http.StatusBadRequest, false, "entry Encryption Password must be at least 12 characters"},
+		{"Unable to seal the password", `{"method":"aes256"}`, errors.New("missing secret"), http.StatusInternalServerError, false, "Unable to save the zip request."},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		_, l := newTestLogger()
+
+		zh := ZipRequestHandler{
+			repo:      mr,
+			passwords: fakePasswords{test.sealErr},
+			logger:    l,
+		}
+
+		var entry *storage.Entry
+		mr.On("Add", mock.Anything).Run(func(args mock.Arguments) {
+			entry = args.Get(0).(*storage.Entry)
+		}).Return(nil)
+
+		req := httptest.NewRequest("POST", "/zip/request", strings.NewReader(`{"encryption":`+test.encryption+`,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "testHash"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+
+		if test.wantCode != http.StatusCreated {
+			mr.AssertNotCalled(t, "Add", mock.Anything)
+			continue
+		}
+
+		var body ZipRequestResponseBody
+		_ = json.Unmarshal(rr.Body.Bytes(), &body)
+
+		// encrypted archives are always zips, whatever the download's Accept header
+		assert.Equal(t, storage.FormatZip, entry.Format, test.scenario)
+
+		// only the sealed password is saved
+		assert.Empty(t, entry.Encryption.Password, test.scenario)
+		assert.NotEmpty(t, entry.Encryption.SealedPassword, test.scenario)
+
+		if test.wantPassword {
+			assert.NotEmpty(t, body.Password, test.scenario)
+			assert.Equal(t, "sealed:"+body.Password, entry.Encryption.SealedPassword, test.scenario)
+		} else {
+			assert.Empty(t, body.Password, test.scenario)
+			assert.NotContains(t, rr.Body.String(), "Password", test.scenario)
+		}
+	}
+}
+
+func TestZipRequestHandler_ServeHTTP_Ttl(t *testing.T) {
+	tests := []struct {
+		scenario         string
+		reqBody          string
+		wantCode         int
+		wantTtl          time.Duration
+		wantMaxDownloads int
+		wantInResponse   string
+	}{
+		{"Default TTL", `{"files":[{"s3path":"s3://test/test","fileName":"test"}]}`, http.StatusCreated, 5 * time.Minute, 0, `"Link":"/zip/`},
+		{"TTL and number of downloads given", `{"ttlSeconds":3600,"maxDownloads":3,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`, http.StatusCreated, time.Hour, 3, `"Link":"/zip/`},
+		{"TTL above the maximum", `{"ttlSeconds":86401,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`, http.StatusBadRequest, 0, 0, "entry TtlSeconds cannot be more than 86400"},
+		{"Negative number of downloads", `{"maxDownloads":-1,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`, http.StatusBadRequest, 0, 0, "entry MaxDownloads cannot be negative"},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		_, l := newTestLogger()
+
+		zh := ZipRequestHandler{
+			repo:   mr,
+			maxTtl: 24 * time.Hour,
+			logger: l,
+		}
+
+		var entry *storage.Entry
+		mr.On("Add", mock.Anything).Run(func(args mock.Arguments) {
+			entry = args.Get(0).(*storage.Entry)
+		}).Return(nil)
+
+		req := httptest.NewRequest("POST", "/zip/request", strings.NewReader(test.reqBody))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "testHash"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+
+		if test.wantCode != http.StatusCreated {
+			mr.AssertNotCalled(t, "Add", mock.Anything)
+			continue
+		}
+
+		assert.InDelta(t, time.Now().Add(test.wantTtl).Unix(), entry.Ttl, 5, test.scenario)
+		assert.Equal(t, test.wantMaxDownloads, entry.MaxDownloads, test.scenario)
+	}
+}
+
+func TestZipRequestHandler_ServeHTTP_IdempotencyKey(t *testing.T) {
+	reqBody := `{"encryption":{"method":"aes256"},"files":[{"s3path":"s3://test/test","fileName":"test"}]}`
+
+	original := &storage.Entry{
+		Ref:            "original",
+		Hash:           "testHash",
+		Ttl:            time.Now().Add(time.Minute).Unix(),
+		Encryption:     &storage.Encryption{Method: storage.EncryptionAES256, SealedPassword: "sealed:generated password"},
+		IdempotencyKey: "key",
+	}
+	original.RequestHash, _ = requestHash(&storage.Entry{
+		Files:      []storage.File{{S3path: "s3://test/test", FileName: "test"}},
+		Encryption: &storage.Encryption{Method: storage.EncryptionAES256},
+	})
+
+	tests := []struct {
+		scenario       string
+		key            string
+		reqBody        string
+		addErr         error
+		getErr         error
+		wantCode       int
+		wantReplayed   bool
+		wantInResponse string
+	}{
+		{"New request with a key", "key", reqBody, nil, nil, http.StatusCreated, false, `"Link":"/zip/`},
+		{"Retried request", "key", reqBody, storage.IdempotencyKeyError{Key: "key", Ref: "original"}, nil, http.StatusCreated, true, `{"Link":"/zip/original","Password":"generated password"}`},
+		{"Retried request with the fields in another order", "key", `{"files":[{"fileName":"test","s3path":"s3://test/test"}],"encryption":{"method":"aes256"}}`, storage.IdempotencyKeyError{Key: "key", Ref: "original"}, nil, http.StatusCreated, true, `{"Link":"/zip/original","Password":"generated password"}`},
+		{"Different request with the same key", "key", `{"files":[{"s3path":"s3://test/other","fileName":"other"}]}`, storage.IdempotencyKeyError{Key: "key", Ref: "original"}, nil, http.StatusConflict, false, "Idempotency-Key has already been used for a different request."},
+		{"Original request still being saved", "key", reqBody, storage.IdempotencyKeyError{Key: "key", Ref: "original"}, storage.NotFoundError{Ref: "original"}, http.StatusConflict, false, "A request with this Idempotency-Key is still in progress."},
+		{"Key too long", strings.Repeat("k", 256), reqBody, nil, nil, http.StatusBadRequest, false, "entry IdempotencyKey cannot be more than 255 characters"},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		_, l := newTestLogger()
+
+		zh := ZipRequestHandler{
+			repo:      mr,
+			passwords: fakePasswords{},
+			logger:    l,
+		}
+
+		var entry *storage.Entry
+		mr.On("Add", mock.Anything).Run(func(args mock.Arguments) {
+			entry = args.Get(0).(*storage.Entry)
+		}).Return(test.addErr)
+		mr.On("Get", "original").Return(original, test.getErr)
+
+		req := httptest.NewRequest("POST", "/zip/request", strings.NewReader(test.reqBody))
+		req.Header.Set("Idempotency-Key", test.key)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "testHash"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+		assert.Equal(t, test.wantReplayed, rr.Header().Get("Idempotent-Replayed") == "true", test.scenario)
+
+		if test.wantCode == http.StatusBadRequest {
+			mr.AssertNotCalled(t, "Add", mock.Anything)
+			continue
+		}
+
+		assert.Equal(t, test.key, entry.IdempotencyKey, test.scenario)
+		assert.NotEmpty(t, entry.RequestHash, test.scenario)
+	}
+}
+
+func TestRequestHash(t *testing.T) {
+	hash := func(password string) string {
+		h, err := requestHash(&storage.Entry{
+			Files:      []storage.File{{S3path: "s3://test/test", FileName: "test"}},
+			Encryption: &storage.Encryption{Method: storage.EncryptionAES256, Password: password},
+		})
+		assert.Nil(t, err)
+		return h
+	}
+
+	assert.Equal(t, hash("first password"), hash("second password"))
+	assert.NotEqual(t, hash("first password"), hash(""))
+
+	entry := &storage.Entry{Encryption: &storage.Encryption{Password: "first password"}}
+	_, _ = requestHash(entry)
+	assert.Equal(t, "first password", entry.Encryption.Password)
+}
+
+func TestZipRequestHandler_ServeHTTP_Policy(t *testing.T) {
+	tests := []struct {
+		scenario string
+		roles    []string
+		addCalls int
+		wantCode int
+	}{
+		{"Files the user is allowed to bundle", []string{"case-worker"}, 1, http.StatusCreated},
+		{"Files the user is not allowed to bundle", []string{"other"}, 0, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		_, l := newTestLogger()
+
+		zh := ZipRequestHandler{
+			repo:   mr,
+			policy: newTestPolicy(t),
+			logger: l,
+		}
+
+		if test.addCalls > 0 {
+			mr.On("Add", mock.AnythingOfType("*storage.Entry")).Return(nil).Times(test.addCalls)
+		}
+
+		req := httptest.NewRequest("POST", "/zip/request", strings.NewReader(`{"files":[{"s3path":"s3://opg-documents/cases/1/letter.pdf","fileName":"letter.pdf"}]}`))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, withRoles(req, test.roles...))
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		mr.AssertExpectations(t)
+	}
+}
+
+func TestZipRequestHandler_ServeHTTP_SignedLink(t *testing.T) {
+	tests := []struct {
+		scenario       string
+		user           string
+		reqBody        string
+		signErr        error
+		wantExpiry     time.Duration
+		wantCode       int
+		wantInResponse string
+	}{
+		{
+			"Signed link",
+			"testHash",
+			`{"signedLink":true,"ttlSeconds":3600,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`,
+			nil,
+			5 * time.Minute,
+			http.StatusCreated,
+			`"SignedLink":"/zip/`,
+		},
+		{
+			"Signed link expires with the zip request",
+			"testHash",
+			`{"signedLink":true,"ttlSeconds":60,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`,
+			nil,
+			time.Minute,
+			http.StatusCreated,
+			`"SignedLink":"/zip/`,
+		},
+		{
+			"Unable to sign the link",
+			"testHash",
+			`{"signedLink":true,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`,
+			errors.New("missing secret"),
+			5 * time.Minute,
+			http.StatusInternalServerError,
+			"Unable to sign the download link.",
+		},
+		{
+			"Signed link for a caller with a certificate",
+			"cert:spiffe://batch.internal",
+			`{"signedLink":true,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`,
+			nil,
+			0,
+			http.StatusBadRequest,
+			"entry SignedLink can only be used with a user's token",
+		},
+		{
+			"Signed link for an asynchronous zip request",
+			"testHash",
+			`{"signedLink":true,"async":true,"files":[{"s3path":"s3://test/test","fileName":"test"}]}`,
+			nil,
+			0,
+			http.StatusBadRequest,
+			"entry SignedLink cannot be used with Async",
+		},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		ms := new(MockLinkSigner)
+		_, l := newTestLogger()
+
+		zh := ZipRequestHandler{
+			repo:     mr,
+			queue:    jobs.NewMemoryQueue(1),
+			asyncTtl: time.Hour,
+			maxTtl:   time.Hour,
+			links:    ms,
+			linkTtl:  5 * time.Minute,
+			logger:   l,
+		}
+
+		mr.On("Add", mock.AnythingOfType("*storage.Entry")).Return(nil).Maybe()
+		if test.wantExpiry > 0 {
+			ms.On("Sign", mock.AnythingOfType("string"), mock.MatchedBy(func(expires time.Time) bool {
+				// the expiry of the zip request is a Unix timestamp, so is up to a second early
+				return (test.wantExpiry - time.Until(expires)).Abs() <= time.Second
+			})).Return("expires=1&signature=abc", test.signErr).Once()
+		}
+
+		req := httptest.NewRequest("POST", "/zip/request", strings.NewReader(test.reqBody))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, test.user))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+		ms.AssertExpectations(t)
+
+		if test.wantCode == http.StatusCreated {
+			var body ZipRequestResponseBody
+			_ = json.NewDecoder(rr.Body).Decode(&body)
+			assert.Equal(t, body.Link+"?expires=1&signature=abc", body.SignedLink, test.scenario)
+		}
+	}
+}
+
+func TestZipRequestHandler_ServeHTTP_ApiClient(t *testing.T) {
+	tests := []struct {
+		scenario       string
+		reqBody        string
+		wantCode       int
+		wantInResponse string
+	}{
+		{"Zip request made by a client", `{"files":[{"s3path":"s3://opg-documents/batch/1.pdf","fileName":"1.pdf"}]}`, http.StatusCreated, `"Link":"/zip/`},
+		{"Files outside the client's locations", `{"files":[{"s3path":"s3://opg-documents/cases/1.pdf","fileName":"1.pdf"}]}`, http.StatusForbidden, "not allowed to access s3://opg-documents/cases/1.pdf"},
+		{"Signed link for a client", `{"signedLink":true,"files":[{"s3path":"s3://opg-documents/batch/1.pdf","fileName":"1.pdf"}]}`, http.StatusBadRequest, "entry SignedLink can only be used with a user's token"},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		_, l := newTestLogger()
+
+		zh := ZipRequestHandler{
+			repo:   mr,
+			maxTtl: time.Hour,
+			logger: l,
+		}
+
+		var entry *storage.Entry
+		mr.On("Add", mock.AnythingOfType("*storage.Entry")).Run(func(args mock.Arguments) {
+			entry = args.Get(0).(*storage.Entry)
+		}).Return(nil).Maybe()
+
+		req := httptest.NewRequest("POST", "/zip/request", strings.NewReader(test.reqBody))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, withClient(t, req, "s3://opg-documents/batch"))
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+		if test.wantCode == http.StatusCreated {
+			// only the client can download the zip request
+			assert.Equal(t, "client:batch", entry.Hash, test.scenario)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"opg-file-service/dynamo"
+	"opg-file-service/internal"
+	"opg-file-service/middleware"
+	"opg-file-service/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many zip requests are listed at a time, unless the request asks for fewer or more
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// previousHashCursor starts the reference to list from once the zip requests made with the
+// user's hash from before user-hash-salt was rotated are being listed
+const previousHashCursor = "previous:"
+
+// ZipRequestSummary describes a zip request without listing its files
+type ZipRequestSummary struct {
+	Reference    string
+	Expires      time.Time
+	Status       string `json:",omitempty"`
+	Async        bool
+	Format       string `json:",omitempty"`
+	FileCount    int
+	Downloads    int
+	MaxDownloads int
+	LastDownload *time.Time `json:",omitempty"`
+}
+
+func newZipRequestSummary(entry *storage.Entry) ZipRequestSummary {
+	summary := ZipRequestSummary{
+		Reference:    entry.Ref,
+		Expires:      time.Unix(entry.Ttl, 0).UTC(),
+		Status:       entry.Status,
+		Async:        entry.Async,
+		Format:       entry.Format,
+		FileCount:    entry.FileCount,
+		Downloads:    entry.Downloads,
+		MaxDownloads: entry.AllowedDownloads(),
+	}
+
+	if entry.LastDownload != 0 {
+		lastDownload := time.Unix(entry.LastDownload, 0).UTC()
+		summary.LastDownload = &lastDownload
+	}
+
+	return summary
+}
+
+type ZipRequestsResponseBody struct {
+	Requests []ZipRequestSummary
+	Next     string `json:",omitempty"` // passed as after to get the next page, until there are no more
+}
+
+type ZipRequestsHandler struct {
+	repo   dynamo.RepositoryInterface
+	logger *slog.Logger
+}
+
+func NewZipRequestsHandler(logger *slog.Logger, repo dynamo.RepositoryInterface) *ZipRequestsHandler {
+	return &ZipRequestsHandler{
+		repo,
+		logger,
+	}
+}
+
+func (zrh *ZipRequestsHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	limit := defaultListLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxListLimit {
+			internal.WriteJSONError(rw, "limit", "Limit must be a number from 1 to "+strconv.Itoa(maxListLimit)+".", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, next, err := zrh.list(r, limit, r.URL.Query().Get("after"))
+	if err != nil {
+		zrh.logger.Error(err.Error())
+		internal.WriteJSONError(rw, "request", "Unable to list zip requests.", http.StatusInternalServerError)
+		return
+	}
+
+	body := ZipRequestsResponseBody{Requests: make([]ZipRequestSummary, len(entries)), Next: next}
+	for i, entry := range entries {
+		body.Requests[i] = newZipRequestSummary(entry)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		zrh.logger.Error(err.Error())
+	}
+}
+
+// list finds a page of the user's zip requests. Those made with the user's hash from before
+// user-hash-salt was rotated, which are still theirs for a while, are listed after the others.
+func (zrh *ZipRequestsHandler) list(r *http.Request, limit int, after string) ([]*storage.Entry, string, error) {
+	userHash, _ := r.Context().Value(middleware.HashedEmail{}).(string)
+	previousHash, _ := r.Context().Value(middleware.PreviousHashedEmail{}).(string)
+	if previousHash == userHash {
+		previousHash = ""
+	}
+
+	if after, ok := strings.CutPrefix(after, previousHashCursor); ok {
+		// the previous salt may have stopped being used since the last page
+		if previousHash == "" {
+			return nil, "", nil
+		}
+		return zrh.listPrevious(r, previousHash, limit, after)
+	}
+
+	entries, next, err := zrh.repo.List(r.Context(), userHash, limit, after)
+	if err != nil || next != "" || previousHash == "" {
+		return entries, next, err
+	}
+
+	if len(entries) == limit {
+		return entries, previousHashCursor, nil
+	}
+
+	previous, next, err := zrh.listPrevious(r, previousHash, limit-len(entries), "")
+	return append(entries, previous...), next, err
+}
+
+func (zrh *ZipRequestsHandler) listPrevious(r *http.Request, previousHash string, limit int, after string) ([]*storage.Entry, string, error) {
+	entries, next, err := zrh.repo.List(r.Context(), previousHash, limit, after)
+	if next != "" {
+		next = previousHashCursor + next
+	}
+	return entries, next, err
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"opg-file-service/middleware"
+	"opg-file-service/storage"
+	"testing"
+)
+
+func TestZipRequestsHandler_ServeHTTP(t *testing.T) {
+	entries := []*storage.Entry{
+		{Ref: "test1", Hash: "user", Ttl: 1893456000, Format: storage.FormatZip, FileCount: 2},
+		{Ref: "test2", Hash: "user", Ttl: 1893456000, MaxDownloads: 3, Downloads: 1, LastDownload: 1767225600, FileCount: 1},
+	}
+
+	tests := []struct {
+		scenario       string
+		query          string
+		wantLimit      int
+		wantAfter      string
+		listOut        []*storage.Entry
+		listNext       string
+		listErr        error
+		wantCode       int
+		wantInResponse string
+	}{
+		{
+			"List the first page",
+			"",
+			defaultListLimit,
+			"",
+			entries,
+			"test2",
+			nil,
+			http.StatusOK,
+			`{"Requests":[` +
+				`{"Reference":"test1","Expires":"2030-01-01T00:00:00Z","Async":false,"Format":"zip","FileCount":2,"Downloads":0,"MaxDownloads":1},` +
+				`{"Reference":"test2","Expires":"2030-01-01T00:00:00Z","Async":false,"FileCount":1,"Downloads":1,"MaxDownloads":3,"LastDownload":"2026-01-01T00:00:00Z"}` +
+				`],"Next":"test2"}`,
+		},
+		{
+			"List the next page",
+			"?limit=2&after=test2",
+			2,
+			"test2",
+			nil,
+			"",
+			nil,
+			http.StatusOK,
+			`{"Requests":[]}`,
+		},
+		{
+			"Limit is too high",
+			"?limit=101",
+			0,
+			"",
+			nil,
+			"",
+			nil,
+			http.StatusBadRequest,
+			"Limit must be a number from 1 to 100.",
+		},
+		{
+			"Limit is not a number",
+			"?limit=all",
+			0,
+			"",
+			nil,
+			"",
+			nil,
+			http.StatusBadRequest,
+			"Limit must be a number from 1 to 100.",
+		},
+		{
+			"Unable to list zip requests",
+			"",
+			defaultListLimit,
+			"",
+			nil,
+			"",
+			errors.New("some DB error"),
+			http.StatusInternalServerError,
+			"Unable to list zip requests.",
+		},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		_, l := newTestLogger()
+
+		zh := ZipRequestsHandler{
+			repo:   mr,
+			logger: l,
+		}
+
+		if test.wantLimit > 0 {
+			mr.On("List", "user", test.wantLimit, test.wantAfter).Return(test.listOut, test.listNext, test.listErr).Once()
+		}
+
+		req := httptest.NewRequest("GET", "/zip/requests"+test.query, nil)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+		mr.AssertExpectations(t)
+	}
+}
+
+func TestZipRequestsHandler_ServeHTTP_PreviousHash(t *testing.T) {
+	type listCall struct {
+		hash    string
+		limit   int
+		after   string
+		entries []*storage.Entry
+		next    string
+	}
+
+	tests := []struct {
+		scenario     string
+		query        string
+		previousHash any
+		calls        []listCall
+		wantRefs     []string
+		wantNext     string
+	}{
+		{
+			"Previous zip requests follow the others",
+			"?limit=3",
+			"previous",
+			[]listCall{
+				{"user", 3, "", []*storage.Entry{{Ref: "current1"}}, ""},
+				{"previous", 2, "", []*storage.Entry{{Ref: "previous1"}, {Ref: "previous2"}}, "previous2"},
+			},
+			[]string{"current1", "previous1", "previous2"},
+			"previous:previous2",
+		},
+		{
+			"Next page of previous zip requests",
+			"?limit=3&after=previous:previous2",
+			"previous",
+			[]listCall{{"previous", 3, "previous2", []*storage.Entry{{Ref: "previous3"}}, ""}},
+			[]string{"previous3"},
+			"",
+		},
+		{
+			"Page filled before the previous zip requests",
+			"?limit=1",
+			"previous",
+			[]listCall{{"user", 1, "", []*storage.Entry{{Ref: "current1"}}, ""}},
+			[]string{"current1"},
+			"previous:",
+		},
+		{
+			"Previous salt no longer used",
+			"?after=previous:previous2",
+			nil,
+			nil,
+			[]string{},
+			"",
+		},
+		{
+			"Salt has not been rotated",
+			"",
+			"user",
+			[]listCall{{"user", defaultListLimit, "", []*storage.Entry{{Ref: "current1"}}, ""}},
+			[]string{"current1"},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		_, l := newTestLogger()
+
+		zh := ZipRequestsHandler{
+			repo:   mr,
+			logger: l,
+		}
+
+		for _, call := range test.calls {
+			mr.On("List", call.hash, call.limit, call.after).Return(call.entries, call.next, nil).Once()
+		}
+
+		req := httptest.NewRequest("GET", "/zip/requests"+test.query, nil)
+		ctx := context.WithValue(req.Context(), middleware.HashedEmail{}, "user")
+		if test.previousHash != nil {
+			ctx = context.WithValue(ctx, middleware.PreviousHashedEmail{}, test.previousHash)
+		}
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req.WithContext(ctx))
+
+		var body ZipRequestsResponseBody
+		assert.Equal(t, http.StatusOK, rr.Code, test.scenario)
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body), test.scenario)
+
+		refs := []string{}
+		for _, summary := range body.Requests {
+			refs = append(refs, summary.Reference)
+		}
+		assert.Equal(t, test.wantRefs, refs, test.scenario)
+		assert.Equal(t, test.wantNext, body.Next, test.scenario)
+		mr.AssertExpectations(t)
+	}
+}
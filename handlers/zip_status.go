@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"log/slog"
+	"net/http"
+	"opg-file-service/authz"
+	"opg-file-service/dynamo"
+	"opg-file-service/internal"
+	"opg-file-service/storage"
+	"time"
+)
+
+// how long a presigned link to a built archive can be used for
+const presignExpiry = 15 * time.Minute
+
+// allows us to mock s3.PresignClient in our tests
+type Presigner interface {
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+type ZipStatusResponseBody struct {
+	Status string
+	Link   string `json:",omitempty"`
+}
+
+type ZipStatusHandler struct {
+	repo      dynamo.RepositoryInterface
+	presigner Presigner
+	bucket    string
+	policy    *authz.Policy // nil when every user can bundle any file
+	logger    *slog.Logger
+}
+
+func NewZipStatusHandler(logger *slog.Logger, cfg *aws.Config, repo dynamo.RepositoryInterface, bucket string, policy *authz.Policy) *ZipStatusHandler {
+	s3Client := s3.NewFromConfig(*cfg, func(u *s3.Options) {
+		u.UsePathStyle = true
+	})
+
+	return &ZipStatusHandler{
+		repo,
+		s3.NewPresignClient(s3Client),
+		bucket,
+		policy,
+		logger,
+	}
+}
+
+func (zsh *ZipStatusHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	entry := findOwnedEntry(rw, r, zsh.repo, zsh.logger)
+	if entry == nil {
+		return
+	}
+
+	if !entry.Async {
+		internal.WriteJSONError(rw, "ref", "Reference token is not for an asynchronous zip request.", http.StatusNotFound)
+		return
+	}
+
+	// the archive is downloaded with the link, so the user's access is checked as it would be
+	// for a download
+	if !allowFiles(rw, r, zsh.policy, entry.Files, zsh.logger) {
+		return
+	}
+
+	body := ZipStatusResponseBody{Status: entry.Status}
+
+	if entry.Status == storage.StatusReady {
+		req, err := zsh.presigner.PresignGetObject(r.Context(), &s3.GetObjectInput{
+			Bucket: aws.String(zsh.bucket),
+			Key:    aws.String(entry.ArchiveKey),
+		}, s3.WithPresignExpires(min(presignExpiry, time.Until(time.Unix(entry.Ttl, 0)))))
+		if err != nil {
+			zsh.logger.Error(err.Error())
+			internal.WriteJSONError(rw, "zip", "Unable to create a link to the archive.", http.StatusInternalServerError)
+			return
+		}
+		body.Link = req.URL
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		zsh.logger.Error(err.Error())
+	}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"opg-file-service/middleware"
+	"opg-file-service/storage"
+	"testing"
+	"time"
+)
+
+func TestZipStatusHandler_ServeHTTP(t *testing.T) {
+	ttl := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		scenario       string
+		entry          *storage.Entry
+		getErr         error
+		presignErr     error
+		wantCode       int
+		wantInResponse string
+	}{
+		{
+			"Reference token not found",
+			&storage.Entry{},
+			errors.New("not found"),
+			nil,
+			http.StatusNotFound,
+			"Reference token not found.",
+		},
+		{
+			"Reference token has expired",
+			&storage.Entry{Ref: "test", Hash: "user", Ttl: 1, Async: true},
+			nil,
+			nil,
+			http.StatusNotFound,
+			"Reference token has expired.",
+		},
+		{
+			"Access denied",
+			&storage.Entry{Ref: "test", Hash: "other", Ttl: ttl, Async: true},
+			nil,
+			nil,
+			http.StatusForbidden,
+			"Access denied.",
+		},
+		{
+			"Zip request is not asynchronous",
+			&storage.Entry{Ref: "test", Hash: "user", Ttl: ttl},
+			nil,
+			nil,
+			http.StatusNotFound,
+			"Reference token is not for an asynchronous zip request.",
+		},
+		{
+			"Archive is being built",
+			&storage.Entry{Ref: "test", Hash: "user", Ttl: ttl, Async: true, Status: storage.StatusBuilding},
+			nil,
+			nil,
+			http.StatusOK,
+			`{"Status":"building"}`,
+		},
+		{
+			"Archive is ready",
+			&storage.Entry{Ref: "test", Hash: "user", Ttl: ttl, Async: true, Status: storage.StatusReady, ArchiveKey: "test.zip"},
+			nil,
+			nil,
+			http.StatusOK,
+			`{"Status":"ready","Link":"https://archives.s3/test.zip?signed"}`,
+		},
+		{
+			"Unable to create a link to the archive",
+			&storage.Entry{Ref: "test", Hash: "user", Ttl: ttl, Async: true, Status: storage.StatusReady, ArchiveKey: "test.zip"},
+			nil,
+			errors.New("presign error"),
+			http.StatusInternalServerError,
+			"Unable to create a link to the archive.",
+		},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mp := new(MockPresigner)
+		_, l := newTestLogger()
+
+		zsh := ZipStatusHandler{
+			repo:      mr,
+			presigner: mp,
+			bucket:    "archives",
+			logger:    l,
+		}
+
+		mr.On("Get", "test").Return(test.entry, test.getErr).Once()
+		mp.On("PresignGetObject", mock.MatchedBy(func(in *s3.GetObjectInput) bool {
+			return *in.Bucket == "archives" && *in.Key == "test.zip"
+		}), mock.MatchedBy(func(expires time.Duration) bool {
+			return expires > 0 && expires <= presignExpiry
+		})).Return(&v4.PresignedHTTPRequest{URL: "https://archives.s3/test.zip?signed"}, test.presignErr)
+
+		req := httptest.NewRequest("GET", "/zip/test/status", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zsh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantInResponse, test.scenario)
+	}
+}
+
+func TestZipStatusHandler_ServeHTTP_Policy(t *testing.T) {
+	mr := new(MockRepository)
+	_, l := newTestLogger()
+
+	zsh := ZipStatusHandler{
+		repo:      mr,
+		presigner: new(MockPresigner),
+		bucket:    "archives",
+		policy:    newTestPolicy(t),
+		logger:    l,
+	}
+
+	mr.On("Get", "test").Return(&storage.Entry{
+		Ref:        "test",
+		Hash:       "user",
+		Ttl:        time.Now().Add(time.Hour).Unix(),
+		Async:      true,
+		Status:     storage.StatusReady,
+		ArchiveKey: "test.zip",
+		Files:      []storage.File{{S3path: "s3://opg-documents/cases/1/letter.pdf", FileName: "letter.pdf"}},
+	}, nil).Once()
+
+	req := httptest.NewRequest("GET", "/zip/test/status", nil)
+	req.SetPathValue("reference", "test")
+	rr := httptest.NewRecorder()
+
+	zsh.ServeHTTP(rr, withRoles(req, "other"))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "Link")
+}
@@ -9,6 +9,8 @@ import (
 	"net/http/httptest"
 	"opg-file-service/middleware"
 	"opg-file-service/storage"
+	"opg-file-service/webhook"
+	"opg-file-service/zipper"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -30,8 +32,8 @@ func TestZipHandler_ServeHTTP(t *testing.T) {
 		repoGetCalls int
 		repoGetOut   *storage.Entry
 		repoGetErr   error
-		repoDelCalls int
-		repoDelErr   error
+		consumeCalls int
+		consumeErr   error
 		addFileCalls int
 		addFileErr   error
 		openCalls    int
@@ -155,20 +157,20 @@ func TestZipHandler_ServeHTTP(t *testing.T) {
 				Ttl: 9999999999,
 			},
 			nil,
-			1,
+			0,
 			nil,
 			0,
 			nil,
 			1,
 			1,
 			errors.New("some error when closing zip"),
-			200,
+			500,
 			[]string{
 				"some error when closing zip",
 			},
 		},
 		{
-			"Error when deleting entry from DB after it has been processed",
+			"Error when marking entry as consumed after it has been processed",
 			"test",
 			"",
 			1,
@@ -178,7 +180,7 @@ func TestZipHandler_ServeHTTP(t *testing.T) {
 			},
 			nil,
 			1,
-			errors.New("some error deleting entry"),
+			errors.New("some error consuming entry"),
 			0,
 			nil,
 			1,
@@ -186,9 +188,37 @@ func TestZipHandler_ServeHTTP(t *testing.T) {
 			nil,
 			200,
 			[]string{
-				"some error deleting entry",
+				"some error consuming entry",
 			},
 		},
+		{
+			"Zip request is built asynchronously",
+			"test",
+			"user",
+			1,
+			&storage.Entry{
+				Ref:   "test",
+				Hash:  "user",
+				Ttl:   9999999999,
+				Async: true,
+				Files: []storage.File{
+					{
+						S3path:   "s3://files/file",
+						FileName: "file",
+					},
+				},
+			},
+			nil,
+			0,
+			nil,
+			0,
+			nil,
+			0,
+			0,
+			nil,
+			409,
+			[]string{},
+		},
 		{
 			"Successfully zip multiple files",
 			"test",
@@ -232,9 +262,9 @@ func TestZipHandler_ServeHTTP(t *testing.T) {
 		logBuf, l := newTestLogger()
 
 		zh := ZipHandler{
-			repo:   mr,
-			zipper: mz,
-			logger: l,
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			logger:    l,
 		}
 
 		mux := http.NewServeMux()
@@ -248,10 +278,23 @@ func TestZipHandler_ServeHTTP(t *testing.T) {
 		rr := httptest.NewRecorder()
 		ctx := context.WithValue(req.Context(), middleware.HashedEmail{}, test.userHash)
 
-		mr.On("Get", test.ref).Return(test.repoGetOut, test.repoGetErr).Times(test.repoGetCalls)
-		mr.On("Delete", test.repoGetOut).Return(test.repoDelErr).Times(test.repoDelCalls)
+		if test.repoGetCalls > 0 {
+			mr.On("Get", test.ref).Return(test.repoGetOut, test.repoGetErr).Times(test.repoGetCalls)
+		}
+		if test.openCalls > 0 {
+			// every download which is started either consumes or releases its claim
+			mr.On("Claim", test.ref, claimLease).Return(test.repoGetOut, nil).Once()
+			if test.consumeCalls > 0 {
+				mr.On("Consume", test.repoGetOut).Return(test.consumeErr).Once()
+			} else {
+				mr.On("Release", test.repoGetOut).Return(nil).Once()
+			}
+		}
 
-		mz.On("Open", rr).Return().Times(test.openCalls)
+		mz.On("Open", mock.AnythingOfType("*handlers.countingResponseWriter"), zipper.Zip).Return(nil).Times(test.openCalls)
+		if test.openCalls > 0 {
+			mz.On("Prefetch", test.repoGetOut.Files).Return().Times(test.openCalls)
+		}
 		mz.On("Close").Return(test.closeErr).Times(test.closeCalls)
 
 		if test.addFileCalls > 0 {
@@ -266,5 +309,586 @@ func TestZipHandler_ServeHTTP(t *testing.T) {
 		}
 
 		assert.Equal(t, test.wantCode, res.StatusCode, test.scenario)
+		mr.AssertExpectations(t)
 	}
 }
+
+func TestZipHandler_ServeHTTP_Format(t *testing.T) {
+	tests := []struct {
+		scenario    string
+		entryFormat string
+		accept      string
+		openErr     error
+		wantFormat  zipper.Format
+		wantCode    int
+	}{
+		{"Defaults to zip", "", "", nil, zipper.Zip, 200},
+		{"Format negotiated from Accept header", "", "application/json, application/x-tar", nil, zipper.Tar, 200},
+		{"Format stored on the entry takes precedence", "tar.zst", "application/x-tar", nil, zipper.TarZst, 200},
+		{"Unable to open archive", "tar.gz", "", errors.New("some error opening archive"), zipper.TarGz, 500},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		_, l := newTestLogger()
+
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			logger:    l,
+		}
+
+		entry := &storage.Entry{
+			Ref:    "test",
+			Hash:   "user",
+			Ttl:    9999999999,
+			Format: test.entryFormat,
+		}
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req.Header.Set("Accept", test.accept)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+
+		rr := httptest.NewRecorder()
+
+		mr.On("Get", "test").Return(entry, nil)
+		mr.On("Claim", "test", claimLease).Return(entry, nil)
+		mr.On("Release", entry).Return(nil).Maybe()
+		mr.On("Consume", entry).Return(nil)
+		mz.On("Open", mock.AnythingOfType("*handlers.countingResponseWriter"), test.wantFormat).Return(test.openErr).Once()
+		mz.On("Prefetch", mock.Anything).Return().Maybe()
+		mz.On("Close").Return(nil).Maybe()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		mz.AssertExpectations(t)
+	}
+}
+
+func TestZipHandler_ServeHTTP_FailurePolicy(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://files/file1", FileName: "file1"},
+		{S3path: "s3://files/missing", FileName: "missing", Folder: "folder"},
+		{S3path: "s3://files/file3", FileName: "file3"},
+	}
+
+	t.Run("Skip files which cannot be zipped and list them in an error report", func(t *testing.T) {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		_, l := newTestLogger()
+
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			logger:    l,
+		}
+
+		entry := &storage.Entry{Ref: "test", Hash: "user", Ttl: 9999999999, FailurePolicy: storage.FailurePolicySkip, Files: files}
+
+		mr.On("Get", "test").Return(entry, nil).Once()
+		mr.On("Claim", "test", claimLease).Return(entry, nil).Once()
+		mr.On("Release", entry).Return(nil).Maybe()
+		mr.On("Consume", entry).Return(nil).Once()
+		mz.On("Open", mock.Anything, zipper.Zip).Return(nil).Once()
+		mz.On("Prefetch", files).Return().Once()
+		mz.On("SkipFailures").Return().Once()
+		mz.On("AddFile", &files[0]).Return(nil).Once()
+		mz.On("AddFile", &files[1]).Return(errors.New("NoSuchKey")).Once()
+		mz.On("AddFile", &files[2]).Return(nil).Once()
+		mz.On("AddErrorReport", []zipper.FileError{
+			{Path: "folder/missing", S3path: "s3://files/missing", Reason: "NoSuchKey"},
+		}).Return(nil).Once()
+		mz.On("Close").Return(nil).Once()
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mz.AssertExpectations(t)
+		mr.AssertExpectations(t)
+	})
+
+	t.Run("Abort the connection when the archive has already started streaming", func(t *testing.T) {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		_, l := newTestLogger()
+
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			logger:    l,
+		}
+
+		entry := &storage.Entry{Ref: "test", Hash: "user", Ttl: 9999999999, FailurePolicy: storage.FailurePolicyAbort, Files: files}
+
+		mr.On("Get", "test").Return(entry, nil).Once()
+		mr.On("Claim", "test", claimLease).Return(entry, nil).Once()
+		mr.On("Release", entry).Return(nil).Once()
+		mz.On("Open", mock.Anything, zipper.Zip).Return(nil).Once()
+		mz.On("Prefetch", files).Return().Once()
+		mz.On("AddFile", &files[0]).Run(func(args mock.Arguments) {
+			_, _ = mz.Calls[0].Arguments.Get(0).(http.ResponseWriter).Write([]byte("PK"))
+		}).Return(nil).Once()
+		mz.On("AddFile", &files[1]).Return(errors.New("NoSuchKey")).Once()
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			zh.ServeHTTP(rr, req)
+		})
+		assert.Equal(t, "PK", rr.Body.String())
+		mz.AssertExpectations(t)
+		mr.AssertExpectations(t)
+		mr.AssertNotCalled(t, "Consume", entry)
+	})
+}
+
+func TestZipHandler_ServeHTTP_Claim(t *testing.T) {
+	tests := []struct {
+		scenario  string
+		claimErr  error
+		wantCode  int
+		wantError string
+	}{
+		{"Download already in progress", storage.ClaimedError{Ref: "test"}, http.StatusConflict, "A download of this reference is already in progress."},
+		{"Reference already used", storage.ConsumedError{Ref: "test"}, http.StatusNotFound, "Reference token has already been used."},
+		{"Reference deleted since it was found", storage.NotFoundError{Ref: "test"}, http.StatusNotFound, "Reference token not found."},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		_, l := newTestLogger()
+
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			logger:    l,
+		}
+
+		entry := &storage.Entry{Ref: "test", Hash: "user", Ttl: 9999999999}
+
+		mr.On("Get", "test").Return(entry, nil).Once()
+		mr.On("Claim", "test", claimLease).Return(nil, test.claimErr).Once()
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantError, test.scenario)
+		mr.AssertExpectations(t)
+		mr.AssertNotCalled(t, "Release", mock.Anything)
+		mz.AssertNotCalled(t, "Open", mock.Anything, mock.Anything)
+	}
+}
+
+func TestZipHandler_ServeHTTP_PreviousHash(t *testing.T) {
+	tests := []struct {
+		scenario     string
+		previousHash any
+		wantCode     int
+		wantError    string
+	}{
+		{"Made with the salt the user's hash was rotated from", "oldUser", http.StatusNotFound, "Reference token has already been used."},
+		{"Made by another user before the salt was rotated", "otherUser", http.StatusForbidden, "Access denied."},
+		{"Salt has not been rotated", nil, http.StatusForbidden, "Access denied."},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		_, l := newTestLogger()
+
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			logger:    l,
+		}
+
+		entry := &storage.Entry{Ref: "test", Hash: "oldUser", Ttl: 9999999999}
+
+		mr.On("Get", "test").Return(entry, nil).Once()
+		if test.wantCode == http.StatusNotFound {
+			// the claim fails once the user is found to own the zip request, so nothing is zipped
+			mr.On("Claim", "test", claimLease).Return(nil, storage.ConsumedError{Ref: "test"}).Once()
+		}
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		ctx := context.WithValue(req.Context(), middleware.HashedEmail{}, "user")
+		if test.previousHash != nil {
+			ctx = context.WithValue(ctx, middleware.PreviousHashedEmail{}, test.previousHash)
+		}
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req.WithContext(ctx))
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Contains(t, rr.Body.String(), test.wantError, test.scenario)
+		mr.AssertExpectations(t)
+	}
+}
+
+func TestZipHandler_ServeHTTP_Store(t *testing.T) {
+	files := []storage.File{{S3path: "s3://files/file1", FileName: "file1.pdf"}}
+
+	tests := []struct {
+		scenario          string
+		format            string
+		storeErr          error
+		wantStore         bool
+		wantCode          int
+		wantContentLength string
+	}{
+		{"Content-Length is sent for stored zips", "zip", nil, true, 200, "1234"},
+		{"Unable to find the size of files", "", errors.New("NotFound"), true, 500, ""},
+		{"Store is ignored for other formats", "tar", nil, false, 200, ""},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		_, l := newTestLogger()
+
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			logger:    l,
+		}
+
+		entry := &storage.Entry{Ref: "test", Hash: "user", Ttl: 9999999999, Format: test.format, Store: true, Files: files}
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+
+		rr := httptest.NewRecorder()
+
+		mr.On("Get", "test").Return(entry, nil)
+		mr.On("Claim", "test", claimLease).Return(entry, nil)
+		mr.On("Release", entry).Return(nil).Maybe()
+		mr.On("Consume", entry).Return(nil).Maybe()
+		mz.On("Open", mock.Anything, mock.Anything).Return(nil).Once()
+		if test.wantStore {
+			mz.On("Store", files).Return(zipper.ArchiveInfo{Size: 1234, ETag: `"etag"`}, test.storeErr).Once()
+		}
+		mz.On("Prefetch", files).Return().Maybe()
+		mz.On("AddFile", &files[0]).Return(nil).Maybe()
+		mz.On("Close").Return(nil).Maybe()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		assert.Equal(t, test.wantContentLength, rr.Header().Get("Content-Length"), test.scenario)
+		mz.AssertExpectations(t)
+	}
+}
+
+func TestZipHandler_ServeHTTP_Range(t *testing.T) {
+	files := []storage.File{{S3path: "s3://files/file1", FileName: "file1.pdf"}}
+
+	tests := []struct {
+		scenario         string
+		rangeHdr         string
+		ifRange          string
+		wantRange        []int64
+		rangeErr         error
+		wantCode         int
+		wantContentRange string
+		wantLength       string
+		wantConsume      bool
+	}{
+		{"Whole archive", "", "", nil, nil, 200, "", "1234", true},
+		{"Resume to the end of the archive", "bytes=1000-", `"etag"`, []int64{1000, 1234}, nil, 206, "bytes 1000-1233/1234", "234", true},
+		{"Start of the archive keeps the entry", "bytes=0-99", "", []int64{0, 100}, nil, 206, "bytes 0-99/1234", "100", false},
+		{"Archive has changed since the download started", "bytes=1000-", `"old"`, nil, nil, 200, "", "1234", true},
+		{"Range not satisfiable", "bytes=5000-", "", nil, nil, 416, "bytes */1234", "", false},
+		{"Unable to write the range", "bytes=1000-", "", []int64{1000, 1234}, errors.New("some range error"), 500, "", "", false},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		_, l := newTestLogger()
+
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			logger:    l,
+		}
+
+		entry := &storage.Entry{Ref: "test", Hash: "user", Ttl: 9999999999, Store: true, Files: files}
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req.Header.Set("Range", test.rangeHdr)
+		req.Header.Set("If-Range", test.ifRange)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+
+		rr := httptest.NewRecorder()
+		var w http.ResponseWriter
+
+		mr.On("Get", "test").Return(entry, nil)
+		mr.On("Claim", "test", claimLease).Return(entry, nil)
+		if test.wantConsume {
+			mr.On("Consume", entry).Return(nil).Once()
+		} else {
+			mr.On("Release", entry).Return(nil).Once()
+		}
+		mz.On("Open", mock.Anything, zipper.Zip).Return(nil).Run(func(args mock.Arguments) {
+			w = args.Get(0).(http.ResponseWriter)
+		}).Once()
+		mz.On("Store", files).Return(zipper.ArchiveInfo{Size: 1234, ETag: `"etag"`}, nil).Once()
+		if test.wantRange != nil {
+			mz.On("Range", test.wantRange[0], test.wantRange[1]).Return(test.rangeErr).Once()
+		}
+		mz.On("Prefetch", files).Return().Maybe()
+		mz.On("AddFile", &files[0]).Return(nil).Run(func(args mock.Arguments) {
+			_, _ = w.Write([]byte("data"))
+		}).Maybe()
+		mz.On("Close").Return(nil).Maybe()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+
+		// an error sent in place of the archive has none of its headers, other than the size of
+		// the archive for a range which cannot be satisfied
+		if test.wantCode < http.StatusBadRequest {
+			assert.Equal(t, "bytes", rr.Header().Get("Accept-Ranges"), test.scenario)
+			assert.Equal(t, `"etag"`, rr.Header().Get("ETag"), test.scenario)
+		} else {
+			assert.Empty(t, rr.Header().Get("Accept-Ranges"), test.scenario)
+			assert.Empty(t, rr.Header().Get("ETag"), test.scenario)
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"), test.scenario)
+		}
+		assert.Equal(t, test.wantContentRange, rr.Header().Get("Content-Range"), test.scenario)
+		assert.Equal(t, test.wantLength, rr.Header().Get("Content-Length"), test.scenario)
+		mz.AssertExpectations(t)
+		mr.AssertExpectations(t)
+	}
+}
+
+func TestZipHandler_ServeHTTP_Callback(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://files/file1", FileName: "file1"},
+		{S3path: "s3://files/missing", FileName: "missing"},
+	}
+
+	tests := []struct {
+		scenario      string
+		failurePolicy string
+		wantCode      int
+		wantNotified  webhook.Notification
+	}{
+		{
+			"Notified when the download completes",
+			storage.FailurePolicySkip,
+			http.StatusOK,
+			webhook.Notification{
+				Reference: "test",
+				Status:    webhook.StatusComplete,
+				Files:     2,
+				Failures:  []zipper.FileError{{Path: "missing", S3path: "s3://files/missing", Reason: "NoSuchKey"}},
+			},
+		},
+		{
+			"Notified when the download fails",
+			storage.FailurePolicyAbort,
+			http.StatusInternalServerError,
+			webhook.Notification{Reference: "test", Status: webhook.StatusFailed, Files: 2},
+		},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		mn := new(MockNotifier)
+		_, l := newTestLogger()
+
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			notifier:  mn,
+			logger:    l,
+		}
+
+		entry := &storage.Entry{
+			Ref:           "test",
+			Hash:          "user",
+			Ttl:           9999999999,
+			FailurePolicy: test.failurePolicy,
+			CallbackUrl:   "https://sirius.example/callback",
+			Files:         files,
+		}
+
+		mr.On("Get", "test").Return(entry, nil).Once()
+		mr.On("Claim", "test", claimLease).Return(entry, nil).Once()
+		mr.On("Release", entry).Return(nil).Maybe()
+		mr.On("Consume", entry).Return(nil)
+		mz.On("Open", mock.Anything, zipper.Zip).Return(nil).Once()
+		mz.On("Prefetch", files).Return().Once()
+		mz.On("SkipFailures").Return().Maybe()
+		mz.On("AddFile", &files[0]).Return(nil).Once()
+		mz.On("AddFile", &files[1]).Return(errors.New("NoSuchKey")).Once()
+		mz.On("AddErrorReport", mock.Anything).Return(nil)
+		mz.On("Close").Return(nil)
+		mn.On("Notify", "https://sirius.example/callback", test.wantNotified).Return().Once()
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		mn.AssertExpectations(t)
+	}
+}
+
+func TestZipHandler_ServeHTTP_Manifest(t *testing.T) {
+	files := []storage.File{{S3path: "s3://files/file1", FileName: "file1"}}
+
+	tests := []struct {
+		scenario       string
+		addManifestErr error
+		wantCode       int
+	}{
+		{"Manifest added after the files", nil, http.StatusOK},
+		{"Unable to sign the manifest", errors.New("some signing error"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		_, l := newTestLogger()
+
+		signer := zipper.NewManifestSigner(nil)
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			signer:    signer,
+			logger:    l,
+		}
+
+		entry := &storage.Entry{Ref: "test", Hash: "user", Ttl: 9999999999, Manifest: true, Files: files}
+
+		mr.On("Get", "test").Return(entry, nil).Once()
+		mr.On("Claim", "test", claimLease).Return(entry, nil).Once()
+		mr.On("Release", entry).Return(nil).Maybe()
+		mr.On("Consume", entry).Return(nil)
+		mz.On("Open", mock.Anything, zipper.Zip).Return(nil).Once()
+		mz.On("RecordManifest").Return(nil).Once()
+		mz.On("Prefetch", files).Return().Once()
+		mz.On("AddFile", &files[0]).Return(nil).Once()
+		mz.On("AddManifest", signer).Return(test.addManifestErr).Once()
+		mz.On("Close").Return(nil).Maybe()
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		mz.AssertExpectations(t)
+	}
+}
+
+func TestZipHandler_ServeHTTP_Encryption(t *testing.T) {
+	files := []storage.File{{S3path: "s3://files/file1", FileName: "file1"}}
+	enc := &storage.Encryption{Method: storage.EncryptionAES256, Password: "correct horse battery"}
+
+	tests := []struct {
+		scenario   string
+		encryptErr error
+		wantCode   int
+	}{
+		{"Files encrypted", nil, http.StatusOK},
+		{"Unable to encrypt the archive", errors.New("some encryption error"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		_, l := newTestLogger()
+
+		zh := ZipHandler{
+			repo:      mr,
+			newZipper: func() zipper.ZipperInterface { return mz },
+			logger:    l,
+		}
+
+		entry := &storage.Entry{Ref: "test", Hash: "user", Ttl: 9999999999, Format: storage.FormatZip, Encryption: enc, Files: files}
+
+		mr.On("Get", "test").Return(entry, nil).Once()
+		mr.On("Claim", "test", claimLease).Return(entry, nil).Once()
+		mr.On("Release", entry).Return(nil).Maybe()
+		mr.On("Consume", entry).Return(nil)
+		mz.On("Open", mock.Anything, zipper.Zip).Return(nil).Once()
+		mz.On("Encrypt", enc).Return(test.encryptErr).Once()
+		if test.encryptErr == nil {
+			mz.On("Prefetch", files).Return().Once()
+			mz.On("AddFile", &files[0]).Return(nil).Once()
+			mz.On("Close").Return(nil).Once()
+		}
+
+		req := httptest.NewRequest("GET", "/zip/test", nil)
+		req.SetPathValue("reference", "test")
+		req = req.WithContext(context.WithValue(req.Context(), middleware.HashedEmail{}, "user"))
+		rr := httptest.NewRecorder()
+
+		zh.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.wantCode, rr.Code, test.scenario)
+		mz.AssertExpectations(t)
+	}
+}
+
+func TestZipHandler_ServeHTTP_Policy(t *testing.T) {
+	entry := &storage.Entry{
+		Ref:   "test",
+		Hash:  "user",
+		Ttl:   9999999999,
+		Files: []storage.File{{S3path: "s3://opg-documents/cases/1/letter.pdf", FileName: "letter.pdf"}},
+	}
+
+	mr := new(MockRepository)
+	_, l := newTestLogger()
+
+	zh := ZipHandler{
+		repo:      mr,
+		newZipper: func() zipper.ZipperInterface { return new(MockZipper) },
+		policy:    newTestPolicy(t),
+		logger:    l,
+	}
+
+	// the user's roles no longer allow the files, so the download is not started
+	mr.On("Get", "test").Return(entry, nil).Once()
+
+	req := httptest.NewRequest("GET", "/zip/test", nil)
+	req.SetPathValue("reference", "test")
+	rr := httptest.NewRecorder()
+
+	zh.ServeHTTP(rr, withRoles(req, "other"))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "not allowed to access s3://opg-documents/cases/1/letter.pdf")
+	mr.AssertExpectations(t)
+}
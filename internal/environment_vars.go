@@ -1,6 +1,9 @@
 package internal
 
-import "os"
+import (
+	"os"
+	"strconv"
+)
 
 func GetEnvVar(e string, d string) string {
 	if envVar, ok := os.LookupEnv(e); !ok {
@@ -9,3 +12,12 @@ func GetEnvVar(e string, d string) string {
 		return envVar
 	}
 }
+
+// GetEnvInt returns the integer value of an environment variable, falling back to the default when it is unset or not a number
+func GetEnvInt(e string, d int) int {
+	i, err := strconv.Atoi(GetEnvVar(e, strconv.Itoa(d)))
+	if err != nil {
+		return d
+	}
+	return i
+}
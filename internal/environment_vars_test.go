@@ -32,3 +32,28 @@ func TestGetEnvVar(t *testing.T) {
 		assert.Equal(t, test.want, actual)
 	}
 }
+
+func TestGetEnvInt(t *testing.T) {
+	tests := []struct {
+		env  string
+		val  *string
+		def  int
+		want int
+	}{
+		{"TEST", str("5"), 2, 5},
+		{"TEST", str("-1"), 2, -1},
+		{"TEST", str("five"), 2, 2},
+		{"TEST", str(""), 2, 2},
+		{"TEST", nil, 2, 2},
+	}
+
+	for _, test := range tests {
+		_ = os.Unsetenv(test.env)
+		if test.val != nil {
+			_ = os.Setenv(test.env, *test.val)
+		}
+		actual := GetEnvInt(test.env, test.def)
+		assert.Equal(t, test.want, actual)
+	}
+	_ = os.Unsetenv("TEST")
+}
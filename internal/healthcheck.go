@@ -1,9 +1,11 @@
 package internal
 
 import (
+	"crypto/tls"
 	"flag"
 	"net/http"
 	"os"
+	"strings"
 )
 
 func RunHealthcheck(addr string) {
@@ -14,7 +16,13 @@ func RunHealthcheck(addr string) {
 		return
 	}
 
-	resp, err := http.Get(addr)
+	client := http.DefaultClient
+	if strings.HasPrefix(addr, "https://") {
+		// the service is checked on localhost, which is not a name its certificate is for
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+
+	resp, err := client.Get(addr)
 	if err != nil {
 		os.Stdout.Write([]byte("FAIL: ERROR"))
 		os.Exit(1)
@@ -0,0 +1,269 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"log/slog"
+	"opg-file-service/dynamo"
+	"opg-file-service/storage"
+	"opg-file-service/webhook"
+	"opg-file-service/zipper"
+	"time"
+)
+
+// buildLease is how long a claim on a build lasts, which the builder renews while it runs,
+// so that a build whose worker has stopped can be taken over by another
+const buildLease = 5 * time.Minute
+
+// ErrBuildInProgress is returned when an archive is already being built by another worker
+var ErrBuildInProgress = errors.New("archive is already being built")
+
+// allows us to mock manager.Uploader in our tests
+type Uploader interface {
+	Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error)
+}
+
+// Builder builds the archive of an asynchronous zip request, uploading it to the archive
+// bucket and recording its progress on the request's entry
+type Builder struct {
+	repo      dynamo.RepositoryInterface
+	newZipper func() zipper.ZipperInterface
+	uploader  Uploader
+	bucket    string
+	notifier  webhook.NotifierInterface
+	signer    zipper.Signer
+	lease     time.Duration
+	logger    *slog.Logger
+}
+
+// archive describes an archive which has been uploaded to the archive bucket
+type archive struct {
+	key      string
+	size     int64
+	failures []zipper.FileError
+}
+
+func NewBuilder(logger *slog.Logger, cfg *aws.Config, repo dynamo.RepositoryInterface, bucket string, notifier webhook.NotifierInterface, signer zipper.Signer, keys zipper.CustomerKeys, passwords zipper.Passwords) *Builder {
+	z := zipper.NewZipper(cfg, keys, passwords)
+
+	s3Client := s3.NewFromConfig(*cfg, func(u *s3.Options) {
+		u.UsePathStyle = true
+	})
+
+	return &Builder{
+		repo:      repo,
+		newZipper: func() zipper.ZipperInterface { return z.Clone() },
+		uploader:  manager.NewUploader(s3Client),
+		bucket:    bucket,
+		notifier:  notifier,
+		signer:    signer,
+		lease:     buildLease,
+		logger:    logger,
+	}
+}
+
+func (b *Builder) Build(ctx context.Context, job Job) error {
+	entry, err := b.repo.Get(ctx, job.Ref)
+	if err != nil {
+		return err
+	}
+
+	if entry.IsExpired() {
+		return errors.New("zip request has expired: " + entry.Ref)
+	}
+
+	// the same job can be received more than once
+	if entry.Status == storage.StatusReady {
+		return nil
+	}
+
+	entry, err = b.repo.ClaimBuild(ctx, job.Ref, b.lease)
+	var claimedErr storage.ClaimedError
+	if errors.As(err, &claimedErr) {
+		return ErrBuildInProgress
+	}
+	if err != nil {
+		return err
+	}
+
+	buildCtx, cancel := context.WithCancel(ctx)
+	renewed := make(chan struct{})
+	claim := *entry
+	go func() {
+		defer close(renewed)
+		b.renew(buildCtx, cancel, &claim)
+	}()
+
+	a, err := b.upload(buildCtx, entry)
+	cancel()
+	<-renewed
+
+	// how the build ended is saved even when shutting down, so it is not left building
+	saveCtx := context.WithoutCancel(ctx)
+
+	if err != nil {
+		entry.Status = storage.StatusFailed
+		if endErr := b.repo.EndBuild(saveCtx, entry); endErr != nil {
+			b.logger.Error("Unable to update status for reference", slog.Any("err", endErr.Error()), slog.Any("ref", entry.Ref))
+		}
+		b.notify(ctx, entry, webhook.StatusFailed, nil)
+		return err
+	}
+
+	entry.Status = storage.StatusReady
+	entry.ArchiveKey = a.key
+
+	if err := b.repo.EndBuild(saveCtx, entry); err != nil {
+		return err
+	}
+
+	b.notify(ctx, entry, webhook.StatusComplete, a)
+	return nil
+}
+
+// renew keeps the claim on a build until ctx is done, cancelling the build if the claim is
+// taken over by another worker
+func (b *Builder) renew(ctx context.Context, cancel context.CancelFunc, claim *storage.Entry) {
+	ticker := time.NewTicker(b.lease / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := b.repo.RenewBuild(ctx, claim, b.lease)
+			var claimedErr storage.ClaimedError
+			var notFoundErr storage.NotFoundError
+			if errors.As(err, &claimedErr) || errors.As(err, &notFoundErr) {
+				b.logger.Error("Lost the claim on the build for reference", slog.Any("err", err.Error()), slog.Any("ref", claim.Ref))
+				cancel()
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				b.logger.Error("Unable to renew the claim on the build for reference", slog.Any("err", err.Error()), slog.Any("ref", claim.Ref))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// notify tells the entry's callback URL, if it has one, how building its archive ended
+func (b *Builder) notify(ctx context.Context, entry *storage.Entry, status string, a *archive) {
+	if entry.CallbackUrl == "" {
+		return
+	}
+
+	n := webhook.Notification{
+		Reference: entry.Ref,
+		Status:    status,
+		Files:     len(entry.Files),
+	}
+	if a != nil {
+		n.Bytes = a.size
+		n.Failures = a.failures
+	}
+
+	b.notifier.Notify(ctx, entry.CallbackUrl, n)
+}
+
+// upload streams the archive of an entry into a multipart upload
+func (b *Builder) upload(ctx context.Context, entry *storage.Entry) (*archive, error) {
+	entry.DeDupe()
+
+	format, ok := zipper.FormatByName(entry.Format)
+	if !ok {
+		format = zipper.Zip
+	}
+
+	key := entry.Ref + format.Extension
+	pr, pw := io.Pipe()
+	cw := &countingWriter{Writer: pw}
+
+	z := b.newZipper()
+	if err := z.OpenWriter(cw, format); err != nil {
+		return nil, err
+	}
+
+	uploaded := make(chan error, 1)
+	go func() {
+		_, err := b.uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket:             aws.String(b.bucket),
+			Key:                aws.String(key),
+			Body:               pr,
+			ContentType:        aws.String(format.ContentType),
+			ContentDisposition: aws.String("attachment; filename=\"download" + format.Extension + "\""),
+		})
+
+		// stop the zipper writing to a pipe nobody is reading
+		_ = pr.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	failures, err := b.write(ctx, z, entry, format)
+
+	// an error fails the upload, so that the incomplete parts are removed
+	_ = pw.CloseWithError(err)
+	uploadErr := <-uploaded
+
+	if err != nil {
+		return nil, err
+	}
+	if uploadErr != nil {
+		return nil, uploadErr
+	}
+
+	return &archive{key, cw.written, failures}, nil
+}
+
+func (b *Builder) write(ctx context.Context, z zipper.ZipperInterface, entry *storage.Entry, format zipper.Format) ([]zipper.FileError, error) {
+	if entry.Store && format.Name == storage.FormatZip {
+		if _, err := z.Store(ctx, entry.Files); err != nil {
+			return nil, err
+		}
+	}
+
+	if entry.Encryption != nil {
+		if err := z.Encrypt(entry.Encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	if entry.Manifest {
+		if err := z.RecordManifest(); err != nil {
+			return nil, err
+		}
+	}
+
+	z.Prefetch(ctx, entry.Files)
+
+	failures, err := zipper.AddFiles(ctx, z, entry.Files, entry.FailurePolicy)
+	if err == nil && entry.Manifest {
+		err = z.AddManifest(b.signer)
+	}
+	if len(failures) > 0 {
+		b.logger.Info("Files skipped for reference", slog.Any("ref", entry.Ref), slog.Any("count", len(failures)))
+	}
+
+	closeErr := z.Close()
+	if err != nil {
+		return failures, err
+	}
+
+	return failures, closeErr
+}
+
+// countingWriter counts the bytes of an archive as they are written to its upload
+type countingWriter struct {
+	io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.written += int64(n)
+	return n, err
+}
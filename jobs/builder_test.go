@@ -0,0 +1,300 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"opg-file-service/storage"
+	"opg-file-service/webhook"
+	"opg-file-service/zipper"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestBuilder(mr *MockRepository, mz *MockZipper, mu *MockUploader) *Builder {
+	return &Builder{
+		repo:      mr,
+		newZipper: func() zipper.ZipperInterface { return mz },
+		uploader:  mu,
+		bucket:    "archives",
+		notifier:  new(MockNotifier),
+		lease:     buildLease,
+		logger:    slog.New(slog.NewJSONHandler(io.Discard, nil)),
+	}
+}
+
+func TestNewBuilder(t *testing.T) {
+	b := NewBuilder(slog.New(slog.NewJSONHandler(io.Discard, nil)), aws.NewConfig(), new(MockRepository), "archives", new(MockNotifier), nil, nil, nil)
+
+	assert.NotNil(t, b.newZipper())
+	assert.NotNil(t, b.uploader)
+	assert.Equal(t, "archives", b.bucket)
+	assert.Equal(t, buildLease, b.lease)
+}
+
+func TestBuilder_Build(t *testing.T) {
+	files := []storage.File{{S3path: "s3://files/file1", FileName: "file1"}}
+
+	tests := []struct {
+		scenario     string
+		format       string
+		uploadErr    error
+		wantKey      string
+		wantStatuses []string
+		wantNotified webhook.Notification
+		wantErr      error
+	}{
+		{
+			"Archive uploaded",
+			"",
+			nil,
+			"test.zip",
+			[]string{storage.StatusBuilding, storage.StatusReady},
+			webhook.Notification{Reference: "test", Status: webhook.StatusComplete, Files: 1, Bytes: 17},
+			nil,
+		},
+		{
+			"Archive uploaded in another format",
+			storage.FormatTarGz,
+			nil,
+			"test.tar.gz",
+			[]string{storage.StatusBuilding, storage.StatusReady},
+			webhook.Notification{Reference: "test", Status: webhook.StatusComplete, Files: 1, Bytes: 17},
+			nil,
+		},
+		{
+			"Upload failed",
+			"",
+			errors.New("some S3 error"),
+			"",
+			[]string{storage.StatusBuilding, storage.StatusFailed},
+			webhook.Notification{Reference: "test", Status: webhook.StatusFailed, Files: 1},
+			errors.New("some S3 error"),
+		},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		mz := new(MockZipper)
+		mu := new(MockUploader)
+		b := newTestBuilder(mr, mz, mu)
+
+		format, ok := zipper.FormatByName(test.format)
+		if !ok {
+			format = zipper.Zip
+		}
+
+		entry := &storage.Entry{
+			Ref:         "test",
+			Hash:        "user",
+			Ttl:         9999999999,
+			Async:       true,
+			Format:      test.format,
+			Status:      storage.StatusPending,
+			CallbackUrl: "https://sirius.example/callback",
+			Files:       files,
+		}
+
+		var statuses []string
+		mr.On("Get", "test").Return(entry, nil).Once()
+		mr.On("ClaimBuild", "test", buildLease).Run(func(args mock.Arguments) {
+			entry.Status = storage.StatusBuilding
+			statuses = append(statuses, entry.Status)
+		}).Return(entry, nil).Once()
+		mr.On("EndBuild", entry).Run(func(args mock.Arguments) {
+			statuses = append(statuses, args.Get(0).(*storage.Entry).Status)
+		}).Return(nil).Once()
+
+		var w io.Writer
+		mz.On("OpenWriter", mock.Anything, format).Run(func(args mock.Arguments) {
+			w = args.Get(0).(io.Writer)
+		}).Return(nil).Once()
+		mz.On("Prefetch", files).Return().Once()
+		mz.On("AddFile", &files[0]).Run(func(args mock.Arguments) {
+			_, _ = w.Write([]byte("contents of file1"))
+		}).Return(nil).Once()
+		mz.On("Close").Return(nil).Once()
+
+		uploaded := new(bytes.Buffer)
+		mu.On("Upload", mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+			return *input.Bucket == "archives" && *input.ContentType == format.ContentType
+		})).Run(func(args mock.Arguments) {
+			if test.uploadErr == nil {
+				_, _ = io.Copy(uploaded, args.Get(0).(*s3.PutObjectInput).Body)
+			}
+		}).Return(nil, test.uploadErr).Once()
+
+		mn := b.notifier.(*MockNotifier)
+		mn.On("Notify", "https://sirius.example/callback", test.wantNotified).Return().Once()
+
+		err := b.Build(t.Context(), Job{Ref: "test"})
+
+		assert.Equal(t, test.wantErr, err, test.scenario)
+		assert.Equal(t, test.wantStatuses, statuses, test.scenario)
+		assert.Equal(t, test.wantKey, entry.ArchiveKey, test.scenario)
+		if test.uploadErr == nil {
+			assert.Equal(t, "contents of file1", uploaded.String(), test.scenario)
+		}
+		mr.AssertExpectations(t)
+		mz.AssertExpectations(t)
+		mu.AssertExpectations(t)
+		mn.AssertExpectations(t)
+	}
+}
+
+func TestBuilder_Build_Interrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	mr := new(MockRepository)
+	mz := new(MockZipper)
+	mu := new(MockUploader)
+	b := newTestBuilder(mr, mz, mu)
+
+	files := []storage.File{{S3path: "s3://files/file1", FileName: "file1"}}
+	entry := &storage.Entry{Ref: "test", Ttl: 9999999999, Async: true, Status: storage.StatusPending, Files: files}
+
+	mr.On("Get", "test").Return(entry, nil).Once()
+	mr.On("ClaimBuild", "test", buildLease).Return(entry, nil).Once()
+
+	// the failure is still saved once shutting down has cancelled the build
+	mr.On("EndBuild", mock.MatchedBy(func(e *storage.Entry) bool {
+		return e.Status == storage.StatusFailed
+	})).Return(nil).Once()
+
+	mz.On("OpenWriter", mock.Anything, zipper.Zip).Return(nil).Once()
+	mz.On("Prefetch", files).Return().Once()
+	mz.On("AddFile", &files[0]).Run(func(args mock.Arguments) {
+		cancel()
+	}).Return(context.Canceled).Once()
+	mz.On("Close").Return(nil).Once()
+	mu.On("Upload", mock.Anything).Return(nil, context.Canceled).Once()
+
+	err := b.Build(ctx, Job{Ref: "test"})
+
+	assert.Equal(t, context.Canceled, err)
+	mr.AssertExpectations(t)
+}
+
+func TestBuilder_Build_InProgress(t *testing.T) {
+	mr := new(MockRepository)
+	b := newTestBuilder(mr, new(MockZipper), new(MockUploader))
+
+	mr.On("Get", "test").Return(&storage.Entry{Ref: "test", Ttl: 9999999999, Async: true, Status: storage.StatusBuilding}, nil).Once()
+	mr.On("ClaimBuild", "test", buildLease).Return(nil, storage.ClaimedError{Ref: "test"}).Once()
+
+	err := b.Build(t.Context(), Job{Ref: "test"})
+
+	assert.Equal(t, ErrBuildInProgress, err)
+	mr.AssertNotCalled(t, "EndBuild", mock.Anything)
+}
+
+func TestBuilder_Renew(t *testing.T) {
+	tests := []struct {
+		scenario      string
+		renewErr      error
+		wantCancelled bool
+	}{
+		{
+			"Claim renewed",
+			nil,
+			false,
+		},
+		{
+			"Claim renewed after an error",
+			errors.New("some DynamoDB error"),
+			false,
+		},
+		{
+			"Claim taken over by another worker",
+			storage.ClaimedError{Ref: "test"},
+			true,
+		},
+		{
+			"Entry deleted",
+			storage.NotFoundError{Ref: "test"},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		b := newTestBuilder(mr, new(MockZipper), new(MockUploader))
+		b.lease = 50 * time.Millisecond
+
+		claim := &storage.Entry{Ref: "test", ClaimID: "claim"}
+		renewed := make(chan struct{}, 1)
+		mr.On("RenewBuild", claim, b.lease).Run(func(args mock.Arguments) {
+			select {
+			case renewed <- struct{}{}:
+			default:
+			}
+		}).Return(test.renewErr)
+
+		ctx, cancel := context.WithCancel(t.Context())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			b.renew(ctx, cancel, claim)
+		}()
+
+		<-renewed
+		if !test.wantCancelled {
+			// the claim is still renewed after the first time
+			<-renewed
+			assert.Nil(t, ctx.Err(), test.scenario)
+			cancel()
+		}
+		<-done
+
+		assert.NotNil(t, ctx.Err(), test.scenario)
+		cancel()
+	}
+}
+
+func TestBuilder_Build_Skipped(t *testing.T) {
+	tests := []struct {
+		scenario string
+		entry    *storage.Entry
+		getErr   error
+		wantErr  error
+	}{
+		{
+			"Entry not found",
+			nil,
+			storage.NotFoundError{Ref: "test"},
+			storage.NotFoundError{Ref: "test"},
+		},
+		{
+			"Entry has expired",
+			&storage.Entry{Ref: "test", Ttl: 1, Async: true},
+			nil,
+			errors.New("zip request has expired: test"),
+		},
+		{
+			"Archive has already been built",
+			&storage.Entry{Ref: "test", Ttl: 9999999999, Async: true, Status: storage.StatusReady},
+			nil,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		mr := new(MockRepository)
+		b := newTestBuilder(mr, new(MockZipper), new(MockUploader))
+
+		mr.On("Get", "test").Return(test.entry, test.getErr).Once()
+
+		err := b.Build(t.Context(), Job{Ref: "test"})
+
+		assert.Equal(t, test.wantErr, err, test.scenario)
+		mr.AssertNotCalled(t, "ClaimBuild", mock.Anything, mock.Anything)
+	}
+}
@@ -0,0 +1,166 @@
+package jobs
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"net/http"
+	"opg-file-service/storage"
+	"opg-file-service/webhook"
+	"opg-file-service/zipper"
+	"time"
+)
+
+type MockRepository struct {
+	mock.Mock
+}
+
+func (m *MockRepository) Get(ctx context.Context, ref string) (*storage.Entry, error) {
+	args := m.Called(ref)
+	entry, _ := args.Get(0).(*storage.Entry)
+	return entry, args.Error(1)
+}
+
+func (m *MockRepository) Delete(ctx context.Context, entry *storage.Entry) error {
+	args := m.Called(entry)
+	return args.Error(0)
+}
+
+func (m *MockRepository) Add(ctx context.Context, entry *storage.Entry) error {
+	args := m.Called(entry)
+	return args.Error(0)
+}
+
+func (m *MockRepository) Claim(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	args := m.Called(ref, lease)
+	entry, _ := args.Get(0).(*storage.Entry)
+	return entry, args.Error(1)
+}
+
+func (m *MockRepository) Release(ctx context.Context, entry *storage.Entry) error {
+	args := m.Called(entry)
+	return args.Error(0)
+}
+
+func (m *MockRepository) Consume(ctx context.Context, entry *storage.Entry) error {
+	args := m.Called(entry)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ClaimBuild(ctx context.Context, ref string, lease time.Duration) (*storage.Entry, error) {
+	args := m.Called(ref, lease)
+	entry, _ := args.Get(0).(*storage.Entry)
+	return entry, args.Error(1)
+}
+
+func (m *MockRepository) RenewBuild(ctx context.Context, entry *storage.Entry, lease time.Duration) error {
+	args := m.Called(entry, lease)
+	return args.Error(0)
+}
+
+func (m *MockRepository) EndBuild(ctx context.Context, entry *storage.Entry) error {
+	args := m.Called(entry)
+	return args.Error(0)
+}
+
+func (m *MockRepository) List(ctx context.Context, hash string, limit int, after string) ([]*storage.Entry, string, error) {
+	args := m.Called(hash, limit, after)
+	entries, _ := args.Get(0).([]*storage.Entry)
+	return entries, args.String(1), args.Error(2)
+}
+
+type MockZipper struct {
+	mock.Mock
+}
+
+func (m *MockZipper) Open(rw http.ResponseWriter, format zipper.Format) error {
+	args := m.Called(rw, format)
+	return args.Error(0)
+}
+
+func (m *MockZipper) OpenWriter(w io.Writer, format zipper.Format) error {
+	args := m.Called(w, format)
+	return args.Error(0)
+}
+
+func (m *MockZipper) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockZipper) Store(ctx context.Context, files []storage.File) (zipper.ArchiveInfo, error) {
+	args := m.Called(files)
+	return args.Get(0).(zipper.ArchiveInfo), args.Error(1)
+}
+
+func (m *MockZipper) Range(start, end int64) error {
+	args := m.Called(start, end)
+	return args.Error(0)
+}
+
+func (m *MockZipper) Prefetch(ctx context.Context, files []storage.File) {
+	m.Called(files)
+}
+
+func (m *MockZipper) AddFile(ctx context.Context, f *storage.File) error {
+	args := m.Called(f)
+	return args.Error(0)
+}
+
+func (m *MockZipper) SkipFailures() {
+	m.Called()
+}
+
+func (m *MockZipper) AddErrorReport(failures []zipper.FileError) error {
+	args := m.Called(failures)
+	return args.Error(0)
+}
+
+func (m *MockZipper) Encrypt(enc *storage.Encryption) error {
+	args := m.Called(enc)
+	return args.Error(0)
+}
+
+func (m *MockZipper) RecordManifest() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockZipper) AddManifest(signer zipper.Signer) error {
+	args := m.Called(signer)
+	return args.Error(0)
+}
+
+type MockUploader struct {
+	mock.Mock
+}
+
+func (m *MockUploader) Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	args := m.Called(input)
+	out, _ := args.Get(0).(*manager.UploadOutput)
+	return out, args.Error(1)
+}
+
+type MockNotifier struct {
+	mock.Mock
+}
+
+func (m *MockNotifier) Allowed(callbackUrl string) bool {
+	args := m.Called(callbackUrl)
+	return args.Bool(0)
+}
+
+func (m *MockNotifier) Notify(ctx context.Context, callbackUrl string, n webhook.Notification) {
+	m.Called(callbackUrl, n)
+}
+
+type MockBuilder struct {
+	mock.Mock
+}
+
+func (m *MockBuilder) Build(ctx context.Context, job Job) error {
+	args := m.Called(job)
+	return args.Error(0)
+}
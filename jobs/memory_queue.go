@@ -0,0 +1,43 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+)
+
+// MemoryQueue holds jobs in memory, so they are only seen by workers in the same process
+// and are lost if it stops. A job which is being built when it stops is not tried again,
+// and its entry is left failed.
+type MemoryQueue struct {
+	jobs chan Job
+}
+
+func NewMemoryQueue(size int) *MemoryQueue {
+	return &MemoryQueue{jobs: make(chan Job, size)}
+}
+
+func (q *MemoryQueue) Send(ctx context.Context, job Job) error {
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return errors.New("job queue is full")
+	}
+}
+
+func (q *MemoryQueue) Receive(ctx context.Context) (*Message, error) {
+	select {
+	case job := <-q.jobs:
+		return &Message{Job: job}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *MemoryQueue) Delete(ctx context.Context, msg *Message) error {
+	return nil
+}
+
+func (q *MemoryQueue) Extend(ctx context.Context, msg *Message) error {
+	return nil
+}
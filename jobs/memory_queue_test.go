@@ -0,0 +1,28 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryQueue(t *testing.T) {
+	q := NewMemoryQueue(1)
+
+	assert.Nil(t, q.Send(t.Context(), Job{Ref: "test"}))
+	assert.Equal(t, errors.New("job queue is full"), q.Send(t.Context(), Job{Ref: "other"}))
+
+	msg, err := q.Receive(t.Context())
+	assert.Nil(t, err)
+	assert.Equal(t, Job{Ref: "test"}, msg.Job)
+	assert.Nil(t, q.Delete(t.Context(), msg))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	msg, err = q.Receive(ctx)
+	assert.Nil(t, msg)
+	assert.Equal(t, context.Canceled, err)
+}
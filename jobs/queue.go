@@ -0,0 +1,35 @@
+package jobs
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// visibilityTimeout is how long a received message is hidden from other workers, which
+	// the worker handling it extends every heartbeat for as long as its archive is being built
+	visibilityTimeout = 5 * time.Minute
+	heartbeat         = time.Minute
+)
+
+// Job asks for the archive of an asynchronous zip request to be built
+type Job struct {
+	Ref string `json:"ref"`
+}
+
+// Message is a Job received from a Queue, which is deleted once it has been handled
+type Message struct {
+	Job     Job
+	receipt string
+}
+
+// Queue passes jobs from the API to the workers which build archives. MemoryQueue runs
+// in-process for local development, while SQSQueue shares jobs between instances.
+type Queue interface {
+	Send(ctx context.Context, job Job) error
+	// Receive waits for the next job, returning nil if none arrives before the queue stops waiting
+	Receive(ctx context.Context) (*Message, error)
+	Delete(ctx context.Context, msg *Message) error
+	// Extend keeps a message hidden from other workers for another visibilityTimeout
+	Extend(ctx context.Context, msg *Message) error
+}
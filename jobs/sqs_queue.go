@@ -0,0 +1,88 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"time"
+)
+
+// allows us to mock sqs.Client in our tests
+type SQSClient interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+// SQSQueue passes jobs through an SQS queue. Messages are hidden from other workers while they
+// are being handled, and those which are received but never deleted, such as when a worker
+// stops part way through a build, are picked up again once their visibility timeout has passed.
+type SQSQueue struct {
+	client SQSClient
+	url    string
+}
+
+func NewSQSQueue(cfg *aws.Config, url string) *SQSQueue {
+	return &SQSQueue{
+		client: sqs.NewFromConfig(*cfg),
+		url:    url,
+	}
+}
+
+func (q *SQSQueue) Send(ctx context.Context, job Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.url),
+		MessageBody: aws.String(string(body)),
+	})
+
+	return err
+}
+
+func (q *SQSQueue) Receive(ctx context.Context) (*Message, error) {
+	out, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.url),
+		MaxNumberOfMessages: 1,
+		WaitTimeSeconds:     20,
+		VisibilityTimeout:   int32(visibilityTimeout / time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out.Messages) == 0 {
+		return nil, nil
+	}
+
+	msg := &Message{receipt: aws.ToString(out.Messages[0].ReceiptHandle)}
+	if err := json.Unmarshal([]byte(aws.ToString(out.Messages[0].Body)), &msg.Job); err != nil {
+		return msg, err
+	}
+
+	return msg, nil
+}
+
+func (q *SQSQueue) Delete(ctx context.Context, msg *Message) error {
+	_, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.url),
+		ReceiptHandle: aws.String(msg.receipt),
+	})
+
+	return err
+}
+
+func (q *SQSQueue) Extend(ctx context.Context, msg *Message) error {
+	_, err := q.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.url),
+		ReceiptHandle:     aws.String(msg.receipt),
+		VisibilityTimeout: int32(visibilityTimeout / time.Second),
+	})
+
+	return err
+}
@@ -0,0 +1,135 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockSQSClient struct {
+	mock.Mock
+}
+
+func (m *MockSQSClient) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	args := m.Called(params)
+	return args.Get(0).(*sqs.SendMessageOutput), args.Error(1)
+}
+
+func (m *MockSQSClient) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	args := m.Called(params)
+	return args.Get(0).(*sqs.ReceiveMessageOutput), args.Error(1)
+}
+
+func (m *MockSQSClient) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	args := m.Called(params)
+	return args.Get(0).(*sqs.DeleteMessageOutput), args.Error(1)
+}
+
+func (m *MockSQSClient) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	args := m.Called(params)
+	return args.Get(0).(*sqs.ChangeMessageVisibilityOutput), args.Error(1)
+}
+
+func TestNewSQSQueue(t *testing.T) {
+	q := NewSQSQueue(aws.NewConfig(), "queue-url")
+	assert.IsType(t, new(sqs.Client), q.client)
+	assert.Equal(t, "queue-url", q.url)
+}
+
+func TestSQSQueue_Send(t *testing.T) {
+	mc := new(MockSQSClient)
+	q := SQSQueue{client: mc, url: "queue-url"}
+
+	mc.On("SendMessage", &sqs.SendMessageInput{
+		QueueUrl:    aws.String("queue-url"),
+		MessageBody: aws.String(`{"ref":"test"}`),
+	}).Return(new(sqs.SendMessageOutput), nil).Once()
+
+	assert.Nil(t, q.Send(t.Context(), Job{Ref: "test"}))
+	mc.AssertExpectations(t)
+}
+
+func TestSQSQueue_Receive(t *testing.T) {
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String("queue-url"),
+		MaxNumberOfMessages: 1,
+		WaitTimeSeconds:     20,
+		VisibilityTimeout:   300,
+	}
+
+	tests := []struct {
+		scenario string
+		out      *sqs.ReceiveMessageOutput
+		err      error
+		wantMsg  *Message
+		wantErr  error
+	}{
+		{
+			"Message received",
+			&sqs.ReceiveMessageOutput{Messages: []types.Message{
+				{Body: aws.String(`{"ref":"test"}`), ReceiptHandle: aws.String("receipt")},
+			}},
+			nil,
+			&Message{Job: Job{Ref: "test"}, receipt: "receipt"},
+			nil,
+		},
+		{
+			"No messages before the wait time ended",
+			&sqs.ReceiveMessageOutput{},
+			nil,
+			nil,
+			nil,
+		},
+		{
+			"Error from SQS",
+			new(sqs.ReceiveMessageOutput),
+			errors.New("some SQS error"),
+			nil,
+			errors.New("some SQS error"),
+		},
+	}
+
+	for _, test := range tests {
+		mc := new(MockSQSClient)
+		q := SQSQueue{client: mc, url: "queue-url"}
+
+		mc.On("ReceiveMessage", input).Return(test.out, test.err).Once()
+
+		msg, err := q.Receive(t.Context())
+		assert.Equal(t, test.wantMsg, msg, test.scenario)
+		assert.Equal(t, test.wantErr, err, test.scenario)
+	}
+}
+
+func TestSQSQueue_Delete(t *testing.T) {
+	mc := new(MockSQSClient)
+	q := SQSQueue{client: mc, url: "queue-url"}
+
+	mc.On("DeleteMessage", &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String("queue-url"),
+		ReceiptHandle: aws.String("receipt"),
+	}).Return(new(sqs.DeleteMessageOutput), nil).Once()
+
+	assert.Nil(t, q.Delete(t.Context(), &Message{receipt: "receipt"}))
+	mc.AssertExpectations(t)
+}
+
+func TestSQSQueue_Extend(t *testing.T) {
+	mc := new(MockSQSClient)
+	q := SQSQueue{client: mc, url: "queue-url"}
+
+	mc.On("ChangeMessageVisibility", &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String("queue-url"),
+		ReceiptHandle:     aws.String("receipt"),
+		VisibilityTimeout: 300,
+	}).Return(new(sqs.ChangeMessageVisibilityOutput), nil).Once()
+
+	assert.Nil(t, q.Extend(t.Context(), &Message{receipt: "receipt"}))
+	mc.AssertExpectations(t)
+}
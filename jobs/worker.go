@@ -0,0 +1,125 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// allows us to mock Builder in our tests
+type BuilderInterface interface {
+	Build(ctx context.Context, job Job) error
+}
+
+// Worker takes jobs from a Queue and builds their archives
+type Worker struct {
+	queue     Queue
+	builder   BuilderInterface
+	heartbeat time.Duration
+	logger    *slog.Logger
+}
+
+func NewWorker(logger *slog.Logger, queue Queue, builder BuilderInterface) *Worker {
+	return &Worker{
+		queue:     queue,
+		builder:   builder,
+		heartbeat: heartbeat,
+		logger:    logger,
+	}
+}
+
+// Run handles jobs with the given number of goroutines until ctx is cancelled
+func (w *Worker) Run(ctx context.Context, concurrency int) {
+	var wg sync.WaitGroup
+	for range max(concurrency, 1) {
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				w.next(ctx)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// next receives and handles a single job
+func (w *Worker) next(ctx context.Context) {
+	msg, err := w.queue.Receive(ctx)
+	if err != nil && ctx.Err() == nil {
+		w.logger.Error("Unable to receive job", slog.Any("err", err.Error()))
+
+		// a message which cannot be read will never succeed, so is dropped
+		if msg != nil {
+			w.delete(ctx, msg)
+			return
+		}
+
+		// back off rather than spinning while the queue is unavailable
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+		}
+		return
+	}
+	if msg == nil {
+		return
+	}
+
+	start := time.Now()
+	w.logger.Info("Building archive for reference", slog.Any("ref", msg.Job.Ref))
+
+	// keep the message from being received by another worker while it is built
+	built := make(chan struct{})
+	extended := make(chan struct{})
+	go func() {
+		defer close(extended)
+		w.extend(ctx, msg, built)
+	}()
+
+	err = w.builder.Build(ctx, msg.Job)
+	close(built)
+	<-extended
+
+	if errors.Is(err, ErrBuildInProgress) {
+		// the message is left to be received again, by when the other build will have ended
+		w.logger.Info("Archive is already being built for reference", slog.Any("ref", msg.Job.Ref))
+		return
+	}
+
+	if err != nil {
+		w.logger.Error("Unable to build archive for reference", slog.Any("err", err.Error()), slog.Any("ref", msg.Job.Ref))
+	} else {
+		w.logger.Info("Build took: " + time.Since(start).String())
+	}
+
+	// a build which was interrupted by shutting down is left on the queue to be tried again
+	if ctx.Err() == nil {
+		w.delete(ctx, msg)
+	}
+}
+
+// extend keeps a message hidden every heartbeat until built is closed
+func (w *Worker) extend(ctx context.Context, msg *Message, built <-chan struct{}) {
+	ticker := time.NewTicker(w.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.queue.Extend(ctx, msg); err != nil && ctx.Err() == nil {
+				w.logger.Error("Unable to extend job", slog.Any("err", err.Error()), slog.Any("ref", msg.Job.Ref))
+			}
+		case <-built:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Worker) delete(ctx context.Context, msg *Message) {
+	if err := w.queue.Delete(ctx, msg); err != nil {
+		w.logger.Error("Unable to delete job", slog.Any("err", err.Error()))
+	}
+}
@@ -0,0 +1,139 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWorker_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	q := NewMemoryQueue(2)
+	_ = q.Send(ctx, Job{Ref: "ref1"})
+	_ = q.Send(ctx, Job{Ref: "ref2"})
+
+	mb := new(MockBuilder)
+	mb.On("Build", Job{Ref: "ref1"}).Return(errors.New("some build error")).Once()
+	mb.On("Build", Job{Ref: "ref2"}).Return(nil).Run(func(args mock.Arguments) {
+		cancel()
+	}).Once()
+
+	w := NewWorker(slog.New(slog.NewJSONHandler(io.Discard, nil)), q, mb)
+	w.Run(ctx, 1)
+
+	mb.AssertExpectations(t)
+}
+
+// unreadableQueue returns a message which cannot be read
+type unreadableQueue struct {
+	deleted []*Message
+}
+
+func (q *unreadableQueue) Send(ctx context.Context, job Job) error {
+	return nil
+}
+
+func (q *unreadableQueue) Receive(ctx context.Context) (*Message, error) {
+	return &Message{receipt: "receipt"}, errors.New("invalid character")
+}
+
+func (q *unreadableQueue) Delete(ctx context.Context, msg *Message) error {
+	q.deleted = append(q.deleted, msg)
+	return nil
+}
+
+func (q *unreadableQueue) Extend(ctx context.Context, msg *Message) error {
+	return nil
+}
+
+func TestWorker_Next_UnreadableMessage(t *testing.T) {
+	q := new(unreadableQueue)
+	mb := new(MockBuilder)
+
+	w := NewWorker(slog.New(slog.NewJSONHandler(io.Discard, nil)), q, mb)
+	w.next(t.Context())
+
+	assert.Equal(t, []*Message{{receipt: "receipt"}}, q.deleted)
+	mb.AssertNotCalled(t, "Build", mock.Anything)
+}
+
+// recordingQueue returns a single message, recording what happens to it
+type recordingQueue struct {
+	mu       sync.Mutex
+	msg      *Message
+	deleted  int
+	extended int
+}
+
+func (q *recordingQueue) Send(ctx context.Context, job Job) error {
+	return nil
+}
+
+func (q *recordingQueue) Receive(ctx context.Context) (*Message, error) {
+	return q.msg, nil
+}
+
+func (q *recordingQueue) Delete(ctx context.Context, msg *Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deleted++
+	return nil
+}
+
+func (q *recordingQueue) Extend(ctx context.Context, msg *Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.extended++
+	return nil
+}
+
+func TestWorker_Next(t *testing.T) {
+	tests := []struct {
+		scenario    string
+		buildErr    error
+		wantDeleted int
+	}{
+		{
+			"Archive built",
+			nil,
+			1,
+		},
+		{
+			"Archive could not be built",
+			errors.New("some build error"),
+			1,
+		},
+		{
+			"Archive is being built by another worker",
+			ErrBuildInProgress,
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		q := &recordingQueue{msg: &Message{Job: Job{Ref: "test"}, receipt: "receipt"}}
+
+		// the build runs for long enough for the message to be extended
+		mb := new(MockBuilder)
+		mb.On("Build", Job{Ref: "test"}).Run(func(args mock.Arguments) {
+			time.Sleep(50 * time.Millisecond)
+		}).Return(test.buildErr).Once()
+
+		w := NewWorker(slog.New(slog.NewJSONHandler(io.Discard, nil)), q, mb)
+		w.heartbeat = 10 * time.Millisecond
+		w.next(t.Context())
+
+		assert.Equal(t, test.wantDeleted, q.deleted, test.scenario)
+		assert.GreaterOrEqual(t, q.extended, 1, test.scenario)
+		mb.AssertExpectations(t)
+	}
+}
@@ -10,6 +10,10 @@
 //	      type: apiKey
 //	      name: Authorization
 //	      in: header
+//	    ApiKey:
+//	      type: apiKey
+//	      name: X-API-Key
+//	      in: header
 //
 //	  Consumes:
 //		  - application/json
@@ -22,16 +26,24 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log"
 	"log/slog"
 	"net/http"
+	"opg-file-service/authz"
 	"opg-file-service/cache"
 	"opg-file-service/dynamo"
 	"opg-file-service/handlers"
 	"opg-file-service/internal"
+	"opg-file-service/jobs"
 	"opg-file-service/middleware"
+	"opg-file-service/tlsconfig"
+	"opg-file-service/webhook"
+	"opg-file-service/zipper"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -48,7 +60,11 @@ func main() {
 	ctx := context.Background()
 	logger := telemetry.NewLogger("opg-file-service")
 
-	internal.RunHealthcheck("http://localhost:8000" + os.Getenv("PATH_PREFIX") + "/health-check")
+	scheme := "http"
+	if os.Getenv("TLS_CERT_FILE") != "" {
+		scheme = "https"
+	}
+	internal.RunHealthcheck(scheme + "://localhost:8000" + os.Getenv("PATH_PREFIX") + "/health-check")
 
 	if err := run(ctx, logger); err != nil {
 		logger.Error("fatal startup error", slog.Any("err", err.Error()))
@@ -86,77 +102,417 @@ func run(ctx context.Context, logger *slog.Logger) error {
 		return err
 	}
 
-	repository := dynamo.NewRepository(cfg, logger)
+	repository, err := newRepository(cfg, logger)
+	if err != nil {
+		return err
+	}
+	if c, ok := repository.(io.Closer); ok {
+		defer func() {
+			_ = c.Close()
+		}()
+	}
+
+	secretsCache, err := newSecretsCache(cfg)
+	if err != nil {
+		return err
+	}
+
+	// tokens signed with asymmetric keys are only accepted when there is a JWKS to verify them with
+	var jwks *middleware.JWKS
+	if jwksUrl := internal.GetEnvVar("JWT_JWKS_URL", ""); jwksUrl != "" {
+		jwks, err = middleware.NewJWKS(logger, jwksUrl, time.Duration(internal.GetEnvInt("JWT_JWKS_REFRESH", 3600))*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+
+	// users authenticate with a JWT, and batch clients with an API key
+	jwt := middleware.JwtVerify(logger, secretsCache, jwks, middleware.NewJwtPolicy())
+	auth := middleware.CertificateVerify(logger, middleware.ApiKeyVerify(logger, secretsCache, jwt))
+	signedLink := middleware.SignedLinkVerify(logger, secretsCache, auth)
+
+	// users can bundle any file unless there is a policy of what their roles and scopes allow
+	var policy *authz.Policy
+	if policyFile := internal.GetEnvVar("AUTHZ_POLICY_FILE", ""); policyFile != "" {
+		policy, err = authz.LoadPolicy(policyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	notifier := webhook.NewNotifier(logger, secretsCache)
+	signer := zipper.NewManifestSigner(secretsCache)
+	keys := zipper.NewSecretCustomerKeys(secretsCache)
+	passwords := zipper.NewSecretPasswords(secretsCache)
 
-	secretsCache := cache.New(cfg)
-	jwt := middleware.JwtVerify(logger, secretsCache)
+	// cancelled on shutdown to stop the workers building asynchronous zip requests
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+
+	// asynchronous zip requests are only enabled when there is a bucket to build archives into
+	var queue jobs.Queue
+	asyncBucket := os.Getenv("ZIP_ASYNC_BUCKET")
+	if asyncBucket != "" {
+		if queueUrl, ok := os.LookupEnv("JOB_QUEUE_URL"); ok {
+			queue = jobs.NewSQSQueue(cfg, queueUrl)
+		} else {
+			queue = jobs.NewMemoryQueue(100)
+		}
+
+		builder := jobs.NewBuilder(logger, cfg, repository, asyncBucket, notifier, signer, keys, passwords)
+		go jobs.NewWorker(logger, queue, builder).Run(workerCtx, internal.GetEnvInt("ZIP_WORKER_CONCURRENCY", 2))
+	}
 
 	// swagger:operation POST /zip/request zip request
 	// Makes a request for a set of files to be downloaded from S3
 	// ---
 	// security:
 	//  - Bearer: []
+	//  - ApiKey: []
 	// parameters:
 	// - name: files
 	//   in: body
 	//   description: s3 file paths alongside the human readable filenames as each file will be displayed in the zip file
 	//   required: true
 	//   schema:
-	//       type: array
-	//       items:
-	//           type: object
-	//           properties:
-	//              s3path:
-	//                  type: string
-	//              filename:
-	//                  type: string
-	//              folder:
-	//                  type: string
+	//       type: object
+	//       properties:
+	//          files:
+	//              type: array
+	//              items:
+	//                  type: object
+	//                  properties:
+	//                     s3path:
+	//                         type: string
+	//                         description: S3 path of the file, or a file:// path or https:// URL from another source
+	//                     filename:
+	//                         type: string
+	//                     folder:
+	//                         type: string
+	//                     versionId:
+	//                         type: string
+	//                         description: Version of the object to fetch, rather than the latest
+	//                     etag:
+	//                         type: string
+	//                         description: Fail the file if the object no longer has this ETag
+	//                     sseCustomerKeyRef:
+	//                         type: string
+	//                         description: Name of the secret holding the SSE-C key the object is encrypted with
+	//          format:
+	//              type: string
+	//              description: Archive format to download the files as, overriding the Accept header of the download request
+	//              enum: [zip, tar, tar.gz, tar.zst]
+	//          failurePolicy:
+	//              type: string
+	//              description: Whether to abort the download when a file cannot be fetched, or skip it and list it in an _errors.txt file inside the archive
+	//              enum: [abort, skip]
+	//          store:
+	//              type: boolean
+	//              description: Store files uncompressed so that the download is sent with a Content-Length and can be resumed with a Range request. Only applies to zip downloads, and cannot be used with the skip failure policy
+	//          async:
+	//              type: boolean
+	//              description: Build the archive in the background and upload it to S3, rather than streaming it from the download request
+	//          callbackUrl:
+	//              type: string
+	//              description: https URL on an allowed host which is sent a signed notification when the download completes or fails
+	//          manifest:
+	//              type: boolean
+	//              description: End the archive with a MANIFEST.json listing the SHA-256 of each file, and its Ed25519 signature in MANIFEST.json.sig. Cannot be used with store
+	//          ttlSeconds:
+	//              type: integer
+	//              description: Seconds the zip request is kept for, up to ZIP_MAX_TTL. Defaults to 5 minutes, or ZIP_ASYNC_TTL for asynchronous zip requests
+	//          maxDownloads:
+	//              type: integer
+	//              description: Number of times the archive can be downloaded before the link stops working, defaulting to once. Cannot be used with async
+	//          signedLink:
+	//              type: boolean
+	//              description: Also return a link signed so that it can be downloaded without a JWT token, for up to ZIP_LINK_TTL seconds. Cannot be used with async
+	//          encryption:
+	//              type: object
+	//              description: Encrypt the files of a zip with WinZip AES-256. Only applies to zip downloads, and cannot be used with store
+	//              properties:
+	//                 method:
+	//                     type: string
+	//                     enum: [aes256]
+	//                 password:
+	//                     type: string
+	//                     description: At least 12 characters, or left out to have a password generated and returned in the response
+	// - name: Idempotency-Key
+	//   in: header
+	//   description: Key of up to 255 characters which makes retrying the request safe. A retry with the same key and body is given the response to the first request while its zip request has not expired
+	//   type: string
 	// responses:
 	//   '201':
-	//     description: Zip request created
+	//     description: Zip request created, or the one made by an earlier request with the same Idempotency-Key, when the response has an Idempotent-Replayed header
 	//     schema:
 	//       type: object
 	//       properties:
 	//         link:
 	//           type: string
-	//           description: Link to download the zip file
+	//           description: Link to download the zip file, or to the status of an asynchronous zip request
+	//         signedLink:
+	//           type: string
+	//           description: Link to download the zip file without a JWT token until it expires, only given when signedLink was requested
+	//         password:
+	//           type: string
+	//           description: Password generated to encrypt the zip, only given when one was not sent with the request
 	//   '403':
-	//     description: Access denied
+	//     description: Access denied to the listed files by the roles and scopes of the JWT token
 	//   '401':
 	//     description: Missing, invalid or expired JWT token
+	//   '429':
+	//     description: Too many requests from the API client
 	//   '400':
 	//     description: Invalid JSON request
+	//   '409':
+	//     description: Idempotency-Key has been used for a different request, or by a request which is still in progress
 	//   '500':
 	//     description: Unexpected error occurred
-	mux.Handle("POST /zip/request", jwt(handlers.NewZipRequestHandler(logger, repository)))
+	mux.Handle("POST /zip/request", auth(handlers.NewZipRequestHandler(logger, repository, queue, notifier, policy, middleware.NewLinkSigner(secretsCache), passwords)))
 
 	// swagger:operation GET /zip/{reference} zip download
 	// Download Zip file from zip request reference
 	// ---
 	// produces:
 	//   - application/zip
+	//   - application/x-tar
+	//   - application/gzip
+	//   - application/zstd
 	//   - application/json
 	// security:
 	//  - Bearer: []
+	//  - ApiKey: []
 	// parameters:
 	// - name: reference
 	//   in: path
 	//   description: reference of the zip file request
 	//   required: true
+	// - name: Accept
+	//   in: header
+	//   description: media type of the archive format to download, used when no format was given in the zip request
+	//   type: string
+	// - name: Range
+	//   in: header
+	//   description: single range of bytes of the download to send, to resume a stored zip download
+	//   type: string
+	// - name: If-Range
+	//   in: header
+	//   description: ETag of the stored zip download being resumed, so that the whole download is sent again if it has changed
+	//   type: string
+	// - name: signature
+	//   in: query
+	//   description: signature of a signed link, which is downloaded without a JWT token along with the rest of its query
+	//   type: string
 	//
 	// responses:
 	//   '200':
 	//     description: Zip file download
+	//   '206':
+	//     description: Range of a stored zip file download
+	//   '416':
+	//     description: Range is outside the stored zip file download
+	//   '409':
+	//     description: Zip request is built asynchronously, or is already being downloaded
+	//   '404':
+	//     description: File download request for ref not found, or already downloaded
+	//   '403':
+	//     description: Access denied, or to the listed files by the roles and scopes of the JWT token
+	//   '401':
+	//     description: Missing, invalid or expired JWT token or signed link
+	//   '429':
+	//     description: Too many requests from the API client
+	//   '500':
+	//     description: Unexpected error occurred
+	mux.Handle("GET /zip/{reference}", signedLink(handlers.NewZipHandler(logger, cfg, repository, notifier, signer, keys, passwords, policy)))
+
+	// swagger:operation GET /zip/requests zip list
+	// List the zip requests made by the authenticated user which have not expired
+	// ---
+	// security:
+	//  - Bearer: []
+	//  - ApiKey: []
+	// parameters:
+	// - name: limit
+	//   in: query
+	//   description: number of zip requests to list, from 1 to 100, defaulting to 20
+	//   type: integer
+	// - name: after
+	//   in: query
+	//   description: next from the previous page, to list the zip requests after it
+	//   type: string
+	//
+	// responses:
+	//   '200':
+	//     description: Page of zip requests, which may be shorter than the limit even when there are more
+	//     schema:
+	//       type: object
+	//       properties:
+	//         requests:
+	//           type: array
+	//           items:
+	//             type: object
+	//             properties:
+	//               reference:
+	//                 type: string
+	//               expires:
+	//                 type: string
+	//                 format: date-time
+	//               status:
+	//                 type: string
+	//                 enum: [downloading, consumed, pending, building, ready, failed]
+	//               async:
+	//                 type: boolean
+	//               format:
+	//                 type: string
+	//               fileCount:
+	//                 type: integer
+	//               downloads:
+	//                 type: integer
+	//                 description: Number of downloads which reached the end of the archive
+	//               maxDownloads:
+	//                 type: integer
+	//               lastDownload:
+	//                 type: string
+	//                 format: date-time
+	//         next:
+	//           type: string
+	//           description: Passed as after to list the next page, left out once there are no more
+	//   '400':
+	//     description: Invalid limit
+	//   '401':
+	//     description: Missing, invalid or expired JWT token
+	//   '429':
+	//     description: Too many requests from the API client
+	//   '500':
+	//     description: Unexpected error occurred
+	mux.Handle("GET /zip/requests", auth(handlers.NewZipRequestsHandler(logger, repository)))
+
+	// swagger:operation GET /zip/{reference}/manifest zip manifest
+	// Describe a zip request and the files in it, without downloading any of them
+	// ---
+	// security:
+	//  - Bearer: []
+	//  - ApiKey: []
+	// parameters:
+	// - name: reference
+	//   in: path
+	//   description: reference of the zip file request
+	//   required: true
+	//
+	// responses:
+	//   '200':
+	//     description: Zip request and its files
+	//     schema:
+	//       type: object
+	//       properties:
+	//         reference:
+	//           type: string
+	//         expires:
+	//           type: string
+	//           format: date-time
+	//         status:
+	//           type: string
+	//           enum: [downloading, consumed, pending, building, ready, failed]
+	//         async:
+	//           type: boolean
+	//         format:
+	//           type: string
+	//         fileCount:
+	//           type: integer
+	//         downloads:
+	//           type: integer
+	//           description: Number of downloads which reached the end of the archive
+	//         maxDownloads:
+	//           type: integer
+	//         lastDownload:
+	//           type: string
+	//           format: date-time
+	//         files:
+	//           type: array
+	//           items:
+	//             type: object
+	//             properties:
+	//               path:
+	//                 type: string
+	//                 description: Where the file is put in the archive
+	//               s3path:
+	//                 type: string
+	//               versionId:
+	//                 type: string
+	//   '404':
+	//     description: File download request for ref not found
+	//   '403':
+	//     description: Access denied
+	//   '401':
+	//     description: Missing, invalid or expired JWT token
+	//   '429':
+	//     description: Too many requests from the API client
+	mux.Handle("GET /zip/{reference}/manifest", auth(handlers.NewZipManifestHandler(logger, repository)))
+
+	// swagger:operation DELETE /zip/{reference} zip cancel
+	// Cancel a zip request, so that it can no longer be downloaded, deleting the archive of an asynchronous one
+	// ---
+	// security:
+	//  - Bearer: []
+	//  - ApiKey: []
+	// parameters:
+	// - name: reference
+	//   in: path
+	//   description: reference of the zip file request
+	//   required: true
+	//
+	// responses:
+	//   '204':
+	//     description: Zip request cancelled
 	//   '404':
 	//     description: File download request for ref not found
 	//   '403':
 	//     description: Access denied
 	//   '401':
 	//     description: Missing, invalid or expired JWT token
+	//   '429':
+	//     description: Too many requests from the API client
 	//   '500':
 	//     description: Unexpected error occurred
-	mux.Handle("GET /zip/{reference}", jwt(handlers.NewZipHandler(logger, cfg, repository)))
+	mux.Handle("DELETE /zip/{reference}", auth(handlers.NewZipCancelHandler(logger, cfg, repository, asyncBucket)))
+
+	if queue != nil {
+		// swagger:operation GET /zip/{reference}/status zip status
+		// Check the status of an asynchronous zip request, and get a link to download its archive once it is ready
+		// ---
+		// security:
+		//  - Bearer: []
+		//  - ApiKey: []
+		// parameters:
+		// - name: reference
+		//   in: path
+		//   description: reference of the zip file request
+		//   required: true
+		//
+		// responses:
+		//   '200':
+		//     description: Status of the zip request
+		//     schema:
+		//       type: object
+		//       properties:
+		//         status:
+		//           type: string
+		//           enum: [pending, building, ready, failed]
+		//         link:
+		//           type: string
+		//           description: Presigned link to download the archive from S3, given once it is ready
+		//   '404':
+		//     description: Asynchronous zip request for ref not found
+		//   '403':
+		//     description: Access denied, or to the listed files by the roles and scopes of the JWT token
+		//   '401':
+		//     description: Missing, invalid or expired JWT token
+		//   '429':
+		//     description: Too many requests from the API client
+		//   '500':
+		//     description: Unexpected error occurred
+		mux.Handle("GET /zip/{reference}/status", auth(handlers.NewZipStatusHandler(logger, cfg, repository, asyncBucket, policy)))
+	}
 
 	stdLogger := log.New(os.Stdout, "opg-file-service", log.LstdFlags)
 
@@ -173,10 +529,24 @@ func run(ctx context.Context, logger *slog.Logger) error {
 		WriteTimeout: 15 * time.Minute,  // max time to write response to the client
 	}
 
+	// TLS is terminated by the load balancer, unless the service is given a certificate to serve
+	if certFile := internal.GetEnvVar("TLS_CERT_FILE", ""); certFile != "" {
+		s.TLSConfig, err = tlsconfig.New(logger, certFile, internal.GetEnvVar("TLS_KEY_FILE", ""), internal.GetEnvVar("TLS_CLIENT_CA_FILE", ""))
+		if err != nil {
+			return err
+		}
+	}
+
 	// start the server
 	go func() {
-		err := s.ListenAndServe()
-		if err != nil {
+		var err error
+		if s.TLSConfig != nil {
+			err = s.ListenAndServeTLS("", "")
+		} else {
+			err = s.ListenAndServe()
+		}
+		// the server is closed when shutting down, which is not a failure to serve
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Error("listen and serve error", slog.Any("err", err.Error()))
 			os.Exit(1)
 		}
@@ -189,10 +559,71 @@ func run(ctx context.Context, logger *slog.Logger) error {
 	sig := <-c
 	logger.Info("signal received: ", "sig", sig)
 
+	stopWorkers()
+
 	tc, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	return s.Shutdown(tc)
+	err = s.Shutdown(tc)
+
+	// give notifications for downloads which have just finished a chance to be delivered,
+	// for no longer than the rest of the shutdown timeout
+	delivered := make(chan struct{})
+	go func() {
+		notifier.Wait()
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+	case <-tc.Done():
+		logger.Error("notifications not delivered before shutting down")
+	}
+
+	return err
+}
+
+// newRepository returns where zip requests are kept, which is DynamoDB unless another
+// backend is chosen with REPOSITORY_BACKEND, such as for running the service locally
+func newRepository(cfg *aws.Config, logger *slog.Logger) (dynamo.RepositoryInterface, error) {
+	switch backend := internal.GetEnvVar("REPOSITORY_BACKEND", "dynamodb"); backend {
+	case "dynamodb":
+		return dynamo.NewRepository(cfg, logger), nil
+	case "memory":
+		return dynamo.NewMemoryRepository(), nil
+	case "bolt":
+		return dynamo.NewBoltRepository(internal.GetEnvVar("REPOSITORY_PATH", "zip-requests.db"))
+	default:
+		return nil, errors.New("unknown repository backend: " + backend)
+	}
+}
+
+// newSecretsCache fetches secrets from each of the SECRET_PROVIDERS in turn, so that secrets
+// can be read from the environment or files, such as when running without localstack
+func newSecretsCache(cfg *aws.Config) (*cache.SecretsCache, error) {
+	var providers []cache.SecretProvider
+	for _, name := range strings.Split(internal.GetEnvVar("SECRET_PROVIDERS", "aws"), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "aws":
+			provider, err := cache.NewAwsProvider(cfg, time.Duration(internal.GetEnvInt("SECRET_ROTATION_WINDOW", 86400))*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, provider)
+		case "env":
+			providers = append(providers, cache.NewEnvProvider())
+		case "file":
+			provider, err := cache.NewFileProvider(internal.GetEnvVar("SECRETS_DIR", "/run/secrets"))
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, provider)
+		default:
+			return nil, errors.New("unknown secret provider: " + name)
+		}
+	}
+
+	return cache.New(providers...), nil
 }
 
 func awsConfig(ctx context.Context) (*aws.Config, error) {
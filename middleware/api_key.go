@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"opg-file-service/authz"
+	"opg-file-service/internal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client holds the ApiClient which made a request, when it was made with an API key
+type Client struct{}
+
+// clientPrefix starts the identity of a caller authenticated with an API key
+const clientPrefix = "client:"
+
+// ApiClient is a service, such as a batch job, which calls the service with an API key rather
+// than a user's token. Its zip requests are made as "client:" followed by its name, in place of
+// a user's hash, so that only it can download them.
+type ApiClient struct {
+	Name   string
+	Policy *authz.Policy // the files the client can bundle, in place of the policy for users
+}
+
+// apiClientConfig is a client in the api-clients secret, which is a JSON object of them by name
+type apiClientConfig struct {
+	KeyHash   string   `json:"keyHash"`   // hex encoded SHA-256 of the client's key, in either case
+	Allow     []string `json:"allow"`     // locations the client can bundle files from
+	RateLimit int      `json:"rateLimit"` // requests the client can make a minute, or 0 for no limit
+}
+
+// ApiKeyVerify accepts requests with the X-API-Key of a client in the api-clients secret, and
+// passes any other request on to verify, such as JwtVerify
+func ApiKeyVerify(logger *slog.Logger, secretsCache cacheable, verify func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+	limiter := newRateLimiter(time.Now)
+
+	return func(next http.Handler) http.Handler {
+		verified := verify(next)
+
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("X-API-Key")
+			if key == "" {
+				verified.ServeHTTP(rw, r)
+				return
+			}
+
+			clients, err := apiClients(secretsCache)
+			if err != nil {
+				logger.Error("Error in fetching API clients from cache:", slog.Any("err", err.Error()))
+				internal.WriteJSONError(rw, "missing_api_clients", err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			name, ok := findApiClient(clients, key)
+			if !ok {
+				internal.WriteJSONError(rw, "error_with_api_key", "Invalid API key.", http.StatusUnauthorized)
+				return
+			}
+
+			if wait := limiter.take(name, clients[name].RateLimit); wait > 0 {
+				logger.Info("Rate limit reached for API client " + name)
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				internal.WriteJSONError(rw, "rate_limited", "Too many requests for this API client.", http.StatusTooManyRequests)
+				return
+			}
+
+			policy, err := authz.NewPolicy(authz.Rule{Allow: clients[name].Allow})
+			if err != nil {
+				logger.Error("Invalid locations for API client "+name, slog.Any("err", err.Error()))
+				internal.WriteJSONError(rw, "missing_api_clients", err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			logger.Info("API key is valid for client " + name)
+
+			ctx := context.WithValue(r.Context(), HashedEmail{}, clientPrefix+name)
+			ctx = context.WithValue(ctx, Client{}, &ApiClient{Name: name, Policy: policy})
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+func apiClients(secretsCache cacheable) (map[string]apiClientConfig, error) {
+	secret, err := secretsCache.GetSecretString("api-clients")
+	if err != nil {
+		return nil, err
+	}
+
+	var clients map[string]apiClientConfig
+	if err := json.Unmarshal([]byte(secret), &clients); err != nil {
+		return nil, errors.New("api-clients must be a JSON object of clients by name")
+	}
+
+	// hashes are compared with the lowercase hex of the key's hash
+	for name, client := range clients {
+		client.KeyHash = strings.ToLower(client.KeyHash)
+		clients[name] = client
+	}
+
+	return clients, nil
+}
+
+// findApiClient returns the name of the client whose key hashes to the hash of key. Every client
+// is checked, and in constant time, so that how long it takes gives nothing away about the keys.
+func findApiClient(clients map[string]apiClientConfig, key string) (string, bool) {
+	sum := sha256.Sum256([]byte(key))
+	hash := []byte(hex.EncodeToString(sum[:]))
+
+	var found string
+	for _, name := range slices.Sorted(maps.Keys(clients)) {
+		if subtle.ConstantTimeCompare(hash, []byte(clients[name].KeyHash)) == 1 {
+			found = name
+		}
+	}
+
+	return found, found != ""
+}
+
+// rateLimiter limits each API client to a number of requests a minute, which it can use in a
+// burst. Requests are only counted by the instance of the service they reach, so across a number
+// of instances a client can make up to that many times its limit.
+type rateLimiter struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(now func() time.Time) *rateLimiter {
+	return &rateLimiter{now: now, buckets: map[string]*tokenBucket{}}
+}
+
+// take uses up one of a client's requests, or returns how long it has to wait for one when it
+// has none left
+func (l *rateLimiter) take(name string, perMinute int) time.Duration {
+	if perMinute <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	limit := float64(perMinute)
+	perSecond := limit / time.Minute.Seconds()
+
+	b, ok := l.buckets[name]
+	if !ok {
+		b = &tokenBucket{tokens: limit, updated: now}
+		l.buckets[name] = b
+	}
+
+	b.tokens = min(limit, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+
+	b.tokens--
+	return 0
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"opg-file-service/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// unauthenticated lets requests without an API key through, in place of JwtVerify
+func unauthenticated(next http.Handler) http.Handler {
+	return next
+}
+
+func TestApiKeyVerify(t *testing.T) {
+	clients := `{
+		"nightly-batch": {"keyHash": "` + keyHash("nightly-key") + `", "allow": ["s3://opg-documents/batch"], "rateLimit": 2},
+		"reports": {"keyHash": "` + keyHash("reports-key") + `"},
+		"misconfigured": {"keyHash": "` + keyHash("misconfigured-key") + `", "allow": ["opg-documents"]},
+		"uppercase": {"keyHash": "` + strings.ToUpper(keyHash("uppercase-key")) + `"}
+	}`
+
+	tests := []struct {
+		scenario     string
+		key          string
+		secret       mockValue
+		expectedCode int
+		expectedBody string
+		expectedHash string
+	}{
+		{"Valid API key", "nightly-key", mockValue{clients, nil}, 200, "", "client:nightly-batch"},
+		{"Valid API key for a client without a rate limit", "reports-key", mockValue{clients, nil}, 200, "", "client:reports"},
+		{"Valid API key for a client whose hash is in uppercase", "uppercase-key", mockValue{clients, nil}, 200, "", "client:uppercase"},
+		{"Request without an API key is passed on", "", mockValue{clients, nil}, 418, "", ""},
+		{"Invalid API key", "other-key", mockValue{clients, nil}, 401, "Invalid API key.", ""},
+		{"API key of a client with invalid locations", "misconfigured-key", mockValue{clients, nil}, 500, "invalid location in policy: opg-documents", ""},
+		{"Cannot fetch API clients", "nightly-key", mockValue{"", errors.New("Missing secret")}, 500, "missing_api_clients", ""},
+		{"API clients are not JSON", "nightly-key", mockValue{"not JSON", nil}, 500, "api-clients must be a JSON object of clients by name", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			mockCache := new(mockSecretsCache)
+			mockCache.On("GetSecretString", "api-clients").Return(test.secret.v, test.secret.e)
+
+			// requests without an API key get a response from this in place of JwtVerify
+			teapot := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusTeapot)
+				})
+			}
+
+			var hashedEmail, client any
+			handler := ApiKeyVerify(slog.New(slog.NewTextHandler(io.Discard, nil)), mockCache, teapot)(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					hashedEmail = r.Context().Value(HashedEmail{})
+					client = r.Context().Value(Client{})
+				}),
+			)
+
+			req := httptest.NewRequest("GET", "/zip/requests", nil)
+			if test.key != "" {
+				req.Header.Set("X-API-Key", test.key)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			assert.Equal(t, test.expectedCode, rw.Code, test.scenario)
+			assert.Contains(t, rw.Body.String(), test.expectedBody, test.scenario)
+			if test.expectedCode == 200 {
+				assert.Equal(t, test.expectedHash, hashedEmail, test.scenario)
+				assert.IsType(t, new(ApiClient), client, test.scenario)
+			}
+		})
+	}
+}
+
+func TestApiKeyVerify_ClientPolicy(t *testing.T) {
+	mockCache := new(mockSecretsCache)
+	mockCache.On("GetSecretString", "api-clients").Return(`{
+		"nightly-batch": {"keyHash": "`+keyHash("nightly-key")+`", "allow": ["s3://opg-documents/batch"]},
+		"no-files": {"keyHash": "`+keyHash("no-files-key")+`"}
+	}`, nil)
+
+	var client *ApiClient
+	handler := ApiKeyVerify(slog.New(slog.NewTextHandler(io.Discard, nil)), mockCache, unauthenticated)
+
+	for _, key := range []string{"nightly-key", "no-files-key"} {
+		req := httptest.NewRequest("GET", "/zip/requests", nil)
+		req.Header.Set("X-API-Key", key)
+
+		handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client = r.Context().Value(Client{}).(*ApiClient)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+
+		files := []storage.File{{S3path: "s3://opg-documents/batch/1.pdf"}, {S3path: "s3://opg-documents/cases/1.pdf"}}
+
+		switch key {
+		case "nightly-key":
+			assert.Equal(t, "nightly-batch", client.Name)
+			assert.Equal(t, []string{"s3://opg-documents/cases/1.pdf"}, client.Policy.Denied(nil, nil, files))
+		default:
+			// a client without any locations cannot bundle any files
+			assert.Equal(t, "no-files", client.Name)
+			assert.Len(t, client.Policy.Denied(nil, nil, files), 2)
+		}
+	}
+}
+
+func TestApiKeyVerify_RateLimit(t *testing.T) {
+	mockCache := new(mockSecretsCache)
+	mockCache.On("GetSecretString", "api-clients").Return(`{
+		"nightly-batch": {"keyHash": "`+keyHash("nightly-key")+`", "rateLimit": 2},
+		"reports": {"keyHash": "`+keyHash("reports-key")+`", "rateLimit": 2}
+	}`, nil)
+
+	handler := ApiKeyVerify(slog.New(slog.NewTextHandler(io.Discard, nil)), mockCache, unauthenticated)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+
+	request := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/zip/requests", nil)
+		req.Header.Set("X-API-Key", key)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 200, request("nightly-key").Code)
+	assert.Equal(t, 200, request("nightly-key").Code)
+
+	rw := request("nightly-key")
+	assert.Equal(t, 429, rw.Code)
+	assert.Equal(t, "30", rw.Header().Get("Retry-After"))
+
+	// each client has its own limit
+	assert.Equal(t, 200, request("reports-key").Code)
+}
+
+func TestRateLimiter_Take(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(func() time.Time { return now })
+
+	// a client can use a minute's requests at once
+	for range 60 {
+		assert.Zero(t, l.take("client", 60))
+	}
+	assert.Equal(t, time.Second, l.take("client", 60))
+
+	// and gets them back at the rate it is limited to
+	now = now.Add(2500 * time.Millisecond)
+	assert.Zero(t, l.take("client", 60))
+	assert.Zero(t, l.take("client", 60))
+	assert.Equal(t, 500*time.Millisecond, l.take("client", 60))
+
+	// up to a minute's worth
+	now = now.Add(time.Hour)
+	for range 60 {
+		assert.Zero(t, l.take("client", 60))
+	}
+	assert.NotZero(t, l.take("client", 60))
+
+	// clients without a limit are never held up
+	for range 100 {
+		assert.Zero(t, l.take("unlimited", 0))
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+)
+
+// certificatePrefix starts the identity of a caller authenticated with a client certificate
+const certificatePrefix = "cert:"
+
+// CertificateVerify accepts requests over a connection with a verified client certificate, when
+// they have neither a token nor an API key, and passes any other request on to verify. The
+// caller is identified as "cert:" followed by the certificate's identity, in place of a user's
+// hash, so that only callers with a certificate for the same identity can download their zip
+// requests.
+func CertificateVerify(logger *slog.Logger, verify func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		verified := verify(next)
+
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			// a caller with a certificate can still make requests for a user with their token
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" {
+				verified.ServeHTTP(rw, r)
+				return
+			}
+
+			identity := certificateIdentity(r.TLS.VerifiedChains[0][0])
+			if identity == "" {
+				verified.ServeHTTP(rw, r)
+				return
+			}
+
+			logger.Info("Client certificate is valid for " + identity)
+
+			ctx := context.WithValue(r.Context(), HashedEmail{}, certificatePrefix+identity)
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// certificateIdentity is the first URI, DNS name or email address in a certificate's subject
+// alternative names, in that order, or its subject's common name when it has none
+func certificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	default:
+		return cert.Subject.CommonName
+	}
+}
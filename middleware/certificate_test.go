@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificateVerify(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "batch-client"}, DNSNames: []string{"batch.internal"}}
+
+	tests := []struct {
+		scenario     string
+		tls          *tls.ConnectionState
+		header       string
+		expectedCode int
+		expectedHash string
+	}{
+		{"Verified client certificate", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, "", 200, "cert:batch.internal"},
+		{"Request without TLS is passed on", nil, "", 418, ""},
+		{"Request without a client certificate is passed on", &tls.ConnectionState{}, "", 418, ""},
+		{"Request with a token is passed on", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, "Authorization", 418, ""},
+		{"Request with an API key is passed on", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, "X-API-Key", 418, ""},
+		{"Certificate without an identity is passed on", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}, "", 418, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			// requests without a client certificate get a response from this in place of JwtVerify
+			teapot := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusTeapot)
+				})
+			}
+
+			var hashedEmail any
+			handler := CertificateVerify(slog.New(slog.NewTextHandler(io.Discard, nil)), teapot)(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					hashedEmail = r.Context().Value(HashedEmail{})
+				}),
+			)
+
+			req := httptest.NewRequest("GET", "/zip/requests", nil)
+			req.TLS = test.tls
+			if test.header != "" {
+				req.Header.Set(test.header, "value")
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			assert.Equal(t, test.expectedCode, rw.Code, test.scenario)
+			if test.expectedCode == 200 {
+				assert.Equal(t, test.expectedHash, hashedEmail, test.scenario)
+			}
+		})
+	}
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://opg.internal/batch")
+
+	tests := []struct {
+		scenario string
+		cert     *x509.Certificate
+		expected string
+	}{
+		{"URI", &x509.Certificate{URIs: []*url.URL{spiffe}, DNSNames: []string{"batch.internal"}, Subject: pkix.Name{CommonName: "batch"}}, "spiffe://opg.internal/batch"},
+		{"DNS name", &x509.Certificate{DNSNames: []string{"batch.internal"}, EmailAddresses: []string{"batch@opg.internal"}}, "batch.internal"},
+		{"Email address", &x509.Certificate{EmailAddresses: []string{"batch@opg.internal"}, Subject: pkix.Name{CommonName: "batch"}}, "batch@opg.internal"},
+		{"Common name", &x509.Certificate{Subject: pkix.Name{CommonName: "batch"}}, "batch"},
+		{"No identity", &x509.Certificate{}, ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, certificateIdentity(test.cert), test.scenario)
+	}
+}
@@ -0,0 +1,281 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// a JWKS is read again for a token signed with a key it does not have, but no more often than this
+const jwksMinRefresh = time.Minute
+
+// JWKS is the set of public keys tokens can be signed with by an identity provider, read from
+// a JSON Web Key Set at an https URL or in a file. The set is read again once it is older than
+// the refresh interval, or when a token is signed with a key it does not have, so that the
+// identity provider can rotate its keys. While it is being read the keys it already has are
+// still used, and only tokens which none of them can verify wait for it.
+type JWKS struct {
+	fetch   func(ctx context.Context) ([]byte, error)
+	refresh time.Duration
+	logger  *slog.Logger
+	now     func() time.Time
+
+	mu      sync.Mutex
+	keys    []publicKey
+	checked time.Time     // when the set was last read, whether or not it could be
+	err     error         // why the set could not be read the last time, if it could not
+	loading chan struct{} // closed once the set being read has been, or nil when it is not being read
+}
+
+// publicKey is a key from a JWKS, along with the one signing method tokens signed with it can use
+type publicKey struct {
+	kid string
+	alg string
+	key any
+}
+
+// jwk is a JSON Web Key, of which only RSA, P-256 and Ed25519 signing keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewJWKS returns the JWKS at an https URL, or in a file when given a file:// URL
+func NewJWKS(logger *slog.Logger, rawUrl string, refresh time.Duration) (*JWKS, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &JWKS{refresh: refresh, logger: logger, now: time.Now}
+
+	switch u.Scheme {
+	case "https":
+		client := &http.Client{Timeout: 10 * time.Second}
+		s.fetch = func(ctx context.Context) ([]byte, error) {
+			return fetchJWKS(ctx, client, u.String())
+		}
+	case "file":
+		s.fetch = func(ctx context.Context) ([]byte, error) {
+			return os.ReadFile(u.Path)
+		}
+	default:
+		return nil, errors.New("JWKS must be an https or file URL: " + rawUrl)
+	}
+
+	return s, nil
+}
+
+// Keys returns the keys a token signed with alg can be verified with, which is the key named
+// by kid, or every key for alg when kid is blank
+func (s *JWKS) Keys(ctx context.Context, kid, alg string) ([]jwt.VerificationKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	since := s.now().Sub(s.checked)
+	if since >= s.refresh || kid != "" && !s.has(kid) && since >= min(s.refresh, jwksMinRefresh) {
+		s.load(ctx)
+	}
+
+	keys := s.find(kid, alg)
+
+	// a token none of the keys can verify waits for the set being read, in case it has its key
+	if len(keys) == 0 && s.loading != nil {
+		loading := s.loading
+		s.mu.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+		}
+		s.mu.Lock()
+
+		keys = s.find(kid, alg)
+	}
+
+	if len(keys) == 0 {
+		if s.err != nil {
+			return nil, keyError{"missing_jwks", s.err}
+		}
+		return nil, errors.New("no " + alg + " key in the JWKS with kid: " + kid)
+	}
+
+	return keys, nil
+}
+
+// find returns the keys a token signed with alg can be verified with
+func (s *JWKS) find(kid, alg string) []jwt.VerificationKey {
+	var keys []jwt.VerificationKey
+	for _, k := range s.keys {
+		if k.alg == alg && (kid == "" || k.kid == kid) {
+			keys = append(keys, k.key)
+		}
+	}
+	return keys
+}
+
+func (s *JWKS) has(kid string) bool {
+	for _, k := range s.keys {
+		if k.kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// load starts reading the set again, unless it is already being read, keeping the keys it had
+// if it cannot be read. The set is read without holding the lock, so that other requests can
+// carry on with the keys it has.
+func (s *JWKS) load(ctx context.Context) {
+	if s.loading != nil {
+		return
+	}
+
+	s.checked = s.now()
+	loading := make(chan struct{})
+	s.loading = loading
+
+	go func() {
+		// the set is shared by every request, so is not read for only as long as this one lasts
+		b, err := s.fetch(context.WithoutCancel(ctx))
+
+		var keys []publicKey
+		if err == nil {
+			keys, err = parseJWKS(b)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if err != nil {
+			s.logger.Error("Unable to read JWKS", slog.Any("err", err.Error()))
+			s.err = err
+		} else {
+			s.keys, s.err = keys, nil
+		}
+
+		s.loading = nil
+		close(loading)
+	}()
+}
+
+func fetchJWKS(ctx context.Context, client *http.Client, jwksUrl string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unable to fetch " + jwksUrl + ": " + resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+}
+
+// parseJWKS parses the signing keys of a JWKS, leaving out any it has of other kinds
+func parseJWKS(b []byte) ([]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []publicKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, alg, err := k.publicKey()
+		if err != nil || k.Alg != "" && k.Alg != alg {
+			continue
+		}
+
+		keys = append(keys, publicKey{kid: k.Kid, alg: alg, key: key})
+	}
+
+	return keys, nil
+}
+
+// publicKey returns the key, and the signing method it is used with
+func (k jwk) publicKey() (any, string, error) {
+	switch {
+	case k.Kty == "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, "", err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, "", err
+		}
+
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 || len(e) > 4 || key.E < 3 {
+			return nil, "", errors.New("unsupported RSA key: " + k.Kid)
+		}
+		return key, "RS256", nil
+
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, "", err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, "", errors.New("invalid P-256 key: " + k.Kid)
+		}
+
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, "", err
+		}
+		return key, "ES256", nil
+
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, "", errors.New("invalid Ed25519 key: " + k.Kid)
+		}
+		return ed25519.PublicKey(x), "EdDSA", nil
+
+	default:
+		return nil, "", errors.New("unsupported key type: " + k.Kty)
+	}
+}
@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// testJWK is the JSON Web Key of a public key, for writing a JWKS in tests
+func testJWK(kid string, key crypto.PublicKey) map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		b, _ := key.Bytes()
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(b[1:33]), "y": b64(b[33:])}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(key)}
+	default:
+		panic("unsupported key")
+	}
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	b, _ := json.Marshal(map[string]any{"keys": keys})
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewJWKS(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	_, err := NewJWKS(l, "https://idp.example/.well-known/jwks.json", time.Hour)
+	assert.Nil(t, err)
+
+	_, err = NewJWKS(l, "file:///etc/jwks.json", time.Hour)
+	assert.Nil(t, err)
+
+	_, err = NewJWKS(l, "http://idp.example/.well-known/jwks.json", time.Hour)
+	assert.EqualError(t, err, "JWKS must be an https or file URL: http://idp.example/.well-known/jwks.json")
+}
+
+func TestJWKS_Keys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	first, _, _ := ed25519.GenerateKey(rand.Reader)
+	second, _, _ := ed25519.GenerateKey(rand.Reader)
+	writeJWKS(t, path, testJWK("first", first))
+
+	now := time.Now()
+	s, _ := NewJWKS(slog.New(slog.NewTextHandler(io.Discard, nil)), "file://"+path, time.Hour)
+	s.now = func() time.Time { return now }
+
+	keys, err := s.Keys(t.Context(), "first", "EdDSA")
+	assert.Nil(t, err)
+	assert.Equal(t, []jwt.VerificationKey{first}, keys)
+
+	// the key is only for EdDSA
+	_, err = s.Keys(t.Context(), "first", "ES256")
+	assert.EqualError(t, err, "no ES256 key in the JWKS with kid: first")
+
+	// a new key is picked up for a token signed with it, but the set is not read again straight away
+	writeJWKS(t, path, testJWK("first", first), testJWK("second", second))
+	_, err = s.Keys(t.Context(), "second", "EdDSA")
+	assert.EqualError(t, err, "no EdDSA key in the JWKS with kid: second")
+
+	now = now.Add(jwksMinRefresh)
+	keys, err = s.Keys(t.Context(), "second", "EdDSA")
+	assert.Nil(t, err)
+	assert.Equal(t, []jwt.VerificationKey{second}, keys)
+
+	// tokens without a kid are checked against every key for their method
+	keys, err = s.Keys(t.Context(), "", "EdDSA")
+	assert.Nil(t, err)
+	assert.Equal(t, []jwt.VerificationKey{first, second}, keys)
+
+	// keys which have been removed are dropped once the set is refreshed
+	writeJWKS(t, path, testJWK("second", second))
+	_, err = s.Keys(t.Context(), "first", "EdDSA")
+	assert.Nil(t, err)
+
+	// the keys it has are still used while the set is being refreshed
+	now = now.Add(time.Hour)
+	_, err = s.Keys(t.Context(), "first", "EdDSA")
+	assert.Nil(t, err)
+
+	waitForJWKS(s)
+	_, err = s.Keys(t.Context(), "first", "EdDSA")
+	assert.EqualError(t, err, "no EdDSA key in the JWKS with kid: first")
+
+	// the keys are kept when the set cannot be read
+	_ = os.Remove(path)
+	now = now.Add(time.Hour)
+	keys, err = s.Keys(t.Context(), "second", "EdDSA")
+	assert.Nil(t, err)
+	assert.Equal(t, []jwt.VerificationKey{second}, keys)
+
+	_, err = s.Keys(t.Context(), "third", "EdDSA")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// waitForJWKS waits for the set to finish being read, if it is being read
+func waitForJWKS(s *JWKS) {
+	s.mu.Lock()
+	loading := s.loading
+	s.mu.Unlock()
+
+	if loading != nil {
+		<-loading
+	}
+}
+
+func TestJWKS_Keys_Loading(t *testing.T) {
+	first, _, _ := ed25519.GenerateKey(rand.Reader)
+	second, _, _ := ed25519.GenerateKey(rand.Reader)
+	b, _ := json.Marshal(map[string]any{"keys": []map[string]string{testJWK("first", first)}})
+	rotated, _ := json.Marshal(map[string]any{"keys": []map[string]string{testJWK("first", first), testJWK("second", second)}})
+
+	now := time.Now()
+	release := make(chan struct{})
+	fetches := 0
+	s := &JWKS{refresh: time.Hour, logger: slog.New(slog.NewTextHandler(io.Discard, nil)), now: func() time.Time { return now }}
+	s.fetch = func(ctx context.Context) ([]byte, error) {
+		fetches++
+		if fetches == 1 {
+			return b, nil
+		}
+		<-release
+		return rotated, nil
+	}
+
+	_, err := s.Keys(t.Context(), "first", "EdDSA")
+	assert.Nil(t, err)
+
+	// while the set is slow to be read again, tokens signed with a key it has are still verified
+	now = now.Add(time.Hour)
+	keys, err := s.Keys(t.Context(), "first", "EdDSA")
+	assert.Nil(t, err)
+	assert.Equal(t, []jwt.VerificationKey{first}, keys)
+
+	// a token signed with a key it does not have waits for it, for as long as its request lasts
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err = s.Keys(ctx, "second", "EdDSA")
+	assert.EqualError(t, err, "no EdDSA key in the JWKS with kid: second")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		keys, err := s.Keys(t.Context(), "second", "EdDSA")
+		assert.Nil(t, err)
+		assert.Equal(t, []jwt.VerificationKey{second}, keys)
+	}()
+
+	close(release)
+	<-done
+	assert.Equal(t, 2, fetches)
+}
+
+func TestFetchJWKS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/jwks.json" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, `{"keys":[]}`)
+	}))
+	defer ts.Close()
+
+	b, err := fetchJWKS(t.Context(), ts.Client(), ts.URL+"/.well-known/jwks.json")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"keys":[]}`, string(b))
+
+	_, err = fetchJWKS(t.Context(), ts.Client(), ts.URL+"/missing")
+	assert.EqualError(t, err, "unable to fetch "+ts.URL+"/missing: 404 Not Found")
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	smallRsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	encryption := testJWK("encryption", &rsaKey.PublicKey)
+	encryption["use"] = "enc"
+	wrongAlg := testJWK("wrong-alg", &rsaKey.PublicKey)
+	wrongAlg["alg"] = "RS512"
+	withAlg := testJWK("with-alg", edKey)
+	withAlg["alg"] = "EdDSA"
+	p384 := testJWK("p384", &ecKey.PublicKey)
+	p384["crv"] = "P-384"
+	offCurve := testJWK("off-curve", &ecKey.PublicKey)
+	offCurve["y"] = offCurve["x"]
+
+	b, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		testJWK("rsa", &rsaKey.PublicKey),
+		testJWK("ec", &ecKey.PublicKey),
+		testJWK("ed", edKey),
+		withAlg,
+		testJWK("small-rsa", &smallRsaKey.PublicKey),
+		encryption,
+		wrongAlg,
+		p384,
+		offCurve,
+		{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+	}})
+
+	keys, err := parseJWKS(b)
+	assert.Nil(t, err)
+	assert.Equal(t, []publicKey{
+		{kid: "rsa", alg: "RS256", key: &rsaKey.PublicKey},
+		{kid: "ec", alg: "ES256", key: &ecKey.PublicKey},
+		{kid: "ed", alg: "EdDSA", key: edKey},
+		{kid: "with-alg", alg: "EdDSA", key: edKey},
+	}, keys)
+
+	_, err = parseJWKS([]byte("not JSON"))
+	assert.NotNil(t, err)
+}
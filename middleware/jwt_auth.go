@@ -4,32 +4,184 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"log/slog"
+	"maps"
 	"net/http"
 	"opg-file-service/internal"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type HashedEmail struct{}
 
+// PreviousHashedEmail is the user's hash with the salt user-hash-salt was rotated from, so that
+// they can still reach the zip requests they made before it was rotated
+type PreviousHashedEmail struct{}
+
+// Roles and Scopes are the roles and scopes a token grants, which decide the files its user can bundle
+type Roles struct{}
+type Scopes struct{}
+
 type cacheable interface {
 	GetSecretString(key string) (string, error)
 }
 
-func JwtVerify(logger *slog.Logger, secretsCache cacheable) func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-			jwtSecret, jwtErr := secretsCache.GetSecretString("jwt-key")
+// rotatable is a secrets cache which keeps the previous version of a secret for a while after
+// it has been rotated
+type rotatable interface {
+	GetPreviousSecretString(key string) (string, error)
+}
 
-			if jwtErr != nil {
-				logger.Error("Error in fetching JWT secret from cache", slog.Any("err", jwtErr.Error()))
-				internal.WriteJSONError(rw, "missing_secret_key", jwtErr.Error(), http.StatusInternalServerError)
-				return
+// previousSecret returns the secret key was rotated from, or blank when there is none. It is
+// only ever used alongside the current secret, so failing to fetch it is not an error.
+func previousSecret(secretsCache cacheable, key string, current string) string {
+	c, ok := secretsCache.(rotatable)
+	if !ok {
+		return ""
+	}
+
+	previous, err := c.GetPreviousSecretString(key)
+	if err != nil || previous == current {
+		return ""
+	}
+	return previous
+}
+
+// keyError is a failure to fetch the keys tokens are verified with, rather than a problem with
+// the token itself
+type keyError struct {
+	field string
+	err   error
+}
+
+func (e keyError) Error() string {
+	return e.err.Error()
+}
+
+func (e keyError) Unwrap() error {
+	return e.err
+}
+
+// JwtPolicy is what a token has to claim to be accepted, besides being signed with a trusted key
+// and not having expired
+type JwtPolicy struct {
+	Issuer        string        // iss the token must have, or blank to accept any
+	Audiences     []string      // aud the token must include one of, or none to accept any
+	MaxAge        time.Duration // longest since the token was issued, which needs iat, or 0 for no limit
+	Leeway        time.Duration // clock skew allowed when checking exp, nbf and iat
+	IdentityClaim string        // claim identifying the user, which is hashed to tell who made a zip request
+	RolesClaim    string        // claim listing the user's roles
+	ScopesClaim   string        // claim listing the scopes the token was granted
+}
+
+func NewJwtPolicy() JwtPolicy {
+	var audiences []string
+	for _, aud := range strings.Split(internal.GetEnvVar("JWT_AUDIENCE", ""), ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			audiences = append(audiences, aud)
+		}
+	}
+
+	return JwtPolicy{
+		Issuer:        internal.GetEnvVar("JWT_ISSUER", ""),
+		Audiences:     audiences,
+		MaxAge:        time.Duration(internal.GetEnvInt("JWT_MAX_AGE", 0)) * time.Second,
+		Leeway:        time.Duration(internal.GetEnvInt("JWT_LEEWAY", 0)) * time.Second,
+		IdentityClaim: internal.GetEnvVar("JWT_IDENTITY_CLAIM", "session-data"),
+		RolesClaim:    internal.GetEnvVar("JWT_ROLES_CLAIM", "roles"),
+		ScopesClaim:   internal.GetEnvVar("JWT_SCOPES_CLAIM", "scope"),
+	}
+}
+
+// parserOptions are the options which make the parser check a token's claims against the policy,
+// apart from its age
+func (p JwtPolicy) parserOptions() []jwt.ParserOption {
+	options := []jwt.ParserOption{jwt.WithLeeway(p.Leeway)}
+
+	if p.Issuer != "" {
+		options = append(options, jwt.WithIssuer(p.Issuer))
+	}
+	if len(p.Audiences) > 0 {
+		options = append(options, jwt.WithAudience(p.Audiences...))
+	}
+	if p.MaxAge > 0 {
+		options = append(options, jwt.WithIssuedAt())
+	}
+
+	return options
+}
+
+// checkAge checks that a token was issued no longer ago than the policy's MaxAge
+func (p JwtPolicy) checkAge(claims jwt.MapClaims, now time.Time) error {
+	if p.MaxAge == 0 {
+		return nil
+	}
+
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return err
+	}
+	if iat == nil {
+		return errors.New("token is missing iat, which is needed to check its age")
+	}
+
+	if now.Sub(iat.Time) > p.MaxAge+p.Leeway {
+		return errors.New("token is older than " + p.MaxAge.String())
+	}
+
+	return nil
+}
+
+// identity returns the claim which identifies the user a token was issued to
+func (p JwtPolicy) identity(claims jwt.MapClaims) (string, error) {
+	name := p.IdentityClaim
+	if name == "" {
+		name = "session-data"
+	}
+
+	identity, ok := claims[name].(string)
+	if !ok || identity == "" {
+		return "", errors.New("token is missing the " + name + " claim")
+	}
+
+	return identity, nil
+}
+
+// list returns the values of a claim which is either an array of strings or a space separated
+// string, as the scope claim is in OAuth 2.0
+func list(claims jwt.MapClaims, name string) []string {
+	switch claim := claims[name].(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		var values []string
+		for _, v := range claim {
+			if v, ok := v.(string); ok && v != "" {
+				values = append(values, v)
 			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
 
+// JwtVerify accepts tokens signed with the HMAC secret in jwt-key, and with RS256, ES256 or
+// EdDSA keys from jwks when it is not nil, whose claims meet the policy
+func JwtVerify(logger *slog.Logger, secretsCache cacheable, jwks *JWKS, policy JwtPolicy) func(next http.Handler) http.Handler {
+	methods := []string{"HS256", "HS384", "HS512"}
+	if jwks != nil {
+		methods = append(methods, "RS256", "ES256", "EdDSA")
+	}
+	parser := jwt.NewParser(append(policy.parserOptions(), jwt.WithValidMethods(methods))...)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 			//Get the token from the header
 			header := r.Header.Get("Authorization")
 
@@ -39,15 +191,26 @@ func JwtVerify(logger *slog.Logger, secretsCache cacheable) func(next http.Handl
 				return
 			}
 
-			header = strings.Split(header, "Bearer ")[1]
+			header, _ = strings.CutPrefix(header, "Bearer ")
+
+			token, parseErr := parser.Parse(header, func(token *jwt.Token) (i interface{}, err error) {
+				kid, _ := token.Header["kid"].(string)
 
-			token, parseErr := jwt.Parse(header, func(token *jwt.Token) (i interface{}, err error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+				if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+					return hmacKeys(secretsCache, kid)
 				}
-				return []byte(jwtSecret), nil
+
+				keys, err := jwks.Keys(r.Context(), kid, token.Method.Alg())
+				return jwt.VerificationKeySet{Keys: keys}, err
 			})
 
+			var keyErr keyError
+			if errors.As(parseErr, &keyErr) {
+				logger.Error("Error in fetching keys to verify JWT with", slog.Any("err", keyErr.Error()))
+				internal.WriteJSONError(rw, keyErr.field, keyErr.Error(), http.StatusInternalServerError)
+				return
+			}
+
 			// Return the error
 			if parseErr != nil {
 				internal.WriteJSONError(rw, "error_with_token", parseErr.Error(), http.StatusUnauthorized)
@@ -56,7 +219,16 @@ func JwtVerify(logger *slog.Logger, secretsCache cacheable) func(next http.Handl
 
 			if token.Valid {
 				claims := token.Claims.(jwt.MapClaims)
-				e := claims["session-data"].(string)
+				if err := policy.checkAge(claims, time.Now()); err != nil {
+					internal.WriteJSONError(rw, "error_with_token", err.Error(), http.StatusUnauthorized)
+					return
+				}
+
+				e, err := policy.identity(claims)
+				if err != nil {
+					internal.WriteJSONError(rw, "error_with_token", err.Error(), http.StatusUnauthorized)
+					return
+				}
 				salt, saltErr := secretsCache.GetSecretString("user-hash-salt")
 				if saltErr != nil {
 					logger.Error("Error in fetching hash salt from cache:", slog.Any("err", saltErr.Error()))
@@ -67,12 +239,57 @@ func JwtVerify(logger *slog.Logger, secretsCache cacheable) func(next http.Handl
 				logger.Info("JWT Token is valid for user " + he)
 
 				ctx := context.WithValue(r.Context(), HashedEmail{}, he)
+				if previousSalt := previousSecret(secretsCache, "user-hash-salt", salt); previousSalt != "" {
+					ctx = context.WithValue(ctx, PreviousHashedEmail{}, hashEmail(e, previousSalt))
+				}
+				ctx = context.WithValue(ctx, Roles{}, list(claims, policy.RolesClaim))
+				ctx = context.WithValue(ctx, Scopes{}, list(claims, policy.ScopesClaim))
 				next.ServeHTTP(rw, r.WithContext(ctx))
 			}
 		})
 	}
 }
 
+// hmacKeys returns the secrets a token signed with HMAC can be verified with. jwt-key holds one
+// secret, or a JSON object of secrets by kid so that they can be rotated without downtime: a
+// token whose kid names one of them is verified with it, and any other with each in turn. The
+// secrets jwt-key was rotated from are tried after its own, for a while after it is rotated.
+func hmacKeys(secretsCache cacheable, kid string) (any, error) {
+	jwtSecret, err := secretsCache.GetSecretString("jwt-key")
+	if err != nil {
+		return nil, keyError{"missing_secret_key", err}
+	}
+
+	jwtSecrets := []string{jwtSecret}
+	if previous := previousSecret(secretsCache, "jwt-key", jwtSecret); previous != "" {
+		jwtSecrets = append(jwtSecrets, previous)
+	}
+
+	var set jwt.VerificationKeySet
+	for _, jwtSecret := range jwtSecrets {
+		var secrets map[string]string
+		if json.Unmarshal([]byte(jwtSecret), &secrets) != nil || len(secrets) == 0 {
+			set.Keys = append(set.Keys, []byte(jwtSecret))
+			continue
+		}
+
+		if secret, ok := secrets[kid]; ok && secret != "" {
+			return []byte(secret), nil
+		}
+
+		for _, kid := range slices.Sorted(maps.Keys(secrets)) {
+			if secrets[kid] != "" {
+				set.Keys = append(set.Keys, []byte(secrets[kid]))
+			}
+		}
+	}
+
+	if len(set.Keys) == 1 {
+		return set.Keys[0], nil
+	}
+	return set, nil
+}
+
 // Create a hash of the users email
 func hashEmail(e string, salt string) string {
 	h := sha256.New()
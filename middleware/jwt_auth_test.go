@@ -2,12 +2,21 @@ package middleware
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -26,6 +35,16 @@ func (c *mockSecretsCache) GetSecretString(key string) (string, error) {
 	return args.String(0), args.Error(1)
 }
 
+// mockRotatingSecretsCache also has the secrets they were last rotated from
+type mockRotatingSecretsCache struct {
+	mockSecretsCache
+}
+
+func (c *mockRotatingSecretsCache) GetPreviousSecretString(key string) (string, error) {
+	args := c.Called(key)
+	return args.String(0), args.Error(1)
+}
+
 func TestJwtVerify(t *testing.T) {
 	tests := []struct {
 		scenario     string
@@ -105,7 +124,7 @@ func TestJwtVerify(t *testing.T) {
 			mockCache := new(mockSecretsCache)
 			mockCache.On("GetSecretString", "jwt-key").Return(test.secret.v, test.secret.e)
 			mockCache.On("GetSecretString", "user-hash-salt").Return(test.salt.v, test.salt.e)
-			handler := JwtVerify(l, mockCache)(testHandler)
+			handler := JwtVerify(l, mockCache, nil, JwtPolicy{})(testHandler)
 			handler.ServeHTTP(rw, req)
 			res := rw.Result()
 
@@ -114,6 +133,350 @@ func TestJwtVerify(t *testing.T) {
 	}
 }
 
+// signToken signs a token for Test.McTestFace@mail.com which expires in an hour
+func signToken(method jwt.SigningMethod, kid string, key any) string {
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"session-data": "Test.McTestFace@mail.com",
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+func TestJwtVerify_RotatedSecrets(t *testing.T) {
+	secrets := `{"current":"MyNewTestSecret","previous":"MyTestSecret"}`
+
+	tests := []struct {
+		scenario     string
+		token        string
+		expectedCode int
+	}{
+		{"Token signed with the current secret", signToken(jwt.SigningMethodHS256, "current", []byte("MyNewTestSecret")), 200},
+		{"Token signed with the previous secret", signToken(jwt.SigningMethodHS256, "previous", []byte("MyTestSecret")), 200},
+		{"Token without a kid", signToken(jwt.SigningMethodHS256, "", []byte("MyTestSecret")), 200},
+		{"Token with an unknown kid", signToken(jwt.SigningMethodHS512, "older", []byte("MyNewTestSecret")), 200},
+		{"Token signed with another secret than its kid", signToken(jwt.SigningMethodHS256, "current", []byte("MyTestSecret")), 401},
+		{"Token signed with a secret which has been removed", signToken(jwt.SigningMethodHS256, "", []byte("MyOldTestSecret")), 401},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/jwt", nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			rw := httptest.NewRecorder()
+
+			mockCache := new(mockSecretsCache)
+			mockCache.On("GetSecretString", "jwt-key").Return(secrets, nil)
+			mockCache.On("GetSecretString", "user-hash-salt").Return("ufUvZWyqrCikO1HPcPfrz7qQ6ENV84p0", nil)
+
+			handler := JwtVerify(slog.New(slog.NewTextHandler(io.Discard, nil)), mockCache, nil, JwtPolicy{})
+			handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rw, req)
+
+			assert.Equal(t, test.expectedCode, rw.Code, test.scenario)
+		})
+	}
+}
+
+func TestJwtVerify_PreviousVersions(t *testing.T) {
+	notFound := errors.New("secret not found")
+
+	tests := []struct {
+		scenario             string
+		token                string
+		previousSecret       mockValue
+		previousSalt         mockValue
+		expectedCode         int
+		expectedPreviousHash any
+	}{
+		{
+			"Token signed with the current secret",
+			signToken(jwt.SigningMethodHS256, "", []byte("MyNewTestSecret")),
+			mockValue{"MyTestSecret", nil},
+			mockValue{"ufUvZWyqrCikO1HPcPfrz7qQ6ENV84p0", nil},
+			200,
+			"d1a046e6300ea9a75cc4f9eda85e8442c3e9913b8eeb4ed0895896571e479a99",
+		},
+		{
+			"Token signed with the previous secret",
+			signToken(jwt.SigningMethodHS256, "", []byte("MyTestSecret")),
+			mockValue{"MyTestSecret", nil},
+			mockValue{"", notFound},
+			200,
+			nil,
+		},
+		{
+			"Token signed with the previous secret after the rotation window",
+			signToken(jwt.SigningMethodHS256, "", []byte("MyTestSecret")),
+			mockValue{"", notFound},
+			mockValue{"", notFound},
+			401,
+			nil,
+		},
+		{
+			"Token signed with a previous secret by kid",
+			signToken(jwt.SigningMethodHS256, "2026-04", []byte("MyTestSecret")),
+			mockValue{`{"2026-04":"MyTestSecret"}`, nil},
+			mockValue{"", notFound},
+			200,
+			nil,
+		},
+		{
+			"Token signed with another secret",
+			signToken(jwt.SigningMethodHS256, "", []byte("MyOldTestSecret")),
+			mockValue{"MyTestSecret", nil},
+			mockValue{"", notFound},
+			401,
+			nil,
+		},
+		{
+			"Salt has not changed",
+			signToken(jwt.SigningMethodHS256, "", []byte("MyNewTestSecret")),
+			mockValue{"", notFound},
+			mockValue{"MyNewSalt", nil},
+			200,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/jwt", nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			rw := httptest.NewRecorder()
+
+			mockCache := new(mockRotatingSecretsCache)
+			mockCache.On("GetSecretString", "jwt-key").Return("MyNewTestSecret", nil)
+			mockCache.On("GetSecretString", "user-hash-salt").Return("MyNewSalt", nil)
+			mockCache.On("GetPreviousSecretString", "jwt-key").Return(test.previousSecret.v, test.previousSecret.e)
+			mockCache.On("GetPreviousSecretString", "user-hash-salt").Return(test.previousSalt.v, test.previousSalt.e).Maybe()
+
+			var hashedEmail, previousHash any
+			handler := JwtVerify(slog.New(slog.NewTextHandler(io.Discard, nil)), mockCache, nil, JwtPolicy{})
+			handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hashedEmail = r.Context().Value(HashedEmail{})
+				previousHash = r.Context().Value(PreviousHashedEmail{})
+			})).ServeHTTP(rw, req)
+
+			assert.Equal(t, test.expectedCode, rw.Code, test.scenario)
+			if test.expectedCode == 200 {
+				assert.Equal(t, hashEmail("Test.McTestFace@mail.com", "MyNewSalt"), hashedEmail, test.scenario)
+				assert.Equal(t, test.expectedPreviousHash, previousHash, test.scenario)
+			}
+		})
+	}
+}
+
+func TestJwtVerify_JWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path,
+		testJWK("rsa", &rsaKey.PublicKey),
+		testJWK("ec", &ecKey.PublicKey),
+		testJWK("ed", edKey.Public()),
+	)
+
+	tests := []struct {
+		scenario     string
+		jwks         string
+		token        string
+		expectedCode int
+		expectedBody string
+	}{
+		{"RS256 token", path, signToken(jwt.SigningMethodRS256, "rsa", rsaKey), 200, ""},
+		{"ES256 token", path, signToken(jwt.SigningMethodES256, "ec", ecKey), 200, ""},
+		{"EdDSA token", path, signToken(jwt.SigningMethodEdDSA, "ed", edKey), 200, ""},
+		{"EdDSA token without a kid", path, signToken(jwt.SigningMethodEdDSA, "", edKey), 200, ""},
+		{"HMAC token", path, signToken(jwt.SigningMethodHS256, "", []byte("MyTestSecret")), 200, ""},
+		{"Token signed with a key which is not in the JWKS", path, signToken(jwt.SigningMethodEdDSA, "ed", otherKey), 401, "token signature is invalid"},
+		{"Token with an unknown kid", path, signToken(jwt.SigningMethodEdDSA, "other", otherKey), 401, "no EdDSA key in the JWKS with kid: other"},
+		{"Token with the kid of a key for another method", path, signToken(jwt.SigningMethodEdDSA, "rsa", edKey), 401, "no EdDSA key in the JWKS with kid: rsa"},
+		{"Token with a method which is not accepted", path, signToken(jwt.SigningMethodRS512, "rsa", rsaKey), 401, "signing method RS512 is invalid"},
+		{"JWKS cannot be read", path + ".missing", signToken(jwt.SigningMethodEdDSA, "ed", edKey), 500, "missing_jwks"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/jwt", nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			rw := httptest.NewRecorder()
+
+			mockCache := new(mockSecretsCache)
+			mockCache.On("GetSecretString", "jwt-key").Return("MyTestSecret", nil)
+			mockCache.On("GetSecretString", "user-hash-salt").Return("ufUvZWyqrCikO1HPcPfrz7qQ6ENV84p0", nil)
+
+			l := slog.New(slog.NewTextHandler(io.Discard, nil))
+			jwks, err := NewJWKS(l, "file://"+test.jwks, time.Hour)
+			assert.Nil(t, err)
+
+			var hashedEmail any
+			handler := JwtVerify(l, mockCache, jwks, JwtPolicy{})
+			handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hashedEmail = r.Context().Value(HashedEmail{})
+			})).ServeHTTP(rw, req)
+
+			assert.Equal(t, test.expectedCode, rw.Code, test.scenario)
+			assert.Contains(t, rw.Body.String(), test.expectedBody, test.scenario)
+			if test.expectedCode == 200 {
+				assert.Equal(t, "d1a046e6300ea9a75cc4f9eda85e8442c3e9913b8eeb4ed0895896571e479a99", hashedEmail, test.scenario)
+			}
+		})
+	}
+}
+
+func TestNewJwtPolicy(t *testing.T) {
+	assert.Equal(t, JwtPolicy{IdentityClaim: "session-data", RolesClaim: "roles", ScopesClaim: "scope"}, NewJwtPolicy())
+
+	t.Setenv("JWT_ISSUER", "https://idp.example")
+	t.Setenv("JWT_AUDIENCE", "opg-file-service, sirius,")
+	t.Setenv("JWT_MAX_AGE", "3600")
+	t.Setenv("JWT_LEEWAY", "30")
+	t.Setenv("JWT_IDENTITY_CLAIM", "email")
+	t.Setenv("JWT_ROLES_CLAIM", "groups")
+	t.Setenv("JWT_SCOPES_CLAIM", "scp")
+
+	assert.Equal(t, JwtPolicy{
+		Issuer:        "https://idp.example",
+		Audiences:     []string{"opg-file-service", "sirius"},
+		MaxAge:        time.Hour,
+		Leeway:        30 * time.Second,
+		IdentityClaim: "email",
+		RolesClaim:    "groups",
+		ScopesClaim:   "scp",
+	}, NewJwtPolicy())
+}
+
+func TestJwtVerify_Policy(t *testing.T) {
+	policy := JwtPolicy{
+		Issuer:        "https://idp.example",
+		Audiences:     []string{"opg-file-service"},
+		MaxAge:        time.Hour,
+		Leeway:        time.Minute,
+		IdentityClaim: "email",
+	}
+
+	// claims returns claims which meet the policy, with changes
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":   "https://idp.example",
+			"aud":   []string{"sirius", "opg-file-service"},
+			"iat":   time.Now().Add(-time.Minute).Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"email": "Test.McTestFace@mail.com",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		scenario     string
+		claims       jwt.MapClaims
+		expectedCode int
+		expectedBody string
+	}{
+		{"Token which meets the policy", claims(nil), 200, ""},
+		{"Token for one audience", claims(jwt.MapClaims{"aud": "opg-file-service"}), 200, ""},
+		{"Token from another issuer", claims(jwt.MapClaims{"iss": "https://elsewhere.example"}), 401, "token has invalid issuer"},
+		{"Token without an issuer", claims(jwt.MapClaims{"iss": nil}), 401, "iss claim is required"},
+		{"Token for another service", claims(jwt.MapClaims{"aud": "sirius"}), 401, "token has invalid audience"},
+		{"Token without an audience", claims(jwt.MapClaims{"aud": nil}), 401, "aud claim is required"},
+		{"Token expired within the leeway", claims(jwt.MapClaims{"exp": time.Now().Add(-30 * time.Second).Unix()}), 200, ""},
+		{"Token expired beyond the leeway", claims(jwt.MapClaims{"exp": time.Now().Add(-2 * time.Minute).Unix()}), 401, "token is expired"},
+		{"Token issued in the future", claims(jwt.MapClaims{"iat": time.Now().Add(2 * time.Minute).Unix()}), 401, "token used before issued"},
+		{"Token older than the max age", claims(jwt.MapClaims{"iat": time.Now().Add(-2 * time.Hour).Unix()}), 401, "token is older than 1h0m0s"},
+		{"Token without iat", claims(jwt.MapClaims{"iat": nil}), 401, "token is missing iat"},
+		{"Token without the identity claim", claims(jwt.MapClaims{"email": nil}), 401, "token is missing the email claim"},
+		{"Token with an identity claim which is not a string", claims(jwt.MapClaims{"email": 42}), 401, "token is missing the email claim"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, test.claims).SignedString([]byte("MyTestSecret"))
+
+			req := httptest.NewRequest("GET", "/jwt", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rw := httptest.NewRecorder()
+
+			mockCache := new(mockSecretsCache)
+			mockCache.On("GetSecretString", "jwt-key").Return("MyTestSecret", nil)
+			mockCache.On("GetSecretString", "user-hash-salt").Return("ufUvZWyqrCikO1HPcPfrz7qQ6ENV84p0", nil)
+
+			var hashedEmail any
+			handler := JwtVerify(slog.New(slog.NewTextHandler(io.Discard, nil)), mockCache, nil, policy)
+			handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hashedEmail = r.Context().Value(HashedEmail{})
+			})).ServeHTTP(rw, req)
+
+			assert.Equal(t, test.expectedCode, rw.Code, test.scenario)
+			assert.Contains(t, rw.Body.String(), test.expectedBody, test.scenario)
+			if test.expectedCode == 200 {
+				assert.Equal(t, "d1a046e6300ea9a75cc4f9eda85e8442c3e9913b8eeb4ed0895896571e479a99", hashedEmail, test.scenario)
+			} else {
+				assert.Contains(t, rw.Body.String(), `"error_with_token"`, test.scenario)
+			}
+		})
+	}
+}
+
+func TestJwtVerify_RolesAndScopes(t *testing.T) {
+	policy := JwtPolicy{IdentityClaim: "session-data", RolesClaim: "roles", ScopesClaim: "scope"}
+
+	tests := []struct {
+		scenario       string
+		claims         jwt.MapClaims
+		expectedRoles  []string
+		expectedScopes []string
+	}{
+		{"Roles and scopes as arrays", jwt.MapClaims{"roles": []string{"case-worker", "admin"}, "scope": []string{"files:read"}}, []string{"case-worker", "admin"}, []string{"files:read"}},
+		{"Scopes as a space separated string", jwt.MapClaims{"scope": "files:read  files:all"}, nil, []string{"files:read", "files:all"}},
+		{"Claims of other types", jwt.MapClaims{"roles": 42, "scope": []any{"files:read", 42, ""}}, nil, []string{"files:read"}},
+		{"No roles or scopes", jwt.MapClaims{}, nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.claims["exp"] = time.Now().Add(time.Hour).Unix()
+			test.claims["session-data"] = "Test.McTestFace@mail.com"
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, test.claims).SignedString([]byte("MyTestSecret"))
+
+			req := httptest.NewRequest("GET", "/jwt", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rw := httptest.NewRecorder()
+
+			mockCache := new(mockSecretsCache)
+			mockCache.On("GetSecretString", "jwt-key").Return("MyTestSecret", nil)
+			mockCache.On("GetSecretString", "user-hash-salt").Return("ufUvZWyqrCikO1HPcPfrz7qQ6ENV84p0", nil)
+
+			var roles, scopes any
+			handler := JwtVerify(slog.New(slog.NewTextHandler(io.Discard, nil)), mockCache, nil, policy)
+			handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				roles = r.Context().Value(Roles{})
+				scopes = r.Context().Value(Scopes{})
+			})).ServeHTTP(rw, req)
+
+			assert.Equal(t, 200, rw.Code, test.scenario)
+			assert.Equal(t, test.expectedRoles, roles, test.scenario)
+			assert.Equal(t, test.expectedScopes, scopes, test.scenario)
+		})
+	}
+}
+
 func TestHashEmail(t *testing.T) {
 	assert.Equal(
 		t,
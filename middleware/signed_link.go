@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"opg-file-service/internal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LinkSigner signs links to download a zip request, which stand in for the token of the user
+// who made it until they expire so that the link can be handed straight to a browser
+type LinkSigner struct {
+	secretsCache cacheable
+}
+
+func NewLinkSigner(secretsCache cacheable) *LinkSigner {
+	return &LinkSigner{secretsCache}
+}
+
+// CanSignLinks reports whether the caller in ctx can be given signed links. Only users
+// authenticated with a token can, as a link only carries a user's hash, roles and scopes, and
+// so could not be downloaded as an API client or a caller with a certificate.
+func CanSignLinks(ctx context.Context) bool {
+	user, _ := ctx.Value(HashedEmail{}).(string)
+	if _, ok := ctx.Value(Client{}).(*ApiClient); ok {
+		return false
+	}
+
+	return user != "" && !strings.HasPrefix(user, clientPrefix) && !strings.HasPrefix(user, certificatePrefix)
+}
+
+// Sign returns the query which makes a link to ref usable until expires, by the user
+// authenticated in ctx with the roles and scopes they have there
+func (s *LinkSigner) Sign(ctx context.Context, ref string, expires time.Time) (string, error) {
+	secret, err := s.secretsCache.GetSecretString("link-signing-key")
+	if err != nil {
+		return "", err
+	}
+
+	user, _ := ctx.Value(HashedEmail{}).(string)
+	if user == "" {
+		return "", errors.New("no user to sign the link for")
+	}
+	if !CanSignLinks(ctx) {
+		return "", errors.New("links can only be signed for users authenticated with a token")
+	}
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("user", user)
+	if roles, _ := ctx.Value(Roles{}).([]string); len(roles) > 0 {
+		query["role"] = roles
+	}
+	if scopes, _ := ctx.Value(Scopes{}).([]string); len(scopes) > 0 {
+		query["scope"] = scopes
+	}
+
+	query.Set("signature", linkSignature(secret, ref, query))
+	return query.Encode(), nil
+}
+
+// SignedLinkVerify accepts requests for a link signed by a LinkSigner in place of a token, and
+// passes any other request on to verify, such as JwtVerify
+func SignedLinkVerify(logger *slog.Logger, secretsCache cacheable, verify func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		verified := verify(next)
+
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+
+			signature := query.Get("signature")
+			if signature == "" {
+				verified.ServeHTTP(rw, r)
+				return
+			}
+			query.Del("signature")
+
+			expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+			if err != nil {
+				internal.WriteJSONError(rw, "error_with_link", "Link signature is invalid.", http.StatusUnauthorized)
+				return
+			}
+
+			secret, err := secretsCache.GetSecretString("link-signing-key")
+			if err != nil {
+				logger.Error("Error in fetching link signing key from cache:", slog.Any("err", err.Error()))
+				internal.WriteJSONError(rw, "missing_secret_key", err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if !hmac.Equal([]byte(signature), []byte(linkSignature(secret, r.PathValue("reference"), query))) {
+				internal.WriteJSONError(rw, "error_with_link", "Link signature is invalid.", http.StatusUnauthorized)
+				return
+			}
+
+			if time.Now().Unix() > expires {
+				internal.WriteJSONError(rw, "error_with_link", "Link has expired.", http.StatusUnauthorized)
+				return
+			}
+
+			user := query.Get("user")
+			logger.Info("Signed link is valid for user " + user)
+
+			ctx := context.WithValue(r.Context(), HashedEmail{}, user)
+			ctx = context.WithValue(ctx, Roles{}, query["role"])
+			ctx = context.WithValue(ctx, Scopes{}, query["scope"])
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// linkSignature is the HMAC-SHA256 of a link's reference and query, which are encoded with
+// their keys sorted so that they sign the same however the query is ordered
+func linkSignature(secret, ref string, query url.Values) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ref + "?" + query.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkSigner_Sign(t *testing.T) {
+	mockCache := new(mockSecretsCache)
+	mockCache.On("GetSecretString", "link-signing-key").Return("MyLinkSecret", nil)
+
+	ctx := context.WithValue(t.Context(), HashedEmail{}, "user")
+	ctx = context.WithValue(ctx, Roles{}, []string{"case-worker", "admin"})
+
+	query, err := NewLinkSigner(mockCache).Sign(ctx, "test", time.Unix(1700000000, 0))
+	assert.Nil(t, err)
+
+	values, _ := url.ParseQuery(query)
+	assert.Equal(t, "1700000000", values.Get("expires"))
+	assert.Equal(t, "user", values.Get("user"))
+	assert.Equal(t, []string{"case-worker", "admin"}, values["role"])
+	assert.NotContains(t, values, "scope")
+	assert.Len(t, values.Get("signature"), 64)
+
+	_, err = NewLinkSigner(mockCache).Sign(t.Context(), "test", time.Unix(1700000000, 0))
+	assert.EqualError(t, err, "no user to sign the link for")
+
+	// links are only signed for users, so cannot stand in for other callers
+	certCtx := context.WithValue(t.Context(), HashedEmail{}, "cert:spiffe://batch.internal")
+	_, err = NewLinkSigner(mockCache).Sign(certCtx, "test", time.Unix(1700000000, 0))
+	assert.EqualError(t, err, "links can only be signed for users authenticated with a token")
+
+	clientCtx := context.WithValue(t.Context(), HashedEmail{}, "client:batch")
+	clientCtx = context.WithValue(clientCtx, Client{}, &ApiClient{Name: "batch"})
+	_, err = NewLinkSigner(mockCache).Sign(clientCtx, "test", time.Unix(1700000000, 0))
+	assert.EqualError(t, err, "links can only be signed for users authenticated with a token")
+
+	missingCache := new(mockSecretsCache)
+	missingCache.On("GetSecretString", "link-signing-key").Return("", errors.New("Missing secret"))
+	_, err = NewLinkSigner(missingCache).Sign(ctx, "test", time.Unix(1700000000, 0))
+	assert.EqualError(t, err, "Missing secret")
+}
+
+func TestSignedLinkVerify(t *testing.T) {
+	mockCache := new(mockSecretsCache)
+	mockCache.On("GetSecretString", "link-signing-key").Return("MyLinkSecret", nil)
+
+	ctx := context.WithValue(t.Context(), HashedEmail{}, "user")
+	ctx = context.WithValue(ctx, Scopes{}, []string{"files:read"})
+
+	sign := func(ref string, expires time.Time) string {
+		query, err := NewLinkSigner(mockCache).Sign(ctx, ref, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return query
+	}
+	valid := sign("test", time.Now().Add(time.Minute))
+
+	tests := []struct {
+		scenario     string
+		ref          string
+		query        string
+		secretErr    error
+		expectedCode int
+		expectedBody string
+	}{
+		{"Signed link", "test", valid, nil, 200, ""},
+		{"Request without a signature is passed on", "test", "", nil, 418, ""},
+		{"Link to another reference", "other", valid, nil, 401, "Link signature is invalid."},
+		{"Link for another user", "test", valid + "&user=other", nil, 401, "Link signature is invalid."},
+		{"Link given another role", "test", valid + "&role=admin", nil, 401, "Link signature is invalid."},
+		{"Link with its expiry changed", "test", sign("test", time.Now().Add(-time.Minute)) + "&expires=9999999999", nil, 401, "Link signature is invalid."},
+		{"Link without an expiry", "test", "user=user&signature=abc", nil, 401, "Link signature is invalid."},
+		{"Expired link", "test", sign("test", time.Now().Add(-time.Minute)), nil, 401, "Link has expired."},
+		{"Cannot fetch link signing key", "test", valid, errors.New("Missing secret"), 500, "missing_secret_key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			cache := mockCache
+			if test.secretErr != nil {
+				cache = new(mockSecretsCache)
+				cache.On("GetSecretString", "link-signing-key").Return("", test.secretErr)
+			}
+
+			// requests without a signed link get a response from this in place of JwtVerify
+			teapot := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusTeapot)
+				})
+			}
+
+			var hashedEmail, scopes any
+			mux := http.NewServeMux()
+			mux.Handle("GET /zip/{reference}", SignedLinkVerify(slog.New(slog.NewTextHandler(io.Discard, nil)), cache, teapot)(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					hashedEmail = r.Context().Value(HashedEmail{})
+					scopes = r.Context().Value(Scopes{})
+				}),
+			))
+
+			rw := httptest.NewRecorder()
+			mux.ServeHTTP(rw, httptest.NewRequest("GET", "/zip/"+test.ref+"?"+test.query, nil))
+
+			assert.Equal(t, test.expectedCode, rw.Code, test.scenario)
+			assert.Contains(t, rw.Body.String(), test.expectedBody, test.scenario)
+			if test.expectedCode == 200 {
+				assert.Equal(t, "user", hashedEmail, test.scenario)
+				assert.Equal(t, []string{"files:read"}, scopes, test.scenario)
+			}
+		})
+	}
+}
@@ -3,8 +3,9 @@
 # Create a DynamoDB table
 awslocal dynamodb create-table \
   --table-name zip-requests \
-  --attribute-definitions AttributeName=Ref,AttributeType=S \
+  --attribute-definitions AttributeName=Ref,AttributeType=S AttributeName=Hash,AttributeType=S \
   --key-schema AttributeName=Ref,KeyType=HASH \
+  --global-secondary-indexes "IndexName=Hash,KeySchema=[{AttributeName=Hash,KeyType=HASH}],Projection={ProjectionType=ALL},ProvisionedThroughput={ReadCapacityUnits=1000,WriteCapacityUnits=1000}" \
   --provisioned-throughput ReadCapacityUnits=1000,WriteCapacityUnits=1000
 
 # Set automatic expiry of records based on the ttl attribute
@@ -20,3 +21,31 @@ awslocal secretsmanager create-secret --name local/jwt-key \
 awslocal secretsmanager create-secret --name local/user-hash-salt \
     --description "Email salt for Go services authentication" \
     --secret-string "ufUvZWyqrCikO1HPcPfrz7qQ6ENV84p0"
+
+awslocal secretsmanager create-secret --name local/callback-signing-key \
+    --description "Key for signing zip request notifications" \
+    --secret-string "MyCallbackSigningKey"
+
+awslocal secretsmanager create-secret --name local/manifest-signing-key \
+    --description "Ed25519 seed for signing archive manifests" \
+    --secret-string "bG9jYWwtbWFuaWZlc3Qtc2lnbmluZy1rZXktc2VlZCE="
+
+awslocal secretsmanager create-secret --name local/link-signing-key \
+    --description "Key for signing links to download zip requests without a token" \
+    --secret-string "MyLinkSigningKey"
+
+# the key of the local client is MyBatchClientKey
+awslocal secretsmanager create-secret --name local/api-clients \
+    --description "API clients which can call the service with a key rather than a JWT" \
+    --secret-string '{"local-batch":{"keyHash":"fb1e5637baaaa855a38e39b7a13bf766eb6a988810d8b8dbaa6a055e515aed9d","allow":["s3://files"],"rateLimit":60}}'
+
+awslocal secretsmanager create-secret --name local/password-encryption-key \
+    --description "AES-256 key for sealing the passwords of encrypted zip requests" \
+    --secret-string "bG9jYWwtcGFzc3dvcmQtZW5jcnlwdGlvbi1rZXkhISE="
+
+awslocal secretsmanager create-secret --name local/sse-c-keys/local \
+    --description "SSE-C key for objects encrypted with a customer provided key" \
+    --secret-string "bG9jYWwtc3NlLWMtY3VzdG9tZXIta2V5LTMyYnl0ZXM="
+
+# Create a bucket for asynchronous zip requests to be built into
+awslocal s3 mb s3://zip-archives
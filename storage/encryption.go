@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"crypto/rand"
+	"unicode/utf8"
+)
+
+// Methods a zip request's files can be encrypted with
+const (
+	EncryptionAES256 = "aes256" // WinZip AES-256, which most archive tools can open
+)
+
+// FlagEncrypted is the zip general purpose flag marking a file as encrypted
+const FlagEncrypted = 0x1
+
+// the shortest password a zip request can be given
+const minPasswordLength = 12
+
+type Encryption struct {
+	Method   string `json:"method"`   // EncryptionAES256, blank meaning aes256
+	Password string `json:"password"` // left blank to have a password generated and returned once when the zip request is made
+
+	// the password sealed with the service's key, which is all of it that is saved
+	SealedPassword string `json:"-"`
+}
+
+// GeneratePassword sets a random password, for when one is not given with the zip request
+func (e *Encryption) GeneratePassword() {
+	e.Password = rand.Text()
+}
+
+func (e *Encryption) Validate() (bool, *ErrValidation) {
+	var errs []ErrFieldValidation
+
+	if e.Method != "" && e.Method != EncryptionAES256 {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "Encryption",
+			Message: "entry Encryption Method must be aes256",
+		})
+	}
+
+	if utf8.RuneCountInString(e.Password) < minPasswordLength {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "Encryption",
+			Message: "entry Encryption Password must be at least 12 characters",
+		})
+	}
+
+	var err *ErrValidation
+	if len(errs) > 0 {
+		err = &ErrValidation{Errors: errs}
+	}
+
+	return len(errs) == 0, err
+}
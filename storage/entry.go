@@ -1,15 +1,68 @@
 package storage
 
 import (
+	"slices"
 	"strconv"
 	"time"
 )
 
+// Archive formats a zip request can be downloaded as
+const (
+	FormatZip    = "zip"
+	FormatTar    = "tar"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+)
+
+var ArchiveFormats = []string{FormatZip, FormatTar, FormatTarGz, FormatTarZst}
+
+// What to do when one of the files cannot be added to the archive
+const (
+	FailurePolicyAbort = "abort" // stop the download
+	FailurePolicySkip  = "skip"  // leave the file out and list it in an error report inside the archive
+)
+
+// Progress of a zip request which is built in the background
+const (
+	StatusPending  = "pending"  // waiting for a worker to pick it up
+	StatusBuilding = "building" // archive is being uploaded to S3
+	StatusReady    = "ready"    // archive can be downloaded from S3
+	StatusFailed   = "failed"   // archive could not be built
+)
+
+// Progress of a zip request which is streamed, so that it is only downloaded once
+const (
+	StatusDownloading = "downloading" // being streamed by a request which holds a claim on it
+	StatusConsumed    = "consumed"    // streamed to the end of the archive, so cannot be downloaded again
+)
+
+// MaxIdempotencyKeyLength is the longest an entry's IdempotencyKey can be
+const MaxIdempotencyKeyLength = 255
+
 type Entry struct {
-	Ref   string
-	Hash  string
-	Ttl   int64  // Unix timestamp
-	Files []File `json:"files"`
+	Ref            string
+	Hash           string
+	Ttl            int64       // Unix timestamp
+	Files          []File      `json:"files"`
+	FileCount      int         `json:"-"`             // number of Files, kept by the repository so entries can be listed without them
+	Format         string      `json:"format"`        // one of ArchiveFormats, or blank to negotiate from the Accept header
+	FailurePolicy  string      `json:"failurePolicy"` // FailurePolicyAbort or FailurePolicySkip, blank meaning abort
+	Store          bool        `json:"store"`         // store zip entries uncompressed, so the size of the download is known up front
+	Async          bool        `json:"async"`         // build the archive in the background and upload it to S3, rather than streaming it
+	Status         string      `json:"-"`             // progress of an Async entry, or of a download of one which is streamed
+	ArchiveKey     string      `json:"-"`             // key of an Async entry's archive in the archive bucket, once it is ready
+	CallbackUrl    string      `json:"callbackUrl"`   // notified when the download completes or fails, if on an allowed host
+	Manifest       bool        `json:"manifest"`      // end the archive with a signed manifest of the files in it and their hashes
+	Encryption     *Encryption `json:"encryption"`    // encrypt the files of a zip with a password
+	ClaimID        string      `json:"-"`             // identifies the request streaming the entry, while it is downloading
+	ClaimExpires   int64       `json:"-"`             // Unix timestamp after which an unfinished claim can be taken over
+	TtlSeconds     int64       `json:"ttlSeconds"`    // how long the entry is kept for, or blank for the default
+	MaxDownloads   int         `json:"maxDownloads"`  // how many times the archive can be downloaded, blank meaning once
+	Downloads      int         `json:"-"`             // how many times the archive has been downloaded to the end
+	LastDownload   int64       `json:"-"`             // Unix timestamp of the last download to reach the end of the archive
+	IdempotencyKey string      `json:"-"`             // Idempotency-Key of the request which made the entry, unique for its user
+	RequestHash    string      `json:"-"`             // hash of the request which made the entry, to tell a retry from another request with its key
+	SignedLink     bool        `json:"signedLink"`    // return a short-lived link which can be downloaded without a token
 }
 
 func (entry Entry) IsExpired() bool {
@@ -17,6 +70,14 @@ func (entry Entry) IsExpired() bool {
 	return ttlTime.Before(time.Now())
 }
 
+// AllowedDownloads is how many times the archive can be downloaded before the entry is used up
+func (entry Entry) AllowedDownloads() int {
+	if entry.MaxDownloads == 0 {
+		return 1
+	}
+	return entry.MaxDownloads
+}
+
 func (entry Entry) Validate() (bool, *ErrValidation) {
 	var errs []ErrFieldValidation
 
@@ -46,6 +107,41 @@ func (entry Entry) Validate() (bool, *ErrValidation) {
 		})
 	}
 
+	if entry.TtlSeconds < 0 {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "TtlSeconds",
+			Message: "entry TtlSeconds cannot be negative",
+		})
+	}
+
+	if entry.MaxDownloads < 0 {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "MaxDownloads",
+			Message: "entry MaxDownloads cannot be negative",
+		})
+	}
+
+	if entry.Async && entry.MaxDownloads != 0 {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "MaxDownloads",
+			Message: "entry MaxDownloads cannot be used with Async",
+		})
+	}
+
+	if entry.Async && entry.SignedLink {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "SignedLink",
+			Message: "entry SignedLink cannot be used with Async",
+		})
+	}
+
+	if len(entry.IdempotencyKey) > MaxIdempotencyKeyLength {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "IdempotencyKey",
+			Message: "entry IdempotencyKey cannot be more than " + strconv.Itoa(MaxIdempotencyKeyLength) + " characters",
+		})
+	}
+
 	if len(entry.Files) == 0 {
 		errs = append(errs, ErrFieldValidation{
 			Field:   "Files",
@@ -53,6 +149,61 @@ func (entry Entry) Validate() (bool, *ErrValidation) {
 		})
 	}
 
+	if entry.Format != "" && !slices.Contains(ArchiveFormats, entry.Format) {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "Format",
+			Message: "entry Format must be one of zip, tar, tar.gz or tar.zst",
+		})
+	}
+
+	if entry.FailurePolicy != "" && entry.FailurePolicy != FailurePolicyAbort && entry.FailurePolicy != FailurePolicySkip {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "FailurePolicy",
+			Message: "entry FailurePolicy must be one of abort or skip",
+		})
+	}
+
+	if entry.Store && entry.Format != "" && entry.Format != FormatZip {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "Store",
+			Message: "entry Store can only be used with the zip Format",
+		})
+	}
+
+	if entry.Store && entry.FailurePolicy == FailurePolicySkip {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "Store",
+			Message: "entry Store cannot be used with the skip FailurePolicy",
+		})
+	}
+
+	if entry.Store && entry.Manifest {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "Manifest",
+			Message: "entry Manifest cannot be used with Store",
+		})
+	}
+
+	if entry.Encryption != nil {
+		if entry.Format != "" && entry.Format != FormatZip {
+			errs = append(errs, ErrFieldValidation{
+				Field:   "Encryption",
+				Message: "entry Encryption can only be used with the zip Format",
+			})
+		}
+
+		if entry.Store {
+			errs = append(errs, ErrFieldValidation{
+				Field:   "Encryption",
+				Message: "entry Encryption cannot be used with Store",
+			})
+		}
+
+		if ok, validationErr := entry.Encryption.Validate(); !ok {
+			errs = append(errs, validationErr.Errors...)
+		}
+	}
+
 	for _, file := range entry.Files {
 		if ok, validationErr := file.Validate(); !ok {
 			errs = append(errs, validationErr.Errors...)
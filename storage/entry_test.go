@@ -42,6 +42,36 @@ func TestEntry_Validate(t *testing.T) {
 			true,
 			nil,
 		},
+		{
+			"No errors returned for valid format and failure policy",
+			&Entry{
+				Ref:           "test",
+				Hash:          "user",
+				Ttl:           9999999999,
+				Format:        FormatTarGz,
+				FailurePolicy: FailurePolicySkip,
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			true,
+			nil,
+		},
+		{
+			"No errors returned for stored zip",
+			&Entry{
+				Ref:    "test",
+				Hash:   "user",
+				Ttl:    9999999999,
+				Format: FormatZip,
+				Store:  true,
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			true,
+			nil,
+		},
 		{
 			"Validate blank fields",
 			&Entry{},
@@ -72,6 +102,194 @@ func TestEntry_Validate(t *testing.T) {
 				},
 			},
 		},
+		{
+			"Validate archive format",
+			&Entry{
+				Ref:    "test",
+				Hash:   "user",
+				Ttl:    9999999999,
+				Format: "rar",
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			false,
+			&ErrValidation{
+				Errors: []ErrFieldValidation{
+					{Field: "Format", Message: "entry Format must be one of zip, tar, tar.gz or tar.zst"},
+				},
+			},
+		},
+		{
+			"Validate failure policy",
+			&Entry{
+				Ref:           "test",
+				Hash:          "user",
+				Ttl:           9999999999,
+				FailurePolicy: "retry",
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			false,
+			&ErrValidation{
+				Errors: []ErrFieldValidation{
+					{Field: "FailurePolicy", Message: "entry FailurePolicy must be one of abort or skip"},
+				},
+			},
+		},
+		{
+			"Validate store",
+			&Entry{
+				Ref:           "test",
+				Hash:          "user",
+				Ttl:           9999999999,
+				Format:        FormatTar,
+				FailurePolicy: FailurePolicySkip,
+				Store:         true,
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			false,
+			&ErrValidation{
+				Errors: []ErrFieldValidation{
+					{Field: "Store", Message: "entry Store can only be used with the zip Format"},
+					{Field: "Store", Message: "entry Store cannot be used with the skip FailurePolicy"},
+				},
+			},
+		},
+		{
+			"Validate manifest",
+			&Entry{
+				Ref:      "test",
+				Hash:     "user",
+				Ttl:      9999999999,
+				Store:    true,
+				Manifest: true,
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			false,
+			&ErrValidation{
+				Errors: []ErrFieldValidation{
+					{Field: "Manifest", Message: "entry Manifest cannot be used with Store"},
+				},
+			},
+		},
+		{
+			"Validate encryption",
+			&Entry{
+				Ref:        "test",
+				Hash:       "user",
+				Ttl:        9999999999,
+				Format:     FormatTar,
+				Store:      true,
+				Encryption: &Encryption{Method: "zipcrypto", Password: "short"},
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			false,
+			&ErrValidation{
+				Errors: []ErrFieldValidation{
+					{Field: "Store", Message: "entry Store can only be used with the zip Format"},
+					{Field: "Encryption", Message: "entry Encryption can only be used with the zip Format"},
+					{Field: "Encryption", Message: "entry Encryption cannot be used with Store"},
+					{Field: "Encryption", Message: "entry Encryption Method must be aes256"},
+					{Field: "Encryption", Message: "entry Encryption Password must be at least 12 characters"},
+				},
+			},
+		},
+		{
+			"Valid encryption",
+			&Entry{
+				Ref:        "test",
+				Hash:       "user",
+				Ttl:        9999999999,
+				Format:     FormatZip,
+				Encryption: &Encryption{Method: EncryptionAES256, Password: "correct horse battery"},
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			true,
+			nil,
+		},
+		{
+			"Valid TTL and number of downloads",
+			&Entry{
+				Ref:          "test",
+				Hash:         "user",
+				Ttl:          9999999999,
+				TtlSeconds:   3600,
+				MaxDownloads: 3,
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			true,
+			nil,
+		},
+		{
+			"Invalid TTL and number of downloads",
+			&Entry{
+				Ref:          "test",
+				Hash:         "user",
+				Ttl:          9999999999,
+				TtlSeconds:   -1,
+				MaxDownloads: -1,
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			false,
+			&ErrValidation{
+				Errors: []ErrFieldValidation{
+					{Field: "TtlSeconds", Message: "entry TtlSeconds cannot be negative"},
+					{Field: "MaxDownloads", Message: "entry MaxDownloads cannot be negative"},
+				},
+			},
+		},
+		{
+			"Number of downloads for an async entry",
+			&Entry{
+				Ref:          "test",
+				Hash:         "user",
+				Ttl:          9999999999,
+				Async:        true,
+				MaxDownloads: 2,
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			false,
+			&ErrValidation{
+				Errors: []ErrFieldValidation{
+					{Field: "MaxDownloads", Message: "entry MaxDownloads cannot be used with Async"},
+				},
+			},
+		},
+		{
+			"Signed link for an async entry",
+			&Entry{
+				Ref:        "test",
+				Hash:       "user",
+				Ttl:        9999999999,
+				Async:      true,
+				SignedLink: true,
+				Files: []File{
+					{S3path: "s3://files/file", FileName: "file"},
+				},
+			},
+			false,
+			&ErrValidation{
+				Errors: []ErrFieldValidation{
+					{Field: "SignedLink", Message: "entry SignedLink cannot be used with Async"},
+				},
+			},
+		},
 		{
 			"Errors include File validations",
 			&Entry{
@@ -6,6 +6,24 @@ type NotFoundError struct {
 	Ref string
 }
 
+// ClaimedError is returned when an entry is being downloaded by another request, or its
+// archive is being built, or has been built, by another worker
+type ClaimedError struct {
+	Ref string
+}
+
+// ConsumedError is returned when an entry has already been downloaded
+type ConsumedError struct {
+	Ref string
+}
+
+// IdempotencyKeyError is returned when an entry is added with an idempotency key which its
+// user has already made another entry with
+type IdempotencyKeyError struct {
+	Key string
+	Ref string // the entry which was made with the key
+}
+
 type ErrFieldValidation struct {
 	Field   string `json:"field"`
 	Message string `json:"message"`
@@ -19,6 +37,18 @@ func (err NotFoundError) Error() string {
 	return "Could not find entry with reference: " + err.Ref
 }
 
+func (err ClaimedError) Error() string {
+	return "Entry is already being downloaded with reference: " + err.Ref
+}
+
+func (err ConsumedError) Error() string {
+	return "Entry has already been downloaded with reference: " + err.Ref
+}
+
+func (err IdempotencyKeyError) Error() string {
+	return "Idempotency key " + err.Key + " has already been used for entry with reference: " + err.Ref
+}
+
 func (e ErrFieldValidation) Error() string {
 	return fmt.Sprintf("Field %s failed validation: %s", e.Field, e.Message)
 }
@@ -3,27 +3,56 @@ package storage
 import (
 	"archive/zip"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 )
 
+// extensions of file types which are already compressed, so gain nothing from being deflated
+var compressedExtensions = []string{"7z", "docx", "gif", "gz", "jpeg", "jpg", "mp3", "mp4", "pdf", "png", "pptx", "xlsx", "zip"}
+
+// characters the name of a secret holding an SSE-C key can be made of
+var keyRefRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 type File struct {
-	S3path   string `json:"s3path"`
-	FileName string `json:"filename"`
-	Folder   string `json:"folder"`
+	S3path            string `json:"s3path"`
+	FileName          string `json:"filename"`
+	Folder            string `json:"folder"`
+	VersionID         string `json:"versionId"`         // version of the object to fetch, rather than the latest
+	ETag              string `json:"etag"`              // fetch the object only while it still has this ETag
+	SSECustomerKeyRef string `json:"sseCustomerKeyRef"` // name of the secret holding the SSE-C key the object is encrypted with
 }
 
-func (f *File) GetZipFileHeader() *zip.FileHeader {
+// GetZipFileHeader returns the header of the file in a zip, flagged as encrypted when it
+// is to be encrypted with enc
+func (f *File) GetZipFileHeader(enc *Encryption) *zip.FileHeader {
 	loc, _ := time.LoadLocation("Europe/London")
 
+	method := zip.Deflate
+	if f.IsCompressed() {
+		method = zip.Store
+	}
+
 	// We have to set a special flag so zip files recognize utf file names
 	// See http://stackoverflow.com/questions/30026083/creating-a-zip-archive-with-unicode-filenames-using-gos-archive-zip
-	return &zip.FileHeader{
+	fh := &zip.FileHeader{
 		Name:     f.GetRelativePath(),
-		Method:   zip.Deflate,
+		Method:   method,
 		Flags:    0x800,
 		Modified: time.Now().In(loc),
 	}
+
+	if enc != nil {
+		fh.Flags |= FlagEncrypted
+	}
+
+	return fh
+}
+
+// IsCompressed reports whether the file's extension is that of an already compressed file type
+func (f *File) IsCompressed() bool {
+	_, extension := f.GetFileNameAndExtension()
+	return slices.Contains(compressedExtensions, strings.ToLower(extension))
 }
 
 func (f *File) GetRelativePath() string {
@@ -67,6 +96,13 @@ func (f *File) Validate() (bool, *ErrValidation) {
 		})
 	}
 
+	if f.SSECustomerKeyRef != "" && !keyRefRegex.MatchString(f.SSECustomerKeyRef) {
+		errs = append(errs, ErrFieldValidation{
+			Field:   "SSECustomerKeyRef",
+			Message: "SSECustomerKeyRef can only contain letters, numbers, hyphens and underscores",
+		})
+	}
+
 	var err *ErrValidation
 	if len(errs) > 0 {
 		err = &ErrValidation{Errors: errs}
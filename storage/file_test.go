@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"archive/zip"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -11,8 +12,38 @@ func TestFile_GetZipFileHeader(t *testing.T) {
 		FileName: "file",
 		Folder:   "folder",
 	}
-	fh := f.GetZipFileHeader()
+	fh := f.GetZipFileHeader(nil)
 	assert.Equal(t, f.GetRelativePath(), fh.Name)
+	assert.Equal(t, zip.Deflate, fh.Method)
+	assert.Equal(t, uint16(0x800), fh.Flags)
+
+	f.FileName = "file.pdf"
+	fh = f.GetZipFileHeader(nil)
+	assert.Equal(t, zip.Store, fh.Method)
+
+	fh = f.GetZipFileHeader(&Encryption{Method: EncryptionAES256, Password: "password"})
+	assert.Equal(t, uint16(0x800|FlagEncrypted), fh.Flags)
+}
+
+func TestFile_IsCompressed(t *testing.T) {
+	tests := []struct {
+		fileName string
+		want     bool
+	}{
+		{"file.pdf", true},
+		{"file.JPG", true},
+		{"file.docx", true},
+		{"archive.tar.gz", true},
+		{"file.txt", false},
+		{"file.doc", false},
+		{"file", false},
+	}
+
+	file := File{}
+	for _, test := range tests {
+		file.FileName = test.fileName
+		assert.Equal(t, test.want, file.IsCompressed(), test.fileName)
+	}
 }
 
 func TestFile_GetRelativePath(t *testing.T) {
@@ -89,6 +120,32 @@ func TestFile_Validate(t *testing.T) {
 				},
 			},
 		},
+		{
+			"Pinned version with SSE-C key",
+			&File{
+				S3path:            "s3://files/file",
+				FileName:          "file",
+				VersionID:         "3HL4kqtJlcpXroDTDmJ.rmSpXd3dIbrHY",
+				ETag:              `"9bb58f26192e4ba00f01e2e7b136bbd8"`,
+				SSECustomerKeyRef: "case-documents_2024",
+			},
+			true,
+			nil,
+		},
+		{
+			"SSE-C key reference with invalid characters",
+			&File{
+				S3path:            "s3://files/file",
+				FileName:          "file",
+				SSECustomerKeyRef: "../jwt-secret",
+			},
+			false,
+			&ErrValidation{
+				Errors: []ErrFieldValidation{
+					{Field: "SSECustomerKeyRef", Message: "SSECustomerKeyRef can only contain letters, numbers, hyphens and underscores"},
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,116 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// the certificate files are checked for changes no more often than this
+const reloadInterval = 10 * time.Second
+
+// New returns the TLS config for serving the certificate in certFile and keyFile, which are read
+// again when they change so that the certificate can be renewed without a restart. When
+// clientCAFile is set, client certificates are asked for and verified against the CAs in it,
+// though connections without one are still accepted so that they can authenticate with a token.
+func New(logger *slog.Logger, certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if keyFile == "" {
+		return nil, errors.New("TLS_KEY_FILE must be set along with TLS_CERT_FILE")
+	}
+
+	r := &reloader{certFile: certFile, keyFile: keyFile, logger: logger, now: time.Now}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + clientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// reloader serves a certificate from files, reading them again when they have changed
+type reloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+	now      func() time.Time
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // when the files had last changed as of reading them
+	checked time.Time
+}
+
+func (r *reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.now().Sub(r.checked) >= reloadInterval {
+		// the certificate being served is kept if the new one cannot be read, such as when only
+		// one of the files has been replaced so far, and read again once both have been
+		if err := r.load(); err != nil {
+			r.logger.Error("Unable to reload TLS certificate", slog.Any("err", err.Error()))
+		}
+	}
+
+	return r.cert, nil
+}
+
+// load reads the certificate again, if the files have changed since it was last read
+func (r *reloader) load() error {
+	r.checked = r.now()
+
+	modTime, err := lastModified(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if r.cert != nil {
+		r.logger.Info("Reloaded TLS certificate from " + r.certFile)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+// lastModified returns when the last of the files was changed
+func lastModified(names ...string) (time.Time, error) {
+	var last time.Time
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
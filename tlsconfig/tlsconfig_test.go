@@ -0,0 +1,200 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newCertificate returns a certificate for name signed by parent, or self-signed when parent is nil
+func newCertificate(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCertificate writes a certificate and its key as PEM files
+func writeCertificate(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	key, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile != "" {
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	writeCertificate(t, newCertificate(t, "file-service", nil), certFile, keyFile)
+	writeCertificate(t, newCertificate(t, "internal-ca", nil), caFile, "")
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	config, err := New(l, certFile, keyFile, "")
+	assert.Nil(t, err)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+	assert.Nil(t, config.ClientCAs)
+
+	config, err = New(l, certFile, keyFile, caFile)
+	assert.Nil(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, config.ClientAuth)
+	assert.NotNil(t, config.ClientCAs)
+
+	_, err = New(l, certFile, "", "")
+	assert.EqualError(t, err, "TLS_KEY_FILE must be set along with TLS_CERT_FILE")
+
+	_, err = New(l, certFile, filepath.Join(dir, "missing.key"), "")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = New(l, certFile, keyFile, keyFile)
+	assert.EqualError(t, err, "no certificates found in "+keyFile)
+}
+
+func TestReloader_GetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	first, second := newCertificate(t, "first", nil), newCertificate(t, "second", nil)
+	writeCertificate(t, first, certFile, keyFile)
+
+	now := time.Now()
+	r := &reloader{certFile: certFile, keyFile: keyFile, logger: slog.New(slog.NewTextHandler(io.Discard, nil)), now: func() time.Time { return now }}
+	assert.Nil(t, r.load())
+
+	served := func() string {
+		cert, err := r.GetCertificate(nil)
+		assert.Nil(t, err)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	assert.Equal(t, "first", served())
+
+	// the files are not checked again straight away
+	writeCertificate(t, second, certFile, keyFile)
+	_ = os.Chtimes(certFile, now.Add(time.Second), now.Add(time.Second))
+	assert.Equal(t, "first", served())
+
+	now = now.Add(reloadInterval)
+	assert.Equal(t, "second", served())
+
+	// a certificate which does not match its key is not served
+	writeCertificate(t, first, certFile, "")
+	_ = os.Chtimes(certFile, now.Add(2*time.Second), now.Add(2*time.Second))
+	now = now.Add(reloadInterval)
+	assert.Equal(t, "second", served())
+
+	// until the key is replaced as well
+	writeCertificate(t, first, certFile, keyFile)
+	_ = os.Chtimes(keyFile, now.Add(3*time.Second), now.Add(3*time.Second))
+	now = now.Add(reloadInterval)
+	assert.Equal(t, "first", served())
+}
+
+func TestNew_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+
+	ca := newCertificate(t, "internal-ca", nil)
+	writeCertificate(t, ca, caFile, "")
+	writeCertificate(t, newCertificate(t, "file-service", &ca), certFile, keyFile)
+
+	config, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			_, _ = io.WriteString(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		}
+	}))
+	ts.TLS = config
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	request := func(certs ...tls.Certificate) (string, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Leaf)
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: "file-service",
+			// the certificate is sent even when the server does not ask for one from its CA
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(certs) == 0 {
+					return &tls.Certificate{}, nil
+				}
+				return &certs[0], nil
+			},
+		}}}
+
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	// a client with a certificate from the CA is identified by it
+	identity, err := request(newCertificate(t, "batch-client", &ca))
+	assert.Nil(t, err)
+	assert.Equal(t, "batch-client", identity)
+
+	// a client without a certificate can still connect, to authenticate some other way
+	identity, err = request()
+	assert.Nil(t, err)
+	assert.Equal(t, "", identity)
+
+	// but not with a certificate from another CA
+	other := newCertificate(t, "other-ca", nil)
+	_, err = request(newCertificate(t, "batch-client", &other))
+	assert.NotNil(t, err)
+}
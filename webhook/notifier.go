@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"opg-file-service/internal"
+	"opg-file-service/zipper"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcome of the download or build a notification is sent for
+const (
+	StatusComplete = "complete"
+	StatusFailed   = "failed"
+)
+
+// header holding the HMAC-SHA256 of the notification body, so receivers can check it came from us
+const SignatureHeader = "X-Signature-256"
+
+type Notification struct {
+	Reference string             `json:"reference"`
+	Status    string             `json:"status"`
+	Files     int                `json:"files"` // number of files in the zip request, including any which failed
+	Bytes     int64              `json:"bytes"` // bytes of the archive sent or uploaded
+	Failures  []zipper.FileError `json:"failures,omitempty"`
+	Timestamp int64              `json:"timestamp"` // Unix timestamp, so receivers can reject replayed notifications
+}
+
+type NotifierInterface interface {
+	Allowed(callbackUrl string) bool
+	Notify(ctx context.Context, callbackUrl string, n Notification)
+}
+
+type cacheable interface {
+	GetSecretString(key string) (string, error)
+}
+
+// allows us to mock http.Client in our tests
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type Notifier struct {
+	client       HTTPClient
+	secrets      cacheable
+	allowedHosts []string
+	maxAttempts  int
+	backoff      time.Duration // wait before the first retry, doubled for each retry after it
+	logger       *slog.Logger
+	wg           sync.WaitGroup
+}
+
+func NewNotifier(logger *slog.Logger, secrets cacheable) *Notifier {
+	var allowedHosts []string
+	for _, host := range strings.Split(internal.GetEnvVar("CALLBACK_ALLOWED_HOSTS", ""), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			allowedHosts = append(allowedHosts, host)
+		}
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		// a redirect could send the notification to a host which is not allowed, so the
+		// redirect is treated as the receiver's response instead
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &Notifier{
+		client:       client,
+		secrets:      secrets,
+		allowedHosts: allowedHosts,
+		maxAttempts:  max(internal.GetEnvInt("CALLBACK_MAX_ATTEMPTS", 5), 1),
+		backoff:      time.Second,
+		logger:       logger,
+	}
+}
+
+// Allowed reports whether notifications can be sent to callbackUrl, which must be an https URL on an allowed host
+func (n *Notifier) Allowed(callbackUrl string) bool {
+	u, err := url.Parse(callbackUrl)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+
+	return slices.Contains(n.allowedHosts, u.Host)
+}
+
+// Notify sends a notification in the background, so that the caller is not held up by a slow receiver
+func (n *Notifier) Notify(ctx context.Context, callbackUrl string, notification Notification) {
+	// the notification outlives the request it is sent for
+	ctx = context.WithoutCancel(ctx)
+
+	n.wg.Go(func() {
+		if err := n.Send(ctx, callbackUrl, notification); err != nil {
+			n.logger.Error("Unable to send notification for reference", slog.Any("err", err.Error()), slog.Any("ref", notification.Reference))
+		}
+	})
+}
+
+// Wait blocks until the notifications being sent have been delivered or given up on
+func (n *Notifier) Wait() {
+	n.wg.Wait()
+}
+
+// Send posts a signed notification to callbackUrl, retrying with exponential backoff until it is accepted
+func (n *Notifier) Send(ctx context.Context, callbackUrl string, notification Notification) error {
+	notification.Timestamp = time.Now().Unix()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	secret, err := n.secrets.GetSecretString("callback-signing-key")
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	wait := n.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(ctx, callbackUrl, body, signature)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= n.maxAttempts {
+			return err
+		}
+
+		n.logger.Info("Retrying notification for reference", slog.Any("ref", notification.Reference), slog.Any("attempt", attempt), slog.Any("err", err.Error()))
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// post makes a single attempt at sending a notification, reporting whether a failure is worth retrying
+func (n *Notifier) post(ctx context.Context, callbackUrl string, body []byte, signature string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = errors.New("callback responded with status " + strconv.Itoa(res.StatusCode))
+
+	// other client errors will fail the same way however many times they are sent
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500, err
+}
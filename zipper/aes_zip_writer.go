@@ -0,0 +1,251 @@
+package zipper
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"opg-file-service/storage"
+	"strconv"
+)
+
+// WinZip AES-256 (AE-2), as described at https://www.winzip.com/en/support/aes-encryption/
+const (
+	aesMethod        = 99     // compression method of an encrypted file, whose real method is in its AES extra field
+	aesExtraID       = 0x9901 // AES extra field
+	aesVendorVersion = 2      // AE-2, which leaves out the CRC-32 as the authentication code covers the contents
+	aesStrength256   = 3
+	aesKeyLen        = 32
+	aesSaltLen       = 16
+	aesVerifierLen   = 2
+	aesMACLen        = 10
+	aesIterations    = 1000
+	aesReaderVersion = 51
+)
+
+// AESZipWriter adapts zip.Writer to encrypt the files whose headers are flagged with
+// storage.FlagEncrypted, using the password it is given with Encrypt. Other files are
+// written as zip.Writer would write them.
+type AESZipWriter struct {
+	zw       *zip.Writer
+	password string
+	current  *aesFileWriter
+}
+
+func NewAESZipWriter(w io.Writer) *AESZipWriter {
+	return &AESZipWriter{zw: zip.NewWriter(w)}
+}
+
+// Encrypt sets the password files flagged as encrypted are encrypted with
+func (aw *AESZipWriter) Encrypt(enc *storage.Encryption) error {
+	if enc.Method != "" && enc.Method != storage.EncryptionAES256 {
+		return errors.New("zip: unsupported encryption method: " + enc.Method)
+	}
+	if enc.Password == "" {
+		return errors.New("zip: missing password")
+	}
+
+	aw.password = enc.Password
+	return nil
+}
+
+func (aw *AESZipWriter) CreateHeader(fh *zip.FileHeader) (io.Writer, error) {
+	if err := aw.closeFile(); err != nil {
+		return nil, err
+	}
+
+	if fh.Flags&storage.FlagEncrypted == 0 {
+		return aw.zw.CreateHeader(fh)
+	}
+	if aw.password == "" {
+		return nil, errors.New("zip: no password to encrypt " + fh.Name + " with")
+	}
+
+	method := fh.Method
+	if method != zip.Store && method != zip.Deflate {
+		return nil, errors.New("zip: unable to encrypt a file compressed with method " + strconv.Itoa(int(method)))
+	}
+
+	salt := make([]byte, aesSaltLen)
+	_, _ = rand.Read(salt)
+
+	keys, err := pbkdf2.Key(sha1.New, aw.password, salt, aesIterations, 2*aesKeyLen+aesVerifierLen)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(keys[:aesKeyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	// CreateRaw leaves the header to us, so it is filled in as CreateHeader would, with the
+	// sizes following the contents in a data descriptor once they are known
+	fh.Method = aesMethod
+	fh.Flags |= 0x8
+	fh.ReaderVersion = aesReaderVersion
+	fh.CreatorVersion = aesReaderVersion
+	fh.CRC32, fh.CompressedSize64, fh.UncompressedSize64 = 0, 0, 0
+	if !fh.Modified.IsZero() {
+		fh.ModifiedTime, fh.ModifiedDate = msDosTime(fh.Modified)
+		fh.Extra = appendExtTimeExtra(fh.Extra, fh.Modified)
+	}
+	fh.Extra = appendAESExtra(fh.Extra, method)
+
+	raw, err := aw.zw.CreateRaw(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	fw := &aesFileWriter{
+		header: fh,
+		raw:    raw,
+		ctr:    &aesCTR{block: block, used: aes.BlockSize},
+		mac:    hmac.New(sha1.New, keys[aesKeyLen:2*aesKeyLen]),
+	}
+
+	// the salt and password verifier come before the encrypted contents
+	if _, err := raw.Write(append(salt, keys[2*aesKeyLen:]...)); err != nil {
+		return nil, err
+	}
+
+	fw.w = fw.encrypt
+	if method == zip.Deflate {
+		fw.comp, _ = flate.NewWriter(writerFunc(fw.encrypt), 5)
+		fw.w = fw.comp.Write
+	}
+
+	aw.current = fw
+	return fw, nil
+}
+
+func (aw *AESZipWriter) Close() error {
+	if err := aw.closeFile(); err != nil {
+		return err
+	}
+	return aw.zw.Close()
+}
+
+// closeFile finishes the file being written, which must happen before zip.Writer writes its data descriptor
+func (aw *AESZipWriter) closeFile() error {
+	if aw.current == nil {
+		return nil
+	}
+
+	err := aw.current.close()
+	aw.current = nil
+	return err
+}
+
+// aesFileWriter compresses and encrypts the contents of a file
+type aesFileWriter struct {
+	header  *zip.FileHeader
+	raw     io.Writer
+	ctr     *aesCTR
+	mac     hash.Hash
+	comp    *flate.Writer
+	w       func(p []byte) (int, error) // compresses then encrypts, or only encrypts a stored file
+	size    uint64                      // bytes of contents written
+	encSize uint64                      // bytes of encrypted contents written
+	buf     []byte
+	closed  bool
+}
+
+func (fw *aesFileWriter) Write(p []byte) (int, error) {
+	if fw.closed {
+		return 0, errors.New("zip: write to closed file")
+	}
+
+	n, err := fw.w(p)
+	fw.size += uint64(n)
+	return n, err
+}
+
+// encrypt writes the encrypted form of p to the zip, adding it to the authentication code
+func (fw *aesFileWriter) encrypt(p []byte) (int, error) {
+	if cap(fw.buf) < len(p) {
+		fw.buf = make([]byte, len(p))
+	}
+	b := fw.buf[:len(p)]
+
+	fw.ctr.XORKeyStream(b, p)
+	fw.mac.Write(b)
+
+	n, err := fw.raw.Write(b)
+	fw.encSize += uint64(n)
+	return n, err
+}
+
+func (fw *aesFileWriter) close() error {
+	fw.closed = true
+
+	if fw.comp != nil {
+		if err := fw.comp.Close(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fw.raw.Write(fw.mac.Sum(nil)[:aesMACLen]); err != nil {
+		return err
+	}
+
+	// filled in before zip.Writer writes them to the data descriptor and central directory
+	fh := fw.header
+	fh.CompressedSize64 = aesSaltLen + aesVerifierLen + fw.encSize + aesMACLen
+	fh.UncompressedSize64 = fw.size
+	fh.CompressedSize = uint32(min(fh.CompressedSize64, uint32max))
+	fh.UncompressedSize = uint32(min(fh.UncompressedSize64, uint32max))
+
+	return nil
+}
+
+// aesCTR is AES in counter mode as WinZip uses it, with a little endian counter starting at 1,
+// which is why cipher.NewCTR cannot be used
+type aesCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int // bytes of stream already used
+}
+
+func (c *aesCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.used = 0
+		}
+
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
+
+// appendAESExtra appends the AES extra field, holding the method the file was really compressed with
+func appendAESExtra(b []byte, method uint16) []byte {
+	b = binary.LittleEndian.AppendUint16(b, aesExtraID)
+	b = binary.LittleEndian.AppendUint16(b, 7) // size of the fields below
+	b = binary.LittleEndian.AppendUint16(b, aesVendorVersion)
+	b = append(b, 'A', 'E')
+	b = append(b, aesStrength256)
+	return binary.LittleEndian.AppendUint16(b, method)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,168 @@
+package zipper
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"opg-file-service/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decryptAESFile checks the password and authentication code of a file written by AESZipWriter,
+// returning its decrypted and decompressed contents
+func decryptAESFile(f *zip.File, password string) ([]byte, error) {
+	if f.Method != aesMethod || f.Flags&storage.FlagEncrypted == 0 {
+		return nil, errors.New("file is not encrypted")
+	}
+
+	extra := f.Extra
+	var method uint16
+	for len(extra) >= 4 {
+		id, size := binary.LittleEndian.Uint16(extra), binary.LittleEndian.Uint16(extra[2:])
+		if id == aesExtraID {
+			method = binary.LittleEndian.Uint16(extra[4+5:])
+		}
+		extra = extra[4+size:]
+	}
+
+	rc, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	salt, verifier := raw[:aesSaltLen], raw[aesSaltLen:aesSaltLen+aesVerifierLen]
+	enc, mac := raw[aesSaltLen+aesVerifierLen:len(raw)-aesMACLen], raw[len(raw)-aesMACLen:]
+
+	keys, _ := pbkdf2.Key(sha1.New, password, salt, aesIterations, 2*aesKeyLen+aesVerifierLen)
+	if !bytes.Equal(keys[2*aesKeyLen:], verifier) {
+		return nil, errors.New("wrong password")
+	}
+
+	h := hmac.New(sha1.New, keys[aesKeyLen:2*aesKeyLen])
+	h.Write(enc)
+	if !hmac.Equal(h.Sum(nil)[:aesMACLen], mac) {
+		return nil, errors.New("authentication code does not match")
+	}
+
+	block, _ := aes.NewCipher(keys[:aesKeyLen])
+	dec := make([]byte, len(enc))
+	(&aesCTR{block: block, used: aes.BlockSize}).XORKeyStream(dec, enc)
+
+	if method == zip.Deflate {
+		return io.ReadAll(flate.NewReader(bytes.NewReader(dec)))
+	}
+	return dec, nil
+}
+
+func TestAESZipWriter(t *testing.T) {
+	modified := time.Date(2024, 3, 5, 14, 30, 12, 0, time.UTC)
+	enc := &storage.Encryption{Method: storage.EncryptionAES256, Password: "correct horse battery"}
+
+	tests := []struct {
+		scenario  string
+		name      string
+		contents  string
+		method    uint16
+		encrypted bool
+	}{
+		{"Deflated file", "folder/file1.pdf", "contents of file1", zip.Deflate, true},
+		{"Large deflated file", "file2.jpg", strings.Repeat("contents of file2", 10000), zip.Deflate, true},
+		{"Stored file", "file3", "contents of file3", zip.Store, true},
+		{"Empty file", "empty", "", zip.Deflate, true},
+		{"Unencrypted file", "file4", "contents of file4", zip.Deflate, false},
+	}
+
+	buf := new(bytes.Buffer)
+	aw := NewAESZipWriter(buf)
+	assert.Nil(t, aw.Encrypt(enc))
+
+	for _, test := range tests {
+		fh := &zip.FileHeader{Name: test.name, Method: test.method, Modified: modified}
+		if test.encrypted {
+			fh.Flags |= storage.FlagEncrypted
+		}
+
+		w, err := aw.CreateHeader(fh)
+		assert.Nil(t, err, test.scenario)
+		_, err = io.WriteString(w, test.contents)
+		assert.Nil(t, err, test.scenario)
+	}
+	assert.Nil(t, aw.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Len(t, zr.File, len(tests))
+
+	for i, test := range tests {
+		f := zr.File[i]
+		assert.Equal(t, test.name, f.Name, test.scenario)
+		assert.Equal(t, modified, f.Modified.UTC(), test.scenario)
+		assert.Equal(t, uint64(len(test.contents)), f.UncompressedSize64, test.scenario)
+
+		if !test.encrypted {
+			rc, err := f.Open()
+			assert.Nil(t, err, test.scenario)
+			b, _ := io.ReadAll(rc)
+			assert.Equal(t, test.contents, string(b), test.scenario)
+			continue
+		}
+
+		b, err := decryptAESFile(f, enc.Password)
+		assert.Nil(t, err, test.scenario)
+		assert.Equal(t, test.contents, string(b), test.scenario)
+
+		_, err = decryptAESFile(f, "wrong password")
+		assert.EqualError(t, err, "wrong password", test.scenario)
+	}
+}
+
+func TestAESZipWriter_Tampered(t *testing.T) {
+	enc := &storage.Encryption{Password: "correct horse battery"}
+
+	buf := new(bytes.Buffer)
+	aw := NewAESZipWriter(buf)
+	assert.Nil(t, aw.Encrypt(enc))
+
+	w, _ := aw.CreateHeader(&zip.FileHeader{Name: "file", Method: zip.Store, Flags: storage.FlagEncrypted})
+	_, _ = io.WriteString(w, "contents of file")
+	assert.Nil(t, aw.Close())
+
+	b := buf.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	assert.Nil(t, err)
+
+	// flip the first byte of the encrypted contents
+	offset, _ := zr.File[0].DataOffset()
+	b[offset+aesSaltLen+aesVerifierLen] ^= 0xff
+
+	_, err = decryptAESFile(zr.File[0], enc.Password)
+	assert.EqualError(t, err, "authentication code does not match")
+}
+
+func TestAESZipWriter_Errors(t *testing.T) {
+	aw := NewAESZipWriter(io.Discard)
+
+	assert.EqualError(t, aw.Encrypt(&storage.Encryption{Method: "zipcrypto", Password: "correct horse battery"}), "zip: unsupported encryption method: zipcrypto")
+	assert.EqualError(t, aw.Encrypt(&storage.Encryption{}), "zip: missing password")
+
+	_, err := aw.CreateHeader(&zip.FileHeader{Name: "file", Flags: storage.FlagEncrypted})
+	assert.EqualError(t, err, "zip: no password to encrypt file with")
+
+	assert.Nil(t, aw.Encrypt(&storage.Encryption{Password: "correct horse battery"}))
+	_, err = aw.CreateHeader(&zip.FileHeader{Name: "file", Method: 12, Flags: storage.FlagEncrypted})
+	assert.EqualError(t, err, "zip: unable to encrypt a file compressed with method 12")
+}
@@ -0,0 +1,118 @@
+package zipper
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// SpillBuffer is an io.WriterAt which keeps up to limit bytes in memory, moving its
+// contents to a temporary file on disk once a write goes beyond that limit
+type SpillBuffer struct {
+	mu    sync.Mutex
+	limit int64
+	mem   []byte
+	file  *os.File
+	size  int64
+}
+
+func NewSpillBuffer(limit int64) *SpillBuffer {
+	return &SpillBuffer{limit: limit}
+}
+
+func (b *SpillBuffer) WriteAt(p []byte, offset int64) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	end := offset + int64(len(p))
+
+	if b.file == nil && end > b.limit {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.file != nil {
+		n, err = b.file.WriteAt(p, offset)
+		b.size = max(b.size, offset+int64(n))
+		return n, err
+	}
+
+	if end > int64(len(b.mem)) {
+		if end > int64(cap(b.mem)) {
+			mem := make([]byte, end, max(end, 2*int64(cap(b.mem))))
+			copy(mem, b.mem)
+			b.mem = mem
+		}
+		b.mem = b.mem[:end]
+	}
+
+	n = copy(b.mem[offset:], p)
+	b.size = max(b.size, end)
+
+	return n, nil
+}
+
+// Size returns the number of bytes written to the buffer
+func (b *SpillBuffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.size
+}
+
+// Spilled reports whether the buffer has moved its contents to disk
+func (b *SpillBuffer) Spilled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.file != nil
+}
+
+// Reader returns a reader over everything written to the buffer so far
+func (b *SpillBuffer) Reader() io.Reader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.mem[:b.size])
+}
+
+// Close releases the memory held by the buffer and removes its temporary file, if any
+func (b *SpillBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.mem = nil
+	if b.file == nil {
+		return nil
+	}
+
+	name := b.file.Name()
+	err := b.file.Close()
+	b.file = nil
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+func (b *SpillBuffer) spill() error {
+	f, err := os.CreateTemp("", "opg-file-service-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b.mem[:b.size]); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	b.file = f
+	b.mem = nil
+	return nil
+}
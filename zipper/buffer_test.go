@@ -0,0 +1,48 @@
+package zipper
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSpillBuffer_InMemory(t *testing.T) {
+	b := NewSpillBuffer(16)
+
+	_, err := b.WriteAt([]byte("World"), 6)
+	assert.Nil(t, err)
+	_, err = b.WriteAt([]byte("Hello "), 0)
+	assert.Nil(t, err)
+
+	assert.False(t, b.Spilled())
+	assert.Equal(t, int64(11), b.Size())
+
+	got, _ := io.ReadAll(b.Reader())
+	assert.Equal(t, "Hello World", string(got))
+	assert.Nil(t, b.Close())
+}
+
+func TestSpillBuffer_Spill(t *testing.T) {
+	b := NewSpillBuffer(8)
+
+	_, err := b.WriteAt([]byte("Hello "), 0)
+	assert.Nil(t, err)
+	assert.False(t, b.Spilled())
+
+	_, err = b.WriteAt([]byte("World"), 6)
+	assert.Nil(t, err)
+	assert.True(t, b.Spilled())
+	assert.Equal(t, int64(11), b.Size())
+
+	name := b.file.Name()
+	_, err = os.Stat(name)
+	assert.Nil(t, err)
+
+	got, _ := io.ReadAll(b.Reader())
+	assert.Equal(t, "Hello World", string(got))
+
+	assert.Nil(t, b.Close())
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+}
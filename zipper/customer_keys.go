@@ -0,0 +1,47 @@
+package zipper
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+)
+
+// SSE-C keys are held in secrets with this prefix, so a zip request can only refer to them
+// and not to any other secret of the service
+const customerKeySecretPrefix = "sse-c-keys/"
+
+// CustomerKeys finds the keys of objects encrypted with SSE-C, so that zip requests only
+// hold a reference to a key rather than the key itself
+type CustomerKeys interface {
+	CustomerKey(ref string) ([]byte, error)
+}
+
+// SecretCustomerKeys finds SSE-C keys held base64 encoded in Secrets Manager
+type SecretCustomerKeys struct {
+	secrets cacheable
+}
+
+func NewSecretCustomerKeys(secrets cacheable) *SecretCustomerKeys {
+	return &SecretCustomerKeys{secrets}
+}
+
+func (k *SecretCustomerKeys) CustomerKey(ref string) ([]byte, error) {
+	secret, err := k.secrets.GetSecretString(customerKeySecretPrefix + ref)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("SSE-C key " + ref + " must be a base64 encoded 256-bit key")
+	}
+
+	return key, nil
+}
+
+// customerKeyHeaders returns the algorithm, key and key MD5 S3 needs to read an object
+// encrypted with an SSE-C key
+func customerKeyHeaders(key []byte) (string, string, string) {
+	sum := md5.Sum(key)
+	return "AES256", base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,44 @@
+package zipper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var testCustomerKey = bytes.Repeat([]byte{9}, 32)
+
+func TestSecretCustomerKeys_CustomerKey(t *testing.T) {
+	tests := []struct {
+		scenario  string
+		secret    string
+		secretErr error
+		wantKey   []byte
+		wantErr   error
+	}{
+		{"Key found", base64.StdEncoding.EncodeToString(testCustomerKey), nil, testCustomerKey, nil},
+		{"Key is not 256 bits", base64.StdEncoding.EncodeToString([]byte("too short")), nil, nil, errors.New("SSE-C key documents must be a base64 encoded 256-bit key")},
+		{"Key is not base64 encoded", "not base64!", nil, nil, errors.New("SSE-C key documents must be a base64 encoded 256-bit key")},
+		{"Unable to fetch the key", "", errors.New("some secrets error"), nil, errors.New("some secrets error")},
+	}
+
+	for _, test := range tests {
+		ms := new(MockSecretsCache)
+		ms.On("GetSecretString", "sse-c-keys/documents").Return(test.secret, test.secretErr)
+
+		key, err := NewSecretCustomerKeys(ms).CustomerKey("documents")
+
+		assert.Equal(t, test.wantKey, key, test.scenario)
+		assert.Equal(t, test.wantErr, err, test.scenario)
+	}
+}
+
+func TestCustomerKeyHeaders(t *testing.T) {
+	algorithm, key, md5 := customerKeyHeaders(testCustomerKey)
+
+	assert.Equal(t, "AES256", algorithm)
+	assert.Equal(t, "CQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQk=", key)
+	assert.Equal(t, "SCY5xzBvyA28HDOoR/qKFA==", md5)
+}
@@ -0,0 +1,96 @@
+package zipper
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"opg-file-service/storage"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Format describes an archive format which files can be streamed as
+type Format struct {
+	Name        string
+	ContentType string
+	Extension   string
+	mediaTypes  []string // media types in an Accept header which select this format
+}
+
+var (
+	Zip    = Format{storage.FormatZip, "application/zip", ".zip", []string{"application/zip", "application/x-zip-compressed"}}
+	Tar    = Format{storage.FormatTar, "application/x-tar", ".tar", []string{"application/x-tar"}}
+	TarGz  = Format{storage.FormatTarGz, "application/gzip", ".tar.gz", []string{"application/gzip", "application/x-gzip", "application/x-gtar"}}
+	TarZst = Format{storage.FormatTarZst, "application/zstd", ".tar.zst", []string{"application/zstd"}}
+)
+
+var formats = []Format{Zip, Tar, TarGz, TarZst}
+
+// FormatByName returns the Format with the given name, as stored on a storage.Entry
+func FormatByName(name string) (Format, bool) {
+	for _, f := range formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// FormatFromAccept picks the most preferred Format listed in an Accept header,
+// falling back to Zip when none of the listed media types are supported
+func FormatFromAccept(accept string) Format {
+	best, bestQ := Zip, 0.0
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		for _, f := range formats {
+			for _, mt := range f.mediaTypes {
+				if mt == mediaType && q > bestQ {
+					best, bestQ = f, q
+				}
+			}
+		}
+	}
+
+	return best
+}
+
+// newArchiveWriter creates a ZipWriter which writes files to w in the given format
+func newArchiveWriter(w io.Writer, format Format) (ZipWriter, error) {
+	switch format.Name {
+	case storage.FormatZip:
+		return NewAESZipWriter(w), nil
+	case storage.FormatTar:
+		return newTarWriter(w), nil
+	case storage.FormatTarGz:
+		gw := gzip.NewWriter(w)
+		return newTarWriter(gw, gw), nil
+	case storage.FormatTarZst:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return newTarWriter(zw, zw), nil
+	}
+
+	return nil, errors.New("unsupported archive format: " + format.Name)
+}
+
+// needsSize reports whether the size of a file must be known before it is added to the archive
+func (f Format) needsSize() bool {
+	return f.Name == storage.FormatTar || f.Name == storage.FormatTarGz || f.Name == storage.FormatTarZst
+}
@@ -0,0 +1,94 @@
+package zipper
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"opg-file-service/storage"
+	"testing"
+)
+
+func TestFormatByName(t *testing.T) {
+	for _, name := range storage.ArchiveFormats {
+		f, ok := FormatByName(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, name, f.Name)
+	}
+
+	_, ok := FormatByName("rar")
+	assert.False(t, ok)
+
+	_, ok = FormatByName("")
+	assert.False(t, ok)
+}
+
+func TestFormatFromAccept(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   Format
+	}{
+		{"", Zip},
+		{"*/*", Zip},
+		{"application/json", Zip},
+		{"application/zip", Zip},
+		{"application/x-tar", Tar},
+		{"application/gzip", TarGz},
+		{"application/x-gzip", TarGz},
+		{"application/zstd", TarZst},
+		{"application/json, application/x-tar", Tar},
+		{"application/zip;q=0.5, application/zstd", TarZst},
+		{"application/zip, application/zstd;q=0.9", Zip},
+		{"application/zstd;q=nope, application/gzip;q=0.1", TarGz},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, FormatFromAccept(test.accept), test.accept)
+	}
+}
+
+func TestNewArchiveWriter(t *testing.T) {
+	decompress := map[string]func(r io.Reader) io.Reader{
+		storage.FormatTar: func(r io.Reader) io.Reader { return r },
+		storage.FormatTarGz: func(r io.Reader) io.Reader {
+			gr, err := gzip.NewReader(r)
+			assert.Nil(t, err)
+			return gr
+		},
+		storage.FormatTarZst: func(r io.Reader) io.Reader {
+			zr, err := zstd.NewReader(r)
+			assert.Nil(t, err)
+			return zr
+		},
+	}
+
+	for _, format := range []Format{Tar, TarGz, TarZst} {
+		buf := new(bytes.Buffer)
+		aw, err := newArchiveWriter(buf, format)
+		assert.Nil(t, err, format.Name)
+
+		f := storage.File{FileName: "file.txt", Folder: "folder"}
+		fh := f.GetZipFileHeader(nil)
+		fh.UncompressedSize64 = 5
+
+		w, err := aw.CreateHeader(fh)
+		assert.Nil(t, err, format.Name)
+		_, _ = w.Write([]byte("Hello"))
+		assert.Nil(t, aw.Close(), format.Name)
+
+		tr := tar.NewReader(decompress[format.Name](buf))
+		hdr, err := tr.Next()
+		assert.Nil(t, err, format.Name)
+		assert.Equal(t, "folder/file.txt", hdr.Name, format.Name)
+		b, _ := io.ReadAll(tr)
+		assert.Equal(t, "Hello", string(b), format.Name)
+
+		_, err = tr.Next()
+		assert.Equal(t, io.EOF, err, format.Name)
+	}
+
+	_, err := newArchiveWriter(io.Discard, Format{Name: "rar"})
+	assert.Equal(t, "unsupported archive format: rar", err.Error())
+}
@@ -0,0 +1,290 @@
+package zipper
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"opg-file-service/storage"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Names of the archive entries holding the manifest and its signature, which are always the last in the archive
+const (
+	ManifestName          = "MANIFEST.json"
+	ManifestSignatureName = "MANIFEST.json.sig"
+)
+
+// Manifest lists the files taken from S3 for an archive, so that its contents can be proved to match
+type Manifest struct {
+	Files []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Path      string `json:"path"`                // name of the file inside the archive
+	S3path    string `json:"s3path,omitempty"`    // blank for the error report, which is written by the service
+	VersionID string `json:"versionId,omitempty"` // blank when the bucket is not versioned
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"` // hex encoded
+}
+
+// Signer signs the manifest of an archive
+type Signer interface {
+	Sign(manifest []byte) ([]byte, error)
+}
+
+type cacheable interface {
+	GetSecretString(key string) (string, error)
+}
+
+// ManifestSigner signs manifests with the Ed25519 key whose base64 encoded seed is held in Secrets Manager
+type ManifestSigner struct {
+	secrets cacheable
+}
+
+func NewManifestSigner(secrets cacheable) *ManifestSigner {
+	return &ManifestSigner{secrets}
+}
+
+func (s *ManifestSigner) Sign(manifest []byte) ([]byte, error) {
+	secret, err := s.secrets.GetSecretString("manifest-signing-key")
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("manifest signing key must be a base64 encoded Ed25519 seed")
+	}
+
+	return ed25519.Sign(ed25519.NewKeyFromSeed(seed), manifest), nil
+}
+
+// manifestRecorder collects the manifest of an archive as files are added to it
+type manifestRecorder struct {
+	mu       sync.Mutex
+	versions map[string]string // version of each object downloaded, by objectKey
+	files    []ManifestFile
+}
+
+func (m *manifestRecorder) setVersion(key, versionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.versions[key] = versionID
+}
+
+func (m *manifestRecorder) add(f *storage.File, hw *hashingWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files = append(m.files, ManifestFile{
+		Path:      f.GetRelativePath(),
+		S3path:    f.S3path,
+		VersionID: m.versions[objectKey(f)],
+		Size:      hw.n,
+		SHA256:    hex.EncodeToString(hw.h.Sum(nil)),
+	})
+}
+
+// addReport records a file written by the service rather than taken from S3
+func (m *manifestRecorder) addReport(name string, content []byte) {
+	sum := sha256.Sum256(content)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files = append(m.files, ManifestFile{
+		Path:   name,
+		Size:   int64(len(content)),
+		SHA256: hex.EncodeToString(sum[:]),
+	})
+}
+
+// hashingWriter hashes the contents of a file on its way into the archive
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, h: sha256.New()}
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	hw.n += int64(n)
+	return n, err
+}
+
+// withVersionID passes the version of the object fetched by a download to record,
+// as manager.Downloader only returns the number of bytes downloaded
+func withVersionID(record func(versionID string)) func(*manager.Downloader) {
+	return func(d *manager.Downloader) {
+		d.ClientOptions = append(d.ClientOptions, func(o *s3.Options) {
+			o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+				return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RecordVersionID",
+					func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+						out, md, err := next.HandleInitialize(ctx, in)
+						if res, ok := out.Result.(*s3.GetObjectOutput); ok && res.VersionId != nil {
+							record(*res.VersionId)
+						}
+						return out, md, err
+					}), middleware.After)
+			})
+		})
+	}
+}
+
+// VerifyManifest checks that the manifest of an archive was signed by the key belonging
+// to publicKey, and that every file in the archive matches its entry in the manifest
+func VerifyManifest(r io.ReaderAt, size int64, format Format, publicKey ed25519.PublicKey) (*Manifest, error) {
+	type summary struct {
+		size   int64
+		sha256 string
+	}
+
+	var (
+		manifest, signature []byte
+		files               = map[string]summary{}
+	)
+
+	err := walkArchive(r, size, format, func(name string, contents io.Reader) error {
+		switch name {
+		case ManifestName:
+			b, err := io.ReadAll(contents)
+			manifest = b
+			return err
+		case ManifestSignatureName:
+			b, err := io.ReadAll(contents)
+			signature = b
+			return err
+		}
+
+		hw := newHashingWriter(io.Discard)
+		if _, err := io.Copy(hw, contents); err != nil {
+			return err
+		}
+		files[name] = summary{hw.n, hex.EncodeToString(hw.h.Sum(nil))}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil || signature == nil {
+		return nil, errors.New("archive does not contain a signed manifest")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(string(signature))
+	if err != nil || !ed25519.Verify(publicKey, manifest, sig) {
+		return nil, errors.New("manifest signature is not valid")
+	}
+
+	m := new(Manifest)
+	if err := json.Unmarshal(manifest, m); err != nil {
+		return nil, err
+	}
+
+	for _, f := range m.Files {
+		got, ok := files[f.Path]
+		if !ok {
+			return m, errors.New("file in manifest is missing from the archive: " + f.Path)
+		}
+		if got.size != f.Size || got.sha256 != f.SHA256 {
+			return m, errors.New("file does not match the manifest: " + f.Path)
+		}
+		delete(files, f.Path)
+	}
+
+	for name := range files {
+		return m, errors.New("file in the archive is missing from the manifest: " + name)
+	}
+
+	return m, nil
+}
+
+// walkArchive calls fn with the name and contents of each file in an archive
+func walkArchive(r io.ReaderAt, size int64, format Format, fn func(name string, contents io.Reader) error) error {
+	if format.Name == storage.FormatZip {
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(f.Name, rc)
+			_ = rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var tr *tar.Reader
+	sr := io.NewSectionReader(r, 0, size)
+
+	switch format.Name {
+	case storage.FormatTar:
+		tr = tar.NewReader(sr)
+	case storage.FormatTarGz:
+		gr, err := gzip.NewReader(sr)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		tr = tar.NewReader(gr)
+	case storage.FormatTarZst:
+		zr, err := zstd.NewReader(sr)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		tr = tar.NewReader(zr)
+	default:
+		return errors.New("unsupported archive format: " + format.Name)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// marshalManifest encodes a manifest for the archive, readable by people as well as programs
+func marshalManifest(m Manifest) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
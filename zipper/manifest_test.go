@@ -0,0 +1,257 @@
+package zipper
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"opg-file-service/storage"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockSecretsCache struct {
+	mock.Mock
+}
+
+func (m *MockSecretsCache) GetSecretString(key string) (string, error) {
+	args := m.Called(key)
+	return args.Get(0).(string), args.Error(1)
+}
+
+var testManifestSeed = bytes.Repeat([]byte{7}, ed25519.SeedSize)
+
+func newTestManifestSigner() (*ManifestSigner, ed25519.PublicKey) {
+	ms := new(MockSecretsCache)
+	ms.On("GetSecretString", "manifest-signing-key").Return(base64.StdEncoding.EncodeToString(testManifestSeed), nil)
+
+	return NewManifestSigner(ms), ed25519.NewKeyFromSeed(testManifestSeed).Public().(ed25519.PublicKey)
+}
+
+// buildManifestArchive zips files with a signed manifest, in the given format
+func buildManifestArchive(t *testing.T, format Format, files []storage.File, objects map[string]string) []byte {
+	signer, _ := newTestManifestSigner()
+
+	buf := new(bytes.Buffer)
+	z := Zipper{s3: &fakeDownloader{objects: objects}, concurrency: 2, memoryLimit: 4}
+
+	assert.Nil(t, z.OpenWriter(buf, format))
+	assert.Nil(t, z.RecordManifest())
+	z.Prefetch(t.Context(), files)
+
+	_, err := AddFiles(t.Context(), &z, files, storage.FailurePolicySkip)
+	assert.Nil(t, err)
+	assert.Nil(t, z.AddManifest(signer))
+	assert.Nil(t, z.Close())
+
+	return buf.Bytes()
+}
+
+func TestManifestSigner_Sign(t *testing.T) {
+	tests := []struct {
+		scenario  string
+		secret    string
+		secretErr error
+		wantErr   error
+	}{
+		{"Signed with the Ed25519 key", base64.StdEncoding.EncodeToString(testManifestSeed), nil, nil},
+		{"Key is not an Ed25519 seed", base64.StdEncoding.EncodeToString([]byte("too short")), nil, errors.New("manifest signing key must be a base64 encoded Ed25519 seed")},
+		{"Key is not base64 encoded", "not base64!", nil, errors.New("manifest signing key must be a base64 encoded Ed25519 seed")},
+		{"Unable to fetch the key", "", errors.New("some secrets error"), errors.New("some secrets error")},
+	}
+
+	for _, test := range tests {
+		ms := new(MockSecretsCache)
+		ms.On("GetSecretString", "manifest-signing-key").Return(test.secret, test.secretErr)
+
+		sig, err := NewManifestSigner(ms).Sign([]byte("manifest"))
+
+		assert.Equal(t, test.wantErr, err, test.scenario)
+		if test.wantErr == nil {
+			publicKey := ed25519.NewKeyFromSeed(testManifestSeed).Public().(ed25519.PublicKey)
+			assert.True(t, ed25519.Verify(publicKey, []byte("manifest"), sig), test.scenario)
+		}
+	}
+}
+
+func TestZipper_AddManifest(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://bucket/file1", FileName: "file1.txt", Folder: "folder"},
+		{S3path: "s3://bucket/missing", FileName: "missing.txt"},
+		{S3path: "s3://bucket/file2", FileName: "file2.txt"},
+	}
+	objects := map[string]string{"file1": "contents of file1", "file2": "contents of file2"}
+
+	for _, format := range []Format{Zip, Tar, TarGz, TarZst} {
+		b := buildManifestArchive(t, format, files, objects)
+
+		var names []string
+		err := walkArchive(bytes.NewReader(b), int64(len(b)), format, func(name string, contents io.Reader) error {
+			names = append(names, name)
+			return nil
+		})
+		assert.Nil(t, err, format.Name)
+		assert.Equal(t, []string{"folder/file1.txt", "file2.txt", ErrorReportName, ManifestName, ManifestSignatureName}, names, format.Name)
+
+		_, publicKey := newTestManifestSigner()
+		m, err := VerifyManifest(bytes.NewReader(b), int64(len(b)), format, publicKey)
+		assert.Nil(t, err, format.Name)
+		assert.Len(t, m.Files, 3, format.Name)
+		assert.Equal(t, []ManifestFile{
+			{Path: "folder/file1.txt", S3path: "s3://bucket/file1", Size: 17, SHA256: "9dac22979e1931a3e8fe51795a5e0a78df49e25bd5da8397b56bb1820ee9d6cd"},
+			{Path: "file2.txt", S3path: "s3://bucket/file2", Size: 17, SHA256: "5a6f0a07a8ee8061923876559c4eb8cc1bcb4df254ed64fc2dfb8a0609397339"},
+		}, m.Files[:2], format.Name)
+
+		// the error report is signed along with the files, though it is not taken from S3
+		assert.Equal(t, ErrorReportName, m.Files[2].Path, format.Name)
+		assert.Empty(t, m.Files[2].S3path, format.Name)
+	}
+}
+
+func TestZipper_AddManifest_Errors(t *testing.T) {
+	z := Zipper{zw: NewAESZipWriter(io.Discard)}
+	assert.Equal(t, errors.New("unable to add a manifest which was not recorded"), z.AddManifest(nil))
+
+	z = Zipper{objects: map[string]storedObject{}}
+	assert.Equal(t, errors.New("unable to record a manifest of a stored zip"), z.RecordManifest())
+
+	z = Zipper{format: Zip, manifest: &manifestRecorder{}}
+	_, err := z.Store(t.Context(), nil)
+	assert.Equal(t, errors.New("unable to store files in an archive with a manifest"), err)
+}
+
+func TestVerifyManifest_Invalid(t *testing.T) {
+	files := []storage.File{{S3path: "s3://bucket/file1", FileName: "file1.txt"}}
+	good := buildManifestArchive(t, Zip, files, map[string]string{"file1": "contents of file1"})
+
+	// copy the manifest and its signature from a good archive into one with other files
+	zr, _ := zip.NewReader(bytes.NewReader(good), int64(len(good)))
+	var manifest, signature []byte
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		switch f.Name {
+		case ManifestName:
+			manifest = b
+		case ManifestSignatureName:
+			signature = b
+		}
+	}
+
+	archive := func(entries ...string) []byte {
+		buf := new(bytes.Buffer)
+		zw := zip.NewWriter(buf)
+		for i := 0; i < len(entries); i += 2 {
+			w, _ := zw.Create(entries[i])
+			_, _ = w.Write([]byte(entries[i+1]))
+		}
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+
+	_, publicKey := newTestManifestSigner()
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{8}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+
+	tests := []struct {
+		scenario  string
+		archive   []byte
+		publicKey ed25519.PublicKey
+		wantErr   error
+	}{
+		{
+			"No manifest",
+			archive("file1.txt", "contents of file1"),
+			publicKey,
+			errors.New("archive does not contain a signed manifest"),
+		},
+		{
+			"Signed with another key",
+			good,
+			otherKey,
+			errors.New("manifest signature is not valid"),
+		},
+		{
+			"Manifest has been changed",
+			archive("file1.txt", "contents of file1", ManifestName, string(bytes.Replace(manifest, []byte("file1"), []byte("file2"), 1)), ManifestSignatureName, string(signature)),
+			publicKey,
+			errors.New("manifest signature is not valid"),
+		},
+		{
+			"File has been changed",
+			archive("file1.txt", "contents of file2", ManifestName, string(manifest), ManifestSignatureName, string(signature)),
+			publicKey,
+			errors.New("file does not match the manifest: file1.txt"),
+		},
+		{
+			"File has been removed",
+			archive(ManifestName, string(manifest), ManifestSignatureName, string(signature)),
+			publicKey,
+			errors.New("file in manifest is missing from the archive: file1.txt"),
+		},
+		{
+			"File has been added",
+			archive("file1.txt", "contents of file1", "extra.txt", "extra", ManifestName, string(manifest), ManifestSignatureName, string(signature)),
+			publicKey,
+			errors.New("file in the archive is missing from the manifest: extra.txt"),
+		},
+		{
+			"Error report has been added",
+			archive("file1.txt", "contents of file1", ErrorReportName, "file2.txt could not be included", ManifestName, string(manifest), ManifestSignatureName, string(signature)),
+			publicKey,
+			errors.New("file in the archive is missing from the manifest: " + ErrorReportName),
+		},
+	}
+
+	for _, test := range tests {
+		_, err := VerifyManifest(bytes.NewReader(test.archive), int64(len(test.archive)), Zip, test.publicKey)
+		assert.Equal(t, test.wantErr, err, test.scenario)
+	}
+}
+
+func TestWithVersionID(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("x-amz-version-id", "v2")
+		rw.Header().Set("Content-Range", "bytes 0-16/17")
+		rw.WriteHeader(http.StatusPartialContent)
+		_, _ = rw.Write([]byte("contents of file1"))
+	}))
+	defer srv.Close()
+
+	client := s3.New(s3.Options{
+		Region:       "eu-west-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+
+	var versionID string
+	buf := manager.NewWriteAtBuffer(nil)
+	_, err := manager.NewDownloader(client).Download(t.Context(), buf, &s3.GetObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("file1"),
+	}, withVersionID(func(v string) { versionID = v }))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "contents of file1", string(buf.Bytes()))
+	assert.Equal(t, "v2", versionID)
+}
+
+func TestMarshalManifest(t *testing.T) {
+	b, err := marshalManifest(Manifest{Files: []ManifestFile{{Path: "a&b.txt", S3path: "s3://bucket/a", Size: 1, SHA256: "ab"}}})
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"path": "a&b.txt"`)
+
+	var m Manifest
+	assert.Nil(t, json.Unmarshal(b, &m))
+	assert.Equal(t, "s3://bucket/a", m.Files[0].S3path)
+}
@@ -0,0 +1,89 @@
+package zipper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"opg-file-service/storage"
+)
+
+// the secret holding the key zip request passwords are sealed with
+const passwordKeySecret = "password-encryption-key"
+
+// Passwords seals the passwords of encrypted zip requests before they are saved, so that they
+// cannot be read by anyone who can read the zip requests, and opens them to write the archive
+type Passwords interface {
+	Seal(enc *storage.Encryption) error
+	Open(enc *storage.Encryption) (*storage.Encryption, error)
+}
+
+// SecretPasswords seals passwords with AES-256-GCM, using a base64 encoded key in Secrets Manager
+type SecretPasswords struct {
+	secrets cacheable
+}
+
+func NewSecretPasswords(secrets cacheable) *SecretPasswords {
+	return &SecretPasswords{secrets}
+}
+
+// Seal replaces the password with SealedPassword
+func (p *SecretPasswords) Seal(enc *storage.Encryption) error {
+	aead, err := p.aead()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce)
+
+	enc.SealedPassword = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(enc.Password), nil))
+	enc.Password = ""
+	return nil
+}
+
+// Open returns a copy of enc with the password from its SealedPassword. Passwords saved before
+// they were sealed are returned as they are.
+func (p *SecretPasswords) Open(enc *storage.Encryption) (*storage.Encryption, error) {
+	if enc.SealedPassword == "" {
+		return enc, nil
+	}
+
+	aead, err := p.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(enc.SealedPassword)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("zip request password is not sealed")
+	}
+
+	password, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("unable to open zip request password")
+	}
+
+	opened := *enc
+	opened.Password, opened.SealedPassword = string(password), ""
+	return &opened, nil
+}
+
+func (p *SecretPasswords) aead() (cipher.AEAD, error) {
+	secret, err := p.secrets.GetSecretString(passwordKeySecret)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New(passwordKeySecret + " must be a base64 encoded 256-bit key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,76 @@
+package zipper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"opg-file-service/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testPasswordKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{5}, 32))
+
+func newTestPasswords() *SecretPasswords {
+	ms := new(MockSecretsCache)
+	ms.On("GetSecretString", "password-encryption-key").Return(testPasswordKey, nil)
+	return NewSecretPasswords(ms)
+}
+
+func TestSecretPasswords_Seal(t *testing.T) {
+	p := newTestPasswords()
+
+	enc := &storage.Encryption{Method: storage.EncryptionAES256, Password: "correct horse battery"}
+	assert.Nil(t, p.Seal(enc))
+	assert.Empty(t, enc.Password)
+	assert.NotContains(t, enc.SealedPassword, "correct horse battery")
+
+	opened, err := p.Open(enc)
+	assert.Nil(t, err)
+	assert.Equal(t, &storage.Encryption{Method: storage.EncryptionAES256, Password: "correct horse battery"}, opened)
+
+	// the same password is sealed differently each time
+	other := &storage.Encryption{Password: "correct horse battery"}
+	_ = p.Seal(other)
+	assert.NotEqual(t, enc.SealedPassword, other.SealedPassword)
+}
+
+func TestSecretPasswords_Open(t *testing.T) {
+	sealed := &storage.Encryption{Password: "correct horse battery"}
+	_ = newTestPasswords().Seal(sealed)
+
+	raw, _ := base64.StdEncoding.DecodeString(sealed.SealedPassword)
+	raw[len(raw)-1] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		scenario     string
+		enc          *storage.Encryption
+		key          string
+		keyErr       error
+		wantPassword string
+		wantErr      error
+	}{
+		{"Sealed password", sealed, testPasswordKey, nil, "correct horse battery", nil},
+		{"Password saved before passwords were sealed", &storage.Encryption{Password: "correct horse battery"}, testPasswordKey, nil, "correct horse battery", nil},
+		{"Sealed with another key", sealed, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{6}, 32)), nil, "", errors.New("unable to open zip request password")},
+		{"Sealed password has been changed", &storage.Encryption{SealedPassword: tampered}, testPasswordKey, nil, "", errors.New("unable to open zip request password")},
+		{"Sealed password is not base64", &storage.Encryption{SealedPassword: "not base64!"}, testPasswordKey, nil, "", errors.New("zip request password is not sealed")},
+		{"Key is not 256 bits", sealed, base64.StdEncoding.EncodeToString([]byte("too short")), nil, "", errors.New("password-encryption-key must be a base64 encoded 256-bit key")},
+		{"Unable to fetch the key", sealed, "", errors.New("some secrets error"), "", errors.New("some secrets error")},
+	}
+
+	for _, test := range tests {
+		ms := new(MockSecretsCache)
+		ms.On("GetSecretString", "password-encryption-key").Return(test.key, test.keyErr)
+
+		opened, err := NewSecretPasswords(ms).Open(test.enc)
+
+		assert.Equal(t, test.wantErr, err, test.scenario)
+		if test.wantErr == nil {
+			assert.Equal(t, test.wantPassword, opened.Password, test.scenario)
+			assert.Empty(t, opened.SealedPassword, test.scenario)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package zipper
+
+import (
+	"context"
+	"opg-file-service/storage"
+	"sync"
+)
+
+// fetch is a single file being downloaded ahead of being written to the zip
+type fetch struct {
+	file storage.File
+	key  string // objectKey of the file
+	buf  *SpillBuffer
+	err  error
+	done chan struct{}
+}
+
+// prefetcher downloads files concurrently ahead of the zip writer, keeping at most
+// cap(slots) downloaded but not yet zipped files at a time. Fetches are handed back
+// in the order the files were requested.
+type prefetcher struct {
+	mu     sync.Mutex
+	queue  []*fetch
+	slots  chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // the goroutines starting and running downloads
+}
+
+func newPrefetcher(ctx context.Context, files []storage.File, concurrency int, download func(ctx context.Context, f *storage.File) (*SpillBuffer, error)) *prefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+
+	p := &prefetcher{
+		slots:  make(chan struct{}, concurrency),
+		cancel: cancel,
+	}
+
+	for _, file := range files {
+		p.queue = append(p.queue, &fetch{file: file, key: objectKey(&file), done: make(chan struct{})})
+	}
+
+	queue := p.queue
+	p.wg.Go(func() {
+		for _, f := range queue {
+			select {
+			case p.slots <- struct{}{}:
+			case <-ctx.Done():
+				f.err = ctx.Err()
+				close(f.done)
+				continue
+			}
+
+			p.wg.Go(func() {
+				f.buf, f.err = download(ctx, &f.file)
+				close(f.done)
+			})
+		}
+	})
+
+	// clean up after ourselves even if the download is abandoned part way through
+	context.AfterFunc(ctx, p.close)
+
+	return p
+}
+
+// next returns the fetch for the object with the given key if it is the next one in the queue
+func (p *prefetcher) next(key string) *fetch {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue) == 0 || p.queue[0].key != key {
+		return nil
+	}
+
+	f := p.queue[0]
+	p.queue = p.queue[1:]
+
+	return f
+}
+
+// wait blocks until the fetch has finished downloading
+func (p *prefetcher) wait(ctx context.Context, f *fetch) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release discards a fetch which has been consumed, freeing its slot for the next download
+func (p *prefetcher) release(f *fetch) {
+	go func() {
+		<-f.done
+		if f.buf != nil {
+			_ = f.buf.Close()
+		}
+		<-p.slots
+	}()
+}
+
+// close cancels outstanding downloads, including those released without being waited for,
+// and removes any buffered files which were never consumed
+func (p *prefetcher) close() {
+	if p == nil {
+		return
+	}
+
+	p.cancel()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, f := range p.queue {
+		<-f.done
+		if f.buf != nil {
+			_ = f.buf.Close()
+		}
+	}
+	p.queue = nil
+}
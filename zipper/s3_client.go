@@ -0,0 +1,11 @@
+package zipper
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// allows us to mock s3.Client in our tests
+type S3Client interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
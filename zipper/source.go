@@ -0,0 +1,120 @@
+package zipper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Source fetches files from somewhere other than S3, such as a mounted volume or another
+// document service
+type Source interface {
+	Open(ctx context.Context, u *url.URL) (io.ReadCloser, error)
+}
+
+// Sources are where files which are not in S3 are fetched from, by the scheme of their URI
+type Sources map[string]Source
+
+// FileSource fetches file:// URIs from a directory, such as a mounted volume. The path of
+// a URI is relative to the directory, and cannot reach outside of it.
+type FileSource struct {
+	dir string
+}
+
+func NewFileSource(dir string) *FileSource {
+	return &FileSource{dir}
+}
+
+func (s *FileSource) Open(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, errors.New("file is not on this host: " + u.String())
+	}
+
+	f, err := os.OpenInRoot(s.dir, strings.TrimPrefix(u.Path, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = errors.New("not a file: " + u.String())
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// HTTPSource fetches https:// URLs from a list of allowed hosts, such as an internal
+// document service, so that the service cannot be used to make requests elsewhere
+type HTTPSource struct {
+	client       *http.Client
+	allowedHosts []string
+}
+
+func NewHTTPSource(client *http.Client, allowedHosts []string) *HTTPSource {
+	s := &HTTPSource{allowedHosts: allowedHosts}
+
+	// redirects are only followed to hosts which are also allowed
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !s.allowed(req.URL) {
+			return errors.New("redirected to a host which is not an allowed source: " + req.URL.Host)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	s.client = &c
+
+	return s
+}
+
+func (s *HTTPSource) Open(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	if !s.allowed(u) {
+		return nil, errors.New("host is not an allowed source: " + u.Host)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, errors.New("unable to fetch " + u.String() + ": " + resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (s *HTTPSource) allowed(u *url.URL) bool {
+	return u.Scheme == "https" && u.User == nil && slices.Contains(s.allowedHosts, u.Host)
+}
+
+// copySource writes the contents of a file fetched from a source to w
+func copySource(ctx context.Context, w io.Writer, src Source, u *url.URL) error {
+	rc, err := src.Open(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	_, err = io.Copy(w, rc)
+	return err
+}
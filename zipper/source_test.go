@@ -0,0 +1,161 @@
+package zipper
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"opg-file-service/storage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSource_Open(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "docs"), 0o755)
+	_ = os.WriteFile(filepath.Join(dir, "docs", "file.txt"), []byte("contents of file"), 0o644)
+
+	tests := []struct {
+		scenario string
+		uri      string
+		want     string
+		wantErr  bool
+	}{
+		{"File in the directory", "file:///docs/file.txt", "contents of file", false},
+		{"File on localhost", "file://localhost/docs/file.txt", "contents of file", false},
+		{"Missing file", "file:///docs/missing.txt", "", true},
+		{"Directory", "file:///docs", "", true},
+		{"Path outside the directory", "file:///../docs/file.txt", "", true},
+		{"File on another host", "file://elsewhere/docs/file.txt", "", true},
+	}
+
+	s := NewFileSource(dir)
+	for _, test := range tests {
+		u, _ := url.Parse(test.uri)
+		rc, err := s.Open(t.Context(), u)
+		if test.wantErr {
+			assert.NotNil(t, err, test.scenario)
+			continue
+		}
+
+		assert.Nil(t, err, test.scenario)
+		b, _ := io.ReadAll(rc)
+		_ = rc.Close()
+		assert.Equal(t, test.want, string(b), test.scenario)
+	}
+}
+
+func TestHTTPSource_Open(t *testing.T) {
+	elsewhere := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "contents from elsewhere")
+	}))
+	defer elsewhere.Close()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/documents/1":
+			_, _ = io.WriteString(w, "contents of document 1")
+		case "/moved":
+			http.Redirect(w, r, "/documents/1", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, elsewhere.URL, http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	host := ts.Listener.Addr().String()
+
+	tests := []struct {
+		scenario string
+		uri      string
+		want     string
+		wantErr  string
+	}{
+		{"Document on an allowed host", "https://" + host + "/documents/1", "contents of document 1", ""},
+		{"Redirect on the same host", "https://" + host + "/moved", "contents of document 1", ""},
+		{"Missing document", "https://" + host + "/documents/2", "", "unable to fetch https://" + host + "/documents/2: 404 Not Found"},
+		{"Host not allowed", elsewhere.URL + "/documents/1", "", "host is not an allowed source: " + elsewhere.Listener.Addr().String()},
+		{"Redirect to a host not allowed", "https://" + host + "/elsewhere", "", "redirected to a host which is not an allowed source: " + elsewhere.Listener.Addr().String()},
+		{"Plain HTTP", "http://" + host + "/documents/1", "", "host is not an allowed source: " + host},
+		{"URL with credentials", "https://user:pass@" + host + "/documents/1", "", "host is not an allowed source: " + host},
+	}
+
+	s := NewHTTPSource(ts.Client(), []string{host})
+	for _, test := range tests {
+		u, _ := url.Parse(test.uri)
+		rc, err := s.Open(t.Context(), u)
+		if test.wantErr != "" {
+			assert.ErrorContains(t, err, test.wantErr, test.scenario)
+			continue
+		}
+
+		assert.Nil(t, err, test.scenario)
+		b, _ := io.ReadAll(rc)
+		_ = rc.Close()
+		assert.Equal(t, test.want, string(b), test.scenario)
+	}
+}
+
+func TestZipper_AddFile_Sources(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "file2.txt"), []byte("contents of file2"), 0o644)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "contents of file3")
+	}))
+	defer ts.Close()
+
+	files := []storage.File{
+		{S3path: "s3://bucket/file1", FileName: "file1"},
+		{S3path: "file:///file2.txt", FileName: "file2"},
+		{S3path: "https://" + ts.Listener.Addr().String() + "/documents/3", FileName: "file3"},
+	}
+
+	for _, concurrency := range []int{0, 2} {
+		buf := new(bytes.Buffer)
+		z := Zipper{
+			s3:          &fakeDownloader{objects: map[string]string{"file1": "contents of file1"}},
+			sources:     Sources{"file": NewFileSource(dir), "https": NewHTTPSource(ts.Client(), []string{ts.Listener.Addr().String()})},
+			concurrency: concurrency,
+			memoryLimit: 4,
+		}
+		assert.Nil(t, z.OpenWriter(buf, Zip))
+
+		z.Prefetch(t.Context(), files)
+		for _, file := range files {
+			assert.Nil(t, z.AddFile(t.Context(), &file))
+		}
+		assert.Nil(t, z.Close())
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		assert.Nil(t, err)
+		assert.Len(t, zr.File, 3)
+		for _, f := range zr.File {
+			rc, _ := f.Open()
+			b, _ := io.ReadAll(rc)
+			_ = rc.Close()
+			assert.Equal(t, "contents of "+f.Name, string(b))
+		}
+	}
+}
+
+func TestZipper_AddFile_UnknownSource(t *testing.T) {
+	z := Zipper{zw: NewAESZipWriter(io.Discard), sources: Sources{"file": NewFileSource(t.TempDir())}}
+
+	err := z.AddFile(t.Context(), &storage.File{S3path: "ftp://host/file", FileName: "file"})
+	assert.EqualError(t, err, "invalid S3 path: ftp://host/file")
+}
+
+func TestZipper_Store_Sources(t *testing.T) {
+	z := Zipper{sources: Sources{"file": NewFileSource(t.TempDir())}}
+	_ = z.OpenWriter(io.Discard, Zip)
+
+	_, err := z.Store(t.Context(), []storage.File{{S3path: "file:///file.txt", FileName: "file"}})
+	assert.EqualError(t, err, "unable to store a file which is not in S3: file:///file.txt")
+}
@@ -0,0 +1,378 @@
+package zipper
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"opg-file-service/storage"
+	"time"
+)
+
+// zip record lengths and signatures, see https://pkware.cachefly.net/webdocs/casestudies/APPNOTE.TXT
+const (
+	localHeaderLen        = 30
+	dataDescriptorLen     = 16
+	dataDescriptor64Len   = 24
+	directoryHeaderLen    = 46
+	directoryEndLen       = 22
+	directory64EndLen     = 56
+	directory64LocatorLen = 20
+	extTimeExtraLen       = 9
+
+	localHeaderSignature        = 0x04034b50
+	dataDescriptorSignature     = 0x08074b50
+	directoryHeaderSignature    = 0x02014b50
+	directoryEndSignature       = 0x06054b50
+	directory64EndSignature     = 0x06064b50
+	directory64LocatorSignature = 0x07064b50
+
+	zipVersion20 = 20
+	zipVersion45 = 45
+
+	extTimeExtraID = 0x5455
+	zip64ExtraID   = 0x0001
+
+	uint16max = 1<<16 - 1
+	uint32max = 1<<32 - 1
+)
+
+// StoredZipWriter writes zip files in which every file is stored uncompressed. Unlike
+// zip.Writer, the exact length of its output can be worked out from the names and sizes
+// of the files alone, see StoredZipSize, and it can write just part of the zip, see SetRange.
+type StoredZipWriter struct {
+	w          io.Writer
+	offset     uint64
+	start, end uint64 // range of the zip passed on to w
+	dir        []*storedFile
+	current    *storedFile
+	closed     bool
+}
+
+type storedFile struct {
+	header  *zip.FileHeader
+	offset  uint64
+	size    uint64
+	crc32   hash.Hash32
+	skipped bool // whether any of the contents were skipped rather than written
+}
+
+func NewStoredZipWriter(w io.Writer) *StoredZipWriter {
+	return &StoredZipWriter{w: w, end: math.MaxUint64}
+}
+
+// SetRange limits the output to the bytes of the zip from start up to but excluding
+// end, with everything outside the range being discarded
+func (sw *StoredZipWriter) SetRange(start, end int64) {
+	sw.start = uint64(start)
+	sw.end = uint64(end)
+}
+
+// Offset returns the number of bytes of the zip written or skipped so far
+func (sw *StoredZipWriter) Offset() int64 {
+	return int64(sw.offset)
+}
+
+// Skip moves past the next n bytes of the current file without writing them, for
+// contents which fall outside the range being written. As the CRC-32 of a skipped file
+// cannot be calculated, it must be set on the file's header before the next file is created.
+func (sw *StoredZipWriter) Skip(n int64) error {
+	f := sw.current
+	if f == nil {
+		return errors.New("zip: skip without a file")
+	}
+	if n == 0 {
+		return nil
+	}
+	if sw.offset < sw.end && sw.offset+uint64(n) > sw.start {
+		return errors.New("zip: skip within the range being written")
+	}
+
+	f.skipped = true
+	f.size += uint64(n)
+	sw.offset += uint64(n)
+
+	return nil
+}
+
+// StoredZipSize returns the number of bytes StoredZipWriter will write for files with
+// the given headers, each of which must have UncompressedSize64 set
+func StoredZipSize(headers []*zip.FileHeader) int64 {
+	var offset uint64
+	var dirSize uint64
+	usedZip64 := false
+
+	for _, fh := range headers {
+		dirEntryLen, zip64 := directoryEntryLen(fh, offset)
+		dirSize += dirEntryLen
+		usedZip64 = usedZip64 || zip64
+
+		offset += localHeaderLen + uint64(len(fh.Name)) + extTimeExtraLen
+		offset += fh.UncompressedSize64
+		offset += descriptorLen(fh.UncompressedSize64)
+	}
+
+	return int64(offset + dirSize + endLen(uint64(len(headers)), dirSize, offset, usedZip64))
+}
+
+// CreateHeader writes the local file header for fh, returning a writer for the file's contents
+func (sw *StoredZipWriter) CreateHeader(fh *zip.FileHeader) (io.Writer, error) {
+	if sw.closed {
+		return nil, errors.New("zip: write to closed writer")
+	}
+	if len(fh.Name) > uint16max {
+		return nil, errors.New("zip: FileHeader.Name too long")
+	}
+	if err := sw.closeFile(); err != nil {
+		return nil, err
+	}
+
+	fh.Method = zip.Store
+	fh.Flags |= 0x8 // sizes and CRC follow the data in a data descriptor
+
+	f := &storedFile{header: fh, offset: sw.offset, crc32: crc32.NewIEEE()}
+
+	b := make([]byte, 0, localHeaderLen+len(fh.Name)+extTimeExtraLen)
+	b = binary.LittleEndian.AppendUint32(b, localHeaderSignature)
+	b = binary.LittleEndian.AppendUint16(b, zipVersion20)
+	b = binary.LittleEndian.AppendUint16(b, fh.Flags)
+	b = binary.LittleEndian.AppendUint16(b, zip.Store)
+	b = appendMsDosTime(b, fh.Modified)
+	b = binary.LittleEndian.AppendUint32(b, 0) // crc32, in data descriptor
+	b = binary.LittleEndian.AppendUint32(b, 0) // compressed size, in data descriptor
+	b = binary.LittleEndian.AppendUint32(b, 0) // uncompressed size, in data descriptor
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(fh.Name)))
+	b = binary.LittleEndian.AppendUint16(b, extTimeExtraLen)
+	b = append(b, fh.Name...)
+	b = appendExtTimeExtra(b, fh.Modified)
+
+	if err := sw.write(b); err != nil {
+		return nil, err
+	}
+
+	sw.dir = append(sw.dir, f)
+	sw.current = f
+
+	return storedFileWriter{sw, f}, nil
+}
+
+// Encrypt always fails, as encrypting files would change the size of the zip
+func (sw *StoredZipWriter) Encrypt(enc *storage.Encryption) error {
+	return errors.New("unable to encrypt a stored zip")
+}
+
+// Close writes the central directory, finishing the zip file
+func (sw *StoredZipWriter) Close() error {
+	if sw.closed {
+		return errors.New("zip: writer closed twice")
+	}
+	if err := sw.closeFile(); err != nil {
+		return err
+	}
+	sw.closed = true
+
+	start := sw.offset
+	usedZip64 := false
+
+	for _, f := range sw.dir {
+		fh := f.header
+		size := f.size
+
+		readerVersion := uint16(zipVersion20)
+		var zip64Extra []byte
+		if size >= uint32max || f.offset >= uint32max {
+			usedZip64 = true
+			readerVersion = zipVersion45
+			zip64Extra = appendZip64Extra(nil, size, f.offset)
+		}
+
+		b := make([]byte, 0, directoryHeaderLen+len(fh.Name)+extTimeExtraLen+len(zip64Extra))
+		b = binary.LittleEndian.AppendUint32(b, directoryHeaderSignature)
+		b = binary.LittleEndian.AppendUint16(b, zipVersion20) // creator version
+		b = binary.LittleEndian.AppendUint16(b, readerVersion)
+		b = binary.LittleEndian.AppendUint16(b, fh.Flags)
+		b = binary.LittleEndian.AppendUint16(b, zip.Store)
+		b = appendMsDosTime(b, fh.Modified)
+		b = binary.LittleEndian.AppendUint32(b, fh.CRC32)
+		b = binary.LittleEndian.AppendUint32(b, uint32(min(size, uint32max))) // compressed size
+		b = binary.LittleEndian.AppendUint32(b, uint32(min(size, uint32max))) // uncompressed size
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(fh.Name)))
+		b = binary.LittleEndian.AppendUint16(b, uint16(extTimeExtraLen+len(zip64Extra)))
+		b = binary.LittleEndian.AppendUint16(b, 0) // comment length
+		b = binary.LittleEndian.AppendUint16(b, 0) // disk number start
+		b = binary.LittleEndian.AppendUint16(b, 0) // internal file attributes
+		b = binary.LittleEndian.AppendUint32(b, fh.ExternalAttrs)
+		b = binary.LittleEndian.AppendUint32(b, uint32(min(f.offset, uint32max)))
+		b = append(b, fh.Name...)
+		b = appendExtTimeExtra(b, fh.Modified)
+		b = append(b, zip64Extra...)
+
+		if err := sw.write(b); err != nil {
+			return err
+		}
+	}
+
+	end := sw.offset
+	records := uint64(len(sw.dir))
+	size := end - start
+
+	var b []byte
+	if usedZip64 || records >= uint16max || size >= uint32max || start >= uint32max {
+		b = binary.LittleEndian.AppendUint32(b, directory64EndSignature)
+		b = binary.LittleEndian.AppendUint64(b, directory64EndLen-12) // length of the remaining record
+		b = binary.LittleEndian.AppendUint16(b, zipVersion45)         // version made by
+		b = binary.LittleEndian.AppendUint16(b, zipVersion45)         // version needed to extract
+		b = binary.LittleEndian.AppendUint32(b, 0)                    // number of this disk
+		b = binary.LittleEndian.AppendUint32(b, 0)                    // disk with the start of the central directory
+		b = binary.LittleEndian.AppendUint64(b, records)              // entries on this disk
+		b = binary.LittleEndian.AppendUint64(b, records)              // total entries
+		b = binary.LittleEndian.AppendUint64(b, size)                 // size of the central directory
+		b = binary.LittleEndian.AppendUint64(b, start)                // offset of the central directory
+
+		b = binary.LittleEndian.AppendUint32(b, directory64LocatorSignature)
+		b = binary.LittleEndian.AppendUint32(b, 0)   // disk with the zip64 end of central directory
+		b = binary.LittleEndian.AppendUint64(b, end) // offset of the zip64 end of central directory
+		b = binary.LittleEndian.AppendUint32(b, 1)   // total number of disks
+	}
+
+	b = binary.LittleEndian.AppendUint32(b, directoryEndSignature)
+	b = binary.LittleEndian.AppendUint16(b, 0) // number of this disk
+	b = binary.LittleEndian.AppendUint16(b, 0) // disk with the start of the central directory
+	b = binary.LittleEndian.AppendUint16(b, uint16(min(records, uint16max)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(min(records, uint16max)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(min(size, uint32max)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(min(start, uint32max)))
+	b = binary.LittleEndian.AppendUint16(b, 0) // comment length
+
+	return sw.write(b)
+}
+
+// closeFile writes the data descriptor of the file currently being written, if any
+func (sw *StoredZipWriter) closeFile() error {
+	f := sw.current
+	if f == nil {
+		return nil
+	}
+	sw.current = nil
+
+	fh := f.header
+	if !f.skipped {
+		fh.CRC32 = f.crc32.Sum32()
+	}
+	fh.CompressedSize64 = f.size
+	fh.UncompressedSize64 = f.size
+
+	b := binary.LittleEndian.AppendUint32(nil, dataDescriptorSignature)
+	b = binary.LittleEndian.AppendUint32(b, fh.CRC32)
+	if f.size >= uint32max {
+		b = binary.LittleEndian.AppendUint64(b, f.size)
+		b = binary.LittleEndian.AppendUint64(b, f.size)
+	} else {
+		b = binary.LittleEndian.AppendUint32(b, uint32(f.size))
+		b = binary.LittleEndian.AppendUint32(b, uint32(f.size))
+	}
+
+	return sw.write(b)
+}
+
+// write passes on the part of b which falls in the range being written
+func (sw *StoredZipWriter) write(b []byte) error {
+	from := min(max(sw.start, sw.offset), sw.offset+uint64(len(b))) - sw.offset
+	to := max(min(sw.end, sw.offset+uint64(len(b))), sw.offset) - sw.offset
+
+	sw.offset += uint64(len(b))
+
+	if from >= to {
+		return nil
+	}
+
+	n, err := sw.w.Write(b[from:to])
+	if err == nil && n < int(to-from) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+type storedFileWriter struct {
+	sw *StoredZipWriter
+	f  *storedFile
+}
+
+func (w storedFileWriter) Write(p []byte) (int, error) {
+	if w.sw.current != w.f {
+		return 0, errors.New("zip: write to closed file")
+	}
+
+	if err := w.sw.write(p); err != nil {
+		return 0, err
+	}
+	w.f.crc32.Write(p)
+	w.f.size += uint64(len(p))
+
+	return len(p), nil
+}
+
+// directoryEntryLen returns the length of a file's central directory header, and whether it needs zip64 extensions
+func directoryEntryLen(fh *zip.FileHeader, offset uint64) (uint64, bool) {
+	n := uint64(directoryHeaderLen + len(fh.Name) + extTimeExtraLen)
+	zip64 := fh.UncompressedSize64 >= uint32max || offset >= uint32max
+	if zip64 {
+		n += uint64(len(appendZip64Extra(nil, fh.UncompressedSize64, offset)))
+	}
+	return n, zip64
+}
+
+func descriptorLen(size uint64) uint64 {
+	if size >= uint32max {
+		return dataDescriptor64Len
+	}
+	return dataDescriptorLen
+}
+
+func endLen(records, dirSize, dirOffset uint64, usedZip64 bool) uint64 {
+	if usedZip64 || records >= uint16max || dirSize >= uint32max || dirOffset >= uint32max {
+		return directory64EndLen + directory64LocatorLen + directoryEndLen
+	}
+	return directoryEndLen
+}
+
+// appendZip64Extra appends a zip64 extended information field holding each value too large for the central directory header
+func appendZip64Extra(b []byte, size, offset uint64) []byte {
+	var fields []uint64
+	if size >= uint32max {
+		fields = append(fields, size, size) // uncompressed then compressed size
+	}
+	if offset >= uint32max {
+		fields = append(fields, offset)
+	}
+
+	b = binary.LittleEndian.AppendUint16(b, zip64ExtraID)
+	b = binary.LittleEndian.AppendUint16(b, uint16(8*len(fields)))
+	for _, v := range fields {
+		b = binary.LittleEndian.AppendUint64(b, v)
+	}
+	return b
+}
+
+// appendExtTimeExtra appends an extended timestamp field holding the modification time, as archive/zip does
+func appendExtTimeExtra(b []byte, t time.Time) []byte {
+	b = binary.LittleEndian.AppendUint16(b, extTimeExtraID)
+	b = binary.LittleEndian.AppendUint16(b, 5) // size of flags and mod time
+	b = append(b, 1)                           // flags: mod time present
+	return binary.LittleEndian.AppendUint32(b, uint32(t.Unix()))
+}
+
+// appendMsDosTime appends the modification time and date in MS-DOS format
+func appendMsDosTime(b []byte, t time.Time) []byte {
+	dosTime, dosDate := msDosTime(t)
+	b = binary.LittleEndian.AppendUint16(b, dosTime)
+	return binary.LittleEndian.AppendUint16(b, dosDate)
+}
+
+// msDosTime returns the modification time and date in MS-DOS format
+func msDosTime(t time.Time) (uint16, uint16) {
+	return uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11), uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+}
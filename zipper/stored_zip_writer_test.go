@@ -0,0 +1,224 @@
+package zipper
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+type storedTestFile struct {
+	name     string
+	contents string
+}
+
+func TestStoredZipWriter(t *testing.T) {
+	modified := time.Date(2024, 3, 5, 14, 30, 12, 0, time.UTC)
+
+	tests := []struct {
+		scenario string
+		files    []storedTestFile
+	}{
+		{"Empty archive", nil},
+		{"Single file", []storedTestFile{{"file.txt", "contents of file"}}},
+		{"Empty file", []storedTestFile{{"empty", ""}}},
+		{
+			"Several files in folders",
+			[]storedTestFile{
+				{"folder/file1.pdf", "contents of file1"},
+				{"folder/file2.jpg", strings.Repeat("x", 100000)},
+				{"file3", "contents of file3"},
+			},
+		},
+		{"UTF-8 file name", []storedTestFile{{"dossier/résumé.docx", "contents"}}},
+	}
+
+	for _, test := range tests {
+		var headers []*zip.FileHeader
+		buf := new(bytes.Buffer)
+		sw := NewStoredZipWriter(buf)
+
+		for _, f := range test.files {
+			fh := &zip.FileHeader{Name: f.name, Method: zip.Deflate, Flags: 0x800, Modified: modified}
+			w, err := sw.CreateHeader(fh)
+			assert.Nil(t, err, test.scenario)
+			_, err = io.WriteString(w, f.contents)
+			assert.Nil(t, err, test.scenario)
+
+			headers = append(headers, &zip.FileHeader{Name: f.name, UncompressedSize64: uint64(len(f.contents))})
+		}
+		assert.Nil(t, sw.Close(), test.scenario)
+
+		assert.Equal(t, int64(buf.Len()), StoredZipSize(headers), test.scenario)
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		assert.Nil(t, err, test.scenario)
+		assert.Len(t, zr.File, len(test.files), test.scenario)
+
+		for i, zf := range zr.File {
+			assert.Equal(t, test.files[i].name, zf.Name, test.scenario)
+			assert.Equal(t, zip.Store, zf.Method, test.scenario)
+			assert.Equal(t, crc32.ChecksumIEEE([]byte(test.files[i].contents)), zf.CRC32, test.scenario)
+			assert.True(t, modified.Equal(zf.Modified), test.scenario)
+
+			rc, err := zf.Open()
+			assert.Nil(t, err, test.scenario)
+			b, err := io.ReadAll(rc)
+			assert.Nil(t, err, test.scenario)
+			assert.Equal(t, test.files[i].contents, string(b), test.scenario)
+		}
+	}
+}
+
+func TestStoredZipWriter_Zip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes more than 4GiB")
+	}
+
+	size := int64(1<<32 + 10)
+	cw := &countingWriter{}
+	sw := NewStoredZipWriter(cw)
+
+	w, err := sw.CreateHeader(&zip.FileHeader{Name: "large", Modified: time.Now()})
+	assert.Nil(t, err)
+	_, err = io.CopyN(w, zeroReader{}, size)
+	assert.Nil(t, err)
+
+	_, err = sw.CreateHeader(&zip.FileHeader{Name: "small", Modified: time.Now()})
+	assert.Nil(t, err)
+	assert.Nil(t, sw.Close())
+
+	assert.Equal(t, cw.n, StoredZipSize([]*zip.FileHeader{
+		{Name: "large", UncompressedSize64: uint64(size)},
+		{Name: "small"},
+	}))
+}
+
+func TestStoredZipWriter_Closed(t *testing.T) {
+	sw := NewStoredZipWriter(io.Discard)
+
+	w, _ := sw.CreateHeader(&zip.FileHeader{Name: "file1"})
+	_, _ = sw.CreateHeader(&zip.FileHeader{Name: "file2"})
+
+	_, err := w.Write([]byte("too late"))
+	assert.EqualError(t, err, "zip: write to closed file")
+
+	assert.Nil(t, sw.Close())
+	assert.EqualError(t, sw.Close(), "zip: writer closed twice")
+
+	_, err = sw.CreateHeader(&zip.FileHeader{Name: "file3"})
+	assert.EqualError(t, err, "zip: write to closed writer")
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestStoredZipWriter_Range(t *testing.T) {
+	modified := time.Date(2024, 3, 5, 14, 30, 12, 0, time.UTC)
+	contents := []string{strings.Repeat("a", 50), strings.Repeat("b", 80)}
+
+	write := func(w io.Writer, start, end int64, skipFirst bool) *StoredZipWriter {
+		sw := NewStoredZipWriter(w)
+		if end > 0 {
+			sw.SetRange(start, end)
+		}
+
+		for i, c := range contents {
+			fh := &zip.FileHeader{Name: "file" + string(rune('1'+i)), Modified: modified}
+			fw, err := sw.CreateHeader(fh)
+			assert.Nil(t, err)
+
+			if i == 0 && skipFirst {
+				fh.CRC32 = crc32.ChecksumIEEE([]byte(c))
+				assert.Nil(t, sw.Skip(int64(len(c))))
+				continue
+			}
+			_, err = io.WriteString(fw, c)
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, sw.Close())
+		return sw
+	}
+
+	full := new(bytes.Buffer)
+	write(full, 0, 0, false)
+
+	for _, r := range [][2]int64{{0, 10}, {10, 100}, {100, int64(full.Len())}, {0, int64(full.Len())}} {
+		buf := new(bytes.Buffer)
+		write(buf, r[0], r[1], false)
+		assert.Equal(t, full.Bytes()[r[0]:r[1]], buf.Bytes(), r)
+	}
+
+	// the contents of the first file can be skipped when the range starts after them
+	second := int64(bytes.Index(full.Bytes(), []byte(contents[1])))
+	buf := new(bytes.Buffer)
+	sw := write(buf, second, int64(full.Len()), true)
+	assert.Equal(t, full.Bytes()[second:], buf.Bytes())
+	assert.Equal(t, int64(full.Len()), sw.Offset())
+}
+
+func TestStoredZipWriter_Skip(t *testing.T) {
+	sw := NewStoredZipWriter(io.Discard)
+	assert.EqualError(t, sw.Skip(10), "zip: skip without a file")
+
+	_, _ = sw.CreateHeader(&zip.FileHeader{Name: "file"})
+	assert.EqualError(t, sw.Skip(10), "zip: skip within the range being written")
+	assert.Nil(t, sw.Skip(0))
+}
+
+func TestStoredZipWriter_Zip64Boundary(t *testing.T) {
+	tests := []struct {
+		scenario  string
+		size      uint64
+		zip64Size bool
+	}{
+		{"Below the limit", uint32max - 1, false},
+		{"At the limit", uint32max, true},
+	}
+
+	for _, test := range tests {
+		fh := &zip.FileHeader{Name: "large", Modified: time.Now()}
+		buf := new(bytes.Buffer)
+		sw := NewStoredZipWriter(buf)
+
+		_, err := sw.CreateHeader(fh)
+		assert.Nil(t, err, test.scenario)
+
+		// the contents are skipped, so only the local header and what follows the contents are written
+		headerLen := sw.Offset()
+		sw.SetRange(headerLen+int64(test.size), math.MaxInt64)
+		assert.Nil(t, sw.Skip(int64(test.size)), test.scenario)
+		assert.Nil(t, sw.Close(), test.scenario)
+
+		assert.Equal(t, sw.Offset(), StoredZipSize([]*zip.FileHeader{{Name: "large", UncompressedSize64: test.size}}), test.scenario)
+
+		b := buf.Bytes()[headerLen:]
+		assert.Equal(t, uint32(dataDescriptorSignature), binary.LittleEndian.Uint32(b), test.scenario)
+		if test.zip64Size {
+			assert.Equal(t, test.size, binary.LittleEndian.Uint64(b[8:]), test.scenario)
+			assert.Equal(t, test.size, binary.LittleEndian.Uint64(b[16:]), test.scenario)
+		} else {
+			assert.Equal(t, uint32(test.size), binary.LittleEndian.Uint32(b[8:]), test.scenario)
+			assert.Equal(t, uint32(test.size), binary.LittleEndian.Uint32(b[12:]), test.scenario)
+		}
+	}
+}
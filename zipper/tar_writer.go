@@ -0,0 +1,55 @@
+package zipper
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"opg-file-service/storage"
+)
+
+// TarWriter adapts tar.Writer to the ZipWriter interface, so that tarballs can be
+// built from the same zip.FileHeader as zip files. As tar headers carry the size of
+// each file, UncompressedSize64 must be set on the header before it is created.
+type TarWriter struct {
+	tw      *tar.Writer
+	closers []io.Closer // compression layers to close once the tar stream is finished
+}
+
+func newTarWriter(w io.Writer, closers ...io.Closer) *TarWriter {
+	return &TarWriter{
+		tw:      tar.NewWriter(w),
+		closers: closers,
+	}
+}
+
+func (t *TarWriter) CreateHeader(fh *zip.FileHeader) (io.Writer, error) {
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     fh.Name,
+		Size:     int64(fh.UncompressedSize64),
+		Mode:     0644,
+		ModTime:  fh.Modified,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t.tw, nil
+}
+
+func (t *TarWriter) Encrypt(enc *storage.Encryption) error {
+	return errors.New("unable to encrypt a tar archive")
+}
+
+func (t *TarWriter) Close() error {
+	err := t.tw.Close()
+
+	for _, c := range t.closers {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
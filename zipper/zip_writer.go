@@ -3,10 +3,12 @@ package zipper
 import (
 	"archive/zip"
 	"io"
+	"opg-file-service/storage"
 )
 
 // allows us to mock zip.Writer in our tests
 type ZipWriter interface {
 	Close() error
 	CreateHeader(fh *zip.FileHeader) (io.Writer, error)
+	Encrypt(enc *storage.Encryption) error // sets how files whose headers are flagged as encrypted are encrypted
 }
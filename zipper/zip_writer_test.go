@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"github.com/stretchr/testify/mock"
 	"io"
+	"opg-file-service/storage"
 )
 
 type MockZipWriter struct {
@@ -15,6 +16,11 @@ func (m *MockZipWriter) Close() error {
 	return args.Error(0)
 }
 
+func (m *MockZipWriter) Encrypt(enc *storage.Encryption) error {
+	args := m.Called(enc)
+	return args.Error(0)
+}
+
 func (m *MockZipWriter) CreateHeader(fh *zip.FileHeader) (io.Writer, error) {
 	args := m.Called(fh)
 	return args.Get(0).(io.Writer), args.Error(1)
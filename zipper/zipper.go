@@ -3,84 +3,830 @@ package zipper
 import (
 	"archive/zip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"io"
 	"net/http"
 	"net/url"
+	"opg-file-service/internal"
 	"opg-file-service/storage"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ZipperInterface interface {
-	Open(rw http.ResponseWriter)
+	Open(rw http.ResponseWriter, format Format) error
+	OpenWriter(w io.Writer, format Format) error
 	Close() error
+	Store(ctx context.Context, files []storage.File) (ArchiveInfo, error)
+	Range(start, end int64) error
+	Prefetch(ctx context.Context, files []storage.File)
 	AddFile(ctx context.Context, f *storage.File) error
+	SkipFailures()
+	AddErrorReport(failures []FileError) error
+	RecordManifest() error
+	AddManifest(signer Signer) error
+	Encrypt(enc *storage.Encryption) error
+}
+
+// FileError records a file which could not be added to an archive
+type FileError struct {
+	Path   string `json:"path"`
+	S3path string `json:"s3path"`
+	Reason string `json:"reason"`
+}
+
+// ArchiveInfo describes a stored zip before any of it is written
+type ArchiveInfo struct {
+	Size int64
+	ETag string // changes whenever the contents of the zip would
+}
+
+// storedObject is what is known about a file in S3 once the zipper is storing files
+type storedObject struct {
+	size     int64
+	modified time.Time
+	etag     string
+	crc32    uint32
+	hasCRC32 bool
+}
+
+// ErrorReportName is the name of the archive entry listing files which could not be included
+const ErrorReportName = "_errors.txt"
+
+// bucketClients fetch objects from S3, with the role of the bucket for a bucket in another account
+type bucketClients struct {
+	s3       Downloader
+	s3Client S3Client
 }
 
 type Zipper struct {
-	rw http.ResponseWriter
-	zw ZipWriter
-	s3 Downloader
+	w           io.Writer
+	zw          ZipWriter
+	format      Format
+	s3          Downloader
+	s3Client    S3Client
+	buckets     map[string]bucketClients // clients for buckets in other accounts, by bucket name
+	sources     Sources                  // where files which are not in S3 are fetched from
+	keys        CustomerKeys             // keys of objects encrypted with SSE-C
+	passwords   Passwords                // opens the sealed passwords of encrypted zip requests
+	concurrency int                      // number of files to download ahead of the one being zipped
+	memoryLimit int64                    // bytes of each prefetched file to hold in memory before spilling to disk
+	prefetcher  *prefetcher
+	objects     map[string]storedObject // files by objectKey, once the zipper is storing files
+	rangeStart  int64                   // range of a stored zip being written
+	rangeEnd    int64
+	ranged      bool                // whether only part of the zip is being written
+	manifest    *manifestRecorder   // files added to the archive, once the zipper is recording a manifest
+	encryption  *storage.Encryption // how files are encrypted, once the zipper is encrypting them
+	skipping    bool                // whether files which fail are being skipped, so must be downloaded before being added
 }
 
-func NewZipper(cfg *aws.Config) *Zipper {
-	s3Client := s3.NewFromConfig(*cfg, func(u *s3.Options) {
-		u.UsePathStyle = true
-	})
+func NewZipper(cfg *aws.Config, keys CustomerKeys, passwords Passwords) *Zipper {
+	clients := newBucketClients(*cfg)
 
-	downloader := manager.NewDownloader(s3Client)
-	downloader.Concurrency = 1
+	// buckets in other accounts are given as a comma separated list of bucket=role ARN
+	buckets := map[string]bucketClients{}
+	for _, pair := range strings.Split(internal.GetEnvVar("S3_BUCKET_ROLES", ""), ",") {
+		bucket, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || bucket == "" || role == "" {
+			continue
+		}
+
+		bucketCfg := cfg.Copy()
+		bucketCfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(*cfg), role))
+		buckets[bucket] = newBucketClients(bucketCfg)
+	}
+
+	sources := Sources{}
+	if dir := internal.GetEnvVar("FILE_SOURCE_ROOT", ""); dir != "" {
+		sources["file"] = NewFileSource(dir)
+	}
 
+	var allowedHosts []string
+	for _, host := range strings.Split(internal.GetEnvVar("HTTP_SOURCE_ALLOWED_HOSTS", ""), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			allowedHosts = append(allowedHosts, host)
+		}
+	}
+	if len(allowedHosts) > 0 {
+		// a timeout on the whole request would cut off large files, so only connecting and
+		// waiting for the response are limited
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = 30 * time.Second
+		sources["https"] = NewHTTPSource(&http.Client{Transport: transport}, allowedHosts)
+	}
+
+	return &Zipper{
+		s3:          clients.s3,
+		s3Client:    clients.s3Client,
+		buckets:     buckets,
+		sources:     sources,
+		keys:        keys,
+		passwords:   passwords,
+		concurrency: internal.GetEnvInt("ZIP_PREFETCH_CONCURRENCY", 4),
+		memoryLimit: int64(internal.GetEnvInt("ZIP_PREFETCH_MEMORY_LIMIT", 8*1024*1024)),
+	}
+}
+
+// Clone returns a Zipper sharing the S3 client and settings of z but none of its
+// per-download state, so that concurrent requests can each have their own
+func (z *Zipper) Clone() *Zipper {
 	return &Zipper{
-		s3: downloader,
+		s3:          z.s3,
+		s3Client:    z.s3Client,
+		buckets:     z.buckets,
+		sources:     z.sources,
+		keys:        z.keys,
+		passwords:   z.passwords,
+		concurrency: z.concurrency,
+		memoryLimit: z.memoryLimit,
+	}
+}
+
+// Open starts streaming an archive as the response to a download request
+func (z *Zipper) Open(rw http.ResponseWriter, format Format) error {
+	if err := z.OpenWriter(rw, format); err != nil {
+		return err
 	}
+
+	rw.Header().Add("Content-Disposition", "attachment; filename=\"download"+format.Extension+"\"")
+	rw.Header().Add("Content-Type", format.ContentType)
+
+	return nil
 }
 
-func (z *Zipper) Open(rw http.ResponseWriter) {
-	z.rw = rw
-	z.zw = zip.NewWriter(rw)
-	z.rw.Header().Add("Content-Disposition", "attachment; filename=\"download.zip\"")
-	z.rw.Header().Add("Content-Type", "application/zip")
+// OpenWriter starts writing an archive to w, such as an upload to S3
+func (z *Zipper) OpenWriter(w io.Writer, format Format) error {
+	zw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	z.w = w
+	z.zw = zw
+	z.format = format
+
+	return nil
 }
 
 func (z *Zipper) Close() error {
+	z.prefetcher.close()
+	z.prefetcher = nil
+
 	err := z.zw.Close()
-	z.rw = nil
+	z.w = nil
 	z.zw = nil
+	z.objects = nil
+	z.rangeStart = 0
+	z.rangeEnd = 0
+	z.ranged = false
+	z.manifest = nil
+	z.encryption = nil
 	return err
 }
 
+// Store switches an open zip to storing files uncompressed, so that the size of the
+// archive can be worked out before any of it is written. It looks up each file in S3
+// and returns the size of the archive, which holds as long as the same files are then
+// added in the same order. As file headers are built from the objects in S3 rather than
+// the current time, the zip is the same each time until one of the objects changes.
+func (z *Zipper) Store(ctx context.Context, files []storage.File) (ArchiveInfo, error) {
+	if z.format.Name != storage.FormatZip {
+		return ArchiveInfo{}, errors.New("unable to store files in a " + z.format.Name + " archive")
+	}
+	if z.manifest != nil {
+		return ArchiveInfo{}, errors.New("unable to store files in an archive with a manifest")
+	}
+	if z.encryption != nil {
+		return ArchiveInfo{}, errors.New("unable to store files in an encrypted archive")
+	}
+	for _, f := range files {
+		if src, _ := z.sourceFor(&f); src != nil {
+			return ArchiveInfo{}, errors.New("unable to store a file which is not in S3: " + f.S3path)
+		}
+	}
+
+	objects, err := z.headObjects(ctx, files)
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+
+	headers := make([]*zip.FileHeader, len(files))
+	etag := sha256.New()
+	for i, f := range files {
+		obj := objects[objectKey(&f)]
+		headers[i] = storedHeader(&f, obj)
+		_, _ = fmt.Fprintf(etag, "%s\x00%d\x00%d\x00%s\n", headers[i].Name, obj.size, obj.modified.UnixNano(), obj.etag)
+	}
+
+	info := ArchiveInfo{
+		Size: StoredZipSize(headers),
+		ETag: `"` + hex.EncodeToString(etag.Sum(nil)[:16]) + `"`,
+	}
+
+	z.objects = objects
+	z.rangeStart, z.rangeEnd = 0, info.Size
+	z.zw = NewStoredZipWriter(z.w)
+
+	return info, nil
+}
+
+// Range limits a stored zip to the bytes from start up to but excluding end, so that an
+// interrupted download can be resumed. Only the parts of files falling inside the range
+// are fetched from S3, apart from files whose CRC-32 is needed but not known by S3. It
+// must be called after Store and before any files are added.
+func (z *Zipper) Range(start, end int64) error {
+	sw, ok := z.zw.(*StoredZipWriter)
+	if !ok {
+		return errors.New("unable to write a range of an archive which is not stored")
+	}
+
+	sw.SetRange(start, end)
+	z.rangeStart, z.rangeEnd = start, end
+	z.ranged = true
+
+	return nil
+}
+
+// Prefetch starts downloading files in the background so that they are ready by
+// the time they are passed to AddFile. Files must then be added in the same order.
+func (z *Zipper) Prefetch(ctx context.Context, files []storage.File) {
+	// a range of a stored zip only needs some of each file, so nothing is fetched up front
+	if z.concurrency < 1 || z.ranged {
+		return
+	}
+
+	z.prefetcher.close()
+	z.prefetcher = newPrefetcher(ctx, files, z.concurrency, z.download)
+}
+
 func (z *Zipper) AddFile(ctx context.Context, f *storage.File) error {
-	if f.S3path == "" {
-		return errors.New("missing S3 path")
+	var (
+		input *s3.GetObjectInput
+		err   error
+	)
+
+	// the file's prefetch is taken before anything can fail, and however the file is added,
+	// so that the next file's is left at the head of the queue
+	fetched := z.prefetcher.next(objectKey(f))
+	if fetched != nil {
+		defer z.prefetcher.release(fetched)
 	}
 
-	u, err := url.Parse(f.S3path)
+	// files from other sources are fetched from their URI rather than from S3
+	src, u := z.sourceFor(f)
+	if src == nil {
+		if input, err = z.objectInput(f); err != nil {
+			return err
+		}
+	}
+
+	if z.objects != nil {
+		return z.addStoredFile(ctx, f, fetched)
+	}
+
+	var buf *SpillBuffer
+
+	if fetched != nil {
+		if err := z.prefetcher.wait(ctx, fetched); err != nil {
+			return err
+		}
+		buf = fetched.buf
+	} else if z.format.needsSize() || z.skipping {
+		if buf, err = z.download(ctx, f); err != nil {
+			return err
+		}
+		defer func() {
+			_ = buf.Close()
+		}()
+	}
+
+	fh := f.GetZipFileHeader(z.encryption)
+	if buf != nil {
+		fh.UncompressedSize64 = uint64(buf.Size())
+	}
+
+	w, err := z.zw.CreateHeader(fh)
 	if err != nil {
-		return errors.New("unable to parse S3 path: " + f.S3path)
+		return err
 	}
 
-	if u.Scheme != "s3" || u.Host == "" || u.Path == "" {
-		return errors.New("invalid S3 path: " + f.S3path)
+	// files are hashed on their way into the archive for its manifest
+	var hw *hashingWriter
+	if z.manifest != nil {
+		hw = newHashingWriter(w)
+		w = hw
 	}
 
-	w, err := z.zw.CreateHeader(f.GetZipFileHeader())
+	if buf != nil {
+		_, err = io.Copy(w, buf.Reader())
+	} else if src != nil {
+		err = copySource(ctx, w, src, u)
+	} else {
+		fw := FakeWriterAt{w} // wrap our io.Writer in a fake io.WriterAt, as S3 requires a io.WriterAt
+		_, err = z.clients(input).s3.Download(ctx, fw, input, z.downloadOptions(f)...)
+		err = objectError(f, err)
+	}
 	if err != nil {
 		return err
 	}
-	fw := FakeWriterAt{w} // wrap our io.Writer in a fake io.WriterAt, as S3 requires a io.WriterAt
 
-	input := s3.GetObjectInput{
-		Bucket: aws.String(u.Host),
-		Key:    aws.String(strings.Trim(u.Path, "/")),
+	if hw != nil {
+		z.manifest.add(f, hw)
 	}
 
-	_, err = z.s3.Download(ctx, fw, &input)
+	return nil
+}
+
+// addStoredFile adds a file to a stored zip, fetching only as much of it from S3 as is
+// needed for the range of the zip being written, or using its prefetch when it has one
+func (z *Zipper) addStoredFile(ctx context.Context, f *storage.File, fetched *fetch) error {
+	obj, ok := z.objects[objectKey(f)]
+	if !ok {
+		return errors.New("unable to add a file which was not stored: " + f.S3path)
+	}
+
+	sw := z.zw.(*StoredZipWriter)
+
+	fh := storedHeader(f, obj)
+	w, err := sw.CreateHeader(fh)
 	if err != nil {
 		return err
 	}
 
+	// the part of the file's contents which falls in the range
+	start := sw.Offset()
+	end := start + obj.size
+	from := min(max(start, z.rangeStart), end)
+	to := max(min(end, z.rangeEnd), from)
+
+	// the CRC-32 follows the contents, so is needed whenever the range goes past them
+	needCRC := z.rangeEnd > end && !obj.hasCRC32
+	if obj.size > 0 && (needCRC || (from == start && to == end)) {
+		return z.copyStoredFile(ctx, w, f, obj, fetched)
+	}
+
+	fh.CRC32 = obj.crc32
+
+	if err := sw.Skip(from - start); err != nil {
+		return err
+	}
+
+	if from < to {
+		input, err := z.objectInput(f)
+		if err != nil {
+			return err
+		}
+		input.Range = aws.String("bytes=" + strconv.FormatInt(from-start, 10) + "-" + strconv.FormatInt(to-start-1, 10))
+
+		n, err := z.clients(input).s3.Download(ctx, FakeWriterAt{w}, input)
+		if err != nil {
+			return objectError(f, err)
+		}
+		if n != to-from {
+			return errSizeChanged(f.S3path)
+		}
+	}
+
+	return sw.Skip(end - to)
+}
+
+// copyStoredFile writes the whole of a file to a stored zip, from its prefetch if it has one
+func (z *Zipper) copyStoredFile(ctx context.Context, w io.Writer, f *storage.File, obj storedObject, fetched *fetch) error {
+	var n int64
+
+	if fetched != nil {
+		if err := z.prefetcher.wait(ctx, fetched); err != nil {
+			return err
+		}
+
+		var err error
+		if n, err = io.Copy(w, fetched.buf.Reader()); err != nil {
+			return err
+		}
+	} else {
+		input, err := z.objectInput(f)
+		if err != nil {
+			return err
+		}
+
+		if n, err = z.clients(input).s3.Download(ctx, FakeWriterAt{w}, input); err != nil {
+			return objectError(f, err)
+		}
+	}
+
+	// the size of the zip has already been promised, so files must not change size
+	if n != obj.size {
+		return errSizeChanged(f.S3path)
+	}
+
+	return nil
+}
+
+// AddErrorReport adds a text file to the archive listing the files which could not be included and why
+func (z *Zipper) AddErrorReport(failures []FileError) error {
+	var b strings.Builder
+
+	b.WriteString("The following files could not be included in this download:\n\n")
+	for _, f := range failures {
+		b.WriteString(f.Path + " (" + f.S3path + "): " + f.Reason + "\n")
+	}
+
+	report := []byte(b.String())
+	if z.manifest != nil {
+		z.manifest.addReport(ErrorReportName, report)
+	}
+
+	return z.addBytes(ErrorReportName, report)
+}
+
+// Encrypt has the zipper encrypt each file added to a zip from then on with the password
+// of enc. File names are not encrypted. It cannot be used with a stored zip.
+func (z *Zipper) Encrypt(enc *storage.Encryption) error {
+	// the password is only opened to write the archive, and never saved again once it is
+	if enc.SealedPassword != "" {
+		if z.passwords == nil {
+			return errors.New("unable to open the password of the zip request")
+		}
+
+		opened, err := z.passwords.Open(enc)
+		if err != nil {
+			return err
+		}
+		enc = opened
+	}
+
+	if err := z.zw.Encrypt(enc); err != nil {
+		return err
+	}
+
+	z.encryption = enc
+	return nil
+}
+
+// SkipFailures has the zipper download each file in full before adding it, as files which
+// fail part way through are skipped rather than failing the archive, and so must leave
+// nothing of themselves in it
+func (z *Zipper) SkipFailures() {
+	z.skipping = true
+}
+
+// RecordManifest has the zipper hash each file as it is added, so that a signed manifest
+// of the archive can be added with AddManifest. It must be called before any files are
+// added or prefetched, and cannot be used with a stored zip.
+func (z *Zipper) RecordManifest() error {
+	if z.objects != nil {
+		return errors.New("unable to record a manifest of a stored zip")
+	}
+
+	z.manifest = &manifestRecorder{versions: map[string]string{}}
 	return nil
 }
+
+// AddManifest adds the manifest of the files added so far to the archive, followed by
+// its signature, which must be the last files in the archive
+func (z *Zipper) AddManifest(signer Signer) error {
+	if z.manifest == nil {
+		return errors.New("unable to add a manifest which was not recorded")
+	}
+
+	m := Manifest{Files: z.manifest.files}
+	if m.Files == nil {
+		m.Files = []ManifestFile{}
+	}
+
+	b, err := marshalManifest(m)
+	if err != nil {
+		return err
+	}
+
+	sig, err := signer.Sign(b)
+	if err != nil {
+		return err
+	}
+
+	if err := z.addBytes(ManifestName, b); err != nil {
+		return err
+	}
+
+	return z.addBytes(ManifestSignatureName, []byte(base64.StdEncoding.EncodeToString(sig)))
+}
+
+// AddFiles adds each of the files to an archive in turn. With FailurePolicySkip, files
+// which cannot be added are left out and listed in an error report at the end of the
+// archive, and are returned; otherwise adding stops at the first file which fails.
+func AddFiles(ctx context.Context, z ZipperInterface, files []storage.File, failurePolicy string) ([]FileError, error) {
+	var failures []FileError
+
+	if failurePolicy == storage.FailurePolicySkip {
+		z.SkipFailures()
+	}
+
+	for _, file := range files {
+		err := z.AddFile(ctx, &file)
+		if err == nil {
+			continue
+		}
+
+		if failurePolicy == storage.FailurePolicySkip && ctx.Err() == nil {
+			failures = append(failures, FileError{
+				Path:   file.GetRelativePath(),
+				S3path: file.S3path,
+				Reason: err.Error(),
+			})
+			continue
+		}
+
+		return failures, err
+	}
+
+	if len(failures) > 0 {
+		if err := z.AddErrorReport(failures); err != nil {
+			return failures, err
+		}
+	}
+
+	return failures, nil
+}
+
+// addBytes adds a file generated by the service, rather than fetched from S3, to the archive
+func (z *Zipper) addBytes(name string, content []byte) error {
+	f := storage.File{FileName: name}
+	fh := f.GetZipFileHeader(z.encryption)
+	fh.UncompressedSize64 = uint64(len(content))
+
+	w, err := z.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(content)
+	return err
+}
+
+// download fetches an object from S3 into a buffer, for files which are prefetched
+func (z *Zipper) download(ctx context.Context, f *storage.File) (*SpillBuffer, error) {
+	buf := NewSpillBuffer(z.memoryLimit)
+
+	if src, u := z.sourceFor(f); src != nil {
+		if err := copySource(ctx, io.NewOffsetWriter(buf, 0), src, u); err != nil {
+			_ = buf.Close()
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	input, err := z.objectInput(f)
+	if err != nil {
+		_ = buf.Close()
+		return nil, err
+	}
+
+	_, err = z.clients(input).s3.Download(ctx, buf, input, z.downloadOptions(f)...)
+	if err != nil {
+		_ = buf.Close()
+		return nil, objectError(f, err)
+	}
+
+	return buf, nil
+}
+
+// sourceFor returns the source a file which is not in S3 is fetched from, along with its
+// URI, or nil for a file in S3
+func (z *Zipper) sourceFor(f *storage.File) (Source, *url.URL) {
+	u, err := url.Parse(f.S3path)
+	if err != nil {
+		return nil, nil
+	}
+
+	// files with a scheme no source is registered for are reported as invalid S3 paths
+	src, ok := z.sources[u.Scheme]
+	if !ok || u.Scheme == "s3" {
+		return nil, nil
+	}
+
+	return src, u
+}
+
+// clients returns the clients for the bucket of an object, which for a bucket in another
+// account assume the bucket's role
+func (z *Zipper) clients(input *s3.GetObjectInput) bucketClients {
+	if c, ok := z.buckets[aws.ToString(input.Bucket)]; ok {
+		return c
+	}
+	return bucketClients{z.s3, z.s3Client}
+}
+
+// downloadOptions returns the options for downloading a file, recording the version of
+// the object fetched when the zipper is recording a manifest
+func (z *Zipper) downloadOptions(f *storage.File) []func(*manager.Downloader) {
+	if z.manifest == nil {
+		return nil
+	}
+
+	m := z.manifest
+	key := objectKey(f)
+	return []func(*manager.Downloader){withVersionID(func(versionID string) {
+		m.setVersion(key, versionID)
+	})}
+}
+
+// headObjects looks up each file in S3, a few at a time
+func (z *Zipper) headObjects(ctx context.Context, files []storage.File) (map[string]storedObject, error) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		objects = make(map[string]storedObject, len(files))
+		errs    = make([]error, len(files))
+		slots   = make(chan struct{}, max(z.concurrency, 1))
+	)
+
+	for i, f := range files {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+
+			obj, err := z.headObject(ctx, &f)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			mu.Lock()
+			objects[objectKey(&f)] = obj
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return objects, nil
+}
+
+func (z *Zipper) headObject(ctx context.Context, f *storage.File) (storedObject, error) {
+	input, err := z.objectInput(f)
+	if err != nil {
+		return storedObject{}, err
+	}
+
+	out, err := z.clients(input).s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		VersionId:            input.VersionId,
+		IfMatch:              input.IfMatch,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		ChecksumMode:         types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return storedObject{}, objectError(f, err)
+	}
+
+	obj := storedObject{
+		size:     aws.ToInt64(out.ContentLength),
+		modified: aws.ToTime(out.LastModified),
+		etag:     aws.ToString(out.ETag),
+	}
+
+	// only a checksum of the whole object, rather than one made up of its parts, is the CRC-32 of its contents
+	if out.ChecksumType == types.ChecksumTypeFullObject && out.ChecksumCRC32 != nil {
+		if b, err := base64.StdEncoding.DecodeString(*out.ChecksumCRC32); err == nil && len(b) == 4 {
+			obj.crc32, obj.hasCRC32 = binary.BigEndian.Uint32(b), true
+		}
+	}
+
+	return obj, nil
+}
+
+// objectInput returns the input to fetch a file, pinned to the version and ETag it was
+// requested with. For a stored zip it must also be the same version of the object as
+// when the zip was sized.
+func (z *Zipper) objectInput(f *storage.File) (*s3.GetObjectInput, error) {
+	input, err := getObjectInput(f.S3path)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.VersionID != "" {
+		input.VersionId = aws.String(f.VersionID)
+	}
+	if f.ETag != "" {
+		input.IfMatch = aws.String(f.ETag)
+	}
+	if obj, ok := z.objects[objectKey(f)]; ok && obj.etag != "" {
+		input.IfMatch = aws.String(obj.etag)
+	}
+
+	if f.SSECustomerKeyRef != "" {
+		if z.keys == nil {
+			return nil, errors.New("unable to fetch an object encrypted with SSE-C: " + f.S3path)
+		}
+
+		key, err := z.keys.CustomerKey(f.SSECustomerKeyRef)
+		if err != nil {
+			return nil, err
+		}
+
+		algorithm, encoded, md5 := customerKeyHeaders(key)
+		input.SSECustomerAlgorithm = aws.String(algorithm)
+		input.SSECustomerKey = aws.String(encoded)
+		input.SSECustomerKeyMD5 = aws.String(md5)
+	}
+
+	return input, nil
+}
+
+// objectKey identifies the object a file is fetched from, as files may be different
+// versions of the same S3 path
+func objectKey(f *storage.File) string {
+	if f.VersionID == "" {
+		return f.S3path
+	}
+	return f.S3path + "?versionId=" + f.VersionID
+}
+
+// objectError explains the errors S3 gives when an object no longer matches the file requested
+func objectError(f *storage.File, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var re *smithyhttp.ResponseError
+	if errors.As(err, &re) && re.HTTPStatusCode() == http.StatusPreconditionFailed {
+		return errors.New("object has changed since it was requested: " + f.S3path)
+	}
+
+	var ae smithy.APIError
+	if errors.As(err, &ae) && ae.ErrorCode() == "NoSuchVersion" {
+		return errors.New("version " + f.VersionID + " of the object no longer exists: " + f.S3path)
+	}
+
+	return err
+}
+
+// storedHeader returns the header of a file in a stored zip, taking its modification time
+// from S3 so that the zip is the same each time it is downloaded
+func storedHeader(f *storage.File, obj storedObject) *zip.FileHeader {
+	fh := f.GetZipFileHeader(nil)
+	if !obj.modified.IsZero() {
+		fh.Modified = obj.modified.In(fh.Modified.Location())
+	}
+	fh.UncompressedSize64 = uint64(obj.size)
+	return fh
+}
+
+func newBucketClients(cfg aws.Config) bucketClients {
+	s3Client := s3.NewFromConfig(cfg, func(u *s3.Options) {
+		u.UsePathStyle = true
+	})
+
+	downloader := manager.NewDownloader(s3Client)
+	downloader.Concurrency = 1
+
+	return bucketClients{downloader, s3Client}
+}
+
+func errSizeChanged(s3path string) error {
+	return errors.New("size of " + s3path + " has changed since the zip was sized")
+}
+
+func getObjectInput(s3path string) (*s3.GetObjectInput, error) {
+	if s3path == "" {
+		return nil, errors.New("missing S3 path")
+	}
+
+	u, err := url.Parse(s3path)
+	if err != nil {
+		return nil, errors.New("unable to parse S3 path: " + s3path)
+	}
+
+	if u.Scheme != "s3" || u.Host == "" || u.Path == "" {
+		return nil, errors.New("invalid S3 path: " + s3path)
+	}
+
+	return &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.Trim(u.Path, "/")),
+	}, nil
+}
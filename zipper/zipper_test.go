@@ -1,36 +1,147 @@
 package zipper
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"hash/crc32"
+	"io"
+	"net/http"
 	"net/http/httptest"
 	"opg-file-service/storage"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewZipper(t *testing.T) {
-	z := NewZipper(aws.NewConfig())
-	assert.Nil(t, z.rw)
+	keys := NewSecretCustomerKeys(nil)
+	passwords := NewSecretPasswords(nil)
+	z := NewZipper(aws.NewConfig(), keys, passwords)
+	assert.Nil(t, z.w)
 	assert.Nil(t, z.zw)
 	assert.NotNil(t, z.s3)
+	assert.NotNil(t, z.s3Client)
+	assert.Equal(t, keys, z.keys)
+	assert.Equal(t, passwords, z.passwords)
+	assert.Equal(t, 4, z.concurrency)
+	assert.Equal(t, int64(8*1024*1024), z.memoryLimit)
+}
+
+func TestNewZipper_Sources(t *testing.T) {
+	t.Setenv("S3_BUCKET_ROLES", "other-account=arn:aws:iam::123456789012:role/documents, invalid")
+	t.Setenv("FILE_SOURCE_ROOT", "/mnt/documents")
+	t.Setenv("HTTP_SOURCE_ALLOWED_HOSTS", "documents.internal, legacy.internal")
+
+	z := NewZipper(aws.NewConfig(), nil, nil)
+
+	assert.Len(t, z.buckets, 1)
+	assert.NotNil(t, z.buckets["other-account"].s3)
+	assert.NotSame(t, z.s3Client, z.buckets["other-account"].s3Client)
+
+	assert.Len(t, z.sources, 2)
+	assert.Equal(t, NewFileSource("/mnt/documents"), z.sources["file"])
+	assert.Equal(t, []string{"documents.internal", "legacy.internal"}, z.sources["https"].(*HTTPSource).allowedHosts)
+	assert.Equal(t, 30*time.Second, z.sources["https"].(*HTTPSource).client.Transport.(*http.Transport).ResponseHeaderTimeout)
+
+	c := z.Clone()
+	assert.Equal(t, z.buckets, c.buckets)
+	assert.Equal(t, z.sources, c.sources)
+}
+
+func TestZipper_AddFile_BucketRole(t *testing.T) {
+	md := new(MockDownloader)
+	other := &fakeDownloader{objects: map[string]string{"file": "contents of file"}}
+
+	buf := new(bytes.Buffer)
+	z := Zipper{zw: NewAESZipWriter(buf), s3: md, buckets: map[string]bucketClients{"other-account": {s3: other}}}
+
+	// objects in a bucket with a role are only fetched with that bucket's clients
+	assert.Nil(t, z.AddFile(t.Context(), &storage.File{S3path: "s3://other-account/file", FileName: "file"}))
+	assert.Nil(t, z.Close())
+	assert.Equal(t, []string{"file"}, other.direct)
+	md.AssertNotCalled(t, "Download")
+}
+
+func TestZipper_Clone(t *testing.T) {
+	md := new(MockDownloader)
+	ms := new(MockS3Client)
+	keys := NewSecretCustomerKeys(nil)
+	z := &Zipper{s3: md, s3Client: ms, keys: keys, concurrency: 2, memoryLimit: 10, w: httptest.NewRecorder(), zw: new(MockZipWriter), objects: map[string]storedObject{}}
+
+	c := z.Clone()
+
+	assert.NotSame(t, z, c)
+	assert.Equal(t, md, c.s3)
+	assert.Equal(t, ms, c.s3Client)
+	assert.Equal(t, keys, c.keys)
+	assert.Nil(t, c.objects)
+	assert.Equal(t, 2, c.concurrency)
+	assert.Equal(t, int64(10), c.memoryLimit)
+	assert.Nil(t, c.w)
+	assert.Nil(t, c.zw)
 }
 
 func TestZipper_Open(t *testing.T) {
 	rr := httptest.NewRecorder()
 	z := Zipper{}
-	z.Open(rr)
+	err := z.Open(rr, Zip)
+	assert.Nil(t, err)
 	hm := rr.Result().Header
 
 	assert.Equal(t, "application/zip", hm.Get("Content-Type"))
 	assert.Equal(t, "attachment; filename=\"download.zip\"", hm.Get("Content-Disposition"))
-	assert.Equal(t, rr, z.rw)
-	assert.IsType(t, new(zip.Writer), z.zw)
+	assert.Equal(t, rr, z.w)
+	assert.IsType(t, new(AESZipWriter), z.zw)
+}
+
+func TestZipper_Open_Tar(t *testing.T) {
+	rr := httptest.NewRecorder()
+	z := Zipper{}
+	err := z.Open(rr, TarGz)
+	assert.Nil(t, err)
+	hm := rr.Result().Header
+
+	assert.Equal(t, "application/gzip", hm.Get("Content-Type"))
+	assert.Equal(t, "attachment; filename=\"download.tar.gz\"", hm.Get("Content-Disposition"))
+	assert.IsType(t, new(TarWriter), z.zw)
+	assert.Equal(t, TarGz, z.format)
+}
+
+func TestZipper_AddFile_Tar(t *testing.T) {
+	fd := &fakeDownloader{objects: map[string]string{"file": "contents of file"}}
+
+	buf := new(bytes.Buffer)
+	z := Zipper{s3: fd, memoryLimit: 1024}
+	_ = z.Open(httptest.NewRecorder(), Tar)
+	z.zw = newTarWriter(buf)
+
+	// without prefetching, files are still buffered so that their size is known for the tar header
+	err := z.AddFile(t.Context(), &storage.File{S3path: "s3://bucket/file", FileName: "file"})
+	assert.Nil(t, err)
+	assert.Nil(t, z.Close())
+	assert.Empty(t, fd.direct)
+
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("contents of file")), hdr.Size)
+	b, _ := io.ReadAll(tr)
+	assert.Equal(t, "contents of file", string(b))
 }
 
 func TestZipper_Close(t *testing.T) {
@@ -42,7 +153,7 @@ func TestZipper_Close(t *testing.T) {
 	err := z.Close()
 
 	assert.Equal(t, e, err)
-	assert.Nil(t, z.rw)
+	assert.Nil(t, z.w)
 	assert.Nil(t, z.zw)
 	m.AssertExpectations(t)
 }
@@ -119,7 +230,7 @@ func TestZipper_AddFile(t *testing.T) {
 		md := new(MockDownloader)
 		rr := httptest.NewRecorder()
 
-		z := Zipper{rr, mz, md}
+		z := Zipper{w: rr, zw: mz, s3: md}
 		f := storage.File{
 			S3path:   test.s3path,
 			FileName: "file",
@@ -140,3 +251,614 @@ func TestZipper_AddFile(t *testing.T) {
 		assert.Equal(t, test.expectedError, err)
 	}
 }
+
+func TestZipper_AddFile_Pinned(t *testing.T) {
+	f := storage.File{
+		S3path:            "s3://bucket/file",
+		FileName:          "file",
+		VersionID:         "v2",
+		ETag:              `"abc123"`,
+		SSECustomerKeyRef: "documents",
+	}
+
+	tests := []struct {
+		scenario      string
+		downloadError error
+		expectedError error
+	}{
+		{"Object still matches", nil, nil},
+		{
+			"Object has changed",
+			&smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusPreconditionFailed}}, Err: errors.New("PreconditionFailed")},
+			errors.New("object has changed since it was requested: s3://bucket/file"),
+		},
+		{
+			"Version no longer exists",
+			&smithy.GenericAPIError{Code: "NoSuchVersion"},
+			errors.New("version v2 of the object no longer exists: s3://bucket/file"),
+		},
+	}
+
+	for _, test := range tests {
+		mz := new(MockZipWriter)
+		md := new(MockDownloader)
+		ms := new(MockSecretsCache)
+		ms.On("GetSecretString", "sse-c-keys/documents").Return(base64.StdEncoding.EncodeToString(testCustomerKey), nil)
+
+		z := Zipper{zw: mz, s3: md, keys: NewSecretCustomerKeys(ms)}
+
+		buf := new(bytes.Buffer)
+		mz.On("CreateHeader", mock.AnythingOfType("*zip.FileHeader")).Return(buf, nil)
+
+		s3input := s3.GetObjectInput{
+			Bucket:               aws.String("bucket"),
+			Key:                  aws.String("file"),
+			VersionId:            aws.String("v2"),
+			IfMatch:              aws.String(`"abc123"`),
+			SSECustomerAlgorithm: aws.String("AES256"),
+			SSECustomerKey:       aws.String("CQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQk="),
+			SSECustomerKeyMD5:    aws.String("SCY5xzBvyA28HDOoR/qKFA=="),
+		}
+		var options []func(*manager.Downloader)
+		md.On("Download", FakeWriterAt{buf}, &s3input, options).Return(int64(0), test.downloadError).Once()
+
+		err := z.AddFile(t.Context(), &f)
+		assert.Equal(t, test.expectedError, err, test.scenario)
+		md.AssertExpectations(t)
+	}
+}
+
+func TestZipper_AddFile_NoCustomerKeys(t *testing.T) {
+	z := Zipper{zw: new(MockZipWriter)}
+	err := z.AddFile(t.Context(), &storage.File{S3path: "s3://bucket/file", FileName: "file", SSECustomerKeyRef: "documents"})
+	assert.EqualError(t, err, "unable to fetch an object encrypted with SSE-C: s3://bucket/file")
+}
+
+// fakeDownloader serves object contents by key and is safe for concurrent use, unlike MockDownloader
+type fakeDownloader struct {
+	objects map[string]string
+	direct  []string // objects downloaded in full straight into the archive
+	ranges  []string // parts of objects downloaded with a range
+	mu      sync.Mutex
+}
+
+func (d *fakeDownloader) Download(ctx context.Context, w io.WriterAt, input *s3.GetObjectInput, options ...func(*manager.Downloader)) (int64, error) {
+	contents, ok := d.objects[*input.Key]
+
+	if input.Range != nil {
+		d.mu.Lock()
+		d.ranges = append(d.ranges, *input.Key+" "+*input.Range)
+		d.mu.Unlock()
+
+		var from, to int
+		_, _ = fmt.Sscanf(*input.Range, "bytes=%d-%d", &from, &to)
+		contents = contents[from : to+1]
+	} else if _, ok := w.(FakeWriterAt); ok {
+		d.mu.Lock()
+		d.direct = append(d.direct, *input.Key)
+		d.mu.Unlock()
+	}
+
+	if !ok {
+		return 0, errors.New("NoSuchKey")
+	}
+
+	n, err := w.WriteAt([]byte(contents), 0)
+	return int64(n), err
+}
+
+func TestZipper_Prefetch(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://bucket/file1", FileName: "file1"},
+		{S3path: "s3://bucket/file2", FileName: "file2"},
+		{S3path: "s3://bucket/file3", FileName: "file3"},
+		{S3path: "s3://bucket/missing", FileName: "missing"},
+	}
+
+	fd := &fakeDownloader{objects: map[string]string{
+		"file1": "contents of file1",
+		"file2": "contents of file2",
+		"file3": "contents of file3",
+	}}
+
+	buf := new(bytes.Buffer)
+	z := Zipper{zw: NewAESZipWriter(buf), s3: fd, concurrency: 2, memoryLimit: 4}
+
+	z.Prefetch(t.Context(), files)
+
+	for _, file := range files[:3] {
+		assert.Nil(t, z.AddFile(t.Context(), &file))
+	}
+	assert.Equal(t, errors.New("NoSuchKey"), z.AddFile(t.Context(), &files[3]))
+	assert.Nil(t, z.Close())
+	assert.Nil(t, z.prefetcher)
+	assert.Empty(t, fd.direct)
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		_ = rc.Close()
+		assert.Equal(t, "contents of "+f.Name, string(b))
+	}
+
+	// files are zipped in the requested order, and the failed file is left out
+	assert.Equal(t, []string{"file1", "file2", "file3"}, names)
+}
+
+func TestZipper_Prefetch_OutOfOrder(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://bucket/file1", FileName: "file1"},
+		{S3path: "s3://bucket/file2", FileName: "file2"},
+	}
+
+	fd := &fakeDownloader{objects: map[string]string{"file1": "1", "file2": "2"}}
+
+	z := Zipper{zw: NewAESZipWriter(io.Discard), s3: fd, concurrency: 1}
+	z.Prefetch(t.Context(), files)
+
+	// a file which isn't next in the prefetch queue is downloaded directly
+	assert.Nil(t, z.AddFile(t.Context(), &files[1]))
+	assert.Nil(t, z.Close())
+	assert.Equal(t, []string{"file2"}, fd.direct)
+}
+
+func TestZipper_Prefetch_InvalidPath(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://bucket/file1", FileName: "file1"},
+		{S3path: "s3://bucket", FileName: "invalid"},
+		{S3path: "s3://bucket/file2", FileName: "file2"},
+	}
+
+	fd := &fakeDownloader{objects: map[string]string{"file1": "1", "file2": "2"}}
+
+	z := Zipper{zw: NewAESZipWriter(io.Discard), s3: fd, concurrency: 2}
+	z.Prefetch(t.Context(), files)
+
+	// a file which fails before it is downloaded still takes its prefetch, leaving the next file's
+	assert.Nil(t, z.AddFile(t.Context(), &files[0]))
+	assert.EqualError(t, z.AddFile(t.Context(), &files[1]), "invalid S3 path: s3://bucket")
+	assert.Nil(t, z.AddFile(t.Context(), &files[2]))
+	assert.Nil(t, z.Close())
+	assert.Empty(t, fd.direct)
+}
+
+func TestZipper_Prefetch_Disabled(t *testing.T) {
+	z := Zipper{concurrency: 0}
+	z.Prefetch(t.Context(), []storage.File{{S3path: "s3://bucket/file"}})
+	assert.Nil(t, z.prefetcher)
+}
+
+func TestZipper_AddErrorReport(t *testing.T) {
+	buf := new(bytes.Buffer)
+	z := Zipper{zw: NewAESZipWriter(buf)}
+
+	err := z.AddErrorReport([]FileError{
+		{Path: "folder/file1", S3path: "s3://bucket/file1", Reason: "NoSuchKey"},
+		{Path: "file2", S3path: "s3://bucket/file2", Reason: "AccessDenied"},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, z.Close())
+
+	zr, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Len(t, zr.File, 1)
+	assert.Equal(t, ErrorReportName, zr.File[0].Name)
+
+	rc, _ := zr.File[0].Open()
+	b, _ := io.ReadAll(rc)
+	assert.Equal(t, "The following files could not be included in this download:\n\n"+
+		"folder/file1 (s3://bucket/file1): NoSuchKey\n"+
+		"file2 (s3://bucket/file2): AccessDenied\n", string(b))
+}
+
+func TestZipper_Encrypt(t *testing.T) {
+	enc := &storage.Encryption{Password: "correct horse battery"}
+
+	buf := new(bytes.Buffer)
+	z := Zipper{zw: NewAESZipWriter(buf), format: Zip}
+	assert.Nil(t, z.Encrypt(enc))
+
+	_, err := z.Store(t.Context(), nil)
+	assert.EqualError(t, err, "unable to store files in an encrypted archive")
+
+	assert.Nil(t, z.AddErrorReport([]FileError{{Path: "file1", S3path: "s3://bucket/file1", Reason: "NoSuchKey"}}))
+	assert.Nil(t, z.Close())
+	assert.Nil(t, z.encryption)
+
+	zr, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Len(t, zr.File, 1)
+
+	b, err := decryptAESFile(zr.File[0], enc.Password)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "file1 (s3://bucket/file1): NoSuchKey")
+
+	z = Zipper{zw: new(TarWriter)}
+	assert.EqualError(t, z.Encrypt(enc), "unable to encrypt a tar archive")
+	assert.Nil(t, z.encryption)
+}
+
+func TestZipper_Encrypt_SealedPassword(t *testing.T) {
+	passwords := newTestPasswords()
+	enc := &storage.Encryption{Password: "correct horse battery"}
+	_ = passwords.Seal(enc)
+
+	buf := new(bytes.Buffer)
+	z := Zipper{zw: NewAESZipWriter(buf), format: Zip, passwords: passwords}
+	assert.Nil(t, z.Encrypt(enc))
+	assert.Nil(t, z.AddErrorReport([]FileError{{Path: "file1", S3path: "s3://bucket/file1", Reason: "NoSuchKey"}}))
+	assert.Nil(t, z.Close())
+
+	// the file is encrypted with the password that was sealed, which is not kept in the entry
+	zr, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	_, err := decryptAESFile(zr.File[0], "correct horse battery")
+	assert.Nil(t, err)
+	assert.Empty(t, enc.Password)
+
+	z = Zipper{zw: NewAESZipWriter(new(bytes.Buffer)), format: Zip}
+	assert.EqualError(t, z.Encrypt(enc), "unable to open the password of the zip request")
+}
+
+func TestAddFiles(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://bucket/file1", FileName: "file1"},
+		{S3path: "s3://bucket/missing", FileName: "missing", Folder: "folder"},
+		{S3path: "s3://bucket/file3", FileName: "file3"},
+	}
+
+	tests := []struct {
+		scenario      string
+		failurePolicy string
+		concurrency   int
+		wantErr       bool
+		wantFailures  []FileError
+		wantNames     []string
+	}{
+		{"Abort on the first file which cannot be added", storage.FailurePolicyAbort, 2, true, nil, nil},
+		{
+			"Skip files which cannot be added and list them in an error report",
+			storage.FailurePolicySkip,
+			2,
+			false,
+			[]FileError{{Path: "folder/missing", S3path: "s3://bucket/missing", Reason: "NoSuchKey"}},
+			[]string{"file1", "file3", ErrorReportName},
+		},
+		{
+			"Skip files which cannot be added without prefetching",
+			storage.FailurePolicySkip,
+			0,
+			false,
+			[]FileError{{Path: "folder/missing", S3path: "s3://bucket/missing", Reason: "NoSuchKey"}},
+			[]string{"file1", "file3", ErrorReportName},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		fd := &fakeDownloader{objects: map[string]string{"file1": "contents of file1", "file3": "contents of file3"}}
+		z := Zipper{s3: fd, zw: NewAESZipWriter(buf), concurrency: test.concurrency, memoryLimit: 4}
+
+		// files are prefetched as they are by the handlers, so a missing file fails before its header is written
+		z.Prefetch(t.Context(), files)
+
+		failures, err := AddFiles(t.Context(), &z, files, test.failurePolicy)
+		assert.Equal(t, test.wantErr, err != nil, test.scenario)
+		assert.Equal(t, test.wantFailures, failures, test.scenario)
+
+		// a file which may be skipped is downloaded in full before anything of it is written
+		if test.failurePolicy == storage.FailurePolicySkip {
+			assert.Empty(t, fd.direct, test.scenario)
+		}
+
+		if !test.wantErr {
+			assert.Nil(t, z.Close(), test.scenario)
+
+			zr, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			var names []string
+			for _, f := range zr.File {
+				names = append(names, f.Name)
+			}
+			assert.Equal(t, test.wantNames, names, test.scenario)
+		} else {
+			_ = z.Close()
+		}
+	}
+}
+
+func TestZipper_Store(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://bucket/file1", FileName: "file1.pdf"},
+		{S3path: "s3://bucket/file2", FileName: "file2.txt", Folder: "folder"},
+		{S3path: "s3://bucket/file2", FileName: "file2 (1).txt", Folder: "folder"},
+	}
+
+	fd := &fakeDownloader{objects: map[string]string{
+		"file1": "contents of file1",
+		"file2": "contents of file2, which is longer",
+	}}
+
+	ms := newStoredS3Client(fd.objects, false)
+
+	rr := httptest.NewRecorder()
+	z := Zipper{s3: fd, s3Client: ms, concurrency: 2, memoryLimit: 1024}
+	assert.Nil(t, z.Open(rr, Zip))
+
+	info, err := z.Store(t.Context(), files)
+	assert.Nil(t, err)
+	assert.IsType(t, new(StoredZipWriter), z.zw)
+
+	z.Prefetch(t.Context(), files[:2])
+	for _, file := range files {
+		assert.Nil(t, z.AddFile(t.Context(), &file))
+	}
+	assert.Nil(t, z.Close())
+	assert.Nil(t, z.objects)
+
+	body := rr.Body.Bytes()
+	assert.Equal(t, info.Size, int64(len(body)))
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assert.Nil(t, err)
+	assert.Len(t, zr.File, 3)
+	for _, f := range zr.File {
+		assert.Equal(t, zip.Store, f.Method)
+		assert.True(t, storedTestModified.Equal(f.Modified))
+	}
+
+	// the same objects make the same zip
+	rr2 := httptest.NewRecorder()
+	z2 := z.Clone()
+	_ = z2.Open(rr2, Zip)
+	info2, _ := z2.Store(t.Context(), files)
+	for _, file := range files {
+		assert.Nil(t, z2.AddFile(t.Context(), &file))
+	}
+	assert.Nil(t, z2.Close())
+	assert.Equal(t, info, info2)
+	assert.Equal(t, body, rr2.Body.Bytes())
+
+	// but a change to any of them changes the ETag
+	fd.objects["file1"] = "new contents of file1"
+	z3 := z.Clone()
+	z3.s3Client = newStoredS3Client(fd.objects, false)
+	_ = z3.Open(httptest.NewRecorder(), Zip)
+	info3, _ := z3.Store(t.Context(), files)
+	assert.NotEqual(t, info.ETag, info3.ETag)
+}
+
+func TestZipper_Store_PrefetchEmpty(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://bucket/file1", FileName: "file1"},
+		{S3path: "s3://bucket/empty", FileName: "empty"},
+		{S3path: "s3://bucket/file2", FileName: "file2"},
+	}
+
+	fd := &fakeDownloader{objects: map[string]string{
+		"file1": "contents of file1",
+		"empty": "",
+		"file2": "contents of file2",
+	}}
+
+	rr := httptest.NewRecorder()
+	z := Zipper{s3: fd, s3Client: newStoredS3Client(fd.objects, false), concurrency: 2, memoryLimit: 1024}
+	assert.Nil(t, z.Open(rr, Zip))
+
+	info, err := z.Store(t.Context(), files)
+	assert.Nil(t, err)
+
+	// the empty file's contents are not needed, but the files after it still use their prefetches
+	z.Prefetch(t.Context(), files)
+	for _, file := range files {
+		assert.Nil(t, z.AddFile(t.Context(), &file))
+	}
+	assert.Nil(t, z.Close())
+	assert.Empty(t, fd.direct)
+	assert.Equal(t, info.Size, int64(rr.Body.Len()))
+}
+
+func TestZipper_Range(t *testing.T) {
+	files := []storage.File{
+		{S3path: "s3://bucket/file1", FileName: "file1.pdf"},
+		{S3path: "s3://bucket/file2", FileName: "file2.txt"},
+		{S3path: "s3://bucket/empty", FileName: "empty"},
+		{S3path: "s3://bucket/file3", FileName: "file3.jpg"},
+	}
+	objects := map[string]string{
+		"file1": strings.Repeat("1", 100),
+		"file2": strings.Repeat("2", 200),
+		"empty": "",
+		"file3": strings.Repeat("3", 300),
+	}
+
+	// build the whole zip to compare ranges of it against
+	rr := httptest.NewRecorder()
+	z := Zipper{s3: &fakeDownloader{objects: objects}, s3Client: newStoredS3Client(objects, false)}
+	_ = z.Open(rr, Zip)
+	info, err := z.Store(t.Context(), files)
+	assert.Nil(t, err)
+	for _, file := range files {
+		assert.Nil(t, z.AddFile(t.Context(), &file))
+	}
+	assert.Nil(t, z.Close())
+	full := rr.Body.Bytes()
+	assert.Equal(t, info.Size, int64(len(full)))
+
+	fileData := func(key string) int64 {
+		return int64(bytes.Index(full, []byte(objects[key])))
+	}
+
+	tests := []struct {
+		scenario   string
+		start, end int64
+		crcs       bool
+		wantRanges []string // parts of objects fetched with a range
+		wantWhole  []string // objects fetched in full
+	}{
+		{
+			"Whole zip",
+			0, info.Size, false,
+			nil,
+			[]string{"file1", "file2", "file3"},
+		},
+		{
+			"Start of the zip only fetches the files it includes",
+			0, fileData("file2") + 50, false,
+			[]string{"file2 bytes=0-49"},
+			[]string{"file1"},
+		},
+		{
+			"Resuming part way through fetches earlier files for their CRC-32",
+			fileData("file2") + 50, info.Size, false,
+			nil,
+			[]string{"file1", "file2", "file3"},
+		},
+		{
+			"Resuming part way through with CRC-32s from S3",
+			fileData("file2") + 50, info.Size, true,
+			[]string{"file2 bytes=50-199"},
+			[]string{"file3"},
+		},
+		{
+			"Range within a file",
+			fileData("file3") + 10, fileData("file3") + 20, true,
+			[]string{"file3 bytes=10-19"},
+			nil,
+		},
+		{
+			"Central directory only",
+			fileData("file3") + 300, info.Size, true,
+			nil,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		fd := &fakeDownloader{objects: objects}
+		rr := httptest.NewRecorder()
+		z := Zipper{s3: fd, s3Client: newStoredS3Client(objects, test.crcs), concurrency: 2}
+
+		_ = z.Open(rr, Zip)
+		_, err := z.Store(t.Context(), files)
+		assert.Nil(t, err, test.scenario)
+		assert.Nil(t, z.Range(test.start, test.end), test.scenario)
+
+		z.Prefetch(t.Context(), files)
+		assert.Nil(t, z.prefetcher, test.scenario)
+
+		for _, file := range files {
+			assert.Nil(t, z.AddFile(t.Context(), &file), test.scenario)
+		}
+		assert.Nil(t, z.Close(), test.scenario)
+
+		assert.Equal(t, full[test.start:test.end], rr.Body.Bytes(), test.scenario)
+		assert.Equal(t, test.wantRanges, fd.ranges, test.scenario)
+		assert.Equal(t, test.wantWhole, fd.direct, test.scenario)
+	}
+}
+
+func TestZipper_Range_NotStored(t *testing.T) {
+	z := Zipper{}
+	_ = z.Open(httptest.NewRecorder(), Zip)
+
+	assert.EqualError(t, z.Range(0, 10), "unable to write a range of an archive which is not stored")
+}
+
+var storedTestModified = time.Date(2024, 3, 5, 14, 30, 12, 0, time.UTC)
+
+// newStoredS3Client returns a MockS3Client which can head the given objects, with their
+// CRC-32 if withCRC32 is set
+func newStoredS3Client(objects map[string]string, withCRC32 bool) *MockS3Client {
+	ms := new(MockS3Client)
+
+	for key, contents := range objects {
+		out := &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(int64(len(contents))),
+			LastModified:  aws.Time(storedTestModified),
+			ETag:          aws.String(`"` + key + contents + `"`),
+		}
+		if withCRC32 {
+			crc := binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE([]byte(contents)))
+			out.ChecksumCRC32 = aws.String(base64.StdEncoding.EncodeToString(crc))
+			out.ChecksumType = types.ChecksumTypeFullObject
+		}
+
+		ms.On("HeadObject", &s3.HeadObjectInput{
+			Bucket:       aws.String("bucket"),
+			Key:          aws.String(key),
+			ChecksumMode: types.ChecksumModeEnabled,
+		}).Return(out, nil)
+	}
+
+	return ms
+}
+
+func TestZipper_Store_Errors(t *testing.T) {
+	files := []storage.File{{S3path: "s3://bucket/file", FileName: "file"}}
+	headInput := &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("file"), ChecksumMode: types.ChecksumModeEnabled}
+
+	t.Run("Format cannot be stored", func(t *testing.T) {
+		z := Zipper{}
+		_ = z.Open(httptest.NewRecorder(), Tar)
+
+		_, err := z.Store(t.Context(), files)
+		assert.EqualError(t, err, "unable to store files in a tar archive")
+	})
+
+	t.Run("Invalid S3 path", func(t *testing.T) {
+		z := Zipper{s3Client: new(MockS3Client)}
+		_ = z.Open(httptest.NewRecorder(), Zip)
+
+		_, err := z.Store(t.Context(), []storage.File{{S3path: "http://bucket/file"}})
+		assert.EqualError(t, err, "invalid S3 path: http://bucket/file")
+	})
+
+	t.Run("Object not found", func(t *testing.T) {
+		ms := new(MockS3Client)
+		ms.On("HeadObject", headInput).Return(nil, errors.New("NotFound"))
+
+		z := Zipper{s3Client: ms}
+		_ = z.Open(httptest.NewRecorder(), Zip)
+
+		_, err := z.Store(t.Context(), files)
+		assert.EqualError(t, err, "NotFound")
+		assert.Nil(t, z.objects)
+		assert.IsType(t, new(AESZipWriter), z.zw)
+	})
+
+	t.Run("Pinned object has changed", func(t *testing.T) {
+		pinned := []storage.File{{S3path: "s3://bucket/file", FileName: "file", VersionID: "v2", ETag: `"abc123"`}}
+
+		ms := new(MockS3Client)
+		ms.On("HeadObject", &s3.HeadObjectInput{
+			Bucket:       aws.String("bucket"),
+			Key:          aws.String("file"),
+			VersionId:    aws.String("v2"),
+			IfMatch:      aws.String(`"abc123"`),
+			ChecksumMode: types.ChecksumModeEnabled,
+		}).Return(nil, &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusPreconditionFailed}}})
+
+		z := Zipper{s3Client: ms}
+		_ = z.Open(httptest.NewRecorder(), Zip)
+
+		_, err := z.Store(t.Context(), pinned)
+		assert.EqualError(t, err, "object has changed since it was requested: s3://bucket/file")
+	})
+
+	t.Run("Object changed size", func(t *testing.T) {
+		ms := new(MockS3Client)
+		ms.On("HeadObject", headInput).Return(&s3.HeadObjectOutput{ContentLength: aws.Int64(4)}, nil)
+		fd := &fakeDownloader{objects: map[string]string{"file": "more than four bytes"}}
+
+		z := Zipper{s3: fd, s3Client: ms}
+		_ = z.Open(httptest.NewRecorder(), Zip)
+
+		_, err := z.Store(t.Context(), files)
+		assert.Nil(t, err)
+
+		err = z.AddFile(t.Context(), &files[0])
+		assert.EqualError(t, err, "size of s3://bucket/file has changed since the zip was sized")
+	})
+}